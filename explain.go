@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mylxsw/openai-dispatcher/internal"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"os"
+	"strings"
+)
+
+// headerFlags Repeatable -header flag, such as -header "X-Ignore-Moderation: true"
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("invalid header %q, the format should be 'Key: Value'", value)
+	}
+
+	h[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	return nil
+}
+
+// runExplain Print the routing decision of a sample request
+//
+//	openai-dispatcher explain -conf config.yaml -model gpt-4 -key xxx -body request.json
+func runExplain(args []string) {
+	var configFilePath, bodyFile string
+	var req internal.ExplainRequest
+	var outputJSON bool
+	headers := headerFlags{}
+
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	fs.StringVar(&configFilePath, "conf", "config.yaml", "Configuration file path")
+	fs.StringVar(&req.Model, "model", "", "Model name, read from the body if empty")
+	fs.StringVar(&req.Endpoint, "endpoint", "/v1/chat/completions", "Request endpoint")
+	fs.StringVar(&req.ClientKey, "key", "", "Client key")
+	fs.Var(headers, "header", "Request header, such as 'X-Ignore-Moderation: true', can be repeated")
+	fs.StringVar(&bodyFile, "body", "", "Request body file")
+	fs.BoolVar(&outputJSON, "json", false, "Output in JSON format")
+	_ = fs.Parse(args)
+
+	req.Headers = headers
+	if bodyFile != "" {
+		body, err := os.ReadFile(bodyFile)
+		if err != nil {
+			panic(fmt.Errorf("failed to read the body file：%v", err))
+		}
+
+		req.Body = body
+	}
+
+	conf, err := config.LoadConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("failed to load the configuration file：%v\n", err)
+		os.Exit(1)
+	}
+
+	explanation, err := internal.Explain(conf, req)
+	if err != nil {
+		panic(fmt.Errorf("explain failed：%v", err))
+	}
+
+	if outputJSON {
+		data, _ := json.MarshalIndent(explanation, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	explanation.Print(os.Stdout)
+}
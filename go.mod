@@ -4,13 +4,16 @@ go 1.21.1
 
 require (
 	github.com/expr-lang/expr v1.16.5
+	github.com/google/uuid v1.3.0
 	github.com/mroth/weightedrand/v2 v2.1.0
 	github.com/mylxsw/go-utils v1.0.3
-	github.com/pkoukk/tiktoken-go v0.1.6
+	github.com/pkoukk/tiktoken-go v0.1.8
+	github.com/pkoukk/tiktoken-go-loader v0.0.2
 	github.com/prometheus/client_golang v1.17.0
 	github.com/sashabaranov/go-openai v1.32.0
 	github.com/tidwall/gjson v1.17.0
 	github.com/tidwall/sjson v1.2.5
+	golang.org/x/image v0.14.0
 	golang.org/x/net v0.18.0
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -20,7 +23,6 @@ require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dlclark/regexp2 v1.10.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions/v2 v2.0.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/prometheus/client_model v0.5.0 // indirect
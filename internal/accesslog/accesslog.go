@@ -0,0 +1,114 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/asteria/level"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/asteria/writer"
+	"github.com/sashabaranov/go-openai"
+	"path/filepath"
+	"time"
+)
+
+// Entry A structured access log entry, one entry is written for each request
+type Entry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Method    string    `json:"method"`
+	Endpoint  string    `json:"endpoint"`
+	Model     string    `json:"model,omitempty"`
+	// RewrittenModel The model name sent to the final upstream
+	RewrittenModel string `json:"rewritten_model,omitempty"`
+	Stream         bool   `json:"stream"`
+	// Upstreams All upstreams tried, in order
+	Upstreams []string `json:"upstreams,omitempty"`
+	Status    int      `json:"status"`
+	// TTFB Time to first byte, in milliseconds
+	TTFB int64 `json:"ttfb_ms"`
+	// Duration Total time, in milliseconds
+	Duration int64 `json:"duration_ms"`
+	// Bytes The size of the response body sent to the client
+	Bytes int64         `json:"bytes"`
+	Usage *openai.Usage `json:"usage,omitempty"`
+	// Moderation The moderation verdict: skipped, ignored, passed, flagged, blocked, error
+	Moderation string `json:"moderation,omitempty"`
+	// OutputModeration The moderation verdict of the output: passed, blocked, error, empty if not checked
+	OutputModeration string `json:"output_moderation,omitempty"`
+	// Cache How the response cache is used: hit, miss, bypass, empty if the request is not cacheable
+	Cache string `json:"cache,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+const (
+	ModerationSkipped = "skipped"
+	ModerationIgnored = "ignored"
+	ModerationPassed  = "passed"
+	ModerationFlagged = "flagged"
+	ModerationBlocked = "blocked"
+	ModerationError   = "error"
+)
+
+// AddUpstream Record an upstream that was tried for the request
+func (e *Entry) AddUpstream(name string) {
+	e.Upstreams = append(e.Upstreams, name)
+}
+
+// Logger Write access log entries to daily rotating files
+type Logger struct {
+	writer *writer.RotatingFileWriter
+}
+
+// New create a new access logger, the log files are written to the dir directory
+func New(ctx context.Context, dir string) *Logger {
+	return &Logger{
+		writer: writer.NewDefaultRotatingFileWriter(ctx, func(le level.Level, module string) string {
+			return filepath.Join(dir, fmt.Sprintf("access.%s.log", time.Now().Format("20060102")))
+		}),
+	}
+}
+
+// Write an access log entry
+func (l *Logger) Write(entry *Entry) {
+	if l == nil || entry == nil {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.F(log.M{"request_id": entry.RequestID}).Errorf("marshal access log failed: %v", err)
+		return
+	}
+
+	if err := l.writer.Write(level.Info, "access", string(data)); err != nil {
+		log.F(log.M{"request_id": entry.RequestID}).Errorf("write access log failed: %v", err)
+	}
+}
+
+// Close the log files opened
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.writer.Close()
+}
+
+type contextKey struct{}
+
+// WithEntry Attach the access log entry to the context
+func WithEntry(ctx context.Context, entry *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// EntryFromContext Get the access log entry from the context.
+// If there is no entry in the context, a new empty entry is returned, so the caller can always write to it
+func EntryFromContext(ctx context.Context) *Entry {
+	if entry, ok := ctx.Value(contextKey{}).(*Entry); ok {
+		return entry
+	}
+
+	return &Entry{}
+}
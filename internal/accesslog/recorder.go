@@ -0,0 +1,150 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultMaxBodySize The default maximum size of the response body kept by the recorder
+const DefaultMaxBodySize = 1 << 20
+
+// ResponseRecorder Wrap the http.ResponseWriter to record the status, time to first byte, size and response body
+type ResponseRecorder struct {
+	http.ResponseWriter
+
+	status      int
+	startTime   time.Time
+	firstByte   time.Time
+	written     int64
+	body        bytes.Buffer
+	maxBodySize int
+	truncated   bool
+}
+
+// NewResponseRecorder create a new ResponseRecorder, at most maxBodySize bytes of the response body are kept,
+// the body is not kept when it is 0
+func NewResponseRecorder(w http.ResponseWriter, maxBodySize int) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w, startTime: time.Now(), maxBodySize: maxBodySize}
+}
+
+// KeepBody Keep at most maxBodySize bytes of the response body if it is more than the current limit,
+// it must be called before the body is written
+func (r *ResponseRecorder) KeepBody(maxBodySize int) {
+	if maxBodySize > r.maxBodySize {
+		r.maxBodySize = maxBodySize
+	}
+}
+
+func (r *ResponseRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *ResponseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+
+	if !r.truncated {
+		if r.body.Len()+len(data) > r.maxBodySize {
+			r.truncated = true
+		} else {
+			r.body.Write(data)
+		}
+	}
+
+	n, err := r.ResponseWriter.Write(data)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *ResponseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap Return the original http.ResponseWriter, used by http.ResponseController
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status The status code of the response
+func (r *ResponseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+
+	return r.status
+}
+
+// TTFB Time to first byte
+func (r *ResponseRecorder) TTFB() time.Duration {
+	if r.firstByte.IsZero() {
+		return 0
+	}
+
+	return r.firstByte.Sub(r.startTime)
+}
+
+// Written The bytes of the response body written to the client
+func (r *ResponseRecorder) Written() int64 {
+	return r.written
+}
+
+// Body The recorded response body, the second return value indicates whether the body is complete
+func (r *ResponseRecorder) Body() ([]byte, bool) {
+	return r.body.Bytes(), !r.truncated
+}
+
+// Usage Extract the token usage from the response body, supports both json and event-stream responses
+func (r *ResponseRecorder) Usage() *openai.Usage {
+	body, _ := r.Body()
+	if len(body) == 0 {
+		return nil
+	}
+
+	if !strings.HasPrefix(r.Header().Get("Content-Type"), "text/event-stream") {
+		return parseUsage(gjson.GetBytes(body, "usage"))
+	}
+
+	var usage *openai.Usage
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		if u := parseUsage(gjson.Get(strings.TrimSpace(line[5:]), "usage")); u != nil {
+			usage = u
+		}
+	}
+
+	return usage
+}
+
+func parseUsage(res gjson.Result) *openai.Usage {
+	if !res.IsObject() {
+		return nil
+	}
+
+	return &openai.Usage{
+		PromptTokens:     int(res.Get("prompt_tokens").Int()),
+		CompletionTokens: int(res.Get("completion_tokens").Int()),
+		TotalTokens:      int(res.Get("total_tokens").Int()),
+	}
+}
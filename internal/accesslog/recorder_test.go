@@ -0,0 +1,88 @@
+package accesslog
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := NewResponseRecorder(w, 16)
+
+	// The status is 200 until it is written
+	assert.Equal(t, http.StatusOK, r.Status())
+	assert.EqualValues(t, 0, r.TTFB())
+
+	r.WriteHeader(http.StatusTeapot)
+	r.WriteHeader(http.StatusOK)
+	_, _ = r.Write([]byte("hello "))
+	_, _ = r.Write([]byte("world"))
+
+	body, complete := r.Body()
+	assert.Equal(t, http.StatusTeapot, r.Status())
+	assert.Equal(t, "hello world", string(body))
+	assert.True(t, complete)
+	assert.True(t, r.TTFB() >= 0)
+
+	// The body beyond the limit is not kept, but it is still written to the client
+	_, _ = r.Write([]byte(", hello again"))
+	_, _ = r.Write([]byte("!"))
+	body, complete = r.Body()
+	assert.Equal(t, "hello world", string(body))
+	assert.False(t, complete)
+	assert.Equal(t, "hello world, hello again!", w.Body.String())
+	assert.EqualValues(t, 25, r.Written())
+	assert.True(t, r.Unwrap() == w)
+
+	// The body is not kept without a limit, unless it is asked before the body is written
+	r = NewResponseRecorder(httptest.NewRecorder(), 0)
+	_, _ = r.Write([]byte("hello"))
+	body, _ = r.Body()
+	assert.Equal(t, 0, len(body))
+	assert.EqualValues(t, 5, r.Written())
+
+	r = NewResponseRecorder(httptest.NewRecorder(), 0)
+	r.KeepBody(16)
+	_, _ = r.Write([]byte("hello"))
+	body, complete = r.Body()
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, complete)
+}
+
+func TestResponseRecorder_Usage(t *testing.T) {
+	r := NewResponseRecorder(httptest.NewRecorder(), DefaultMaxBodySize)
+	assert.True(t, r.Usage() == nil)
+
+	r.Header().Set("Content-Type", "application/json")
+	_, _ = r.Write([]byte(`{"id":"1","usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	assert.EqualValues(t, 10, r.Usage().PromptTokens)
+	assert.EqualValues(t, 15, r.Usage().TotalTokens)
+
+	// The usage of the stream is in the last chunk which has one
+	r = NewResponseRecorder(httptest.NewRecorder(), DefaultMaxBodySize)
+	r.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	_, _ = r.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":1,\"total_tokens\":4}}\n\n" +
+		"data:{\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n" +
+		"data: [DONE]\n\n"))
+	assert.EqualValues(t, 2, r.Usage().CompletionTokens)
+
+	// No usage in the response
+	r = NewResponseRecorder(httptest.NewRecorder(), DefaultMaxBodySize)
+	r.Header().Set("Content-Type", "text/event-stream")
+	_, _ = r.Write([]byte("data: {\"choices\":[]}\n\ndata: [DONE]\n\n"))
+	assert.True(t, r.Usage() == nil)
+}
+
+func TestEntryFromContext(t *testing.T) {
+	// An empty entry is returned when there is none, it can be written safely
+	EntryFromContext(context.Background()).AddUpstream("ignored")
+
+	entry := &Entry{RequestID: "r1"}
+	ctx := WithEntry(context.Background(), entry)
+	EntryFromContext(ctx).AddUpstream("openai#1")
+	assert.EqualValues(t, []string{"openai#1"}, entry.Upstreams)
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/upstream"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminHandler The handler of the admin API, it should be served on a separate listener
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/upstreams", s.adminMethod("GET", s.adminListUpstreams))
+	mux.HandleFunc("/admin/stats", s.adminMethod("GET", s.adminStats))
+	mux.HandleFunc("/admin/reload", s.adminMethod("POST", s.adminReload))
+	mux.HandleFunc("/admin/explain", s.adminMethod("POST", s.adminExplain))
+
+	// The enabling actions also accept the values still disabled, they may have been removed from the configuration by a reload
+	mux.HandleFunc("/admin/upstreams/disable", s.adminMethod("POST", s.adminAction("name", (*state).hasUpstream, upstream.Disable)))
+	mux.HandleFunc("/admin/upstreams/enable", s.adminMethod("POST", s.adminAction("name", orDisabled((*state).hasUpstream, upstream.IsDisabled), upstream.Enable)))
+	mux.HandleFunc("/admin/keys/disable", s.adminMethod("POST", s.adminAction("key", (*state).hasUpstreamKey, upstream.DisableKey)))
+	mux.HandleFunc("/admin/keys/enable", s.adminMethod("POST", s.adminAction("key", orDisabled((*state).hasUpstreamKey, upstream.IsKeyDisabled), upstream.EnableKey)))
+	mux.HandleFunc("/admin/rules/drain", s.adminMethod("POST", s.adminAction("name", (*state).hasRule, upstream.Drain)))
+	mux.HandleFunc("/admin/rules/undrain", s.adminMethod("POST", s.adminAction("name", orDisabled((*state).hasRule, upstream.IsDrained), upstream.Undrain)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		authorized := token != "" && len(array.Filter(s.state.Load().conf.Admin.Keys, func(key string, _ int) bool {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1
+		})) > 0
+		if !authorized {
+			writeAdminResponse(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeAdminResponse(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// adminAction Create a handler that reads the field from the JSON body and applies the action to it,
+// 404 is returned if the value is not known by the current configuration
+func (s *Server) adminAction(field string, known func(st *state, value string) bool, action func(value string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req[field] == "" {
+			writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s is required", field)})
+			return
+		}
+
+		if !known(s.state.Load(), req[field]) {
+			writeAdminResponse(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("%s not found", field)})
+			return
+		}
+
+		action(req[field])
+		writeAdminResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// orDisabled Also accept the values which are disabled
+func orDisabled(known func(st *state, value string) bool, disabled func(value string) bool) func(st *state, value string) bool {
+	return func(st *state, value string) bool {
+		return known(st, value) || disabled(value)
+	}
+}
+
+type adminUpstream struct {
+	Name      string                 `json:"name"`
+	Rule      string                 `json:"rule,omitempty"`
+	Type      string                 `json:"type"`
+	Server    string                 `json:"server"`
+	Key       string                 `json:"key"`
+	Backup    bool                   `json:"backup"`
+	Weight    int                    `json:"weight,omitempty"`
+	Available bool                   `json:"available"`
+	Stats     upstream.StatsSnapshot `json:"stats"`
+}
+
+func newAdminUpstreams(ups *upstream.Upstreams) []adminUpstream {
+	return array.Map(ups.All(), func(up *upstream.Upstream, _ int) adminUpstream {
+		return adminUpstream{
+			Name:      up.Name(),
+			Rule:      up.Rule.Name,
+			Type:      string(up.Rule.Type),
+			Server:    up.MaskedServer(),
+			Key:       up.MaskedKey(),
+			Backup:    up.Rule.Backup,
+			Weight:    up.Rule.Weight,
+			Available: up.Available(),
+			Stats:     up.Stats().Snapshot(),
+		}
+	})
+}
+
+// hasUpstream Whether an upstream of the rules, including the expr rules, has the name
+func (st *state) hasUpstream(name string) bool {
+	for _, rule := range st.conf.Rules {
+		for serverIndex := range rule.Servers {
+			for keyIndex := range rule.Keys {
+				if (&upstream.Upstream{Rule: rule, ServerIndex: serverIndex, KeyIndex: keyIndex}).Name() == name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// hasUpstreamKey Whether the key is used by a rule
+func (st *state) hasUpstreamKey(key string) bool {
+	for _, rule := range st.conf.Rules {
+		if array.In(key, rule.Keys) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasRule Whether a rule has the name
+func (st *state) hasRule(name string) bool {
+	for _, rule := range st.conf.Rules {
+		if rule.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adminListUpstreams The resolved model to upstreams map, the same as the output of -test
+func (s *Server) adminListUpstreams(w http.ResponseWriter, r *http.Request) {
+	st := s.state.Load()
+
+	models := make(map[string][]adminUpstream)
+	for model, ups := range st.upstreams {
+		models[model] = newAdminUpstreams(ups)
+	}
+
+	exprRules := array.Map(st.exprRules, func(rule config.Rule, _ int) map[string]string {
+		return map[string]string{"name": rule.Name, "match": rule.Expr.Match, "replace": rule.Expr.Replace}
+	})
+
+	writeAdminResponse(w, http.StatusOK, map[string]any{
+		"policy":     st.conf.Policy,
+		"models":     models,
+		"default":    newAdminUpstreams(st.defaultUpstreams),
+		"expr_rules": exprRules,
+	})
+}
+
+// adminStats The statistics of all upstreams and the disabled upstreams, keys and drained rules
+func (s *Server) adminStats(w http.ResponseWriter, r *http.Request) {
+	disabledUpstreams, disabledKeys, drainedRules := upstream.Disabled()
+	sort.Strings(disabledUpstreams)
+	sort.Strings(drainedRules)
+
+	writeAdminResponse(w, http.StatusOK, map[string]any{
+		"upstreams":          upstream.AllStats(),
+		"disabled_upstreams": disabledUpstreams,
+		"disabled_keys":      disabledKeys,
+		"drained_rules":      drainedRules,
+	})
+}
+
+func (s *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reload(); err != nil {
+		writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeAdminResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// adminExplain Explain the routing decision of the sample request in the body, see ExplainRequest
+func (s *Server) adminExplain(w http.ResponseWriter, r *http.Request) {
+	var req ExplainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminResponse(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	writeAdminResponse(w, http.StatusOK, s.Explain(req))
+}
+
+func writeAdminResponse(w http.ResponseWriter, statusCode int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/upstream"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	server := newTestServer(t, `keys: ["client-key-123456"]
+admin:
+  listen: "127.0.0.1:0"
+  keys: ["admin-key-1", "admin-key-2"]
+rules:
+  - name: openai
+    servers: ["https://api.openai.com"]
+    keys: ["sk-upstream-1234567890"]
+    models: [gpt-4o]
+`)
+	handler := server.AdminHandler()
+
+	admin := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Any of the admin keys is accepted, the client keys are not
+	assert.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/upstreams", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/upstreams", "client-key-123456", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, admin(http.MethodGet, "/admin/upstreams", "admin-key", "").Code)
+	assert.Equal(t, http.StatusOK, admin(http.MethodGet, "/admin/upstreams", "admin-key-2", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, admin(http.MethodGet, "/admin/rules/drain", "admin-key-1", "").Code)
+
+	name := "openai|s0:k0"
+	defer upstream.Enable(name)
+	defer upstream.EnableKey("sk-upstream-1234567890")
+	defer upstream.Undrain("openai")
+
+	// The unknown names are rejected, so a typo is not taken as success
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodPost, "/admin/upstreams/disable", "admin-key-1", `{}`).Code)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/upstreams/disable", "admin-key-1", `{"name":"openai|s1:k0"}`).Code)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/keys/disable", "admin-key-1", `{"key":"sk-unknown"}`).Code)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/rules/drain", "admin-key-1", `{"name":"anthropic"}`).Code)
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodPost, "/admin/rules/undrain", "admin-key-1", `{"name":"anthropic"}`).Code)
+	assert.False(t, upstream.IsDisabled("openai|s1:k0"))
+
+	available := func() bool {
+		return gjson.Get(admin(http.MethodGet, "/admin/upstreams", "admin-key-1", "").Body.String(), "models.gpt-4o.0.available").Bool()
+	}
+
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/upstreams/disable", "admin-key-1", `{"name":"`+name+`"}`).Code)
+	assert.False(t, available())
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/upstreams/enable", "admin-key-1", `{"name":"`+name+`"}`).Code)
+	assert.True(t, available())
+
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/keys/disable", "admin-key-1", `{"key":"sk-upstream-1234567890"}`).Code)
+	assert.False(t, available())
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/keys/enable", "admin-key-1", `{"key":"sk-upstream-1234567890"}`).Code)
+
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/rules/drain", "admin-key-1", `{"name":"openai"}`).Code)
+	assert.Equal(t, `["openai"]`, gjson.Get(admin(http.MethodGet, "/admin/stats", "admin-key-1", "").Body.String(), "drained_rules").Raw)
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/rules/undrain", "admin-key-1", `{"name":"openai"}`).Code)
+	assert.True(t, available())
+
+	// An upstream disabled before it is removed from the configuration can still be enabled
+	upstream.Disable("removed|s0:k0")
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, "/admin/upstreams/enable", "admin-key-1", `{"name":"removed|s0:k0"}`).Code)
+	assert.False(t, upstream.IsDisabled("removed|s0:k0"))
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/tidwall/gjson"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDispatchAnthropic(t *testing.T) {
+	var img bytes.Buffer
+	assert.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(img.Bytes())
+	}))
+	defer images.Close()
+
+	// A fake Messages API, the image of the request must have been downloaded and sent as base64
+	var requests []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(r)
+		requests = append(requests, body)
+
+		if r.URL.Path != "/v1/messages" || r.Header.Get("X-Api-Key") != "sk-ant" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if gjson.Get(body, "stream").Bool() {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, event := range []string{
+				`{"type":"message_start","message":{"id":"msg_2","usage":{"input_tokens":12}}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"a red"}}`,
+				`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" square"}}`,
+				`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+				`{"type":"message_stop"}`,
+			} {
+				_, _ = w.Write([]byte("event: " + gjson.Get(event, "type").String() + "\ndata: " + event + "\n\n"))
+			}
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"a square"}],"stop_reason":"max_tokens","usage":{"input_tokens":12,"output_tokens":2}}`))
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t, `keys: ["client-key-123456"]
+image-fetch:
+  allow-private: true
+rules:
+  - type: anthropic
+    servers: ["`+upstream.URL+`"]
+    keys: ["sk-ant"]
+    models: [claude-3-5-sonnet]
+`)
+
+	chat := func(stream bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{
+			"model":          "claude-3-5-sonnet",
+			"stream":         stream,
+			"stream_options": map[string]any{"include_usage": stream},
+			"messages": []any{
+				map[string]any{"role": "system", "content": "be brief"},
+				map[string]any{"role": "user", "content": []any{
+					map[string]any{"type": "text", "text": "what is it?"},
+					map[string]any{"type": "image_url", "image_url": map[string]any{"url": images.URL + "/square.png"}},
+				}},
+			},
+		})
+
+		return doRequest(server, http.MethodPost, "/v1/chat/completions", string(body))
+	}
+
+	w := chat(false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a square", gjson.Get(w.Body.String(), "choices.0.message.content").String())
+	assert.Equal(t, "length", gjson.Get(w.Body.String(), "choices.0.finish_reason").String())
+	assert.Equal(t, int64(14), gjson.Get(w.Body.String(), "usage.total_tokens").Int())
+
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "be brief", gjson.Get(requests[0], "system").String())
+	assert.Equal(t, int64(4096), gjson.Get(requests[0], "max_tokens").Int())
+	source := gjson.Get(requests[0], "messages.0.content.1.source")
+	assert.Equal(t, "base64", source.Get("type").String())
+	assert.Equal(t, "image/png", source.Get("media_type").String())
+
+	w = chat(true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream"))
+
+	var content, finish string
+	var usage int64
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == line || data == "[DONE]" {
+			continue
+		}
+
+		content += gjson.Get(data, "choices.0.delta.content").String()
+		finish += gjson.Get(data, "choices.0.finish_reason").String()
+		usage += gjson.Get(data, "usage.total_tokens").Int()
+	}
+
+	assert.Equal(t, "a red square", content)
+	assert.Equal(t, "stop", finish)
+	assert.Equal(t, int64(15), usage)
+	assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+}
@@ -0,0 +1,342 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/stream"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ResultHit The response is served from the cache
+	ResultHit = "hit"
+	// ResultMiss The response is not cached, it is cached after served by the upstream
+	ResultMiss = "miss"
+	// ResultBypass The client asks not to read the cache with the Cache-Control header
+	ResultBypass = "bypass"
+	// ResultSemanticHit The response of a similar request is served from the semantic cache
+	ResultSemanticHit = "semantic-hit"
+	// ResultPartial Some inputs of the embedding request are served from the cache, the others by the upstream
+	ResultPartial = "partial"
+)
+
+// ignoredFields The fields not affecting the response, stream responses are cached as complete responses
+var ignoredFields = []string{"stream", "stream_options", "user"}
+
+// Cache Cache the responses of deterministic requests, and the answers of similar chat requests if semantic is enabled
+type Cache struct {
+	conf       config.Cache
+	store      Store
+	semantic   *semanticCache
+	embeddings *embeddingCache
+}
+
+// New Create a response cache, the disk store is used when the path is set
+func New(ctx context.Context, conf config.Cache) (*Cache, error) {
+	var store Store = NewMemoryStore(conf.Size)
+	if conf.Path != "" {
+		disk, err := NewDiskStore(ctx, conf.Path, int64(conf.DiskMaxMB)*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+
+		store = NewTieredStore(store.(*MemoryStore), disk)
+	}
+
+	c := &Cache{conf: conf, store: store}
+	if conf.Semantic.Enabled {
+		c.semantic = newSemanticCache(conf.Semantic)
+	}
+
+	if conf.Embedding.Enabled {
+		c.embeddings = newEmbeddingCache(conf.Embedding)
+	}
+
+	return c, nil
+}
+
+// MaxBodyBytes The maximum size of the responses cached
+func (c *Cache) MaxBodyBytes() int {
+	return c.conf.MaxBodyBytes
+}
+
+// Decision How the request uses the cache
+type Decision struct {
+	// Key The cache key of the request
+	Key      string
+	Endpoint base.Endpoint
+	TTL      time.Duration
+	// Stream Whether the client asks for a stream response
+	Stream bool
+	// IncludeUsage Whether the client asks for the usage chunk in the stream response
+	IncludeUsage bool
+	// Result hit, miss or bypass
+	Result string
+	// Entry The cached response when hit
+	Entry *Entry
+	// Similarity The similarity of the cached request when it is a semantic hit
+	Similarity float64
+	// store Whether the response should be cached
+	store bool
+	// pending The semantic cache item waiting for the response
+	pending *semanticItem
+}
+
+// Lookup Decide whether the request can be cached and look up the cache, nil is returned if the request can not be cached.
+// The exact cache is looked up first, then the semantic cache for chat completions if it is enabled.
+// The Cache-Control header of the client is respected: no-cache skips the lookup but the response is still cached,
+// no-store skips both
+func (c *Cache) Lookup(ctx context.Context, r *http.Request, clientKey string, model string, body []byte, embed Embedder) *Decision {
+	endpoint := base.Endpoint(strings.TrimSuffix(r.URL.Path, "/"))
+	if !array.In(endpoint, c.conf.Endpoints) || !gjson.ValidBytes(body) {
+		return nil
+	}
+
+	d := &Decision{
+		Endpoint:     endpoint,
+		TTL:          c.TTL(endpoint, model),
+		Stream:       gjson.GetBytes(body, "stream").Bool(),
+		IncludeUsage: gjson.GetBytes(body, "stream_options.include_usage").Bool(),
+	}
+
+	if d.TTL <= 0 {
+		return nil
+	}
+
+	// Only chat completions can be replayed as streams
+	if d.Stream && endpoint != base.EndpointChatCompletion {
+		return nil
+	}
+
+	deterministic := endpoint == base.EndpointEmbedding || c.conf.AnyTemperature
+	if !deterministic {
+		temperature := gjson.GetBytes(body, "temperature")
+		deterministic = temperature.Exists() && temperature.Float() == 0
+	}
+
+	semantic := c.semantic != nil && endpoint == base.EndpointChatCompletion && embed != nil
+	if !deterministic && !semantic {
+		return nil
+	}
+
+	if deterministic {
+		key, err := c.key(endpoint, clientKey, model, body)
+		if err != nil {
+			return nil
+		}
+
+		d.Key = key
+	}
+
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	switch {
+	case strings.Contains(cacheControl, "no-store"):
+		d.Result = ResultBypass
+	case strings.Contains(cacheControl, "no-cache"):
+		d.Result, d.store = ResultBypass, d.Key != ""
+	default:
+		d.Result, d.store = ResultMiss, d.Key != ""
+		if d.Key != "" {
+			if entry, ok := c.store.Get(ctx, d.Key); ok {
+				d.Result, d.Entry, d.store = ResultHit, entry, false
+			}
+		}
+
+		if d.Result == ResultMiss && semantic {
+			c.semantic.lookup(ctx, d, clientKey, model, body, embed)
+		}
+	}
+
+	requestCounter.WithLabelValues(string(endpoint), d.Result).Inc()
+	return d
+}
+
+// TTL Return the TTL of the requests of the endpoint and model, 0 if they should not be cached
+func (c *Cache) TTL(endpoint base.Endpoint, model string) time.Duration {
+	return TTL(c.conf, endpoint, model)
+}
+
+// TTL Return the TTL of the requests of the endpoint and model under the configuration, the first matched rule is used
+func TTL(conf config.Cache, endpoint base.Endpoint, model string) time.Duration {
+	for _, rule := range conf.Rules {
+		if rule.Endpoint != "" && rule.Endpoint != endpoint {
+			continue
+		}
+
+		if len(rule.Models) > 0 && !array.In(model, rule.Models) {
+			continue
+		}
+
+		return rule.TTL
+	}
+
+	return conf.TTL
+}
+
+// key The canonical hash of the request, the fields of the body are sorted, the numbers are normalized and the ignored
+// fields are removed, so that the requests only differ in field order, number format or stream are cached as the same
+func (c *Cache) key(endpoint base.Endpoint, clientKey string, model string, body []byte) (string, error) {
+	normalized, err := canonicalize(body, ignoredFields)
+	if err != nil {
+		return "", err
+	}
+
+	if c.conf.Shared {
+		clientKey = ""
+	}
+
+	return hashParts([]byte(endpoint), []byte(clientKey), []byte(model), normalized), nil
+}
+
+// canonicalize Encode the JSON object with sorted fields and normalized numbers, the ignored fields are removed
+func canonicalize(body []byte, ignored []string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var fields map[string]any
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	for _, field := range ignored {
+		delete(fields, field)
+	}
+
+	return json.Marshal(normalize(fields))
+}
+
+// hashParts The hex encoded sha256 of the parts, each part is terminated by a zero byte
+func hashParts(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalize Format the numbers in the value canonically, such as 0.0 and 0, the integers are kept exact
+func normalize(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, item := range v {
+			v[k] = normalize(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+	case json.Number:
+		if _, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return v
+		}
+
+		if f, err := v.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	}
+
+	return value
+}
+
+// Replay Write the cached response to the client, chat completions are sent as streams if the client asks for it
+func (c *Cache) Replay(w http.ResponseWriter, d *Decision) error {
+	body, contentType := d.Entry.Body, d.Entry.ContentType
+	if d.Stream {
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return err
+		}
+
+		body, contentType = stream.Encode(stream.Split(resp, d.IncludeUsage)), "text/event-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(d.Entry.CreatedAt).Seconds())))
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(body)
+	return err
+}
+
+// finished Whether all choices of the response are finished normally. The choices filtered by the content filter,
+// cut off by the max tokens or not finished are not cached, they would be served to all the later requests
+func finished(reasons []string) bool {
+	for _, reason := range reasons {
+		if reason == "" || reason == string(openai.FinishReasonContentFilter) || reason == string(openai.FinishReasonLength) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Save Cache the response served by the upstream, only the complete successful responses are cached
+func (c *Cache) Save(ctx context.Context, d *Decision, status int, contentType string, body []byte, complete bool) {
+	if !d.store && d.pending == nil {
+		return
+	}
+
+	if status != http.StatusOK || !complete || len(body) == 0 || len(body) > c.conf.MaxBodyBytes {
+		return
+	}
+
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		// The stream may be cut off by the upstream, the recorded body is the raw upstream output
+		if !bytes.Contains(body, []byte("data: [DONE]")) {
+			return
+		}
+
+		resp, err := stream.Merge(body)
+		if err != nil {
+			return
+		}
+
+		if !finished(array.Map(resp.Choices, func(choice openai.ChatCompletionChoice, _ int) string { return string(choice.FinishReason) })) {
+			return
+		}
+
+		if body, err = stream.Marshal(resp); err != nil {
+			return
+		}
+
+		contentType = "application/json"
+	} else if !strings.HasPrefix(contentType, "application/json") || !gjson.ValidBytes(body) {
+		return
+	} else if choices := gjson.GetBytes(body, "choices"); choices.IsArray() {
+		if !finished(array.Map(choices.Array(), func(choice gjson.Result, _ int) string { return choice.Get("finish_reason").String() })) {
+			return
+		}
+	}
+
+	now := time.Now()
+	if d.store {
+		c.store.Set(ctx, d.Key, &Entry{Body: body, ContentType: contentType, CreatedAt: now, ExpiresAt: now.Add(d.TTL)})
+		storeCounter.WithLabelValues(string(d.Endpoint), "exact").Inc()
+
+		if log.DebugEnabled() {
+			log.F(log.M{"request_id": base.RequestID(ctx), "key": d.Key, "endpoint": d.Endpoint, "ttl": d.TTL.String()}).Debug("response cached")
+		}
+	}
+
+	if d.pending != nil {
+		ttl := ternary.If(c.conf.Semantic.TTL > 0, c.conf.Semantic.TTL, d.TTL)
+		d.pending.entry = &Entry{Body: body, ContentType: contentType, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+		c.semantic.add(d.pending)
+		storeCounter.WithLabelValues(string(d.Endpoint), "semantic").Inc()
+	}
+}
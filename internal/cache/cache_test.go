@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/stream"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newCache(t *testing.T, path string) *Cache {
+	c, err := New(context.Background(), config.Cache{
+		Enabled:      true,
+		Endpoints:    []base.Endpoint{base.EndpointChatCompletion, base.EndpointEmbedding},
+		TTL:          time.Hour,
+		Size:         100,
+		MaxBodyBytes: 1024 * 1024,
+		Path:         path,
+		Rules: []config.CacheRule{
+			{Endpoint: base.EndpointChatCompletion, Models: []string{"gpt-4o-mini"}, TTL: 0},
+		},
+	})
+	assert.NoError(t, err)
+	return c
+}
+
+func lookup(c *Cache, path string, body string, headers ...string) *Decision {
+	return lookupWith(c, "tester", nil, path, body, headers...)
+}
+
+func lookupWith(c *Cache, clientKey string, embed Embedder, path string, body string, headers ...string) *Decision {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+
+	return c.Lookup(context.Background(), r, clientKey, gjson.Get(body, "model").String(), []byte(body), embed)
+}
+
+func TestCache_Lookup(t *testing.T) {
+	c := newCache(t, "")
+
+	d := lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, ResultMiss, d.Result)
+
+	// The field order and stream options do not change the key
+	same := lookup(c, "/v1/chat/completions", `{"messages":[{"content":"hi","role":"user"}],"stream":true,"temperature":0.0,"model":"gpt-4o"}`)
+	assert.Equal(t, d.Key, same.Key)
+	assert.True(t, same.Stream)
+
+	// Non-deterministic requests, disabled models and other endpoints are not cached
+	assert.True(t, lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`) == nil)
+	assert.True(t, lookup(c, "/v1/chat/completions", `{"model":"gpt-4o-mini","temperature":0,"messages":[]}`) == nil)
+	assert.True(t, lookup(c, "/v1/completions", `{"model":"gpt-4o","temperature":0,"prompt":"hi"}`) == nil)
+
+	// Embeddings are always deterministic
+	assert.Equal(t, ResultMiss, lookup(c, "/v1/embeddings", `{"model":"text-embedding-3-small","input":"hi"}`).Result)
+
+	// The responses filtered or cut off are not cached
+	for _, reason := range []string{"content_filter", "length", ""} {
+		c.Save(context.Background(), d, http.StatusOK, "application/json", []byte(`{"id":"1","choices":[{"index":0,"message":{"content":"h"},"finish_reason":"`+reason+`"}]}`), true)
+		assert.Equal(t, ResultMiss, lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`).Result)
+	}
+
+	c.Save(context.Background(), d, http.StatusOK, "application/json", []byte(`{"id":"1","choices":[{"index":0,"message":{"content":"hello"},"finish_reason":"stop"}]}`), true)
+	assert.Equal(t, ResultHit, lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`).Result)
+
+	// The cache is separated for each client key, unless it is shared
+	assert.Equal(t, ResultMiss, lookupWith(c, "other", nil, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`).Result)
+
+	c.conf.Shared = true
+	shared := lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, shared.Key, lookupWith(c, "other", nil, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`).Key)
+	c.conf.Shared = false
+
+	// The client can skip the cache
+	bypass := lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, "Cache-Control", "no-cache")
+	assert.Equal(t, ResultBypass, bypass.Result)
+	assert.True(t, bypass.store)
+
+	noStore := lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`, "Cache-Control", "no-store")
+	assert.False(t, noStore.store)
+}
+
+func TestCache_ReplayStream(t *testing.T) {
+	c := newCache(t, t.TempDir())
+
+	body := `{"model":"gpt-4o","temperature":0,"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`
+	d := lookup(c, "/v1/chat/completions", body)
+
+	// The incomplete stream is not cached
+	c.Save(context.Background(), d, http.StatusOK, "text/event-stream", []byte("data: {\"id\":\"1\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n"), true)
+	assert.Equal(t, ResultMiss, lookup(c, "/v1/chat/completions", body).Result)
+
+	sse := "data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"Hel\"}}]}\n\n" +
+		"data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n" +
+		"data: {\"id\":\"1\",\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":1,\"completion_tokens\":2,\"total_tokens\":3}}\n\n" +
+		"data: [DONE]\n\n"
+	c.Save(context.Background(), d, http.StatusOK, "text/event-stream", []byte(sse), true)
+
+	// The stream is cached as a complete response, on disk too
+	disk, err := NewDiskStore(context.Background(), c.conf.Path, 0)
+	assert.NoError(t, err)
+	entry, ok := disk.Get(context.Background(), d.Key)
+	assert.True(t, ok)
+	assert.Equal(t, "Hello", gjson.GetBytes(entry.Body, "choices.0.message.content").String())
+	assert.False(t, gjson.GetBytes(entry.Body, "choices.0.content_filter_results").Exists())
+
+	hit := lookup(c, "/v1/chat/completions", body)
+	assert.Equal(t, ResultHit, hit.Result)
+
+	rec := httptest.NewRecorder()
+	assert.NoError(t, c.Replay(rec, hit))
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+
+	merged, err := stream.Merge(rec.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", merged.Choices[0].Message.Content)
+	assert.Equal(t, 3, merged.Usage.TotalTokens)
+
+	// The non-stream request is served with the same entry
+	hit = lookup(c, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, ResultHit, hit.Result)
+
+	rec = httptest.NewRecorder()
+	assert.NoError(t, c.Replay(rec, hit))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Hello", gjson.Get(rec.Body.String(), "choices.0.message.content").String())
+}
+
+func TestCache_Semantic(t *testing.T) {
+	c, err := New(context.Background(), config.Cache{
+		Enabled:      true,
+		Endpoints:    []base.Endpoint{base.EndpointChatCompletion},
+		TTL:          time.Hour,
+		Size:         100,
+		MaxBodyBytes: 1024 * 1024,
+		Semantic:     config.SemanticCache{Enabled: true, Model: "text-embedding-3-small", Threshold: 0.9, Size: 2},
+	})
+	assert.NoError(t, err)
+
+	vectors := map[string][]float32{
+		"what is the weather today": {1, 0, 0},
+		"what's the weather today?": {0.95, 0.05, 0},
+		"how to cook rice":          {0, 1, 0},
+		"tell me a joke about cats": {0, 0, 1},
+	}
+	embed := func(ctx context.Context, model string, text string) ([]float32, error) {
+		return vectors[text], nil
+	}
+
+	chat := func(question string) string {
+		return `{"model":"gpt-4o","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"` + question + `"}]}`
+	}
+
+	d := lookupWith(c, "tester", embed, "/v1/chat/completions", chat("what is the weather today"))
+	assert.Equal(t, ResultMiss, d.Result)
+	assert.True(t, d.pending != nil)
+	c.Save(context.Background(), d, http.StatusOK, "application/json", []byte(`{"id":"1","choices":[{"index":0,"message":{"role":"assistant","content":"sunny"},"finish_reason":"stop"}]}`), true)
+
+	d = lookupWith(c, "tester", embed, "/v1/chat/completions", chat("what's the weather today?"))
+	assert.Equal(t, ResultSemanticHit, d.Result)
+	assert.True(t, d.Similarity > 0.9)
+	assert.Equal(t, "sunny", gjson.GetBytes(d.Entry.Body, "choices.0.message.content").String())
+
+	// The answers are not shared by other keys, system prompts or dissimilar questions
+	assert.Equal(t, ResultMiss, lookupWith(c, "other", embed, "/v1/chat/completions", chat("what's the weather today?")).Result)
+	assert.Equal(t, ResultMiss, lookupWith(c, "tester", embed, "/v1/chat/completions", strings.Replace(chat("what's the weather today?"), "be brief", "be verbose", 1)).Result)
+	assert.Equal(t, ResultMiss, lookupWith(c, "tester", embed, "/v1/chat/completions", chat("how to cook rice")).Result)
+
+	// The least recently used answer is evicted
+	for _, question := range []string{"how to cook rice", "tell me a joke about cats"} {
+		d = lookupWith(c, "tester", embed, "/v1/chat/completions", chat(question))
+		c.Save(context.Background(), d, http.StatusOK, "application/json", []byte(`{"id":"2","choices":[]}`), true)
+	}
+
+	assert.Equal(t, ResultMiss, lookupWith(c, "tester", embed, "/v1/chat/completions", chat("what's the weather today?")).Result)
+	assert.Equal(t, 2, c.semantic.index("tester").Len())
+}
+
+func TestDiskStore_ConcurrentSet(t *testing.T) {
+	store, err := NewDiskStore(context.Background(), t.TempDir(), 0)
+	assert.NoError(t, err)
+
+	key := "abcdef0123456789"
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Set(context.Background(), key, &Entry{Body: []byte(strconv.Itoa(i)), CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+		}(i)
+	}
+	wg.Wait()
+
+	// One of the writers wins, and no temporary file is left behind
+	_, ok := store.Get(context.Background(), key)
+	assert.True(t, ok)
+
+	files, err := os.ReadDir(filepath.Dir(store.path(key)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, key+".json", files[0].Name())
+}
+
+func TestDiskStore_Purge(t *testing.T) {
+	dir := t.TempDir()
+
+	// The stale temporary files are left by a crashed writer, the recent ones may be being written
+	stale, recent := filepath.Join(dir, "ab", "abc.json.1.tmp"), filepath.Join(dir, "ab", "abc.json.2.tmp")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(stale), os.ModePerm))
+	assert.NoError(t, os.WriteFile(stale, []byte("{"), 0644))
+	assert.NoError(t, os.WriteFile(recent, []byte("{"), 0644))
+	assert.NoError(t, os.Chtimes(stale, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+	store, err := NewDiskStore(context.Background(), dir, 0)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(recent)
+	assert.NoError(t, err)
+
+	body := []byte(strings.Repeat("a", 300))
+	for i := 0; i < 10; i++ {
+		store.Set(context.Background(), fmt.Sprintf("key%02d", i), &Entry{Body: body, ExpiresAt: time.Now().Add(time.Hour)})
+
+		// The files are written in order, the earlier ones are older
+		path := store.path(fmt.Sprintf("key%02d", i))
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	// The oldest entries are removed until the files take 90% of the maximum size
+	store.maxBytes = 2000
+	store.Purge()
+	assert.True(t, store.size.Load() <= 1800)
+	_, ok := store.Get(context.Background(), "key00")
+	assert.False(t, ok)
+	_, ok = store.Get(context.Background(), "key09")
+	assert.True(t, ok)
+}
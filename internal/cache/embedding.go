@@ -0,0 +1,390 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/lru"
+	"github.com/mylxsw/openai-dispatcher/pkg/token"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embeddingIgnoredFields The fields not affecting the embeddings, the input is cached item by item
+var embeddingIgnoredFields = []string{"input", "user"}
+
+// EmbeddingItem The embedding of an input
+type EmbeddingItem struct {
+	// Embedding The raw embedding, a float array or a base64 string depending on the encoding format
+	Embedding json.RawMessage
+	// Tokens The tokens of the input counted by the tokenizer of the model
+	Tokens int
+}
+
+// EmbeddingFetcher Embed the inputs by the upstream, the items are returned in the order of the inputs.
+// The context is cancelled when all requests waiting for the inputs have gone away
+type EmbeddingFetcher func(ctx context.Context, inputs []json.RawMessage) ([]EmbeddingItem, error)
+
+// EmbeddingRequest An embedding request split into inputs
+type EmbeddingRequest struct {
+	Model string
+	// Scope The hash of the model and the parameters, such as the dimensions and encoding format,
+	// the embeddings are only reused by the requests of the same scope
+	Scope  string
+	Inputs []json.RawMessage
+}
+
+// ParseEmbeddingRequest Split the input of the embedding request, a string, an array of strings, a token array
+// or an array of token arrays
+func ParseEmbeddingRequest(body []byte) (*EmbeddingRequest, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, errors.New("invalid embedding request")
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	if model == "" {
+		return nil, errors.New("model is required")
+	}
+
+	params, err := canonicalize(body, embeddingIgnoredFields)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &EmbeddingRequest{Model: model, Scope: hashParts([]byte(model), params)}
+
+	input := gjson.GetBytes(body, "input")
+	switch {
+	case input.Type == gjson.String:
+		req.Inputs = []json.RawMessage{json.RawMessage(input.Raw)}
+	case input.IsArray():
+		items := input.Array()
+		if len(items) > 0 && items[0].Type == gjson.Number {
+			// A single token array
+			req.Inputs = []json.RawMessage{json.RawMessage(input.Raw)}
+			break
+		}
+
+		for _, item := range items {
+			if item.Type != gjson.String && !item.IsArray() {
+				return nil, fmt.Errorf("unsupported input type: %s", item.Raw)
+			}
+
+			req.Inputs = append(req.Inputs, json.RawMessage(item.Raw))
+		}
+	}
+
+	if len(req.Inputs) == 0 {
+		return nil, errors.New("input is required")
+	}
+
+	return req, nil
+}
+
+// ParseEmbeddingResponse Extract the embeddings of the inputs from the upstream response in the order of the inputs,
+// the tokens of each input are counted by the tokenizer of the model
+func ParseEmbeddingResponse(body []byte, model string, inputs []json.RawMessage) ([]EmbeddingItem, error) {
+	data := gjson.GetBytes(body, "data").Array()
+	if len(data) != len(inputs) {
+		return nil, fmt.Errorf("invalid embedding response, %d embeddings for %d inputs", len(data), len(inputs))
+	}
+
+	items := make([]EmbeddingItem, len(inputs))
+	for i, item := range data {
+		index := i
+		if idx := item.Get("index"); idx.Exists() {
+			index = int(idx.Int())
+		}
+
+		embedding := item.Get("embedding")
+		if index < 0 || index >= len(items) || !embedding.Exists() || items[index].Embedding != nil {
+			return nil, fmt.Errorf("invalid embedding at %d", i)
+		}
+
+		items[index].Embedding = json.RawMessage(embedding.Raw)
+	}
+
+	_, estimator := token.EstimatorFor(model)
+	for i, input := range inputs {
+		tokens, err := inputTokens(estimator, input)
+		if err != nil {
+			return nil, err
+		}
+
+		items[i].Tokens = tokens
+	}
+
+	return items, nil
+}
+
+// inputTokens The tokens of the input, a token array is counted as is and a string by the estimator
+func inputTokens(estimator token.Estimator, input json.RawMessage) (int, error) {
+	value := gjson.ParseBytes(input)
+	if value.IsArray() {
+		return len(value.Array()), nil
+	}
+
+	return estimator.TextTokens(value.String())
+}
+
+// embeddingResponse The embedding response in the OpenAI format
+type embeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  embeddingUsage  `json:"usage"`
+}
+
+type embeddingData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+type embeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// EmbeddingResponse Assemble the embedding response of the items, the usage is the tokens sent to the upstream
+// for the request, the cached inputs are not counted
+func EmbeddingResponse(model string, items []EmbeddingItem, promptTokens int) []byte {
+	resp := embeddingResponse{
+		Object: "list",
+		Model:  model,
+		Data:   make([]embeddingData, len(items)),
+		Usage:  embeddingUsage{PromptTokens: promptTokens, TotalTokens: promptTokens},
+	}
+
+	for i, item := range items {
+		resp.Data[i] = embeddingData{Object: "embedding", Index: i, Embedding: item.Embedding}
+	}
+
+	body, _ := json.Marshal(resp)
+	return body
+}
+
+// EmbeddingEnabled Whether the embedding requests are cached by input
+func (c *Cache) EmbeddingEnabled() bool {
+	return c.embeddings != nil
+}
+
+// EmbeddingDecision How the inputs of the embedding request use the cache
+type EmbeddingDecision struct {
+	TTL time.Duration
+	// Keys The cache keys of the inputs
+	Keys []string
+	// Items The cached items of the inputs, nil for the missed ones
+	Items []*EmbeddingItem
+	// Result hit if all inputs are cached, partial if some of them are, otherwise miss or bypass
+	Result string
+}
+
+// LookupEmbeddings Look up the inputs of the embedding request, nil is returned if the model is not cached or the
+// client asks not to store the response. The Cache-Control header is respected like the response cache
+func (c *Cache) LookupEmbeddings(r *http.Request, clientKey string, req *EmbeddingRequest) *EmbeddingDecision {
+	d := &EmbeddingDecision{TTL: c.TTL(base.EndpointEmbedding, req.Model)}
+	if d.TTL <= 0 {
+		return nil
+	}
+
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") {
+		return nil
+	}
+
+	if c.conf.Shared {
+		clientKey = ""
+	}
+
+	d.Keys = make([]string, len(req.Inputs))
+	d.Items = make([]*EmbeddingItem, len(req.Inputs))
+
+	hits := 0
+	for i, input := range req.Inputs {
+		d.Keys[i] = hashParts([]byte(req.Scope), []byte(clientKey), input)
+		if strings.Contains(cacheControl, "no-cache") {
+			continue
+		}
+
+		if item, ok := c.embeddings.items.Get(d.Keys[i]); ok {
+			d.Items[i] = item
+			hits++
+		}
+	}
+
+	embeddingInputCounter.WithLabelValues(ResultHit).Add(float64(hits))
+	embeddingInputCounter.WithLabelValues(ResultMiss).Add(float64(len(req.Inputs) - hits))
+
+	switch {
+	case strings.Contains(cacheControl, "no-cache"):
+		d.Result = ResultBypass
+	case hits == len(req.Inputs):
+		d.Result = ResultHit
+	case hits > 0:
+		d.Result = ResultPartial
+	default:
+		d.Result = ResultMiss
+	}
+
+	requestCounter.WithLabelValues(string(base.EndpointEmbedding), d.Result).Inc()
+	return d
+}
+
+// SaveEmbedding Cache the embedding of the input
+func (c *Cache) SaveEmbedding(d *EmbeddingDecision, index int, item EmbeddingItem) {
+	c.embeddings.items.SetWithTTL(d.Keys[index], &item, d.TTL)
+	storeCounter.WithLabelValues(string(base.EndpointEmbedding), "embedding").Inc()
+}
+
+// FetchEmbeddings Embed the inputs by the fetcher, the inputs of concurrent requests with the same batch key are
+// coalesced into one upstream request when the batch window is set. It returns when the embeddings are fetched
+// or the context is done
+func (c *Cache) FetchEmbeddings(ctx context.Context, batchKey string, inputs []json.RawMessage, fetch EmbeddingFetcher) ([]EmbeddingItem, error) {
+	return c.embeddings.batcher.fetch(ctx, batchKey, inputs, fetch)
+}
+
+// embeddingCache The embeddings of the inputs and the batcher of the missed inputs
+type embeddingCache struct {
+	items   *lru.Cache[string, *EmbeddingItem]
+	batcher *batcher
+}
+
+func newEmbeddingCache(conf config.EmbeddingCache) *embeddingCache {
+	return &embeddingCache{
+		items:   lru.New[string, *EmbeddingItem](conf.Size, 0),
+		batcher: newBatcher(conf.BatchWindow, conf.MaxBatchSize),
+	}
+}
+
+// batch The inputs waiting to be embedded in one upstream request
+type batch struct {
+	inputs  []json.RawMessage
+	fetch   EmbeddingFetcher
+	started bool
+	done    chan struct{}
+	items   []EmbeddingItem
+	err     error
+
+	// ctx The context of the upstream request, it is cancelled when all waiters have gone away
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// batcher Coalesce the inputs of concurrent requests into batches, a batch is sent when the window elapses
+// after its first input or it is full
+type batcher struct {
+	window  time.Duration
+	maxSize int
+	lock    sync.Mutex
+	batches map[string]*batch
+}
+
+func newBatcher(window time.Duration, maxSize int) *batcher {
+	return &batcher{window: window, maxSize: maxSize, batches: make(map[string]*batch)}
+}
+
+// fetch Add the inputs to the pending batch of the key and wait for the result, the fetcher of the request
+// creating the batch is used. The requests with too many inputs are not coalesced
+func (b *batcher) fetch(ctx context.Context, key string, inputs []json.RawMessage, fetch EmbeddingFetcher) ([]EmbeddingItem, error) {
+	if b.window <= 0 || len(inputs) >= b.maxSize {
+		batchCounter.WithLabelValues("false").Inc()
+		return fetch(ctx, inputs)
+	}
+
+	b.lock.Lock()
+	bt, ok := b.batches[key]
+	if ok && len(bt.inputs)+len(inputs) > b.maxSize {
+		b.detach(key, bt)
+		go b.send(bt)
+		ok = false
+	}
+
+	if !ok {
+		bt = &batch{fetch: fetch, done: make(chan struct{})}
+		bt.ctx, bt.cancel = context.WithCancel(context.Background())
+		b.batches[key] = bt
+		time.AfterFunc(b.window, func() {
+			b.lock.Lock()
+			b.detach(key, bt)
+			b.lock.Unlock()
+
+			b.send(bt)
+		})
+	}
+
+	offset := len(bt.inputs)
+	bt.inputs = append(bt.inputs, inputs...)
+	bt.waiters++
+	if len(bt.inputs) >= b.maxSize {
+		b.detach(key, bt)
+		go b.send(bt)
+	}
+	b.lock.Unlock()
+
+	select {
+	case <-bt.done:
+	case <-ctx.Done():
+		b.leave(bt)
+		return nil, ctx.Err()
+	}
+
+	if bt.err != nil {
+		return nil, bt.err
+	}
+
+	return bt.items[offset : offset+len(inputs)], nil
+}
+
+// leave Remove a waiter from the batch, the upstream request is cancelled when no one is waiting for it
+func (b *batcher) leave(bt *batch) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bt.waiters--
+	if bt.waiters == 0 {
+		bt.cancel()
+	}
+}
+
+// detach Stop adding inputs to the batch, the lock must be held
+func (b *batcher) detach(key string, bt *batch) {
+	if b.batches[key] == bt {
+		delete(b.batches, key)
+	}
+}
+
+// send Embed the inputs of the batch once, the waiting requests are notified when done
+func (b *batcher) send(bt *batch) {
+	b.lock.Lock()
+	if bt.started {
+		b.lock.Unlock()
+		return
+	}
+
+	bt.started = true
+	b.lock.Unlock()
+
+	defer bt.cancel()
+	defer close(bt.done)
+
+	// All waiters have gone away before the batch is sent
+	if err := bt.ctx.Err(); err != nil {
+		bt.err = err
+		return
+	}
+
+	batchCounter.WithLabelValues("true").Inc()
+
+	bt.items, bt.err = bt.fetch(bt.ctx, bt.inputs)
+	if bt.err == nil && len(bt.items) != len(bt.inputs) {
+		bt.err = fmt.Errorf("%d embeddings returned for %d inputs", len(bt.items), len(bt.inputs))
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mylxsw/go-utils/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseEmbeddingRequest(t *testing.T) {
+	req, err := ParseEmbeddingRequest([]byte(`{"model":"m","input":["a",[1,2]],"dimensions":256}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(req.Inputs))
+	assert.Equal(t, `[1,2]`, string(req.Inputs[1]))
+
+	// A single token array is one input
+	tokens, err := ParseEmbeddingRequest([]byte(`{"input":[1,2,3],"model":"m","dimensions":256.0,"user":"u"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tokens.Inputs))
+
+	// The user and the order of the fields do not change the scope, the dimensions do
+	assert.Equal(t, req.Scope, tokens.Scope)
+	other, err := ParseEmbeddingRequest([]byte(`{"model":"m","input":"a","dimensions":512}`))
+	assert.NoError(t, err)
+	assert.True(t, other.Scope != req.Scope)
+
+	_, err = ParseEmbeddingRequest([]byte(`{"model":"m","input":[]}`))
+	assert.True(t, err != nil)
+}
+
+func TestParseEmbeddingResponse(t *testing.T) {
+	inputs := []json.RawMessage{[]byte(`"hello world"`), []byte(`[1,2,3]`)}
+	items, err := ParseEmbeddingResponse([]byte(`{"data":[{"index":1,"embedding":[2]},{"index":0,"embedding":[1]}],"usage":{"prompt_tokens":100}}`), "text-embedding-3-small", inputs)
+	assert.NoError(t, err)
+	assert.Equal(t, `[1]`, string(items[0].Embedding))
+	// The tokens are counted by the tokenizer of the model rather than split from the usage of the upstream
+	assert.Equal(t, 2, items[0].Tokens)
+	assert.Equal(t, 3, items[1].Tokens)
+
+	_, err = ParseEmbeddingResponse([]byte(`{"data":[{"index":0,"embedding":[1]}]}`), "text-embedding-3-small", inputs)
+	assert.True(t, err != nil)
+}
+
+func TestBatcher(t *testing.T) {
+	var calls atomic.Int32
+	fetch := func(ctx context.Context, inputs []json.RawMessage) ([]EmbeddingItem, error) {
+		calls.Add(1)
+
+		items := make([]EmbeddingItem, len(inputs))
+		for i, input := range inputs {
+			items[i] = EmbeddingItem{Embedding: input, Tokens: 1}
+		}
+
+		return items, nil
+	}
+
+	b := newBatcher(50*time.Millisecond, 4)
+
+	var wg sync.WaitGroup
+	results := make([][]EmbeddingItem, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			input := json.RawMessage(`"` + string(rune('a'+i)) + `"`)
+			items, err := b.fetch(context.Background(), "key", []json.RawMessage{input}, fetch)
+			assert.NoError(t, err)
+			results[i] = items
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for i, items := range results {
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, `"`+string(rune('a'+i))+`"`, string(items[0].Embedding))
+	}
+
+	// The requests with more inputs than the max batch size are sent directly
+	items, err := b.fetch(context.Background(), "key", make([]json.RawMessage, 4), fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(items))
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestBatcher_Cancel(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	hung := func(ctx context.Context, inputs []json.RawMessage) ([]EmbeddingItem, error) {
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	// The batch is sent when both requests have joined it
+	b := newBatcher(time.Hour, 2)
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{first, second} {
+		go func(ctx context.Context) {
+			_, err := b.fetch(ctx, "key", []json.RawMessage{[]byte(`"a"`)}, hung)
+			errs <- err
+		}(ctx)
+	}
+
+	<-started
+
+	// The upstream request is kept while anyone is waiting for it
+	cancelFirst()
+	assert.Equal(t, context.Canceled, <-errs)
+	select {
+	case <-cancelled:
+		t.Fatal("the batch is cancelled while a request is waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancelSecond()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Equal(t, context.Canceled, <-cancelled)
+}
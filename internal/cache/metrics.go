@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_dispatcher_cache_requests_total",
+		Help: "The number of cacheable requests, by endpoint and result (hit, semantic-hit, miss, bypass)",
+	}, []string{"endpoint", "result"})
+
+	storeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_dispatcher_cache_stored_total",
+		Help: "The number of responses cached, by endpoint and cache (exact, semantic, embedding)",
+	}, []string{"endpoint", "cache"})
+
+	embeddingInputCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_dispatcher_cache_embedding_inputs_total",
+		Help: "The number of inputs of the embedding requests looked up, by result (hit, miss)",
+	}, []string{"result"})
+
+	batchCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "openai_dispatcher_cache_embedding_batches_total",
+		Help: "The number of upstream embedding requests of the missed inputs, by whether they are coalesced",
+	}, []string{"coalesced"})
+)
@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/tidwall/gjson"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Embedder Embed the text with the embedding model
+type Embedder func(ctx context.Context, model string, text string) ([]float32, error)
+
+// semanticItem A cached answer and the embedding of the question
+type semanticItem struct {
+	clientKey string
+	// scope The hash of everything else affecting the answer, such as the model, system prompt and tools
+	scope  string
+	vector []float32
+	entry  *Entry
+}
+
+// semanticCache Serve the cached answer of the most similar question, the last user message of chat requests is
+// embedded and searched in the index of the client key
+type semanticCache struct {
+	conf    config.SemanticCache
+	lock    sync.Mutex
+	indexes map[string]*semanticIndex
+}
+
+func newSemanticCache(conf config.SemanticCache) *semanticCache {
+	return &semanticCache{conf: conf, indexes: make(map[string]*semanticIndex)}
+}
+
+// index Return the index of the client key, it is created if not exists
+func (s *semanticCache) index(clientKey string) *semanticIndex {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	idx, ok := s.indexes[clientKey]
+	if !ok {
+		idx = newSemanticIndex(s.conf.Size)
+		s.indexes[clientKey] = idx
+	}
+
+	return idx
+}
+
+// lookup Search the similar question of the request, the decision is a semantic hit if found,
+// otherwise the embedding is kept in the decision so that the answer is added to the index after served
+func (s *semanticCache) lookup(ctx context.Context, d *Decision, clientKey string, model string, body []byte, embed Embedder) {
+	messages := gjson.GetBytes(body, "messages").Array()
+	if len(messages) == 0 || messages[len(messages)-1].Get("role").String() != "user" {
+		return
+	}
+
+	question := messageText(messages[len(messages)-1].Get("content"))
+	if strings.TrimSpace(question) == "" {
+		return
+	}
+
+	vector, err := embed(ctx, s.conf.Model, question)
+	if err != nil {
+		log.F(log.M{"request_id": base.RequestID(ctx), "model": s.conf.Model}).Warningf("embed the question for semantic cache failed: %v", err)
+		return
+	}
+
+	item := &semanticItem{clientKey: clientKey, scope: semanticScope(model, body), vector: normalizeVector(vector)}
+	if entry, similarity := s.index(clientKey).Search(item.scope, item.vector, s.conf.Threshold); entry != nil {
+		d.Result, d.Entry, d.Similarity = ResultSemanticHit, entry, similarity
+		return
+	}
+
+	d.pending = item
+}
+
+// add Add the answer to the index of the client key
+func (s *semanticCache) add(item *semanticItem) {
+	s.index(item.clientKey).Add(item)
+}
+
+// messageText The text of the message content, the text parts are joined if it is an array
+func messageText(content gjson.Result) string {
+	if !content.IsArray() {
+		return content.String()
+	}
+
+	texts := make([]string, 0)
+	for _, part := range content.Array() {
+		if part.Get("type").String() == "text" {
+			texts = append(texts, part.Get("text").String())
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// semanticScope Hash the parts of the request that affect the answer except the question,
+// only the answers of the same scope are reused
+func semanticScope(model string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(model))
+
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		if role := message.Get("role").String(); role == "system" || role == "developer" {
+			hash.Write([]byte{0})
+			hash.Write([]byte(message.Get("content").Raw))
+		}
+	}
+
+	for _, field := range []string{"tools", "tool_choice", "functions", "response_format", "n"} {
+		hash.Write([]byte{0})
+		hash.Write([]byte(gjson.GetBytes(body, field).Raw))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// normalizeVector Scale the vector to unit length, so that the cosine similarity is the dot product
+func normalizeVector(vector []float32) []float32 {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+
+	norm := math.Sqrt(sum)
+	if norm == 0 {
+		return vector
+	}
+
+	res := make([]float32, len(vector))
+	for i, v := range vector {
+		res[i] = float32(float64(v) / norm)
+	}
+
+	return res
+}
+
+// semanticIndex An in-process vector index of the cached answers, searched linearly.
+// The least recently used answers are evicted when it is full
+type semanticIndex struct {
+	lock  sync.Mutex
+	size  int
+	items *list.List
+}
+
+// newSemanticIndex Create an index holding at most size answers
+func newSemanticIndex(size int) *semanticIndex {
+	return &semanticIndex{size: size, items: list.New()}
+}
+
+// Search Return the answer of the most similar question in the scope, nil if the similarity is below the threshold.
+// The vector must be normalized
+func (idx *semanticIndex) Search(scope string, vector []float32, threshold float64) (*Entry, float64) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	var best *list.Element
+	var bestSimilarity float64
+
+	now := time.Now()
+	for elem := idx.items.Front(); elem != nil; {
+		next := elem.Next()
+
+		item := elem.Value.(*semanticItem)
+		if now.After(item.entry.ExpiresAt) {
+			idx.items.Remove(elem)
+		} else if item.scope == scope && len(item.vector) == len(vector) {
+			if similarity := dot(item.vector, vector); similarity >= threshold && similarity > bestSimilarity {
+				best, bestSimilarity = elem, similarity
+			}
+		}
+
+		elem = next
+	}
+
+	if best == nil {
+		return nil, 0
+	}
+
+	idx.items.MoveToFront(best)
+	return best.Value.(*semanticItem).entry, bestSimilarity
+}
+
+// Add Add an answer to the index, the least recently used one is evicted if the index is full
+func (idx *semanticIndex) Add(item *semanticItem) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	idx.items.PushFront(item)
+	for idx.size > 0 && idx.items.Len() > idx.size {
+		idx.items.Remove(idx.items.Back())
+	}
+}
+
+// Len Return the number of answers, including the expired ones not evicted yet
+func (idx *semanticIndex) Len() int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	return idx.items.Len()
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+
+	return sum
+}
@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/lru"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry A cached response
+type Entry struct {
+	// Body The response body, stream responses are merged into a complete response before they are cached
+	Body        []byte    `json:"body"`
+	ContentType string    `json:"content_type"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Expired Whether the entry has expired
+func (e *Entry) Expired() bool {
+	return time.Now().After(e.ExpiresAt)
+}
+
+// Store The storage of the cached responses
+type Store interface {
+	Get(ctx context.Context, key string) (*Entry, bool)
+	Set(ctx context.Context, key string, entry *Entry)
+}
+
+// MemoryStore Keep the entries in an LRU cache
+type MemoryStore struct {
+	entries *lru.Cache[string, *Entry]
+}
+
+// NewMemoryStore Create a memory store holding at most size entries
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{entries: lru.New[string, *Entry](size, 0)}
+}
+
+func (s *MemoryStore) Get(_ context.Context, key string) (*Entry, bool) {
+	return s.entries.Get(key)
+}
+
+func (s *MemoryStore) Set(_ context.Context, key string, entry *Entry) {
+	s.entries.SetWithTTL(key, entry, time.Until(entry.ExpiresAt))
+}
+
+// staleTempFileAge A temporary file not renamed within it is left by a writer which crashed
+const staleTempFileAge = 10 * time.Minute
+
+// DiskStore Keep each entry in a JSON file, the expired files are removed periodically,
+// and the oldest ones are removed when the files exceed the maximum size
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+
+	// size The bytes of the files, it is counted again by each purge, and the files overwritten are counted twice until then
+	size    atomic.Int64
+	purging sync.Mutex
+}
+
+// NewDiskStore Create a disk store in the dir directory holding at most maxBytes of files, 0 for no limit.
+// The expired entries are purged every hour until ctx is done
+func NewDiskStore(ctx context.Context, dir string, maxBytes int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &DiskStore{dir: dir, maxBytes: maxBytes}
+
+	// Count the files left by the previous process
+	s.Purge()
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Purge()
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// path The file of the key, the files are spread into sub directories by the first two characters of the key
+func (s *DiskStore) path(key string) string {
+	return filepath.Join(s.dir, key[:2], key+".json")
+}
+
+func (s *DiskStore) Get(_ context.Context, key string) (*Entry, bool) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Expired() {
+		_ = os.Remove(s.path(key))
+		return nil, false
+	}
+
+	return &entry, true
+}
+
+func (s *DiskStore) Set(ctx context.Context, key string, entry *Entry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		log.F(log.M{"request_id": base.RequestID(ctx), "key": key}).Errorf("create cache directory failed: %v", err)
+		return
+	}
+
+	// Write to a temporary file first, so that the readers never see a partial file,
+	// the file is unique for each writer since the same key may be written concurrently
+	if err := writeFile(path, data); err != nil {
+		log.F(log.M{"request_id": base.RequestID(ctx), "key": key}).Errorf("write cache file failed: %v", err)
+		return
+	}
+
+	if s.maxBytes > 0 && s.size.Add(int64(len(data))) > s.maxBytes {
+		go s.Purge()
+	}
+}
+
+// writeFile Write the data to a temporary file in the same directory and rename it to the path
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// diskFile A file of the disk store
+type diskFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Purge Remove the expired entries and the stale temporary files. If the files still exceed the maximum size,
+// the oldest entries are removed until the files take 90% of it, so that a purge is not started by every write.
+// Only one purge runs at a time, the others return immediately
+func (s *DiskStore) Purge() {
+	if !s.purging.TryLock() {
+		return
+	}
+	defer s.purging.Unlock()
+
+	var files []diskFile
+	var total int64
+	_ = filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		switch {
+		case strings.HasSuffix(path, ".tmp"):
+			if time.Since(info.ModTime()) > staleTempFileAge {
+				_ = os.Remove(path)
+			}
+		case strings.HasSuffix(path, ".json"):
+			if _, ok := s.Get(context.Background(), strings.TrimSuffix(d.Name(), ".json")); !ok {
+				_ = os.Remove(path)
+				return nil
+			}
+
+			files = append(files, diskFile{path: path, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+		}
+
+		return nil
+	})
+
+	if s.maxBytes > 0 && total > s.maxBytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for _, f := range files {
+			if total <= s.maxBytes*9/10 {
+				break
+			}
+
+			if err := os.Remove(f.path); err == nil {
+				total -= f.size
+			}
+		}
+	}
+
+	s.size.Store(total)
+}
+
+// TieredStore Look up the memory store first, then the disk store, the entries found on disk are kept in memory too
+type TieredStore struct {
+	memory *MemoryStore
+	disk   *DiskStore
+}
+
+// NewTieredStore Create a store with the memory store in front of the disk store
+func NewTieredStore(memory *MemoryStore, disk *DiskStore) *TieredStore {
+	return &TieredStore{memory: memory, disk: disk}
+}
+
+func (s *TieredStore) Get(ctx context.Context, key string) (*Entry, bool) {
+	if entry, ok := s.memory.Get(ctx, key); ok {
+		return entry, true
+	}
+
+	entry, ok := s.disk.Get(ctx, key)
+	if ok {
+		s.memory.Set(ctx, key, entry)
+	}
+
+	return entry, ok
+}
+
+func (s *TieredStore) Set(ctx context.Context, key string, entry *Entry) {
+	s.memory.Set(ctx, key, entry)
+	s.disk.Set(ctx, key, entry)
+}
@@ -0,0 +1,241 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
+	"github.com/mylxsw/openai-dispatcher/pkg/stream"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"math/rand"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedactedValue The value used to replace the redacted fields
+const RedactedValue = "[REDACTED]"
+
+// Record A captured request and response, written as one line in the JSONL file
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Method    string    `json:"method"`
+	Endpoint  string    `json:"endpoint"`
+	Model     string    `json:"model,omitempty"`
+	Stream    bool      `json:"stream,omitempty"`
+	Status    int       `json:"status"`
+	// ContentType The content type of the request body, it is sent again when the request is replayed
+	ContentType string `json:"content_type,omitempty"`
+	// Request The request body, it is a JSON string if the body is not a valid JSON
+	Request json.RawMessage `json:"request,omitempty"`
+	// Form The fields and the files of the multipart form request, the content of the files is not captured
+	Form *Form `json:"form,omitempty"`
+	// Redacted Whether any value of the request is redacted, the request is not the one sent by the client anymore
+	Redacted bool `json:"redacted,omitempty"`
+	// Omitted Whether the request body is not captured, only the JSON and the url encoded form bodies are captured
+	Omitted bool `json:"omitted,omitempty"`
+	// Response The response body, for event-stream responses, the chunks are merged into the final message
+	Response json.RawMessage `json:"response,omitempty"`
+	// Truncated Whether the request or response body is truncated because it exceeds the size cap
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Capturer Capture the request and response bodies to rotating JSONL files
+type Capturer struct {
+	conf   config.Capture
+	writer *rotatingWriter
+}
+
+// New create a new Capturer
+func New(conf config.Capture) (*Capturer, error) {
+	writer, err := newRotatingWriter(conf.Path, int64(conf.MaxFileMB)*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Capturer{conf: conf, writer: writer}, nil
+}
+
+// Close the capture file opened
+func (c *Capturer) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	return c.writer.Close()
+}
+
+// MaxBodySize The maximum size of request or response body to capture
+func (c *Capturer) MaxBodySize() int {
+	return c.conf.MaxBodyBytes
+}
+
+// ShouldCapture Determine whether the request of the client key should be captured, the sampling rate is applied here
+func (c *Capturer) ShouldCapture(key *config.ClientKey) bool {
+	if c == nil || key == nil {
+		return false
+	}
+
+	if !c.conf.AllKeys && !key.Capture {
+		return false
+	}
+
+	return c.conf.SampleRate >= 1 || rand.Float64() < c.conf.SampleRate
+}
+
+// Capture Write the record to the capture file, the request and response body will be redacted and truncated
+func (c *Capturer) Capture(rec Record, reqBody []byte, respBody []byte, respComplete bool, contentType string) {
+	var truncated bool
+
+	c.encodeRequest(&rec, reqBody)
+
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		if merged, err := stream.Merge(respBody); err == nil {
+			respBody, _ = json.Marshal(merged)
+		}
+	}
+
+	rec.Response, truncated = c.encodeBody(respBody)
+	rec.Truncated = rec.Truncated || truncated || !respComplete
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.F(log.M{"request_id": rec.RequestID}).Errorf("marshal capture record failed: %v", err)
+		return
+	}
+
+	if err := c.writer.WriteLine(data); err != nil {
+		log.F(log.M{"request_id": rec.RequestID}).Errorf("write capture record failed: %v", err)
+	}
+}
+
+// encodeRequest Redact and truncate the request body. The bodies other than JSON and url encoded forms are not captured,
+// the values in them can not be redacted. The multipart forms are not read, only their fields are captured
+func (c *Capturer) encodeRequest(rec *Record, body []byte) {
+	if rec.Form != nil {
+		rec.Redacted = rec.Form.redact(c.conf.Redact)
+		return
+	}
+
+	// The form can not be parsed
+	if formdata.IsForm(rec.ContentType) {
+		rec.Omitted = true
+		return
+	}
+
+	if len(body) == 0 {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rec.ContentType)
+	switch {
+	case gjson.ValidBytes(body):
+		redacted := Redact(body, c.conf.Redact)
+		rec.Redacted = !bytes.Equal(redacted, body)
+		body = redacted
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			rec.Omitted = true
+			return
+		}
+
+		rec.Redacted = redactValues(values, c.conf.Redact)
+		body = []byte(values.Encode())
+	default:
+		rec.Omitted = true
+		return
+	}
+
+	var truncated bool
+	rec.Request, truncated = c.encodeBody(body)
+	rec.Truncated = rec.Truncated || truncated
+}
+
+// encodeBody Redact and truncate the body, the second return value indicates whether the body is truncated
+func (c *Capturer) encodeBody(body []byte) (json.RawMessage, bool) {
+	if len(body) == 0 {
+		return nil, false
+	}
+
+	if gjson.ValidBytes(body) {
+		body = Redact(body, c.conf.Redact)
+		if c.conf.MaxBodyBytes <= 0 || len(body) <= c.conf.MaxBodyBytes {
+			return body, false
+		}
+	}
+
+	truncated := c.conf.MaxBodyBytes > 0 && len(body) > c.conf.MaxBodyBytes
+	if truncated {
+		body = body[:c.conf.MaxBodyBytes]
+	}
+
+	data, _ := json.Marshal(string(body))
+	return data, truncated
+}
+
+// Redact Replace the values of the given JSON paths with RedactedValue.
+// The paths use the gjson syntax, "#" can be used to match all elements of an array, such as "messages.#.content"
+func Redact(body []byte, paths []string) []byte {
+	for _, path := range paths {
+		for _, p := range expandPath(body, path) {
+			if !gjson.GetBytes(body, p).Exists() {
+				continue
+			}
+
+			if res, err := sjson.SetBytes(body, p, RedactedValue); err == nil {
+				body = res
+			}
+		}
+	}
+
+	return body
+}
+
+// redactValues Replace the values of the form fields with RedactedValue, the paths without "." and "#" are field names
+func redactValues(values map[string][]string, paths []string) bool {
+	var redacted bool
+	for _, path := range paths {
+		if vals, ok := values[path]; ok {
+			for i := range vals {
+				vals[i] = RedactedValue
+			}
+
+			redacted = true
+		}
+	}
+
+	return redacted
+}
+
+// expandPath Expand the "#" in the path to the indexes of the array
+func expandPath(body []byte, path string) []string {
+	segments := strings.Split(path, ".")
+	for i, seg := range segments {
+		if seg != "#" {
+			continue
+		}
+
+		prefix := strings.Join(segments[:i], ".")
+		arr := gjson.GetBytes(body, prefix)
+		if !arr.IsArray() {
+			return nil
+		}
+
+		paths := make([]string, 0)
+		for j := range arr.Array() {
+			expanded := append(append(append([]string{}, segments[:i]...), strconv.Itoa(j)), segments[i+1:]...)
+			paths = append(paths, expandPath(body, strings.Join(expanded, "."))...)
+		}
+
+		return paths
+	}
+
+	return []string{path}
+}
@@ -0,0 +1,135 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	body := []byte(`{"user":"alice","messages":[{"role":"user","content":"hello"},{"role":"assistant","content":"hi","tool_calls":[{"function":{"arguments":"{}"}},{"function":{"arguments":"{\"a\":1}"}}]}]}`)
+
+	res := Redact(body, []string{"user", "messages.#.content", "messages.#.tool_calls.#.function.arguments", "not.exist", "messages.#.name"})
+	assert.Equal(t, `{"user":"[REDACTED]","messages":[{"role":"user","content":"[REDACTED]"},{"role":"assistant","content":"[REDACTED]","tool_calls":[{"function":{"arguments":"[REDACTED]"}},{"function":{"arguments":"[REDACTED]"}}]}]}`, string(res))
+
+	// The "#" of a field which is not an array matches nothing
+	assert.Equal(t, string(body), string(Redact(body, []string{"user.#.name"})))
+}
+
+func TestCapturer_Capture(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(config.Capture{Path: dir, Redact: []string{"messages.#.content", "user"}, MaxBodyBytes: 80})
+	assert.NoError(t, err)
+
+	c.Capture(Record{RequestID: "r1", Method: http.MethodPost, Endpoint: "/v1/chat/completions", Status: 200},
+		[]byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}]}`), []byte(`{"id":"1"}`), true, "application/json")
+
+	// The body larger than the cap is truncated and kept as a string, it is not a valid JSON anymore
+	c.Capture(Record{RequestID: "r2", Method: http.MethodPost, Endpoint: "/v1/chat/completions", Status: 200},
+		[]byte(`{"model":"gpt-4o","prompt":"`+strings.Repeat("a", 100)+`"}`), nil, true, "application/json")
+
+	// The url encoded forms are redacted by the field names, the other bodies can not be redacted and are not captured
+	c.Capture(Record{RequestID: "r3", Method: http.MethodPost, Endpoint: "/v1/completions", ContentType: "application/x-www-form-urlencoded", Status: 200},
+		[]byte(`model=gpt-4o&user=alice`), nil, true, "application/json")
+	c.Capture(Record{RequestID: "r4", Method: http.MethodPost, Endpoint: "/v1/completions", ContentType: "text/plain", Status: 200},
+		[]byte(`model: gpt-4o`), nil, true, "application/json")
+
+	// Only the fields and the file sizes of the multipart forms are captured
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("model", "whisper-1")
+	_ = mw.WriteField("user", "alice")
+	file, _ := mw.CreateFormFile("file", "speech.mp3")
+	_, _ = file.Write([]byte(strings.Repeat("0", 1000)))
+	_ = mw.Close()
+
+	form, err := formdata.Parse(&body, mw.FormDataContentType(), 100)
+	assert.NoError(t, err)
+	defer form.RemoveAll()
+
+	c.Capture(Record{RequestID: "r5", Method: http.MethodPost, Endpoint: "/v1/audio/transcriptions", ContentType: mw.FormDataContentType(), Form: NewForm(form), Status: 200},
+		nil, nil, true, "application/json")
+
+	records := make([]Record, 0)
+	files, _ := filepath.Glob(filepath.Join(dir, "capture.*.jsonl"))
+	assert.Equal(t, 1, len(files))
+	assert.NoError(t, ReadFile(files[0], func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}))
+
+	assert.Equal(t, 5, len(records))
+	assert.Equal(t, `{"model":"gpt-4o","messages":[{"role":"user","content":"[REDACTED]"}]}`, string(records[0].Request))
+	assert.True(t, records[0].Redacted)
+	assert.False(t, records[0].Truncated)
+	assert.True(t, records[1].Truncated)
+	assert.False(t, records[1].Redacted)
+	assert.True(t, bytes.HasPrefix(records[1].Request, []byte(`"{\"model\"`)))
+
+	assert.Equal(t, `"model=gpt-4o\u0026user=%5BREDACTED%5D"`, string(records[2].Request))
+	assert.True(t, records[2].Redacted)
+	assert.True(t, records[3].Omitted)
+	assert.Equal(t, 0, len(records[3].Request))
+
+	assert.EqualValues(t, map[string]string{"model": "whisper-1", "user": RedactedValue}, records[4].Form.Fields)
+	assert.EqualValues(t, []File{{Field: "file", Name: "speech.mp3", Size: 1000}}, records[4].Form.Files)
+	assert.True(t, records[4].Redacted)
+	assert.Equal(t, 0, len(records[4].Request))
+}
+
+func TestReplay(t *testing.T) {
+	var lock sync.Mutex
+	received := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		lock.Lock()
+		received = append(received, r.Header.Get("X-Request-ID")+" "+r.Header.Get("Authorization")+" "+r.Header.Get("Content-Type")+" "+string(body))
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"request_id":"r1","method":"POST","endpoint":"/v1/chat/completions","status":200,"request":{"model":"gpt-4o"}}
+{"request_id":"r2","method":"POST","endpoint":"/v1/chat/completions","status":200,"request":"{\"model\":\"gpt","truncated":true}
+
+{"request_id":"r3","method":"POST","endpoint":"/v1/completions","content_type":"application/x-www-form-urlencoded","status":400,"request":"model=gpt-4o"}
+{"request_id":"r4","method":"POST","endpoint":"/v1/audio/transcriptions","content_type":"multipart/form-data; boundary=x","status":200,"form":{"fields":{"model":"whisper-1"}}}
+{"request_id":"r5","method":"POST","endpoint":"/v1/completions","content_type":"text/plain","status":200,"omitted":true}
+{"request_id":"r6","method":"POST","endpoint":"/v1/chat/completions","status":200,"request":{"model":"gpt-4o","user":"[REDACTED]"},"redacted":true}
+`), 0644))
+
+	var out bytes.Buffer
+	assert.NoError(t, Replay(context.Background(), path, server.URL+"/", "client-key", false, &out))
+
+	// Only the records which can be sent as they were received are replayed, with their content types
+	assert.EqualValues(t, []string{
+		`r1-replay Bearer client-key application/json {"model":"gpt-4o"}`,
+		`r3-replay Bearer client-key application/x-www-form-urlencoded model=gpt-4o`,
+	}, received)
+	assert.True(t, strings.Contains(out.String(), "r2 POST /v1/chat/completions -> skipped: the record is truncated"))
+	assert.True(t, strings.Contains(out.String(), "r3 POST /v1/completions [400] -> [200]"))
+	assert.True(t, strings.Contains(out.String(), "r4 POST /v1/audio/transcriptions -> skipped: the files of the multipart form are not captured"))
+	assert.True(t, strings.Contains(out.String(), "r5 POST /v1/completions -> skipped: the request body is not captured"))
+	assert.True(t, strings.Contains(out.String(), "r6 POST /v1/chat/completions -> skipped: the request is redacted"))
+	assert.True(t, strings.Contains(out.String(), "4 of 6 records are skipped"))
+
+	// The redacted records are replayed when they are allowed explicitly, and flagged in the output
+	received, out = received[:0], bytes.Buffer{}
+	assert.NoError(t, Replay(context.Background(), path, server.URL, "client-key", true, &out))
+	assert.Equal(t, 3, len(received))
+	assert.True(t, strings.Contains(out.String(), "r6 POST /v1/chat/completions [200] -> [200] (redacted)"))
+
+	assert.True(t, Replay(context.Background(), filepath.Join(t.TempDir(), "not-exist.jsonl"), server.URL, "", false, &out) != nil)
+}
@@ -0,0 +1,75 @@
+package capture
+
+import (
+	"context"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
+	"io"
+)
+
+// maxFieldBytes The maximum size of a form field captured, the larger fields are captured as files
+const maxFieldBytes = 64 * 1024
+
+// Form The fields and the files of a multipart form. The form is not read again for capturing,
+// the content of the files is not captured, so the uploads are never kept in memory
+type Form struct {
+	Fields map[string]string `json:"fields,omitempty"`
+	Files  []File            `json:"files,omitempty"`
+}
+
+// File A file of the form
+type File struct {
+	Field string `json:"field"`
+	Name  string `json:"name,omitempty"`
+	Size  int64  `json:"size"`
+}
+
+// NewForm Capture the fields and the files of the form
+func NewForm(form *formdata.Form) *Form {
+	res := Form{Fields: make(map[string]string)}
+	for _, part := range form.Parts {
+		if part.FileName() == "" && part.Size() <= maxFieldBytes {
+			if r, err := part.Open(); err == nil {
+				data, _ := io.ReadAll(r)
+				_ = r.Close()
+
+				res.Fields[part.Name()] = string(data)
+				continue
+			}
+		}
+
+		res.Files = append(res.Files, File{Field: part.Name(), Name: part.FileName(), Size: part.Size()})
+	}
+
+	return &res
+}
+
+// redact Replace the values of the fields with RedactedValue, it returns whether any field is redacted
+func (f *Form) redact(paths []string) bool {
+	values := make(map[string][]string, len(f.Fields))
+	for name, value := range f.Fields {
+		values[name] = []string{value}
+	}
+
+	if !redactValues(values, paths) {
+		return false
+	}
+
+	for name, vals := range values {
+		f.Fields[name] = vals[0]
+	}
+
+	return true
+}
+
+type contextKey struct{}
+
+// WithRecord Attach the record being captured to the context, so that the form of the request can be added to it
+func WithRecord(ctx context.Context, rec *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, rec)
+}
+
+// RecordFromContext Return the record being captured, nil if the request is not captured
+func RecordFromContext(ctx context.Context) *Record {
+	rec, _ := ctx.Value(contextKey{}).(*Record)
+	return rec
+}
@@ -0,0 +1,124 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/go-utils/ternary"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ReadFile Read the records from a capture file, fn is called for each record
+func ReadFile(path string, fn func(rec Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var rec Record
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+// Replay Send the captured requests in the file to the target server again, and print the result to out.
+// The records which can not be sent as they were received are skipped: the truncated ones, the multipart forms whose
+// files are not captured and the bodies not captured. The redacted records are skipped too unless redacted is true
+func Replay(ctx context.Context, path string, target string, key string, redacted bool, out io.Writer) error {
+	// Read all records first, the target server may be capturing to the same file
+	records := make([]Record, 0)
+	if err := ReadFile(path, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var skipped int
+	client := &http.Client{}
+	for _, rec := range records {
+		if reason := skipReason(rec, redacted); reason != "" {
+			skipped++
+			_, _ = fmt.Fprintf(out, "%s %s %s -> skipped: %s\n", rec.RequestID, rec.Method, rec.Endpoint, reason)
+			continue
+		}
+
+		var body io.Reader
+		if len(rec.Request) > 0 {
+			// The body that is not a valid JSON is saved as a JSON string
+			var raw string
+			if err := json.Unmarshal(rec.Request, &raw); err == nil {
+				body = strings.NewReader(raw)
+			} else {
+				body = bytes.NewReader(rec.Request)
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, rec.Method, strings.TrimRight(target, "/")+rec.Endpoint, body)
+		if err != nil {
+			return err
+		}
+
+		// The records captured before the content type is recorded are all JSON requests
+		req.Header.Set("Content-Type", ternary.If(rec.ContentType == "", "application/json", rec.ContentType))
+		req.Header.Set("Authorization", "Bearer "+key)
+		req.Header.Set("X-Request-ID", rec.RequestID+"-replay")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "%s %s %s -> error: %v\n", rec.RequestID, rec.Method, rec.Endpoint, err)
+			continue
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		_, _ = fmt.Fprintf(out, "%s %s %s [%d] -> [%d]%s\n", rec.RequestID, rec.Method, rec.Endpoint, rec.Status, resp.StatusCode, ternary.If(rec.Redacted, " (redacted)", ""))
+	}
+
+	if skipped > 0 {
+		_, _ = fmt.Fprintf(out, "%d of %d records are skipped\n", skipped, len(records))
+	}
+
+	return nil
+}
+
+// skipReason Why the record can not be replayed, empty if it can
+func skipReason(rec Record, redacted bool) string {
+	switch {
+	case rec.Truncated:
+		return "the record is truncated"
+	case rec.Form != nil:
+		return "the files of the multipart form are not captured"
+	case rec.Omitted:
+		return "the request body is not captured"
+	case rec.Redacted && !redacted:
+		return "the request is redacted, use -replay-redacted to replay it anyway"
+	}
+
+	return ""
+}
@@ -0,0 +1,106 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rotatingWriter Write lines to JSONL files, the file is rotated daily, and also when it reaches the maximum size
+type rotatingWriter struct {
+	dir     string
+	maxSize int64
+
+	lock sync.Mutex
+	file *os.File
+	date string
+	seq  int
+	size int64
+}
+
+func newRotatingWriter(dir string, maxSize int64) (*rotatingWriter, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &rotatingWriter{dir: dir, maxSize: maxSize}, nil
+}
+
+func (w *rotatingWriter) filename() string {
+	return filepath.Join(w.dir, fmt.Sprintf("capture.%s.%d.jsonl", w.date, w.seq))
+}
+
+// WriteLine Write a line to the current file
+func (w *rotatingWriter) WriteLine(data []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	date := time.Now().Format("20060102")
+	if w.file == nil || w.date != date || (w.maxSize > 0 && w.size+int64(len(data))+1 > w.maxSize) {
+		if err := w.rotate(date); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(append(data, '\n'))
+	w.size += int64(n)
+
+	return err
+}
+
+func (w *rotatingWriter) rotate(date string) error {
+	if w.file != nil {
+		_ = w.file.Close()
+		w.file = nil
+	}
+
+	if w.date != date {
+		w.date = date
+		w.seq = 0
+	} else if w.size > 0 {
+		w.seq++
+	}
+
+	// Skip the files that are already full, which may be left by the previous process
+	for {
+		stat, err := os.Stat(w.filename())
+		if err != nil || w.maxSize <= 0 || stat.Size() < w.maxSize {
+			break
+		}
+
+		w.seq++
+	}
+
+	f, err := os.OpenFile(w.filename(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = stat.Size()
+
+	return nil
+}
+
+// Close the current file
+func (w *rotatingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
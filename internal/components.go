@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/mylxsw/openai-dispatcher/internal/accesslog"
+	"github.com/mylxsw/openai-dispatcher/internal/cache"
+	"github.com/mylxsw/openai-dispatcher/internal/capture"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/moderation"
+	"io"
+	"reflect"
+)
+
+// components The components writing files or keeping data across the requests. When the configuration is reloaded,
+// a component is kept if its settings are not changed, so the cached responses are not lost, otherwise it is rebuilt
+type components struct {
+	accessLog *component[*accesslog.Logger]
+	auditLog  *component[*moderation.AuditLogger]
+	capturer  *component[*capture.Capturer]
+	cache     *component[*cache.Cache]
+}
+
+// component A component and the settings it is built from
+type component[T any] struct {
+	value  T
+	conf   any
+	cancel context.CancelFunc
+}
+
+// get Return the component, or the zero value if it is disabled
+func (c *component[T]) get() T {
+	if c == nil {
+		var zero T
+		return zero
+	}
+
+	return c.value
+}
+
+// Close Stop the background tasks of the component and close its files
+func (c *component[T]) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.cancel()
+	if closer, ok := any(c.value).(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// buildComponent Return the old component if it is built from the same settings, otherwise create a new one
+// with its own context, which is cancelled when the component is closed. Nothing is created if it is disabled
+func buildComponent[T any](ctx context.Context, old *component[T], enabled bool, conf any, create func(ctx context.Context) (T, error)) (*component[T], error) {
+	if !enabled {
+		return nil, nil
+	}
+
+	if old != nil && reflect.DeepEqual(old.conf, conf) {
+		return old, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	value, err := create(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &component[T]{value: value, conf: conf, cancel: cancel}, nil
+}
+
+// newComponents Build the components of the configuration, the components of old are reused if their settings are not changed
+func newComponents(ctx context.Context, conf *config.Config, old components) (components, error) {
+	var res components
+	var err error
+
+	res.accessLog, err = buildComponent(ctx, old.accessLog, conf.AccessLogPath != "", conf.AccessLogPath, func(ctx context.Context) (*accesslog.Logger, error) {
+		return accesslog.New(ctx, conf.AccessLogPath), nil
+	})
+	if err != nil {
+		res.release(old)
+		return components{}, err
+	}
+
+	res.auditLog, err = buildComponent(ctx, old.auditLog, conf.Moderation.AuditLogPath != "", conf.Moderation.AuditLogPath, func(ctx context.Context) (*moderation.AuditLogger, error) {
+		return moderation.NewAuditLogger(ctx, conf.Moderation.AuditLogPath)
+	})
+	if err != nil {
+		res.release(old)
+		return components{}, err
+	}
+
+	res.capturer, err = buildComponent(ctx, old.capturer, conf.Capture.Enabled, conf.Capture, func(ctx context.Context) (*capture.Capturer, error) {
+		capturer, err := capture.New(conf.Capture)
+		if err != nil {
+			return nil, fmt.Errorf("create capturer failed: %w", err)
+		}
+
+		return capturer, nil
+	})
+	if err != nil {
+		res.release(old)
+		return components{}, err
+	}
+
+	res.cache, err = buildComponent(ctx, old.cache, conf.Cache.Enabled, conf.Cache, func(ctx context.Context) (*cache.Cache, error) {
+		c, err := cache.New(ctx, conf.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("create response cache failed: %w", err)
+		}
+
+		return c, nil
+	})
+	if err != nil {
+		res.release(old)
+		return components{}, err
+	}
+
+	return res, nil
+}
+
+// release Close the components which are not used by next
+func (c components) release(next components) {
+	nexts := next.list()
+	for i, comp := range c.list() {
+		if comp != nexts[i] {
+			_ = comp.Close()
+		}
+	}
+}
+
+func (c components) list() []io.Closer {
+	return []io.Closer{c.accessLog, c.auditLog, c.capturer, c.cache}
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/go-utils/array"
@@ -10,67 +13,184 @@ import (
 	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
 	"github.com/mylxsw/openai-dispatcher/pkg/expr"
 	"gopkg.in/yaml.v3"
-	"os"
 	"strings"
+	"time"
 )
 
 type Config struct {
-	LogPath          string     `yaml:"log-path" json:"log-path,omitempty"`
-	Debug            bool       `yaml:"debug" json:"debug,omitempty"`
-	Verbose          bool       `yaml:"verbose" json:"verbose,omitempty"`
-	Listen           string     `yaml:"listen" json:"listen,omitempty"`
-	Socks5           string     `yaml:"socks5" json:"socks5,omitempty"`
-	Keys             []string   `yaml:"keys" json:"-"`
-	Policy           string     `yaml:"policy" json:"policy,omitempty"`
-	Rules            Rules      `yaml:"rules" json:"rules,omitempty"`
-	ExtraModels      []string   `yaml:"extra-models" json:"extra-models,omitempty"`
-	EnablePrometheus bool       `yaml:"enable-prometheus" json:"enable-prometheus,omitempty"`
-	Moderation       Moderation `yaml:"moderation" json:"moderation,omitempty"`
-}
-
-func (conf *Config) Validate() error {
-	// TODO Check whether the configuration is correct
-
-	if conf.Policy != "" && !array.In(conf.Policy, []string{"random", "round_robin", "weight"}) {
-		return fmt.Errorf("policy Only random, round_robin, and weight are supported")
+	LogPath string `yaml:"log-path" json:"log-path,omitempty"`
+	// AccessLogPath The directory of the access log, one JSON entry is written for each request, empty to disable
+	AccessLogPath    string      `yaml:"access-log-path" json:"access-log-path,omitempty"`
+	Debug            bool        `yaml:"debug" json:"debug,omitempty"`
+	Verbose          bool        `yaml:"verbose" json:"verbose,omitempty"`
+	Listen           string      `yaml:"listen" json:"listen,omitempty"`
+	Socks5           string      `yaml:"socks5" json:"socks5,omitempty"`
+	Keys             []ClientKey `yaml:"keys" json:"-"`
+	Policy           string      `yaml:"policy" json:"policy,omitempty"`
+	Rules            Rules       `yaml:"rules" json:"rules,omitempty"`
+	ExtraModels      []string    `yaml:"extra-models" json:"extra-models,omitempty"`
+	Models           []ModelInfo `yaml:"models" json:"models,omitempty"`
+	ModelList        ModelList   `yaml:"model-list" json:"model-list,omitempty"`
+	EnablePrometheus bool        `yaml:"enable-prometheus" json:"enable-prometheus,omitempty"`
+	Moderation       Moderation  `yaml:"moderation" json:"moderation,omitempty"`
+	Capture          Capture     `yaml:"capture" json:"capture,omitempty"`
+	Cache            Cache       `yaml:"cache" json:"cache,omitempty"`
+	ImageFetch       ImageFetch  `yaml:"image-fetch" json:"image-fetch,omitempty"`
+	Admin            Admin       `yaml:"admin" json:"admin,omitempty"`
+	// Context Trim the conversations exceeding the context of the models before they are sent to the upstreams
+	Context ContextManagement `yaml:"context" json:"context,omitempty"`
+
+	// Include Glob patterns of other configuration files to load, relative to the current file
+	Include []string `yaml:"include" json:"-"`
+	// Sources All configuration files loaded
+	Sources []string `yaml:"-" json:"-"`
+
+	// positions The location (file:line) of each setting, used in validation errors
+	positions map[string]string
+}
+
+// ModelInfo The capabilities of a model in the model registry. The capabilities not declared are unknown,
+// and the requests using them are not restricted
+type ModelInfo struct {
+	// Name The model name, an entry with the same name as a built-in one replaces it
+	Name string `yaml:"name" json:"name"`
+	// Aliases Other names of the model, * matches any characters such as gpt-4o-2024-*
+	Aliases []string `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	// Type The type of the model: chat, completion, embedding, image, audio or moderation
+	Type string `yaml:"type,omitempty" json:"type,omitempty"`
+	// OwnedBy The owner of the model shown in /v1/models
+	OwnedBy string `yaml:"owned-by,omitempty" json:"owned_by,omitempty"`
+	// Created The unix time the model was released, shown in /v1/models
+	Created int64 `yaml:"created,omitempty" json:"created,omitempty"`
+	// ContextWindow The maximum tokens of the prompt and the output
+	ContextWindow int `yaml:"context-window,omitempty" json:"context_window,omitempty"`
+	// MaxOutput The maximum output tokens, max_tokens is clamped to it
+	MaxOutput int `yaml:"max-output,omitempty" json:"max_output,omitempty"`
+	// Vision Whether images are supported in the messages
+	Vision *bool `yaml:"vision,omitempty" json:"vision,omitempty"`
+	// Tools Whether tools and functions are supported
+	Tools *bool `yaml:"tools,omitempty" json:"tools,omitempty"`
+	// Streaming Whether stream responses are supported, the streams are emulated when it is false
+	Streaming *bool `yaml:"streaming,omitempty" json:"streaming,omitempty"`
+	// SystemRole Whether system messages are supported, they are sent as user messages when it is false
+	SystemRole *bool `yaml:"system-role,omitempty" json:"system_role,omitempty"`
+	// JSONMode Whether response_format is supported
+	JSONMode *bool `yaml:"json-mode,omitempty" json:"json_mode,omitempty"`
+	// Reasoning Whether it is a reasoning model, max_tokens is sent as max_completion_tokens
+	// and the sampling parameters are removed
+	Reasoning bool `yaml:"reasoning,omitempty" json:"reasoning,omitempty"`
+	// Tokenizer The tokenizer family used to estimate the tokens: o200k_base, cl100k_base, claude, gemini or glm
+	Tokenizer string `yaml:"tokenizer,omitempty" json:"tokenizer,omitempty"`
+	// Pricing The price in USD per million tokens
+	Pricing *ModelPricing `yaml:"pricing,omitempty" json:"pricing,omitempty"`
+}
+
+// ModelList How the models are listed by /v1/models
+type ModelList struct {
+	// Capabilities Include the capabilities of the models in the registry in the model objects
+	Capabilities bool `yaml:"capabilities" json:"capabilities,omitempty"`
+	// Upstream Add the models listed by the /v1/models of the openai upstreams
+	Upstream bool `yaml:"upstream" json:"upstream,omitempty"`
+	// RefreshInterval How long the models listed by the upstreams are reused, the default value is 10m
+	RefreshInterval time.Duration `yaml:"refresh-interval" json:"refresh-interval,omitempty"`
+}
+
+// ModelPricing The price of a model in USD per million tokens
+type ModelPricing struct {
+	Input       float64 `yaml:"input" json:"input"`
+	Output      float64 `yaml:"output,omitempty" json:"output,omitempty"`
+	CachedInput float64 `yaml:"cached-input,omitempty" json:"cached_input,omitempty"`
+}
+
+// ClientKey The key used by the caller, it can be a plain key string or an object with a name
+type ClientKey struct {
+	// Name The name of the key, used in logs. The masked key is used by default
+	Name string `yaml:"name" json:"name,omitempty"`
+	Key  string `yaml:"key" json:"-"`
+	// Capture Whether to capture the requests and responses of this key, see Config.Capture
+	Capture bool `yaml:"capture,omitempty" json:"capture,omitempty"`
+	// Moderation The moderation policy of this key, the global moderation settings are used by default
+	Moderation *KeyModeration `yaml:"moderation,omitempty" json:"moderation,omitempty"`
+	// Models The models this key can use, * matches any characters such as gpt-4o*, all models are allowed when empty
+	Models []string `yaml:"models,omitempty" json:"models,omitempty"`
+	// Context The context management settings of this key, they override the settings of the models
+	Context *ContextPolicy `yaml:"context,omitempty" json:"context,omitempty"`
+}
+
+// ID A stable identifier of the key, the hash of the key. Unlike the name, it is unique for each key
+func (k *ClientKey) ID() string {
+	sum := sha256.Sum256([]byte(k.Key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// AllowModel Whether the key can use the model
+func (k *ClientKey) AllowModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
 	}
 
-	for i, rule := range conf.Rules {
-		if !array.In(rule.Type, []base.ChannelType{base.ChannelTypeOpenAI, base.ChannelTypeCoze}) {
-			return fmt.Errorf("%s type is under development, so stay tuned #%d", rule.Type, i+1)
+	for _, pattern := range k.Models {
+		if MatchModel(pattern, model) {
+			return true
 		}
+	}
 
-		if rule.Expr != nil {
-			if rule.Expr.Match != "" {
-				if _, err := expr.NewBoolVM(rule.Expr.Match); err != nil {
-					return fmt.Errorf("rule #%d, expr.match: %s", i+1, err)
-				}
-			}
+	return false
+}
 
-			if rule.Expr.Replace != "" {
-				if _, err := expr.NewStringVM(rule.Expr.Replace); err != nil {
-					return fmt.Errorf("rule #%d, expr.replace: %s", i+1, err)
-				}
-			}
-		}
+// MatchModel Whether the model matches the pattern, * in the pattern matches any characters
+func MatchModel(pattern string, model string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == model
 	}
 
-	if conf.Moderation.Enabled {
-		if conf.Moderation.API.Type != "openai" {
-			return fmt.Errorf("moderation api type only support openai")
-		}
+	if !strings.HasPrefix(model, parts[0]) {
+		return false
+	}
 
-		if conf.Moderation.ScoreThreshold > 1 || conf.Moderation.ScoreThreshold < 0 {
-			return fmt.Errorf("moderation score threshold must be between 0 and 1")
+	model = model[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(model, part)
+		if index < 0 {
+			return false
 		}
 
-		if !strings.HasPrefix(conf.Moderation.API.Server, "http://") &&
-			!strings.HasPrefix(conf.Moderation.API.Server, "https://") {
-			return fmt.Errorf("moderation api server must be a valid url")
-		}
+		model = model[index+len(part):]
+	}
 
-		if conf.Moderation.API.Key == "" {
-			return fmt.Errorf("moderation api key is required")
+	return strings.HasSuffix(model, parts[len(parts)-1])
+}
+
+// KeyModeration The moderation policy of a client key, the fields not set fall back to the global moderation settings
+type KeyModeration struct {
+	// Enabled Whether to moderate the requests of this key, it only works when the moderation is enabled globally
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	// CanIgnore Whether the key can bypass the moderation with the X-Ignore-Moderation header
+	CanIgnore *bool `yaml:"can-ignore,omitempty" json:"can-ignore,omitempty"`
+	// Categories The categories to block
+	Categories []string `yaml:"categories,omitempty" json:"categories,omitempty"`
+	// ScoreThreshold The threshold of the categories without a threshold in Thresholds
+	ScoreThreshold float64 `yaml:"score-threshold,omitempty" json:"score-threshold,omitempty"`
+	// Thresholds The threshold of each category, such as {"sexual/minors": 0.1, "violence": 0.9}, merged with the global thresholds
+	Thresholds map[string]float64 `yaml:"thresholds,omitempty" json:"thresholds,omitempty"`
+}
+
+func (k *ClientKey) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		k.Key = value.Value
+		return nil
+	}
+
+	type plain ClientKey
+	return value.Decode((*plain)(k))
+}
+
+// ClientKey Find the client key matching the given key, return nil if not found
+func (conf *Config) ClientKey(key string) *ClientKey {
+	for i := range conf.Keys {
+		if conf.Keys[i].Key == key {
+			return &conf.Keys[i]
 		}
 	}
 
@@ -98,11 +218,21 @@ type Rule struct {
 	Default bool `yaml:"default,omitempty" json:"default,omitempty"`
 	// Backup Alternate rule, which is not used by default and is used only when an error occurs
 	Backup bool `yaml:"backup,omitempty" json:"backup,omitempty"`
-	// Weight, used for the weight policy. The default value is 1. A negative value indicates that the rule is not used
+	// Weight, used for the weight policy. The default value is 1, and it must not be negative.
+	// Use the admin API to drain a rule instead
 	Weight int `yaml:"weight,omitempty" json:"weight,omitempty"`
 
+	// Transforms Transform the requests before they are sent to the upstreams of the rule, applied in order
+	Transforms []Transform `yaml:"transforms,omitempty" json:"transforms,omitempty"`
+
 	// Advanced configuration
 	Expr *Expr `yaml:"expr,omitempty" json:"expr,omitempty"`
+
+	// Source The configuration file where the rule is defined
+	Source string `yaml:"-" json:"-"`
+
+	// positions The location (file:line) of the rule and its fields, used in validation errors
+	positions map[string]string
 }
 
 func (rule Rule) ModelReplacer(model string) string {
@@ -141,19 +271,65 @@ type ModelRewrite struct {
 	Dst string `yaml:"dst" json:"dst"`
 }
 
+// Transform A declarative transformation of the request body sent to the upstream, the fields are paths in the sjson
+// syntax, such as max_tokens or stream_options.include_usage. The operations are applied in the order of
+// rename, remove, default, set, clamp, system prompt, roles and stream emulation or aggregation
+type Transform struct {
+	// Models The upstream models matched after the rewrite, * matches any characters such as o1-*, empty for all models
+	Models []string `yaml:"models,omitempty" json:"models,omitempty"`
+	// Endpoints The endpoints matched, empty for all endpoints
+	Endpoints []base.Endpoint `yaml:"endpoints,omitempty" json:"endpoints,omitempty"`
+	// Rename Move the fields to new paths, such as max_tokens: max_completion_tokens
+	Rename map[string]string `yaml:"rename,omitempty" json:"rename,omitempty"`
+	// Remove The fields to remove, such as temperature
+	Remove []string `yaml:"remove,omitempty" json:"remove,omitempty"`
+	// Default Set the fields only when they are not set by the client
+	Default map[string]any `yaml:"default,omitempty" json:"default,omitempty"`
+	// Set Set the fields, the values of the client are overwritten
+	Set map[string]any `yaml:"set,omitempty" json:"set,omitempty"`
+	// Clamp Limit the numeric fields to the range, such as max_completion_tokens: {max: 32768}
+	Clamp map[string]Range `yaml:"clamp,omitempty" json:"clamp,omitempty"`
+	// SystemPrompt Insert a system message at the beginning of the chat messages if there is none
+	SystemPrompt string `yaml:"system-prompt,omitempty" json:"system-prompt,omitempty"`
+	// Roles Rename the roles of the chat messages, such as system: user
+	Roles map[string]string `yaml:"roles,omitempty" json:"roles,omitempty"`
+	// EmulateStream Send the stream requests as non-stream requests, the responses are converted to streams,
+	// for the upstreams not supporting streams
+	EmulateStream bool `yaml:"emulate-stream,omitempty" json:"emulate-stream,omitempty"`
+	// ChunkSize The characters of each content chunk of the emulated streams, 0 to send the content in one chunk
+	ChunkSize int `yaml:"chunk-size,omitempty" json:"chunk-size,omitempty"`
+	// ChunkInterval The interval between the chunks of the emulated streams to simulate typing, such as 20ms
+	ChunkInterval time.Duration `yaml:"chunk-interval,omitempty" json:"chunk-interval,omitempty"`
+	// AggregateStream Send the non-stream requests as stream requests, the stream responses are merged into
+	// complete responses, for the upstreams only supporting streams
+	AggregateStream bool `yaml:"aggregate-stream,omitempty" json:"aggregate-stream,omitempty"`
+}
+
+// Range A numeric range, the bounds not set are unlimited
+type Range struct {
+	Min *float64 `yaml:"min,omitempty" json:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty" json:"max,omitempty"`
+}
+
+// LoadConfig Load the configuration from a file or a directory.
+// When a directory is given, all *.yaml/*.yml files in it are loaded; files can also include other files with `include`.
+// The rules, keys, extra-models and models are merged, other settings can only be set once
 func LoadConfig(configFilePath string) (*Config, error) {
-	configData, err := os.ReadFile(configFilePath)
-	if err != nil {
+	l := newLoader()
+	if err := l.loadPath(configFilePath); err != nil {
 		return nil, err
 	}
 
-	var conf Config
-	if err := yaml.Unmarshal(configData, &conf); err != nil {
-		return nil, err
-	}
+	conf := l.conf
 
 	conf.ExtraModels = array.Uniq(conf.ExtraModels)
 
+	for i, key := range conf.Keys {
+		if key.Name == "" {
+			conf.Keys[i].Name = maskKey(key.Key)
+		}
+	}
+
 	rules := make(Rules, 0)
 
 	for _, rule := range conf.Rules {
@@ -190,6 +366,9 @@ func LoadConfig(configFilePath string) (*Config, error) {
 					Default:         rule.Default,
 					Backup:          rule.Backup,
 					Weight:          rule.Weight,
+					Transforms:      rule.Transforms,
+					Source:          rule.Source,
+					positions:       rule.positions,
 				})
 			}
 		} else {
@@ -216,6 +395,48 @@ func LoadConfig(configFilePath string) (*Config, error) {
 				"violence",
 				"violence/graphic",
 			}
+
+			// The categories of the local rules are blocked by default too
+			conf.Moderation.Categories = array.Uniq(append(
+				conf.Moderation.Categories,
+				array.Map(conf.Moderation.Local, func(rule LocalModerationRule, _ int) string { return rule.Category })...,
+			))
+		}
+
+		if len(conf.Moderation.Engines) == 0 {
+			if len(conf.Moderation.Local) > 0 {
+				conf.Moderation.Engines = append(conf.Moderation.Engines, ModerationEngineLocal)
+			}
+
+			if conf.Moderation.API.Key != "" || len(conf.Moderation.Local) == 0 {
+				conf.Moderation.Engines = append(conf.Moderation.Engines, ModerationEngineAPI)
+			}
+		}
+
+		if len(conf.Moderation.Endpoints) == 0 {
+			conf.Moderation.Endpoints = append([]base.Endpoint{}, base.DefaultModerationEndpoints...)
+		}
+
+		for i, rule := range conf.Moderation.Local {
+			if rule.Score == 0 {
+				conf.Moderation.Local[i].Score = 1
+			}
+		}
+
+		if conf.Moderation.Output.WindowSize == 0 {
+			conf.Moderation.Output.WindowSize = 200
+		}
+
+		if conf.Moderation.Cache.Size == 0 {
+			conf.Moderation.Cache.Size = 10000
+		}
+
+		if conf.Moderation.Cache.TTL == 0 {
+			conf.Moderation.Cache.TTL = time.Hour
+		}
+
+		if conf.Moderation.FailMode == "" {
+			conf.Moderation.FailMode = ModerationFailOpen
 		}
 
 		if conf.Moderation.ScoreThreshold == 0 {
@@ -235,8 +456,99 @@ func LoadConfig(configFilePath string) (*Config, error) {
 		}
 	}
 
+	if conf.Capture.Enabled {
+		if conf.Capture.SampleRate == 0 {
+			conf.Capture.SampleRate = 1
+		}
+
+		if conf.Capture.MaxBodyBytes == 0 {
+			conf.Capture.MaxBodyBytes = 1024 * 1024
+		}
+
+		if conf.Capture.MaxFileMB == 0 {
+			conf.Capture.MaxFileMB = 100
+		}
+	}
+
+	if conf.Context.Strategy == "" {
+		conf.Context.Strategy = ContextStrategyOldest
+	}
+
+	if conf.ModelList.Upstream && conf.ModelList.RefreshInterval == 0 {
+		conf.ModelList.RefreshInterval = 10 * time.Minute
+	}
+
+	if conf.ImageFetch.MaxBytes == 0 {
+		conf.ImageFetch.MaxBytes = 20 * 1024 * 1024
+	}
+
+	if conf.ImageFetch.Timeout == 0 {
+		conf.ImageFetch.Timeout = 10 * time.Second
+	}
+
+	if len(conf.ImageFetch.MediaTypes) == 0 {
+		conf.ImageFetch.MediaTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/tiff"}
+	}
+
+	if conf.ImageFetch.CacheSize == 0 {
+		conf.ImageFetch.CacheSize = 100
+	}
+
+	if conf.ImageFetch.CacheTTL == 0 {
+		conf.ImageFetch.CacheTTL = 10 * time.Minute
+	}
+
+	if conf.Cache.Enabled {
+		if len(conf.Cache.Endpoints) == 0 {
+			conf.Cache.Endpoints = []base.Endpoint{base.EndpointChatCompletion, base.EndpointCompletion, base.EndpointEmbedding}
+		}
+
+		if conf.Cache.TTL == 0 {
+			conf.Cache.TTL = time.Hour
+		}
+
+		if conf.Cache.Size == 0 {
+			conf.Cache.Size = 10000
+		}
+
+		if conf.Cache.MaxBodyBytes == 0 {
+			conf.Cache.MaxBodyBytes = 1024 * 1024
+		}
+
+		if conf.Cache.DiskMaxMB == 0 {
+			conf.Cache.DiskMaxMB = 1024
+		}
+
+		if conf.Cache.Semantic.Threshold == 0 {
+			conf.Cache.Semantic.Threshold = 0.95
+		}
+
+		if conf.Cache.Semantic.Size == 0 {
+			conf.Cache.Semantic.Size = 1000
+		}
+
+		if conf.Cache.Embedding.Size == 0 {
+			conf.Cache.Embedding.Size = 100000
+		}
+
+		if conf.Cache.Embedding.MaxBatchSize == 0 {
+			conf.Cache.Embedding.MaxBatchSize = 256
+		}
+	}
+
+	// Report the problems found while loading and validating together
+	errs := l.Errs()
 	if err := conf.Validate(); err != nil {
-		return nil, err
+		var validationErrs ValidationErrors
+		if !errors.As(err, &validationErrs) {
+			return nil, err
+		}
+
+		errs = append(errs, validationErrs...)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
 	}
 
 	return &conf, nil
@@ -253,11 +565,98 @@ type ModelKey struct {
 
 type Moderation struct {
 	Enabled bool `yaml:"enabled" json:"enabled"`
-	// ClientCanIgnore If the client can ignore the moderation result, If client send a request with `X-Ignore-Moderation` header, the dispatcher will ignore the moderation result
-	ClientCanIgnore bool          `yaml:"client-can-ignore" json:"client-can-ignore"`
-	Categories      []string      `yaml:"categories" json:"categories"`
-	ScoreThreshold  float64       `yaml:"score-threshold" json:"score-threshold"`
-	API             ModerationAPI `yaml:"api" json:"api"`
+	// ClientCanIgnore If the client can ignore the moderation result, If client send a request with `X-Ignore-Moderation` header, the dispatcher will ignore the moderation result.
+	// It is the default value of the keys, use KeyModeration.CanIgnore to allow only some keys to bypass
+	ClientCanIgnore bool     `yaml:"client-can-ignore" json:"client-can-ignore"`
+	Categories      []string `yaml:"categories" json:"categories"`
+	ScoreThreshold  float64  `yaml:"score-threshold" json:"score-threshold"`
+	// Thresholds The threshold of each category, the categories not listed use ScoreThreshold
+	Thresholds map[string]float64 `yaml:"thresholds" json:"thresholds,omitempty"`
+	API        ModerationAPI      `yaml:"api" json:"api"`
+	// AuditLogPath The directory of the audit log, every flagged or blocked decision is written as one JSON line, empty to disable
+	AuditLogPath string `yaml:"audit-log-path" json:"audit-log-path,omitempty"`
+	// Engines The moderation engines to run in order, local and api are supported.
+	// The following engines are skipped once the request is flagged. By default, local is used when local rules
+	// are configured, and api is used when the api key is set
+	Engines []string `yaml:"engines" json:"engines"`
+	// Local The rules of the local moderation engine
+	Local []LocalModerationRule `yaml:"local" json:"local,omitempty"`
+	// Endpoints The endpoints to moderate, chat, completions, image and speech endpoints are moderated by default.
+	// Embeddings and the output of audio transcriptions and translations can be added
+	Endpoints []base.Endpoint `yaml:"endpoints" json:"endpoints,omitempty"`
+	// Output Moderate the output of chat completions too
+	Output ModerationOutput `yaml:"output" json:"output"`
+	// Cache Cache the api moderation result of each input, so that only the new messages of a conversation are checked
+	Cache ModerationCache `yaml:"cache" json:"cache"`
+	// MaxConcurrency The maximum number of concurrent moderation api requests, 0 for unlimited.
+	// A request waits at most 5 seconds for a free slot
+	MaxConcurrency int `yaml:"max-concurrency" json:"max-concurrency,omitempty"`
+	// FailMode What to do when the moderation fails: open (the default) lets the request pass, closed rejects it
+	FailMode string `yaml:"fail-mode" json:"fail-mode,omitempty"`
+}
+
+// ContextManagement Drop the turns of the chat conversations whose prompt tokens exceed the limit
+type ContextManagement struct {
+	// Enabled Whether to trim the conversations by default, the models and the keys can override it
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Strategy Which turns are dropped first: oldest (the default) or middle
+	Strategy string `yaml:"strategy" json:"strategy,omitempty"`
+	// MaxPromptTokens The limit of the prompt tokens. When it is 0, the context window of the model in the
+	// registry is used, minus the tokens reserved for the output
+	MaxPromptTokens int `yaml:"max-prompt-tokens" json:"max-prompt-tokens,omitempty"`
+	// Models The settings of the models, the first one matching the model is used
+	Models []ContextPolicy `yaml:"models" json:"models,omitempty"`
+}
+
+// ContextPolicy The context management settings of a model or a key, the fields not set fall back to the global settings
+type ContextPolicy struct {
+	// Model The model the settings apply to, * matches any characters. It is only used in the settings of the models
+	Model           string `yaml:"model,omitempty" json:"model,omitempty"`
+	Enabled         *bool  `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+	Strategy        string `yaml:"strategy,omitempty" json:"strategy,omitempty"`
+	MaxPromptTokens int    `yaml:"max-prompt-tokens,omitempty" json:"max-prompt-tokens,omitempty"`
+}
+
+const (
+	ContextStrategyOldest = "oldest"
+	ContextStrategyMiddle = "middle"
+)
+
+const (
+	ModerationFailOpen   = "open"
+	ModerationFailClosed = "closed"
+)
+
+type ModerationCache struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Size The maximum number of inputs cached, the default value is 10000
+	Size int `yaml:"size" json:"size,omitempty"`
+	// TTL How long the result is cached, such as 10m, the default value is 1h
+	TTL time.Duration `yaml:"ttl" json:"ttl,omitempty"`
+}
+
+type ModerationOutput struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// WindowSize The number of characters checked at a time in stream responses, the default value is 200.
+	// A larger window needs fewer moderation calls, but the client receives the output later
+	WindowSize int `yaml:"window-size" json:"window-size,omitempty"`
+}
+
+const (
+	ModerationEngineLocal = "local"
+	ModerationEngineAPI   = "api"
+)
+
+// LocalModerationRule The inputs matching any keyword, regex or dictionary word are flagged with the category and score
+type LocalModerationRule struct {
+	Category string `yaml:"category" json:"category"`
+	// Score The score of the category when matched, the default value is 1
+	Score    float64  `yaml:"score" json:"score,omitempty"`
+	Keywords []string `yaml:"keywords" json:"keywords,omitempty"`
+	Regexes  []string `yaml:"regexes" json:"regexes,omitempty"`
+	// Dictionaries Files containing one word per line, matched with Aho-Corasick, suitable for large word lists
+	Dictionaries  []string `yaml:"dictionaries" json:"dictionaries,omitempty"`
+	CaseSensitive bool     `yaml:"case-sensitive" json:"case-sensitive,omitempty"`
 }
 
 type ModerationAPI struct {
@@ -267,3 +666,122 @@ type ModerationAPI struct {
 	Proxy  bool   `yaml:"proxy" json:"proxy"`
 	Model  string `yaml:"model" json:"model"`
 }
+
+// maskKey Mask the key so that it can be written to logs
+func maskKey(key string) string {
+	if len(key) < 12 {
+		return strings.Repeat("*", len(key))
+	}
+
+	return key[:4] + strings.Repeat("*", len(key)-8) + key[len(key)-4:]
+}
+
+// Capture Capture the request and response bodies to rotating JSONL files, for audit and replay
+type Capture struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Path The directory of the capture files
+	Path string `yaml:"path" json:"path"`
+	// AllKeys Capture the requests of all client keys, otherwise only the keys with capture enabled are captured
+	AllKeys bool `yaml:"all-keys" json:"all-keys"`
+	// SampleRate The sampling rate, between 0 and 1, the default value is 1
+	SampleRate float64 `yaml:"sample-rate" json:"sample-rate"`
+	// Redact JSON paths to be redacted, such as messages.#.content
+	Redact []string `yaml:"redact" json:"redact"`
+	// MaxBodyBytes The maximum size of the request or response body to capture, the default value is 1MB
+	MaxBodyBytes int `yaml:"max-body-bytes" json:"max-body-bytes"`
+	// MaxFileMB The maximum size of a single capture file in MB, the default value is 100
+	MaxFileMB int `yaml:"max-file-mb" json:"max-file-mb"`
+}
+
+// ImageFetch How the images in the requests are downloaded for the providers only accepting base64 images, such as anthropic
+type ImageFetch struct {
+	// MaxBytes The maximum size of an image, the default value is 20MB
+	MaxBytes int64 `yaml:"max-bytes" json:"max-bytes,omitempty"`
+	// Timeout The timeout of downloading an image, the default value is 10s
+	Timeout time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+	// MediaTypes The media types allowed, the default value is jpeg, png, gif, webp, bmp and tiff
+	MediaTypes []string `yaml:"media-types" json:"media-types,omitempty"`
+	// CacheSize The number of downloaded images cached, the default value is 100
+	CacheSize int `yaml:"cache-size" json:"cache-size,omitempty"`
+	// CacheTTL How long the downloaded images are cached, the default value is 10m
+	CacheTTL time.Duration `yaml:"cache-ttl" json:"cache-ttl,omitempty"`
+	// AllowPrivate Whether the images can be downloaded from the loopback, private and link-local addresses
+	AllowPrivate bool `yaml:"allow-private" json:"allow-private,omitempty"`
+}
+
+// Cache Cache the responses of deterministic requests, the identical requests are served from the cache.
+// The chat and completions requests are only cached when the temperature is 0, unless AnyTemperature is set
+type Cache struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Endpoints The endpoints cached, the default value is chat completions, completions and embeddings
+	Endpoints []base.Endpoint `yaml:"endpoints" json:"endpoints,omitempty"`
+	// TTL How long the responses are cached, such as 30m, the default value is 1h
+	TTL time.Duration `yaml:"ttl" json:"ttl,omitempty"`
+	// Rules Override the TTL of some models or endpoints, the first matched rule is used
+	Rules []CacheRule `yaml:"rules" json:"rules,omitempty"`
+	// Size The maximum number of responses cached in memory, the default value is 10000
+	Size int `yaml:"size" json:"size,omitempty"`
+	// MaxBodyBytes The responses larger than it are not cached, the default value is 1MB
+	MaxBodyBytes int `yaml:"max-body-bytes" json:"max-body-bytes,omitempty"`
+	// Path The directory of the disk cache, the responses are only cached in memory when empty
+	Path string `yaml:"path" json:"path,omitempty"`
+	// DiskMaxMB The maximum size of the disk cache in MB, the oldest responses are removed when it is exceeded,
+	// the default value is 1024
+	DiskMaxMB int `yaml:"disk-max-mb" json:"disk-max-mb,omitempty"`
+	// Shared Share the cached responses among all client keys, the responses are cached separately for each key by default.
+	// A response may contain the content of the prompt, only enable it when all keys belong to the same tenant
+	Shared bool `yaml:"shared" json:"shared,omitempty"`
+	// AnyTemperature Cache the chat and completions requests regardless of the temperature
+	AnyTemperature bool `yaml:"any-temperature" json:"any-temperature,omitempty"`
+	// Semantic Serve the answers of similar chat requests, it is looked up when the exact cache misses
+	Semantic SemanticCache `yaml:"semantic" json:"semantic"`
+	// Embedding Cache the embedding of each input of the embedding requests, only the inputs not cached are sent to the upstream
+	Embedding EmbeddingCache `yaml:"embedding" json:"embedding"`
+}
+
+// EmbeddingCache Split the inputs of the embedding requests into per-input cache lookups, the missed inputs are
+// embedded in one upstream request and the response is reassembled in the order of the inputs.
+// The TTL of the response cache and its rules for the embeddings endpoint apply to the inputs
+type EmbeddingCache struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Size The maximum number of inputs cached, the default value is 100000
+	Size int `yaml:"size" json:"size,omitempty"`
+	// BatchWindow Coalesce the missed inputs of concurrent requests of the same client key, model and parameters
+	// arriving within the window into one upstream request, such as 20ms, 0 to disable
+	BatchWindow time.Duration `yaml:"batch-window" json:"batch-window,omitempty"`
+	// MaxBatchSize The maximum number of inputs of a coalesced upstream request, requests with more missed inputs
+	// are sent directly, the default value is 256
+	MaxBatchSize int `yaml:"max-batch-size" json:"max-batch-size,omitempty"`
+}
+
+// SemanticCache Embed the last user message of chat requests, and serve the cached answer of the most similar message.
+// Only the answers of the same client key, model, system prompt and tools are reused
+type SemanticCache struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Model The embedding model, the embedding requests are dispatched like the requests of the clients
+	Model string `yaml:"model" json:"model,omitempty"`
+	// Threshold The minimum cosine similarity to reuse an answer, the default value is 0.95
+	Threshold float64 `yaml:"threshold" json:"threshold,omitempty"`
+	// Size The maximum number of answers cached for each client key, the default value is 1000
+	Size int `yaml:"size" json:"size,omitempty"`
+	// TTL How long the answers are cached, the TTL of the response cache is used by default
+	TTL time.Duration `yaml:"ttl" json:"ttl,omitempty"`
+}
+
+// CacheRule The TTL of the requests matching the endpoint and models
+type CacheRule struct {
+	// Endpoint The endpoint matched, empty for all endpoints
+	Endpoint base.Endpoint `yaml:"endpoint" json:"endpoint,omitempty"`
+	// Models The models matched, empty for all models
+	Models []string `yaml:"models" json:"models,omitempty"`
+	// TTL How long the responses are cached, 0 to disable the cache of the matched requests
+	TTL time.Duration `yaml:"ttl" json:"ttl"`
+}
+
+// Admin The admin API for runtime inspection and control, served on a separate listener
+type Admin struct {
+	// Listen The listen address of the admin API, empty to disable
+	Listen string `yaml:"listen" json:"listen,omitempty"`
+	// Keys The keys used to access the admin API, sent as a Bearer token
+	Keys []string `yaml:"keys" json:"-"`
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?}`)
+
+// interpolate Resolve the references in all string values of the YAML node
+//   - ${ENV_VAR} or ${ENV_VAR:-default}: replaced with the environment variable
+//   - file:///path/to/secret or @/path/to/secret: the whole value is replaced with the content of the file
+//
+// All unresolved references are returned with their field paths
+func interpolate(node *yaml.Node, path string) []string {
+	errs := make([]string, 0)
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			errs = append(errs, interpolate(n, path)...)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			errs = append(errs, interpolate(node.Content[i+1], joinPath(path, node.Content[i].Value))...)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			errs = append(errs, interpolate(n, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" {
+			return errs
+		}
+
+		value, err := resolveValue(node.Value)
+		if err != nil {
+			return append(errs, fmt.Sprintf("%s (line %d): %v", path, node.Line, err))
+		}
+
+		if value != node.Value {
+			node.Value = value
+			// Let the YAML decoder resolve the type again, so that ${PORT} can be used for numbers
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	}
+
+	return errs
+}
+
+func resolveValue(value string) (string, error) {
+	if strings.HasPrefix(value, "file://") || strings.HasPrefix(value, "@/") {
+		filename := strings.TrimPrefix(strings.TrimPrefix(value, "file://"), "@")
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("read secret file %s failed: %v", filename, err)
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var missing []string
+	value = envPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		matches := envPattern.FindStringSubmatch(ref)
+		if val, ok := os.LookupEnv(matches[1]); ok {
+			return val
+		}
+
+		if matches[2] != "" {
+			return matches[3]
+		}
+
+		missing = append(missing, matches[1])
+		return ref
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return value, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
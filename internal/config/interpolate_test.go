@@ -0,0 +1,58 @@
+package config
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "moderation-key")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("sk-secret\n"), 0600))
+
+	t.Setenv("DISPATCHER_TEST_KEY", "sk-from-env")
+	t.Setenv("DISPATCHER_TEST_WEIGHT", "3")
+
+	data := `
+keys:
+  - "${DISPATCHER_TEST_KEY}"
+rules:
+  - name: test
+    servers: ["${DISPATCHER_TEST_SERVER:-https://api.openai.com}"]
+    keys: ["@` + secretFile + `"]
+    weight: ${DISPATCHER_TEST_WEIGHT}
+moderation:
+  api:
+    key: "file://` + secretFile + `"
+`
+
+	var root yaml.Node
+	assert.NoError(t, yaml.Unmarshal([]byte(data), &root))
+	assert.Equal(t, 0, len(interpolate(&root, "")))
+
+	var conf Config
+	assert.NoError(t, root.Decode(&conf))
+	assert.Equal(t, "sk-from-env", conf.Keys[0].Key)
+	assert.Equal(t, "https://api.openai.com", conf.Rules[0].Servers[0])
+	assert.Equal(t, "sk-secret", conf.Rules[0].Keys[0])
+	assert.Equal(t, 3, conf.Rules[0].Weight)
+	assert.Equal(t, "sk-secret", conf.Moderation.API.Key)
+}
+
+func TestInterpolateMissing(t *testing.T) {
+	data := `
+rules:
+  - keys: ["${DISPATCHER_TEST_MISSING}", "@/not/exist/secret"]
+`
+
+	var root yaml.Node
+	assert.NoError(t, yaml.Unmarshal([]byte(data), &root))
+
+	errs := interpolate(&root, "")
+	assert.Equal(t, 2, len(errs))
+	assert.True(t, strings.HasPrefix(errs[0], "rules[0].keys[0]"))
+	assert.True(t, strings.HasPrefix(errs[1], "rules[0].keys[1]"))
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// mergeableKeys Top-level keys that are merged across files, all other keys are global settings
+// which can only be set in one file (or set to the same value)
+var mergeableKeys = map[string]bool{
+	"include":      true,
+	"rules":        true,
+	"keys":         true,
+	"extra-models": true,
+	"models":       true,
+}
+
+// loader Load the configuration from a file or a directory, and merge the included files
+type loader struct {
+	conf    Config
+	visited map[string]bool
+	// globals The file that sets each global setting, and its value
+	globals map[string]globalSetting
+	// ruleSources The file where each named rule is defined
+	ruleSources map[string]string
+	errs        []string
+}
+
+type globalSetting struct {
+	file  string
+	value any
+}
+
+func newLoader() *loader {
+	return &loader{
+		conf:        Config{positions: make(map[string]string)},
+		visited:     make(map[string]bool),
+		globals:     make(map[string]globalSetting),
+		ruleSources: make(map[string]string),
+	}
+}
+
+// loadPath Load a configuration file, or all *.yaml/*.yml files in a directory in alphabetical order
+func (l *loader) loadPath(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !stat.IsDir() {
+		return l.loadFile(path)
+	}
+
+	files := make([]string, 0)
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(path, pattern))
+		files = append(files, matches...)
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no configuration file found in directory %s", path)
+	}
+
+	sort.Strings(files)
+	for _, file := range files {
+		if err := l.loadFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *loader) loadFile(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	// A file may be included more than once, or included by itself
+	if l.visited[absPath] {
+		return nil
+	}
+	l.visited[absPath] = true
+	l.conf.Sources = append(l.conf.Sources, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Empty file
+	if len(root.Content) == 0 {
+		return nil
+	}
+
+	for _, e := range interpolate(&root, "") {
+		l.errs = append(l.errs, fmt.Sprintf("%s: %s", path, e))
+	}
+
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: the configuration must be a mapping", path)
+	}
+
+	l.errs = append(l.errs, checkUnknownFields(doc, reflect.TypeOf(Config{}), "", path)...)
+
+	var fragment Config
+	if err := doc.Decode(&fragment); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var ruleNodes []*yaml.Node
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == "rules" {
+			ruleNodes = doc.Content[i+1].Content
+			continue
+		}
+
+		collectPositions(doc.Content[i+1], doc.Content[i].Value, path, l.conf.positions)
+		l.conf.positions[doc.Content[i].Value] = fmt.Sprintf("%s:%d", path, doc.Content[i].Line)
+	}
+
+	// Check that the global settings are not set to different values in different files
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key := doc.Content[i].Value
+		if mergeableKeys[key] {
+			continue
+		}
+
+		var value any
+		_ = doc.Content[i+1].Decode(&value)
+
+		if prev, ok := l.globals[key]; ok && !reflect.DeepEqual(prev.value, value) {
+			l.errs = append(l.errs, fmt.Sprintf("%s (line %d): conflicting global setting %s, it is already set in %s", path, doc.Content[i].Line, key, prev.file))
+			continue
+		}
+
+		l.globals[key] = globalSetting{file: path, value: value}
+	}
+
+	// Decode the global settings into the merged configuration, absent fields are kept unchanged
+	rules, keys, extraModels, models, sources, positions := l.conf.Rules, l.conf.Keys, l.conf.ExtraModels, l.conf.Models, l.conf.Sources, l.conf.positions
+	if err := doc.Decode(&l.conf); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	l.conf.Include = nil
+	l.conf.Sources = sources
+	l.conf.positions = positions
+	l.conf.Keys = append(keys, fragment.Keys...)
+	l.conf.ExtraModels = append(extraModels, fragment.ExtraModels...)
+	l.conf.Models = append(models, fragment.Models...)
+	l.conf.Rules = rules
+
+	for i, rule := range fragment.Rules {
+		rule.Source = path
+		if i < len(ruleNodes) {
+			rule.positions = make(map[string]string)
+			collectPositions(ruleNodes[i], "", path, rule.positions)
+		}
+
+		if rule.Name != "" {
+			if prev, ok := l.ruleSources[rule.Name]; ok {
+				l.errs = append(l.errs, fmt.Sprintf("%s: duplicate rule name %s, it is already defined in %s", rule.location(""), rule.Name, prev))
+				continue
+			}
+
+			l.ruleSources[rule.Name] = path
+		}
+
+		l.conf.Rules = append(l.conf.Rules, rule)
+	}
+
+	// The include patterns are relative to the directory of the current file
+	for _, pattern := range fragment.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include pattern %s: %w", path, pattern, err)
+		}
+
+		if len(matches) == 0 {
+			l.errs = append(l.errs, fmt.Sprintf("%s: include pattern %s matches no file", path, pattern))
+			continue
+		}
+
+		sort.Strings(matches)
+		for _, match := range matches {
+			if err := l.loadPath(match); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Errs Return all problems found while loading
+func (l *loader) Errs() ValidationErrors {
+	return l.errs
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	return dir
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `
+listen: ":8081"
+keys: ["key-a"]
+include: ["rules.d/*.yaml"]
+`,
+		"rules.d/a.yaml": `
+keys: ["key-b"]
+rules:
+  - name: team-a
+    servers: ["https://a.example.com"]
+    keys: ["sk-a"]
+    models: ["model-a"]
+`,
+		"rules.d/b.yaml": `
+listen: ":8081"
+extra-models: ["model-x"]
+rules:
+  - name: team-b
+    servers: ["https://b.example.com"]
+    keys: ["sk-b"]
+    models: ["model-b"]
+`,
+	})
+
+	conf, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, ":8081", conf.Listen)
+	assert.Equal(t, 2, len(conf.Keys))
+	assert.Equal(t, []string{"model-x"}, conf.ExtraModels)
+	assert.Equal(t, 2, len(conf.Rules))
+	assert.Equal(t, "team-a", conf.Rules[0].Name)
+	assert.Equal(t, filepath.Join(dir, "rules.d", "a.yaml"), conf.Rules[0].Source)
+	assert.Equal(t, 3, len(conf.Sources))
+}
+
+func TestLoadConfigDirectoryConflicts(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": `
+listen: ":8081"
+rules:
+  - name: shared
+    servers: ["https://a.example.com"]
+    keys: ["sk-a"]
+    models: ["model-a"]
+`,
+		"b.yaml": `
+listen: ":8082"
+rules:
+  - name: shared
+    servers: ["https://b.example.com"]
+    keys: ["sk-b"]
+    models: ["model-b"]
+`,
+	})
+
+	_, err := LoadConfig(dir)
+	assert.True(t, err != nil)
+	assert.True(t, strings.Contains(err.Error(), "conflicting global setting listen"))
+	assert.True(t, strings.Contains(err.Error(), "duplicate rule name shared"))
+}
@@ -0,0 +1,505 @@
+package config
+
+import (
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/maps"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/expr"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidationErrors All problems found in the configuration
+type ValidationErrors []string
+
+func (errs ValidationErrors) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// Validate Check whether the configuration is correct, all problems are reported together
+func (conf *Config) Validate() error {
+	errs := make(ValidationErrors, 0)
+	addErr := func(location string, format string, args ...any) {
+		errs = append(errs, fmt.Sprintf("%s: %s", location, fmt.Sprintf(format, args...)))
+	}
+
+	validateThresholds := func(field string, thresholds map[string]float64) {
+		categories := maps.Keys(thresholds)
+		sort.Strings(categories)
+		for _, category := range categories {
+			if threshold := thresholds[category]; threshold > 1 || threshold < 0 {
+				addErr(conf.location(field+"."+category), "moderation threshold of %s must be between 0 and 1", category)
+			}
+		}
+	}
+
+	validateContext := func(field string, policy ContextPolicy) {
+		if policy.Strategy != "" && !array.In(policy.Strategy, []string{ContextStrategyOldest, ContextStrategyMiddle}) {
+			addErr(conf.location(field+".strategy"), "context strategy only oldest and middle are supported")
+		}
+
+		if policy.MaxPromptTokens < 0 {
+			addErr(conf.location(field+".max-prompt-tokens"), "context max prompt tokens must not be negative")
+		}
+	}
+
+	if len(conf.Keys) == 0 {
+		addErr(conf.location("keys"), "no client keys configured, all requests will be rejected")
+	}
+
+	for i, key := range conf.Keys {
+		if key.Key == "" {
+			addErr(conf.location(fmt.Sprintf("keys[%d]", i)), "client key is empty")
+		}
+
+		if key.Moderation != nil {
+			field := fmt.Sprintf("keys[%d].moderation", i)
+			if !conf.Moderation.Enabled {
+				addErr(conf.location(field), "key moderation policy only works when moderation is enabled")
+			}
+
+			if key.Moderation.ScoreThreshold > 1 || key.Moderation.ScoreThreshold < 0 {
+				addErr(conf.location(field+".score-threshold"), "moderation score threshold must be between 0 and 1")
+			}
+
+			validateThresholds(field+".thresholds", key.Moderation.Thresholds)
+		}
+
+		if key.Context != nil {
+			field := fmt.Sprintf("keys[%d].context", i)
+			if key.Context.Model != "" {
+				addErr(conf.location(field+".model"), "key context settings apply to all models of the key, model is not allowed")
+			}
+
+			validateContext(field, *key.Context)
+		}
+
+		for j, model := range key.Models {
+			if model == "" {
+				addErr(conf.location(fmt.Sprintf("keys[%d].models[%d]", i, j)), "key model is empty")
+			}
+		}
+	}
+
+	validateContext("context", ContextPolicy{Strategy: conf.Context.Strategy, MaxPromptTokens: conf.Context.MaxPromptTokens})
+	for i, policy := range conf.Context.Models {
+		field := fmt.Sprintf("context.models[%d]", i)
+		if policy.Model == "" {
+			addErr(conf.location(field), "context model is required")
+		}
+
+		validateContext(field, policy)
+	}
+
+	if conf.ImageFetch.MaxBytes < 0 || conf.ImageFetch.Timeout < 0 || conf.ImageFetch.CacheSize < 0 || conf.ImageFetch.CacheTTL < 0 {
+		addErr(conf.location("image-fetch"), "image fetch limits must not be negative")
+	}
+
+	if conf.ModelList.RefreshInterval < 0 {
+		addErr(conf.location("model-list.refresh-interval"), "model list refresh interval must not be negative")
+	}
+
+	modelNames := make(map[string]bool)
+	for i, model := range conf.Models {
+		field := fmt.Sprintf("models[%d]", i)
+		if model.Name == "" {
+			addErr(conf.location(field), "model name is required")
+		} else if modelNames[model.Name] {
+			addErr(conf.location(field+".name"), "duplicate model %s", model.Name)
+		}
+		modelNames[model.Name] = true
+
+		if model.ContextWindow < 0 || model.MaxOutput < 0 {
+			addErr(conf.location(field), "model context window and max output must not be negative")
+		}
+	}
+
+	if conf.Policy != "" && !array.In(conf.Policy, []string{"random", "round_robin", "weight"}) {
+		addErr(conf.location("policy"), "policy Only random, round_robin, and weight are supported")
+	}
+
+	ruleNames := make(map[string]int)
+	for i, rule := range conf.Rules {
+		if rule.Name != "" {
+			if prev, ok := ruleNames[rule.Name]; ok {
+				addErr(rule.location(""), "duplicate rule name %s, it is already used by rule #%d", rule.Name, prev+1)
+			} else {
+				ruleNames[rule.Name] = i
+			}
+		}
+
+		for _, e := range rule.validate() {
+			addErr(e[0], "rule #%d%s, %s", i+1, ternary.If(rule.Name == "", "", " ("+rule.Name+")"), e[1])
+		}
+	}
+
+	if conf.Moderation.Enabled {
+		if conf.Moderation.ScoreThreshold > 1 || conf.Moderation.ScoreThreshold < 0 {
+			addErr(conf.location("moderation.score-threshold"), "moderation score threshold must be between 0 and 1")
+		}
+
+		for i, engine := range conf.Moderation.Engines {
+			if !array.In(engine, []string{ModerationEngineLocal, ModerationEngineAPI}) {
+				addErr(conf.location(fmt.Sprintf("moderation.engines[%d]", i)), "moderation engine only support local and api")
+			}
+		}
+
+		if array.In(ModerationEngineAPI, conf.Moderation.Engines) {
+			if conf.Moderation.API.Type != "openai" {
+				addErr(conf.location("moderation.api.type"), "moderation api type only support openai")
+			}
+
+			if !isHTTPURL(conf.Moderation.API.Server) {
+				addErr(conf.location("moderation.api.server"), "moderation api server must be a valid url")
+			}
+
+			if conf.Moderation.API.Key == "" {
+				addErr(conf.location("moderation.api.key"), "moderation api key is required")
+			}
+		}
+
+		for i, endpoint := range conf.Moderation.Endpoints {
+			if !array.In(endpoint, base.ModerationEndpoints) {
+				addErr(conf.location(fmt.Sprintf("moderation.endpoints[%d]", i)), "moderation endpoint %s is not supported", endpoint)
+			}
+		}
+
+		if array.In(ModerationEngineLocal, conf.Moderation.Engines) && len(conf.Moderation.Local) == 0 {
+			addErr(conf.location("moderation.local"), "local moderation rules are required when the local engine is used")
+		}
+
+		validateThresholds("moderation.thresholds", conf.Moderation.Thresholds)
+
+		if !array.In(conf.Moderation.FailMode, []string{ModerationFailOpen, ModerationFailClosed}) {
+			addErr(conf.location("moderation.fail-mode"), "moderation fail mode only support open and closed")
+		}
+
+		if conf.Moderation.MaxConcurrency < 0 {
+			addErr(conf.location("moderation.max-concurrency"), "moderation max concurrency must not be negative")
+		}
+
+		if conf.Moderation.Cache.Size < 0 || conf.Moderation.Cache.TTL < 0 {
+			addErr(conf.location("moderation.cache"), "moderation cache size and ttl must not be negative")
+		}
+
+		if conf.Moderation.Output.WindowSize < 0 {
+			addErr(conf.location("moderation.output.window-size"), "moderation output window size must not be negative")
+		}
+
+		for i, rule := range conf.Moderation.Local {
+			field := fmt.Sprintf("moderation.local[%d]", i)
+			if rule.Category == "" {
+				addErr(conf.location(field+".category"), "local moderation rule category is required")
+			}
+
+			if rule.Score > 1 || rule.Score < 0 {
+				addErr(conf.location(field+".score"), "local moderation rule score must be between 0 and 1")
+			}
+
+			if len(rule.Keywords) == 0 && len(rule.Regexes) == 0 && len(rule.Dictionaries) == 0 {
+				addErr(conf.location(field), "local moderation rule has no keywords, regexes or dictionaries")
+			}
+
+			for j, re := range rule.Regexes {
+				if _, err := regexp.Compile(re); err != nil {
+					addErr(conf.location(fmt.Sprintf("%s.regexes[%d]", field, j)), "invalid regex %q: %v", re, err)
+				}
+			}
+
+			for j, dict := range rule.Dictionaries {
+				if _, err := os.Stat(dict); err != nil {
+					addErr(conf.location(fmt.Sprintf("%s.dictionaries[%d]", field, j)), "dictionary file is not readable: %v", err)
+				}
+			}
+		}
+	}
+
+	if conf.Admin.Listen != "" && len(conf.Admin.Keys) == 0 {
+		addErr(conf.location("admin.keys"), "admin keys are required when admin listen is set")
+	}
+
+	if conf.Capture.Enabled {
+		if conf.Capture.Path == "" {
+			addErr(conf.location("capture.path"), "capture path is required")
+		}
+
+		if conf.Capture.SampleRate > 1 || conf.Capture.SampleRate < 0 {
+			addErr(conf.location("capture.sample-rate"), "capture sample rate must be between 0 and 1")
+		}
+	}
+
+	if conf.Cache.Enabled {
+		if conf.Cache.TTL < 0 || conf.Cache.Size < 0 || conf.Cache.MaxBodyBytes < 0 || conf.Cache.DiskMaxMB < 0 {
+			addErr(conf.location("cache"), "cache ttl, size, max body bytes and disk max mb must not be negative")
+		}
+
+		cacheable := []base.Endpoint{base.EndpointChatCompletion, base.EndpointCompletion, base.EndpointEmbedding}
+		for i, endpoint := range conf.Cache.Endpoints {
+			if !array.In(endpoint, cacheable) {
+				addErr(conf.location(fmt.Sprintf("cache.endpoints[%d]", i)), "cache only support %s", strings.Join(array.Map(cacheable, func(e base.Endpoint, _ int) string { return string(e) }), ", "))
+			}
+		}
+
+		for i, rule := range conf.Cache.Rules {
+			if rule.TTL < 0 {
+				addErr(conf.location(fmt.Sprintf("cache.rules[%d].ttl", i)), "cache rule ttl must not be negative")
+			}
+
+			if rule.Endpoint != "" && !array.In(rule.Endpoint, conf.Cache.Endpoints) {
+				addErr(conf.location(fmt.Sprintf("cache.rules[%d].endpoint", i)), "cache rule endpoint %s is not cached", rule.Endpoint)
+			}
+		}
+
+		if conf.Cache.Semantic.Enabled {
+			if conf.Cache.Semantic.Model == "" {
+				addErr(conf.location("cache.semantic.model"), "semantic cache embedding model is required")
+			}
+
+			if conf.Cache.Semantic.Threshold <= 0 || conf.Cache.Semantic.Threshold > 1 {
+				addErr(conf.location("cache.semantic.threshold"), "semantic cache threshold must be between 0 and 1")
+			}
+
+			if conf.Cache.Semantic.Size < 0 || conf.Cache.Semantic.TTL < 0 {
+				addErr(conf.location("cache.semantic"), "semantic cache size and ttl must not be negative")
+			}
+
+			if !array.In(base.EndpointChatCompletion, conf.Cache.Endpoints) {
+				addErr(conf.location("cache.endpoints"), "chat completions must be cached when the semantic cache is enabled")
+			}
+		}
+
+		if conf.Cache.Embedding.Enabled {
+			if conf.Cache.Embedding.Size < 0 || conf.Cache.Embedding.BatchWindow < 0 || conf.Cache.Embedding.MaxBatchSize < 0 {
+				addErr(conf.location("cache.embedding"), "embedding cache size, batch window and max batch size must not be negative")
+			}
+
+			if !array.In(base.EndpointEmbedding, conf.Cache.Endpoints) {
+				addErr(conf.location("cache.endpoints"), "embeddings must be cached when the embedding cache is enabled")
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// validate Check the rule, each problem is returned as [location, message]
+func (rule Rule) validate() [][2]string {
+	errs := make([][2]string, 0)
+	addErr := func(field string, format string, args ...any) {
+		errs = append(errs, [2]string{rule.location(field), fmt.Sprintf(format, args...)})
+	}
+
+	if !array.In(rule.Type, []base.ChannelType{base.ChannelTypeOpenAI, base.ChannelTypeCoze, base.ChannelTypeAnthropic}) {
+		addErr("type", "%s type is under development, so stay tuned", rule.Type)
+	}
+
+	if len(rule.Servers) == 0 {
+		addErr("servers", "servers is empty")
+	}
+
+	for i, server := range rule.Servers {
+		if !isHTTPURL(server) {
+			addErr(fmt.Sprintf("servers[%d]", i), "malformed server url %q", server)
+		}
+	}
+
+	if len(rule.Keys) == 0 {
+		addErr("keys", "keys is empty")
+	}
+
+	if rule.Weight < 0 {
+		addErr("weight", "weight must not be negative, use the admin api to drain a rule")
+	}
+
+	for i, rewrite := range rule.Rewrite {
+		if !array.In(rewrite.Src, rule.Models) {
+			addErr(fmt.Sprintf("rewrite[%d].src", i), "rewrite src %s is not in models", rewrite.Src)
+		}
+
+		if rewrite.Dst == "" {
+			addErr(fmt.Sprintf("rewrite[%d].dst", i), "rewrite dst is empty")
+		}
+	}
+
+	for i, transform := range rule.Transforms {
+		for src, dst := range transform.Rename {
+			if src == "" || dst == "" {
+				addErr(fmt.Sprintf("transforms[%d].rename", i), "rename source and target must not be empty")
+			}
+		}
+
+		for field, r := range transform.Clamp {
+			if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+				addErr(fmt.Sprintf("transforms[%d].clamp.%s", i, field), "clamp min must not be greater than max")
+			}
+		}
+
+		if transform.ChunkSize < 0 || transform.ChunkInterval < 0 {
+			addErr(fmt.Sprintf("transforms[%d]", i), "chunk size and interval must not be negative")
+		}
+
+		if transform.EmulateStream && transform.AggregateStream {
+			addErr(fmt.Sprintf("transforms[%d]", i), "emulate-stream and aggregate-stream can not be both enabled")
+		}
+
+		for from, to := range transform.Roles {
+			if from == "" || to == "" {
+				addErr(fmt.Sprintf("transforms[%d].roles", i), "roles must not be empty")
+			}
+		}
+	}
+
+	if rule.Default && len(rule.GetModels()) == 0 && rule.Expr != nil && rule.Expr.Match != "" {
+		addErr("default", "default rule only matches models by expr, add static models or remove default")
+	}
+
+	if rule.Expr != nil {
+		if rule.Expr.Match != "" {
+			if _, err := expr.NewBoolVM(rule.Expr.Match); err != nil {
+				addErr("expr.match", "expr.match: %s", err)
+			}
+		}
+
+		if rule.Expr.Replace != "" {
+			if _, err := expr.NewStringVM(rule.Expr.Replace); err != nil {
+				addErr("expr.replace", "expr.replace: %s", err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// location Return the location (file:line) of the setting, the parent setting is used if the setting itself is not found
+func (conf *Config) location(path string) string {
+	return lookupPosition(conf.positions, path, path)
+}
+
+// location Return the location (file:line) of the rule field, the rule itself is used if the field is not found
+func (rule Rule) location(field string) string {
+	return lookupPosition(rule.positions, field, ternary.If(field == "", "rules", "rules."+field))
+}
+
+func lookupPosition(positions map[string]string, path string, fallback string) string {
+	for p := path; ; {
+		if pos, ok := positions[p]; ok {
+			return pos
+		}
+
+		if p == "" {
+			return fallback
+		}
+
+		idx := strings.LastIndexAny(p, ".[")
+		if idx < 0 {
+			p = ""
+		} else {
+			p = p[:idx]
+		}
+	}
+}
+
+// collectPositions Record the location of each node in the YAML tree
+func collectPositions(node *yaml.Node, path string, file string, positions map[string]string) {
+	positions[path] = fmt.Sprintf("%s:%d", file, node.Line)
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := joinPath(path, node.Content[i].Value)
+			collectPositions(node.Content[i+1], key, file, positions)
+			// Use the line of the key instead of the value, the value of a mapping or sequence starts on the next line
+			positions[key] = fmt.Sprintf("%s:%d", file, node.Content[i].Line)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			collectPositions(n, fmt.Sprintf("%s[%d]", path, i), file, positions)
+		}
+	}
+}
+
+// checkUnknownFields Report the mapping keys that do not match any field of the target type, such as typos like `modelkeys`
+func checkUnknownFields(node *yaml.Node, typ reflect.Type, path string, file string) []string {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	errs := make([]string, 0)
+	switch node.Kind {
+	case yaml.MappingNode:
+		switch typ.Kind() {
+		case reflect.Struct:
+			fields := yamlFields(typ)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				field, ok := fields[key.Value]
+				if !ok {
+					errs = append(errs, fmt.Sprintf("%s:%d: unknown field %s", file, key.Line, joinPath(path, key.Value)))
+					continue
+				}
+
+				errs = append(errs, checkUnknownFields(node.Content[i+1], field.Type, joinPath(path, key.Value), file)...)
+			}
+		case reflect.Map:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				errs = append(errs, checkUnknownFields(node.Content[i+1], typ.Elem(), joinPath(path, node.Content[i].Value), file)...)
+			}
+		}
+	case yaml.SequenceNode:
+		if typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array {
+			for i, n := range node.Content {
+				errs = append(errs, checkUnknownFields(n, typ.Elem(), fmt.Sprintf("%s[%d]", path, i), file)...)
+			}
+		}
+	}
+
+	return errs
+}
+
+// yamlFields Return the fields of the struct by their YAML names, the same rules as yaml.v3 are used
+func yamlFields(typ reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(field.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		fields[name] = field
+	}
+
+	return fields
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
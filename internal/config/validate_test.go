@@ -0,0 +1,165 @@
+package config
+
+import (
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `keys: ["client-key"]
+rules:
+  - name: broken
+    servers: ["api.openai.com"]
+    keys: []
+    weight: -1
+    modelkeys: []
+    models: [gpt-4]
+    rewrite:
+      - src: gpt-4o
+        dst: gpt-4o-2024-08-06
+  - name: fallback
+    servers: ["https://api.openai.com"]
+    keys: ["sk-xxx"]
+    default: true
+    expr:
+      match: Model matches "^gpt-"
+`,
+	})
+
+	path := filepath.Join(dir, "config.yaml")
+	_, err := LoadConfig(path)
+	assert.True(t, err != nil)
+
+	expected := []string{
+		path + ":7: unknown field rules[0].modelkeys",
+		path + ":4: rule #1 (broken), malformed server url",
+		path + ":5: rule #1 (broken), keys is empty",
+		path + ":6: rule #1 (broken), weight must not be negative",
+		path + ":10: rule #1 (broken), rewrite src gpt-4o is not in models",
+		path + ":15: rule #2 (fallback), default rule only matches models by expr",
+	}
+
+	for _, e := range expected {
+		assert.True(t, strings.Contains(err.Error(), e), "missing: "+e)
+	}
+}
+
+func TestLocalModeration(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `keys: ["client-key"]
+moderation:
+  enabled: true
+  local:
+    - category: custom
+      keywords: ["forbidden"]
+`,
+		"broken.yaml": `keys: ["client-key"]
+moderation:
+  enabled: true
+  engines: [local, remote]
+  local:
+    - category: ""
+      regexes: ["(unclosed"]
+      dictionaries: ["not-exist.txt"]
+  endpoints: [/v1/images/generations, /v1/moderations]
+`,
+	})
+
+	conf, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{ModerationEngineLocal}, conf.Moderation.Engines)
+	assert.Equal(t, 1.0, conf.Moderation.Local[0].Score)
+	assert.True(t, array.In("custom", conf.Moderation.Categories))
+	assert.EqualValues(t, base.DefaultModerationEndpoints, conf.Moderation.Endpoints)
+
+	path := filepath.Join(dir, "broken.yaml")
+	_, err = LoadConfig(path)
+	assert.True(t, err != nil)
+
+	expected := []string{
+		path + ":4: moderation engine only support local and api",
+		path + ":6: local moderation rule category is required",
+		path + ":7: invalid regex",
+		path + ":8: dictionary file is not readable",
+		path + ":9: moderation endpoint /v1/moderations is not supported",
+	}
+
+	for _, e := range expected {
+		assert.True(t, strings.Contains(err.Error(), e), "missing: "+e)
+	}
+}
+
+func TestKeyModeration(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `keys:
+  - name: kids
+    key: client-key
+    moderation:
+      can-ignore: false
+      thresholds:
+        sexual/minors: 1.5
+`,
+	})
+
+	path := filepath.Join(dir, "config.yaml")
+	_, err := LoadConfig(path)
+	assert.True(t, err != nil)
+
+	expected := []string{
+		path + ":4: key moderation policy only works when moderation is enabled",
+		path + ":7: moderation threshold of sexual/minors must be between 0 and 1",
+	}
+
+	for _, e := range expected {
+		assert.True(t, strings.Contains(err.Error(), e), "missing: "+e)
+	}
+}
+
+func TestContextManagement(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `keys:
+  - key: client-key
+    context: {model: gpt-4o, strategy: newest}
+context:
+  max-prompt-tokens: -1
+  models:
+    - {enabled: true}
+rules:
+  - servers: ["https://api.openai.com"]
+    keys: ["sk-xxx"]
+    models: [gpt-4o]
+`,
+	})
+
+	path := filepath.Join(dir, "config.yaml")
+	_, err := LoadConfig(path)
+	assert.True(t, err != nil)
+
+	expected := []string{
+		"key context settings apply to all models of the key, model is not allowed",
+		"context strategy only oldest and middle are supported",
+		"context max prompt tokens must not be negative",
+		"context model is required",
+	}
+
+	for _, e := range expected {
+		assert.True(t, strings.Contains(err.Error(), e), "missing: "+e)
+	}
+}
+
+func TestClientKeyAllowModel(t *testing.T) {
+	key := ClientKey{Models: []string{"gpt-4o*", "*-embedding-*", "claude-*-sonnet-*"}}
+	assert.True(t, key.AllowModel("gpt-4o"))
+	assert.True(t, key.AllowModel("gpt-4o-mini"))
+	assert.True(t, key.AllowModel("text-embedding-3-small"))
+	assert.True(t, key.AllowModel("claude-3-5-sonnet-20241022"))
+	assert.False(t, key.AllowModel("gpt-4"))
+	assert.False(t, key.AllowModel("claude-3-opus-20240229"))
+
+	assert.True(t, (&ClientKey{}).AllowModel("any"))
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/trim"
+	"github.com/tidwall/gjson"
+)
+
+// contextPolicy Resolve the context management settings of the model for the client key. The settings of the key
+// override the first matched settings of the model, which override the global settings
+func (st *state) contextPolicy(key *config.ClientKey, model string) (enabled bool, strategy string, maxPromptTokens int) {
+	enabled, strategy, maxPromptTokens = st.conf.Context.Enabled, st.conf.Context.Strategy, st.conf.Context.MaxPromptTokens
+
+	apply := func(policy config.ContextPolicy) {
+		if policy.Enabled != nil {
+			enabled = *policy.Enabled
+		}
+
+		if policy.Strategy != "" {
+			strategy = policy.Strategy
+		}
+
+		if policy.MaxPromptTokens > 0 {
+			maxPromptTokens = policy.MaxPromptTokens
+		}
+	}
+
+	for _, policy := range st.conf.Context.Models {
+		if config.MatchModel(policy.Model, model) {
+			apply(policy)
+			break
+		}
+	}
+
+	if key != nil && key.Context != nil {
+		apply(*key.Context)
+	}
+
+	return
+}
+
+// upstreamModel The model sent to the first upstream of the model, it is used to count the tokens before the upstream is selected
+func (st *state) upstreamModel(model string) string {
+	if ups, ok := st.upstreams[model]; ok && ups.Len() > 0 {
+		return ups.All()[0].Rule.ModelReplacer(model)
+	}
+
+	return model
+}
+
+// contextLimit The limit of the prompt tokens of the model, the context window in the registry minus the output tokens.
+// The output tokens requested by max_tokens or max_completion_tokens are reserved, otherwise the max output of the model
+// but no more than a quarter of the context window. It is 0 when the context window is unknown
+func (st *state) contextLimit(models []string, body []byte) int {
+	for _, model := range models {
+		info, ok := st.registry.Lookup(model)
+		if !ok || info.ContextWindow <= 0 {
+			continue
+		}
+
+		reserved := int(max(gjson.GetBytes(body, "max_tokens").Int(), gjson.GetBytes(body, "max_completion_tokens").Int()))
+		if reserved <= 0 {
+			reserved = min(info.MaxOutput, info.ContextWindow/4)
+		}
+
+		return max(info.ContextWindow-reserved, 0)
+	}
+
+	return 0
+}
+
+// trimContext Drop the turns of the chat conversation exceeding the prompt token limit of the model, the result is nil
+// when the context management is disabled or the conversation is not trimmed
+func (st *state) trimContext(key *config.ClientKey, model string, body []byte) ([]byte, *trim.Result, error) {
+	enabled, strategy, limit := st.contextPolicy(key, model)
+	if !enabled {
+		return body, nil, nil
+	}
+
+	upstreamModel := st.upstreamModel(model)
+	if limit == 0 {
+		limit = st.contextLimit([]string{upstreamModel, model}, body)
+	}
+
+	if limit == 0 {
+		return body, nil, nil
+	}
+
+	return trim.Trim(body, upstreamModel, strategy, limit)
+}
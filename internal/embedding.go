@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/must"
+	"github.com/mylxsw/openai-dispatcher/internal/accesslog"
+	"github.com/mylxsw/openai-dispatcher/internal/cache"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/token"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bufferedResponse An http.ResponseWriter keeping the response in memory, used by the requests made by the dispatcher itself
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.status == 0 {
+		b.status = statusCode
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+
+	return b.body.Write(data)
+}
+
+// internalRequest The options of the requests made by the dispatcher itself, their content has been moderated
+// as part of the client request, so the moderation is skipped
+type internalRequest struct {
+	// raw Send the request to the upstream directly, the caches are skipped
+	raw bool
+}
+
+type internalRequestKey struct{}
+
+// internalRequestFrom Return the options of the internal request, ok is false for the requests of the clients
+func internalRequestFrom(ctx context.Context) (opts internalRequest, ok bool) {
+	opts, ok = ctx.Value(internalRequestKey{}).(internalRequest)
+	return
+}
+
+// dispatchInternal Dispatch a request made by the dispatcher itself for the client key, the response is kept in memory
+func (s *Server) dispatchInternal(ctx context.Context, st *state, clientKey *config.ClientKey, requestID string, endpoint base.Endpoint, body []byte, opts internalRequest) (*bufferedResponse, error) {
+	entry := &accesslog.Entry{
+		Time:      time.Now(),
+		RequestID: requestID,
+		ClientKey: clientKey.Name,
+		Method:    http.MethodPost,
+		Endpoint:  string(endpoint),
+	}
+
+	ctx = context.WithValue(accesslog.WithEntry(ctx, entry), internalRequestKey{}, opts)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, string(endpoint), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := newBufferedResponse()
+	if err := s.Dispatch(st, clientKey, resp, req); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// embedder Create an embedder for the request of the client key, the embedding requests are dispatched
+// like the requests of the clients, so the upstreams, retries and the response cache apply to them too
+func (s *Server) embedder(st *state, clientKey *config.ClientKey, requestID string) cache.Embedder {
+	return func(ctx context.Context, model string, text string) ([]float32, error) {
+		body := must.Must(json.Marshal(map[string]any{"model": model, "input": text}))
+		resp, err := s.dispatchInternal(ctx, st, clientKey, requestID+"-embedding", base.EndpointEmbedding, body, internalRequest{})
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.status != http.StatusOK {
+			return nil, fmt.Errorf("embedding request failed [%d]: %s", resp.status, resp.body.String())
+		}
+
+		embedding := gjson.GetBytes(resp.body.Bytes(), "data.0.embedding")
+		if !embedding.IsArray() {
+			return nil, fmt.Errorf("invalid embedding response: %s", resp.body.String())
+		}
+
+		values := embedding.Array()
+		vector := make([]float32, len(values))
+		for i, value := range values {
+			vector[i] = float32(value.Float())
+		}
+
+		return vector, nil
+	}
+}
+
+// upstreamError The error response of the upstream, it is sent to the client as is
+type upstreamError struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream request failed [%d]: %s", e.status, string(e.body))
+}
+
+// serveEmbeddings Serve the embedding request from the per-input cache, only the missed inputs are sent to the upstream
+// and the response is reassembled in the order of the inputs. It returns false if the request can not be served this way,
+// such as the model is not cached, then the request is dispatched as usual
+func (s *Server) serveEmbeddings(st *state, clientKey *config.ClientKey, w http.ResponseWriter, r *http.Request, body []byte) (bool, error) {
+	req, err := cache.ParseEmbeddingRequest(body)
+	if err != nil {
+		// Let the upstream report the invalid request
+		return false, nil
+	}
+
+	responseCache := st.cache.get()
+	d := responseCache.LookupEmbeddings(r, clientKey.ID(), req)
+	if d == nil {
+		return false, nil
+	}
+
+	entry := accesslog.EntryFromContext(r.Context())
+	entry.Cache = d.Result
+	w.Header().Set("X-Cache", strings.ToUpper(d.Result))
+
+	// The identical inputs of the request are only embedded once
+	missed := make(map[string][]int)
+	var inputs []json.RawMessage
+	var keys []string
+	for i, item := range d.Items {
+		if item != nil {
+			continue
+		}
+
+		if _, ok := missed[d.Keys[i]]; !ok {
+			inputs, keys = append(inputs, req.Inputs[i]), append(keys, d.Keys[i])
+		}
+
+		missed[d.Keys[i]] = append(missed[d.Keys[i]], i)
+	}
+
+	// The usage only counts the inputs sent to the upstream, the tokens are counted by the tokenizer of the model
+	// since the upstream usage of a coalesced batch can not be split across the requests
+	promptTokens := 0
+	if len(inputs) > 0 {
+		batchKey := clientKey.ID() + "\x00" + req.Scope
+		fetched, err := responseCache.FetchEmbeddings(r.Context(), batchKey, inputs, s.fetchEmbeddings(st, clientKey, entry.RequestID, req.Model, body))
+		if err != nil {
+			var upErr *upstreamError
+			if errors.As(err, &upErr) {
+				w.Header().Set("Content-Type", upErr.contentType)
+				w.WriteHeader(upErr.status)
+				_, err = w.Write(upErr.body)
+			}
+
+			return true, err
+		}
+
+		for i, key := range keys {
+			for _, index := range missed[key] {
+				d.Items[index] = &fetched[i]
+			}
+
+			responseCache.SaveEmbedding(d, missed[key][0], fetched[i])
+			promptTokens += fetched[i].Tokens
+		}
+
+		if _, estimator := token.EstimatorFor(req.Model); estimator.Estimated() {
+			w.Header().Set("X-Usage-Estimated", "true")
+		}
+	}
+
+	resp := cache.EmbeddingResponse(req.Model, array.Map(d.Items, func(item *cache.EmbeddingItem, _ int) cache.EmbeddingItem { return *item }), promptTokens)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(resp)
+	return true, err
+}
+
+// fetchEmbeddings Create a fetcher embedding the inputs with the parameters of the request body,
+// the request is dispatched to the upstreams directly
+func (s *Server) fetchEmbeddings(st *state, clientKey *config.ClientKey, requestID string, model string, body []byte) cache.EmbeddingFetcher {
+	return func(ctx context.Context, inputs []json.RawMessage) ([]cache.EmbeddingItem, error) {
+		reqBody, err := sjson.SetRawBytes(body, "input", must.Must(json.Marshal(inputs)))
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		resp, err := s.dispatchInternal(ctx, st, clientKey, requestID+"-batch", base.EndpointEmbedding, reqBody, internalRequest{raw: true})
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.status != http.StatusOK {
+			return nil, &upstreamError{status: resp.status, contentType: resp.header.Get("Content-Type"), body: resp.body.Bytes()}
+		}
+
+		return cache.ParseEmbeddingResponse(resp.body.Bytes(), model, inputs)
+	}
+}
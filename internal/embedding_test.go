@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSemanticCache(t *testing.T) {
+	var embeddings, completions atomic.Int32
+
+	// A fake upstream, the questions mentioning weather are embedded to similar vectors
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/v1/embeddings":
+			embeddings.Add(1)
+			input := gjson.Get(readBody(r), "input").String()
+			vector := []float64{0, 1}
+			if strings.Contains(input, "weather") {
+				vector = []float64{1, float64(len(input)) / 1000}
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": []any{map[string]any{"index": 0, "embedding": vector}}})
+		case "/v1/chat/completions":
+			completions.Add(1)
+			_, _ = w.Write([]byte(`{"id":"1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"sunny"},"finish_reason":"stop"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t, `keys: ["client-key-123456"]
+rules:
+  - servers: ["`+upstream.URL+`"]
+    keys: ["sk-upstream"]
+    models: [gpt-4o, text-embedding-3-small]
+cache:
+  enabled: true
+  semantic:
+    enabled: true
+    model: text-embedding-3-small
+`)
+
+	ask := func(question string, stream bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{
+			"model":    "gpt-4o",
+			"stream":   stream,
+			"messages": []any{map[string]any{"role": "user", "content": question}},
+		})
+
+		return doRequest(server, http.MethodPost, "/v1/chat/completions", string(body))
+	}
+
+	w := ask("what is the weather today", false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+
+	w = ask("what's the weather like today?", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "SEMANTIC-HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.True(t, strings.Contains(w.Body.String(), `"content":"sunny"`))
+
+	w = ask("how to cook rice", false)
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+
+	assert.Equal(t, int32(3), embeddings.Load())
+	assert.Equal(t, int32(2), completions.Load())
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	var requested [][]string
+
+	// A fake upstream, the embedding of an input is its length and each character is a token
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var inputs []string
+		for _, input := range gjson.Get(readBody(r), "input").Array() {
+			inputs = append(inputs, input.String())
+		}
+		requested = append(requested, inputs)
+
+		data, tokens := make([]any, len(inputs)), 0
+		for i, input := range inputs {
+			data[i] = map[string]any{"object": "embedding", "index": i, "embedding": []int{len(input)}}
+			tokens += len(input)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data, "usage": map[string]any{"prompt_tokens": tokens, "total_tokens": tokens}})
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t, `keys: ["client-key-123456"]
+rules:
+  - servers: ["`+upstream.URL+`"]
+    keys: ["sk-upstream"]
+    models: [text-embedding-3-small]
+cache:
+  enabled: true
+  embedding:
+    enabled: true
+`)
+
+	embed := func(inputs ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"model": "text-embedding-3-small", "input": inputs})
+
+		return doRequest(server, http.MethodPost, "/v1/embeddings", string(body))
+	}
+
+	w := embed("a", "bb")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache"))
+
+	w = embed("bb", "hello world", "a", "hello world")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "PARTIAL", w.Header().Get("X-Cache"))
+	assert.Equal(t, `[2,11,1,11]`, gjson.Get(w.Body.String(), "data.#.embedding.0").Raw)
+	assert.Equal(t, `[0,1,2,3]`, gjson.Get(w.Body.String(), "data.#.index").Raw)
+	// Only the tokens of the input sent to the upstream are counted, by the tokenizer of the model
+	assert.Equal(t, int64(2), gjson.Get(w.Body.String(), "usage.prompt_tokens").Int())
+	assert.Equal(t, "", w.Header().Get("X-Usage-Estimated"))
+
+	w = embed("hello world", "a")
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache"))
+	assert.Equal(t, int64(0), gjson.Get(w.Body.String(), "usage.total_tokens").Int())
+
+	// Only the missed inputs are sent to the upstream, and the identical inputs only once
+	assert.Equal(t, [][]string{{"a", "bb"}, {"hello world"}}, requested)
+}
@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/cache"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
+	"github.com/mylxsw/openai-dispatcher/internal/transform"
+	"github.com/mylxsw/openai-dispatcher/internal/upstream"
+	"github.com/mylxsw/openai-dispatcher/pkg/expr"
+	"github.com/tidwall/gjson"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ExplainRequest A sample request to explain the routing decision for
+type ExplainRequest struct {
+	// Model The model name, read from the body if empty
+	Model string `json:"model,omitempty"`
+	// Endpoint The request path, such as /v1/chat/completions
+	Endpoint string `json:"endpoint,omitempty"`
+	// ClientKey The key used by the caller
+	ClientKey string `json:"client_key,omitempty"`
+	// Headers The request headers
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body The request body
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Explanation The full routing decision of a request
+type Explanation struct {
+	Endpoint   string            `json:"endpoint"`
+	Model      string            `json:"model,omitempty"`
+	Stream     bool              `json:"stream"`
+	ClientKey  string            `json:"client_key,omitempty"`
+	Authorized bool              `json:"authorized"`
+	Policy     string            `json:"policy"`
+	Route      string            `json:"route"`
+	Reason     string            `json:"reason"`
+	Moderation ExplainModeration `json:"moderation"`
+	// Requires The capabilities required by the request, the upstreams whose model lacks them are skipped
+	Requires  []registry.Capability `json:"requires,omitempty"`
+	Upstreams []ExplainUpstream     `json:"upstreams"`
+	Notes     []string              `json:"notes,omitempty"`
+}
+
+// ExplainModeration Whether the request will be checked by moderation
+type ExplainModeration struct {
+	Applicable bool   `json:"applicable"`
+	Reason     string `json:"reason"`
+}
+
+// ExplainUpstream An upstream candidate of the request, in the order of selection priority
+type ExplainUpstream struct {
+	Name            string   `json:"name"`
+	Rule            string   `json:"rule,omitempty"`
+	Source          string   `json:"source,omitempty"`
+	Type            string   `json:"type"`
+	MatchedBy       string   `json:"matched_by"`
+	RewrittenModel  string   `json:"rewritten_model,omitempty"`
+	Backup          bool     `json:"backup"`
+	Weight          int      `json:"weight,omitempty"`
+	Available       bool     `json:"available"`
+	Transformations []string `json:"transformations,omitempty"`
+	// Missing The required capabilities the model of the upstream lacks
+	Missing []registry.Capability `json:"missing,omitempty"`
+}
+
+// Explain Explain the routing decision of the request with the current configuration
+func (s *Server) Explain(req ExplainRequest) *Explanation {
+	return s.state.Load().explain(req)
+}
+
+// Explain Explain the routing decision of the request with the given configuration, the providers and the moderators
+// are not created
+func Explain(conf *config.Config, req ExplainRequest) (*Explanation, error) {
+	st, err := newRoutingState(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return st.explain(req), nil
+}
+
+// explain Explain the routing decision, it follows the same logic as Dispatch, but no handler is called
+func (st *state) explain(req ExplainRequest) *Explanation {
+	endpoint := strings.TrimSuffix(ternary.If(req.Endpoint == "", string(base.EndpointChatCompletion), req.Endpoint), "/")
+	headers := http.Header{}
+	for k, v := range req.Headers {
+		headers.Set(k, v)
+	}
+
+	res := &Explanation{
+		Endpoint:  endpoint,
+		Model:     ternary.If(req.Model == "", gjson.GetBytes(req.Body, "model").String(), req.Model),
+		Stream:    gjson.GetBytes(req.Body, "stream").Bool(),
+		Policy:    string(ternary.If(st.conf.Policy == "", upstream.RoundRobinPolicy, upstream.Policy(st.conf.Policy))),
+		Upstreams: make([]ExplainUpstream, 0),
+	}
+
+	key := st.conf.ClientKey(strings.ToLower(req.ClientKey))
+	if key != nil {
+		res.ClientKey = key.Name
+		res.Authorized = true
+	} else if req.ClientKey != "" {
+		res.Notes = append(res.Notes, "the client key is not configured, the request will be rejected with 401")
+	}
+
+	if key != nil && res.Model != "" && !key.AllowModel(res.Model) {
+		res.Notes = append(res.Notes, fmt.Sprintf("the client key is not allowed to use %s, the request will be rejected with 403", res.Model))
+	}
+
+	res.Moderation = st.explainModeration(key, endpoint, headers, req.Body)
+	if base.Endpoint(endpoint) == base.EndpointChatCompletion {
+		res.Requires = registry.Required(req.Body)
+	}
+
+	if base.Endpoint(endpoint) == base.EndpointChatCompletion && res.Model != "" {
+		if _, trimmed, err := st.trimContext(key, res.Model, req.Body); err == nil && trimmed != nil {
+			res.Notes = append(res.Notes, fmt.Sprintf("the conversation exceeds the context limit, it will be trimmed: %s", trimmed))
+		}
+	}
+
+	if st.conf.Cache.Enabled && res.Model != "" && array.In(base.Endpoint(endpoint), st.conf.Cache.Endpoints) {
+		if ttl := cache.TTL(st.conf.Cache, base.Endpoint(endpoint), res.Model); ttl > 0 {
+			res.Notes = append(res.Notes, fmt.Sprintf("deterministic requests are served from the response cache, the responses are cached for %s", ttl))
+
+			if st.conf.Cache.Semantic.Enabled && base.Endpoint(endpoint) == base.EndpointChatCompletion {
+				res.Notes = append(res.Notes, fmt.Sprintf(
+					"the last user message is embedded with %s, the answer of a similar message (similarity >= %.2f) of the same client key is reused",
+					st.conf.Cache.Semantic.Model, st.conf.Cache.Semantic.Threshold,
+				))
+			}
+
+			if st.conf.Cache.Embedding.Enabled && base.Endpoint(endpoint) == base.EndpointEmbedding {
+				note := "the embedding of each input is cached, only the missed inputs are sent to the upstream"
+				if st.conf.Cache.Embedding.BatchWindow > 0 {
+					note += fmt.Sprintf(", concurrent requests within %s are coalesced into one upstream request", st.conf.Cache.Embedding.BatchWindow)
+				}
+
+				res.Notes = append(res.Notes, note)
+			}
+		}
+	}
+
+	switch {
+	case base.EndpointHasModel(endpoint):
+		if res.Model == "" {
+			res.Route = "error"
+			res.Reason = "model is required for this endpoint, the request will be rejected with 400"
+			return res
+		}
+
+		if ups, ok := st.upstreams[res.Model]; ok && ups.Len() > 0 {
+			res.Route = "static"
+			res.Reason = fmt.Sprintf("model %s is listed in the models or rewrite of the rules", res.Model)
+			res.Upstreams = st.explainUpstreams(ups.All(), res, func(rule config.Rule) string {
+				return ternary.If(array.In(res.Model, rule.Models), "models", "rewrite")
+			})
+		} else if matched := st.matchExprRules(res.Model); len(matched) > 0 {
+			res.Route = "expr"
+			res.Reason = fmt.Sprintf("model %s is matched by the expr of %d rule(s)", res.Model, len(matched))
+
+			candidates := make([]*upstream.Upstream, 0)
+			for _, rule := range matched {
+				for serverIndex := range rule.Servers {
+					for keyIndex := range rule.Keys {
+						candidates = append(candidates, &upstream.Upstream{Rule: rule, ServerIndex: serverIndex, KeyIndex: keyIndex})
+					}
+				}
+			}
+
+			res.Upstreams = st.explainUpstreams(candidates, res, func(rule config.Rule) string {
+				return "expr: " + rule.Expr.Match
+			})
+		} else {
+			res.Route = "default"
+			res.Reason = fmt.Sprintf("model %s is not matched by any rule, the default rules are used", res.Model)
+			res.Upstreams = st.explainUpstreams(st.defaultUpstreams.All(), res, func(rule config.Rule) string { return "default" })
+		}
+	case endpoint == string(base.EndpointTokenize):
+		res.Route = "tokenize"
+		res.Reason = "the tokens are counted by the dispatcher with the tokenizer of the model"
+		return res
+	case isModelsPath(http.MethodGet, endpoint):
+		res.Route = "models"
+		res.Reason = "the model list is served by the dispatcher"
+		if key != nil && len(key.Models) > 0 {
+			res.Notes = append(res.Notes, fmt.Sprintf("only the models matching %s are listed for the client key", strings.Join(key.Models, ", ")))
+		}
+
+		if st.conf.ModelList.Upstream {
+			res.Notes = append(res.Notes, fmt.Sprintf("the models listed by the openai upstreams are added, they are refreshed every %s", st.conf.ModelList.RefreshInterval))
+		}
+
+		return res
+	default:
+		res.Route = "default"
+		res.Reason = "the endpoint has no model, the default rules are used"
+		res.Upstreams = st.explainUpstreams(st.defaultUpstreams.All(), res, func(rule config.Rule) string { return "default" })
+	}
+
+	if len(res.Upstreams) == 0 {
+		res.Notes = append(res.Notes, "no upstream is available, the request will be rejected with 400")
+	} else if len(res.Requires) > 0 && len(array.Filter(res.Upstreams, func(up ExplainUpstream, _ int) bool { return len(up.Missing) == 0 })) == 0 {
+		res.Notes = append(res.Notes, "no upstream supports the capabilities required by the request, the request will be rejected with 400")
+	}
+
+	return res
+}
+
+func (st *state) explainModeration(key *config.ClientKey, endpoint string, headers http.Header, body []byte) ExplainModeration {
+	if !st.conf.Moderation.Enabled {
+		return ExplainModeration{Reason: "moderation is disabled"}
+	}
+
+	mp := st.moderationPolicy(key)
+	if !mp.enabled {
+		return ExplainModeration{Reason: "moderation is disabled for the client key"}
+	}
+
+	if !base.EndpointNeedModeration(endpoint, st.conf.Moderation.Endpoints) {
+		return ExplainModeration{Reason: "the endpoint does not need moderation"}
+	}
+
+	if mp.canIgnore && strings.ToLower(headers.Get("X-Ignore-Moderation")) == "true" {
+		return ExplainModeration{Reason: "ignored by the X-Ignore-Moderation header"}
+	}
+
+	var output string
+	if st.conf.Moderation.Output.Enabled && base.Endpoint(strings.TrimSuffix(endpoint, "/")) == base.EndpointChatCompletion {
+		output = fmt.Sprintf(", the output is checked in windows of %d characters", st.conf.Moderation.Output.WindowSize)
+	}
+
+	messages := gjson.GetBytes(body, "messages").Array()
+	if len(messages) > 0 && strings.ToLower(messages[len(messages)-1].Get("role").String()) == "robot" {
+		return ExplainModeration{Applicable: output != "", Reason: "the input is not checked, the last message is the result of a tool call" + output}
+	}
+
+	thresholds := make([]string, 0, len(mp.policy.Thresholds))
+	for _, category := range mp.policy.Categories {
+		if threshold, ok := mp.policy.Thresholds[category]; ok {
+			thresholds = append(thresholds, fmt.Sprintf("%s >= %.2f", category, threshold))
+		}
+	}
+
+	return ExplainModeration{
+		Applicable: true,
+		Reason: fmt.Sprintf(
+			"%s by %s, categories %s are blocked when the score is above %.2f%s%s%s%s",
+			ternary.If(base.EndpointModerateOutput(endpoint), "the transcribed text is checked", "checked"),
+			strings.Join(st.conf.Moderation.Engines, " -> "),
+			strings.Join(mp.policy.Categories, ", "),
+			mp.policy.ScoreThreshold,
+			ternary.If(len(thresholds) > 0, " ("+strings.Join(thresholds, ", ")+")", ""),
+			ternary.If(mp.canIgnore, ", the client key can bypass it with the X-Ignore-Moderation header", ""),
+			ternary.If(st.conf.Moderation.FailMode == config.ModerationFailClosed, ", the request is rejected if moderation fails", ""),
+			output,
+		),
+	}
+}
+
+// matchExprRules Return the rules whose expr matches the model
+func (st *state) matchExprRules(model string) []config.Rule {
+	return array.Filter(st.exprRules, func(rule config.Rule, _ int) bool {
+		vm, err := expr.NewBoolVM(rule.Expr.Match)
+		if err != nil {
+			return false
+		}
+
+		matched, err := vm.Run(expr.Data{Model: model})
+		return err == nil && matched
+	})
+}
+
+// explainUpstreams Describe the candidates, primary upstreams first, then the backup upstreams
+func (st *state) explainUpstreams(candidates []*upstream.Upstream, res *Explanation, matchedBy func(rule config.Rule) string) []ExplainUpstream {
+	primary := array.Filter(candidates, func(up *upstream.Upstream, _ int) bool { return !up.Rule.Backup })
+	backup := array.Filter(candidates, func(up *upstream.Upstream, _ int) bool { return up.Rule.Backup })
+	if len(primary) == 0 {
+		res.Notes = append(res.Notes, "all upstreams are backup, they are used as primary")
+	}
+
+	return array.Map(append(primary, backup...), func(up *upstream.Upstream, _ int) ExplainUpstream {
+		item := ExplainUpstream{
+			Name:      up.Name(),
+			Rule:      up.Rule.Name,
+			Source:    up.Rule.Source,
+			Type:      string(up.Rule.Type),
+			MatchedBy: matchedBy(up.Rule),
+			Backup:    up.Rule.Backup,
+			Available: up.Available(),
+		}
+
+		if res.Policy == string(upstream.WeightPolicy) {
+			item.Weight = ternary.If(up.Rule.Weight == 0, 1, up.Rule.Weight)
+		}
+
+		if res.Model != "" {
+			item.RewrittenModel = up.Rule.ModelReplacer(res.Model)
+		}
+
+		item.Transformations = explainTransformations(st.registry, up.Rule, res.Endpoint, item.RewrittenModel, res.Stream)
+		if item.RewrittenModel != "" {
+			if missing := st.registry.Missing(item.RewrittenModel, res.Requires); len(missing) > 0 {
+				item.Missing = missing
+			}
+		}
+
+		return item
+	})
+}
+
+// explainTransformations Describe how the request is transformed by the provider of the rule
+func explainTransformations(reg *registry.Registry, rule config.Rule, endpoint string, rewrittenModel string, stream bool) []string {
+	res := make([]string, 0)
+
+	switch rule.Type {
+	case base.ChannelTypeCoze, base.ChannelTypeAnthropic:
+		if base.Endpoint(endpoint) != base.EndpointChatCompletion {
+			return append(res, fmt.Sprintf("%s only supports %s, this upstream will fail and the next one is tried", rule.Type, base.EndpointChatCompletion))
+		}
+
+		res = append(res, fmt.Sprintf("the request is converted to the %s API, and the response is converted back to the OpenAI format", rule.Type))
+		if rule.Type == base.ChannelTypeCoze {
+			res = append(res, fmt.Sprintf("the model %s is used as the coze bot_id", rewrittenModel))
+		}
+	}
+
+	return append(res, transform.New(rule.Transforms, reg).Explain(base.Endpoint(endpoint), rewrittenModel, stream)...)
+}
+
+// Print the explanation in a human-readable format
+func (e *Explanation) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Endpoint   : %s\n", e.Endpoint)
+	_, _ = fmt.Fprintf(w, "Model      : %s\n", ternary.If(e.Model == "", "-", e.Model))
+	_, _ = fmt.Fprintf(w, "Stream     : %v\n", e.Stream)
+	_, _ = fmt.Fprintf(w, "Client Key : %s\n", ternary.If(e.Authorized, e.ClientKey, "(unauthorized)"))
+	_, _ = fmt.Fprintf(w, "Policy     : %s\n", e.Policy)
+	_, _ = fmt.Fprintf(w, "Route      : %s, %s\n", e.Route, e.Reason)
+	_, _ = fmt.Fprintf(w, "Moderation : %s, %s\n", ternary.If(e.Moderation.Applicable, "yes", "no"), e.Moderation.Reason)
+
+	_, _ = fmt.Fprintf(w, "\nUpstreams (in order of priority):\n")
+	for i, up := range e.Upstreams {
+		_, _ = fmt.Fprintf(w, "  %d. %s %s\n", i+1, ternary.If(up.Backup, "[backup]", "[main]  "), up.Name)
+		_, _ = fmt.Fprintf(w, "       type: %s, matched by: %s, available: %v\n", up.Type, up.MatchedBy, up.Available)
+		if up.Source != "" {
+			_, _ = fmt.Fprintf(w, "       defined in: %s\n", up.Source)
+		}
+		if up.RewrittenModel != "" {
+			_, _ = fmt.Fprintf(w, "       model: %s -> %s\n", e.Model, up.RewrittenModel)
+		}
+		if up.Weight > 0 {
+			_, _ = fmt.Fprintf(w, "       weight: %d\n", up.Weight)
+		}
+		for _, t := range up.Transformations {
+			_, _ = fmt.Fprintf(w, "       transform: %s\n", t)
+		}
+	}
+
+	for _, note := range e.Notes {
+		_, _ = fmt.Fprintf(w, "\nNote: %s\n", note)
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	dict := filepath.Join(dir, "dict.txt")
+	assert.NoError(t, os.WriteFile(dict, []byte("forbidden\n"), 0644))
+
+	conf, err := config.LoadConfig(writeTestConfig(t, `keys:
+  - name: alice
+    key: "client-key-123456"
+    models: ["gpt-*", "coze-*"]
+rules:
+  - name: openai
+    servers: ["https://api.openai.com", "https://backup.openai.com"]
+    keys: ["sk-upstream"]
+    models: [gpt-4o, gpt-4]
+    rewrite:
+      - src: gpt-4
+        dst: gpt-4o
+  - name: coze
+    type: coze
+    servers: ["https://api.coze.com"]
+    keys: ["pat-upstream"]
+    expr:
+      match: Model matches "^coze-"
+      replace: trimPrefix(Model, "coze-")
+  - name: fallback
+    servers: ["https://fallback.example.com"]
+    keys: ["sk-fallback"]
+    default: true
+    backup: true
+moderation:
+  enabled: true
+  engines: [local]
+  local:
+    - category: custom
+      dictionaries: ["`+dict+`"]
+`))
+	assert.NoError(t, err)
+
+	// The dictionary is only loaded by the moderator, explaining the routing does not need it
+	assert.NoError(t, os.Remove(dict))
+	_, err = newState(conf)
+	assert.True(t, err != nil)
+
+	st, err := newRoutingState(conf)
+	assert.NoError(t, err)
+	assert.True(t, st.moderation == nil)
+	for _, ups := range st.upstreams {
+		for _, up := range ups.All() {
+			assert.True(t, up.Handler == nil)
+		}
+	}
+
+	res, err := Explain(conf, ExplainRequest{Body: []byte(`{"model":"gpt-4","messages":[{"role":"user","content":"hello"}]}`), ClientKey: "client-key-123456"})
+	assert.NoError(t, err)
+	assert.Equal(t, "static", res.Route)
+	assert.Equal(t, "alice", res.ClientKey)
+	assert.True(t, res.Authorized)
+	assert.True(t, res.Moderation.Applicable)
+	assert.Equal(t, 2, len(res.Upstreams))
+	assert.Equal(t, "models", res.Upstreams[0].MatchedBy)
+	assert.Equal(t, "gpt-4o", res.Upstreams[0].RewrittenModel)
+
+	res, err = Explain(conf, ExplainRequest{Model: "coze-bot"})
+	assert.NoError(t, err)
+	assert.Equal(t, "expr", res.Route)
+	assert.Equal(t, 1, len(res.Upstreams))
+	assert.Equal(t, "bot", res.Upstreams[0].RewrittenModel)
+	assert.True(t, strings.HasPrefix(res.Upstreams[0].MatchedBy, "expr: "))
+	assert.False(t, res.Authorized)
+
+	// The backup upstreams are used as primary when there is no other upstream
+	res, err = Explain(conf, ExplainRequest{Model: "claude-3", ClientKey: "client-key-123456"})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", res.Route)
+	assert.Equal(t, 1, len(res.Upstreams))
+	assert.True(t, res.Upstreams[0].Backup)
+	assert.Equal(t, 2, len(res.Notes))
+
+	res, err = Explain(conf, ExplainRequest{Endpoint: "/v1/embeddings"})
+	assert.NoError(t, err)
+	assert.Equal(t, "error", res.Route)
+
+	res, err = Explain(conf, ExplainRequest{Endpoint: "/v1/models", ClientKey: "unknown-key"})
+	assert.NoError(t, err)
+	assert.Equal(t, "models", res.Route)
+	assert.False(t, res.Authorized)
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/must"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
+	"golang.org/x/net/proxy"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultModelCreated The creation time of the models not in the registry (2023-01-01 UTC),
+// it is fixed so that the model list does not change between requests
+const defaultModelCreated int64 = 1672531200
+
+// ModelObject A model listed by /v1/models
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// Capabilities The capabilities of the model in the registry, only included when model-list.capabilities is set
+	Capabilities *config.ModelInfo `json:"capabilities,omitempty"`
+}
+
+type OpenAIModelResponse struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+// newModelObject Create the model object of the model, the creation time and the owner are read from the registry,
+// the given ones are used for the models not in the registry
+func newModelObject(reg *registry.Registry, conf config.ModelList, id string, created int64, ownedBy string) ModelObject {
+	model := ModelObject{ID: id, Object: "model", Created: created, OwnedBy: ownedBy}
+
+	info, ok := reg.Lookup(id)
+	if !ok {
+		return model
+	}
+
+	model.Created = ternary.If(info.Created > 0, info.Created, model.Created)
+	model.OwnedBy = ternary.If(info.OwnedBy != "", info.OwnedBy, model.OwnedBy)
+	if conf.Capabilities {
+		model.Capabilities = &info
+	}
+
+	return model
+}
+
+// isModelsPath Whether the request is served by the model list of the dispatcher, the model object
+// is only served for GET requests, other methods such as deleting a fine-tuned model are sent to the upstreams
+func isModelsPath(method string, path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return path == "/v1/models" || (method == http.MethodGet && strings.HasPrefix(path, "/v1/models/"))
+}
+
+// serveModels Serve /v1/models and /v1/models/{id} with the models the client key can use
+func (s *Server) serveModels(ctx context.Context, st *state, clientKey *config.ClientKey, w http.ResponseWriter, r *http.Request) error {
+	models := st.listModels(ctx, clientKey)
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/v1/models" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(must.Must(json.Marshal(OpenAIModelResponse{Object: "list", Data: models})))
+		return nil
+	}
+
+	id := strings.TrimPrefix(path, "/v1/models/")
+	w.Header().Set("Content-Type", "application/json")
+	for _, model := range models {
+		if model.ID == id {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(must.Must(json.Marshal(model)))
+			return nil
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write(must.Must(json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": fmt.Sprintf("The model '%s' does not exist or you do not have access to it.", id),
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    "model_not_found",
+		},
+	})))
+	return nil
+}
+
+// listModels The models the client key can use in the order of the id, the models listed by the upstreams
+// are added when model-list.upstream is set
+func (st *state) listModels(ctx context.Context, clientKey *config.ClientKey) []ModelObject {
+	models := st.supportModels
+	if st.upstreamModels != nil {
+		models = append(append([]ModelObject{}, models...), st.upstreamModels.list(ctx, st)...)
+	}
+
+	seen := make(map[string]bool)
+	res := make([]ModelObject, 0, len(models))
+	for _, model := range models {
+		if seen[model.ID] || (clientKey != nil && !clientKey.AllowModel(model.ID)) {
+			continue
+		}
+
+		seen[model.ID] = true
+		res = append(res, model)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// upstreamModels The models listed by the upstreams, they are fetched again when they are older than the refresh interval
+type upstreamModels struct {
+	lock      sync.Mutex
+	models    []ModelObject
+	fetchedAt time.Time
+}
+
+// list Return the models listed by the upstreams, the requests wait for the fetching in progress
+func (u *upstreamModels) list(ctx context.Context, st *state) []ModelObject {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if !u.fetchedAt.IsZero() && time.Since(u.fetchedAt) < st.conf.ModelList.RefreshInterval {
+		return u.models
+	}
+
+	// The models are shared by all the clients, so they are not fetched with the context of the request,
+	// otherwise a disconnected client cancels the fetching for everyone
+	models, ok := st.fetchUpstreamModels(context.WithoutCancel(ctx))
+	if !ok {
+		// The models fetched last time are kept, and fetched again by the next request
+		return u.models
+	}
+
+	// The failed upstreams are skipped until the next refresh, so that the clients are not blocked by them each time
+	u.models, u.fetchedAt = models, time.Now()
+
+	return u.models
+}
+
+// fetchUpstreamModels Fetch the models of the openai upstreams concurrently, each server and key is requested once.
+// ok is false when every upstream failed
+func (st *state) fetchUpstreamModels(ctx context.Context) (models []ModelObject, ok bool) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	var failed int
+	models = make([]ModelObject, 0)
+	requested := make(map[string]bool)
+	for _, rule := range st.conf.Rules {
+		if !array.In(rule.Type, []base.ChannelType{"", base.ChannelTypeOpenAI}) {
+			continue
+		}
+
+		for _, server := range rule.Servers {
+			for _, key := range rule.Keys {
+				if requested[server+"|"+key] {
+					continue
+				}
+				requested[server+"|"+key] = true
+
+				wg.Add(1)
+				go func(rule config.Rule, server, key string) {
+					defer wg.Done()
+
+					listed, err := fetchModels(ctx, server, key, ternary.If(rule.Proxy, st.dialer, nil))
+
+					lock.Lock()
+					defer lock.Unlock()
+
+					if err != nil {
+						failed++
+						log.F(log.M{"request_id": base.RequestID(ctx), "rule": rule.Name, "server": server}).Warningf("fetch upstream models failed: %v", err)
+						return
+					}
+
+					for _, model := range listed {
+						models = append(models, newModelObject(
+							st.registry, st.conf.ModelList, model.ID,
+							ternary.If(model.Created > 0, model.Created, defaultModelCreated),
+							ternary.If(model.OwnedBy != "", model.OwnedBy, "system"),
+						))
+					}
+				}(rule, server, key)
+			}
+		}
+	}
+
+	wg.Wait()
+	return models, len(requested) == 0 || failed < len(requested)
+}
+
+// fetchModels Request the /v1/models of the upstream
+func fetchModels(ctx context.Context, server, key string, dialer proxy.Dialer) ([]ModelObject, error) {
+	client := &http.Client{}
+	if dialer != nil {
+		client.Transport = &http.Transport{Dial: dialer.Dial}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(server, "/")+"/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var res OpenAIModelResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("decode response failed: %w", err)
+	}
+
+	return res.Data, nil
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeModels(t *testing.T) {
+	var listed atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listed.Add(1)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"ft:gpt-4o-mini:acme","object":"model","created":1,"owned_by":"acme"},{"id":"gpt-4o","object":"model","created":2,"owned_by":"x"}]}`))
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t, `keys:
+  - "client-key-123456"
+  - key: "limited-key-123456"
+    models: ["gpt-4o*"]
+rules:
+  - servers: ["`+upstream.URL+`"]
+    keys: ["sk-upstream"]
+    models: [gpt-4o, my-model]
+model-list:
+  capabilities: true
+  upstream: true
+`)
+
+	request := func(method, path, key, body string) *httptest.ResponseRecorder {
+		r := newTestRequest(method, path, body)
+		r.Header.Set("Authorization", "Bearer "+key)
+		return serve(server, r)
+	}
+
+	w := request(http.MethodGet, "/v1/models", "client-key-123456", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `["ft:gpt-4o-mini:acme","gpt-4o","my-model"]`, gjson.Get(w.Body.String(), "data.#.id").Raw)
+
+	// The creation time and the owner are read from the registry, then the upstream
+	assert.Equal(t, `[1,1715367049,1672531200]`, gjson.Get(w.Body.String(), "data.#.created").Raw)
+	assert.Equal(t, `["acme","system","system"]`, gjson.Get(w.Body.String(), "data.#.owned_by").Raw)
+	assert.Equal(t, int64(16384), gjson.Get(w.Body.String(), "data.1.capabilities.max_output").Int())
+
+	w = request(http.MethodGet, "/v1/models", "limited-key-123456", "")
+	assert.Equal(t, `["gpt-4o"]`, gjson.Get(w.Body.String(), "data.#.id").Raw)
+
+	// The upstream models are reused until the refresh interval elapses
+	assert.Equal(t, int32(1), listed.Load())
+
+	w = request(http.MethodGet, "/v1/models/gpt-4o", "limited-key-123456", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gpt-4o", gjson.Get(w.Body.String(), "id").String())
+
+	w = request(http.MethodGet, "/v1/models/my-model", "limited-key-123456", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "model_not_found", gjson.Get(w.Body.String(), "error.code").String())
+
+	w = request(http.MethodPost, "/v1/chat/completions", "limited-key-123456", `{"model":"my-model","messages":[]}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestUpstreamModels(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"ft:gpt-4o-mini:acme","object":"model"}]}`))
+	}))
+	defer upstream.Close()
+
+	st, err := newState(&config.Config{
+		Rules:     config.Rules{{Servers: []string{upstream.URL}, Keys: []string{"sk-upstream"}, Models: []string{"gpt-4o"}}},
+		ModelList: config.ModelList{Upstream: true, RefreshInterval: time.Hour},
+	})
+	assert.NoError(t, err)
+
+	// The failed fetching is not cached, the models are fetched again by the next request
+	assert.Equal(t, 0, len(st.upstreamModels.list(context.Background(), st)))
+	assert.True(t, st.upstreamModels.fetchedAt.IsZero())
+
+	// The models are fetched even if the client has gone
+	failing.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, 1, len(st.upstreamModels.list(ctx, st)))
+	assert.False(t, st.upstreamModels.fetchedAt.IsZero())
+}
@@ -0,0 +1,121 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/asteria/level"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/asteria/writer"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxSnippetLength The maximum number of characters of the offending input written to the audit log
+const maxSnippetLength = 200
+
+const (
+	AuditSourceInput  = "input"
+	AuditSourceOutput = "output"
+
+	AuditActionFlagged = "flagged"
+	AuditActionBlocked = "blocked"
+)
+
+// AuditEntry A flagged or blocked moderation decision
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	// Source The content checked: input or output
+	Source string `json:"source"`
+	// Action The decision: flagged (not blocked) or blocked
+	Action string `json:"action"`
+	// Categories The flagged categories
+	Categories []string `json:"categories"`
+	// Blocked The categories which cause the request to be blocked
+	Blocked []string `json:"blocked,omitempty"`
+	// Scores The scores of the flagged categories
+	Scores map[string]float64 `json:"scores"`
+	// Snippet The beginning of the offending input
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// AuditLogger Write the moderation decisions to daily rotating JSONL files
+type AuditLogger struct {
+	writer *writer.RotatingFileWriter
+}
+
+// NewAuditLogger create a new audit logger, the log files are written to the dir directory
+func NewAuditLogger(ctx context.Context, dir string) (*AuditLogger, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create moderation audit log directory failed: %w", err)
+	}
+
+	return &AuditLogger{
+		writer: writer.NewDefaultRotatingFileWriter(ctx, func(le level.Level, module string) string {
+			return filepath.Join(dir, fmt.Sprintf("moderation.%s.jsonl", time.Now().Format("20060102")))
+		}),
+	}, nil
+}
+
+// Write an audit entry
+func (l *AuditLogger) Write(entry AuditEntry) {
+	if l == nil {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.F(log.M{"request_id": entry.RequestID}).Errorf("marshal moderation audit log failed: %v", err)
+		return
+	}
+
+	if err := l.writer.Write(level.Info, "moderation", string(data)); err != nil {
+		log.F(log.M{"request_id": entry.RequestID}).Errorf("write moderation audit log failed: %v", err)
+	}
+}
+
+// Close the log files opened
+func (l *AuditLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.writer.Close()
+}
+
+// Offending Return the scores of the flagged categories, and the input of the first flagged result
+func (p Policy) Offending(req Request, resp Response) (map[string]float64, string) {
+	scores := make(map[string]float64)
+	var snippet string
+
+	for i, result := range resp.Results {
+		flagged := false
+		for category, score := range result.CategoryScores {
+			if score >= p.Threshold(category) {
+				flagged = true
+				if score > scores[category] {
+					scores[category] = score
+				}
+			}
+		}
+
+		if flagged && snippet == "" && i < len(req.Input) {
+			input := req.Input[i]
+			snippet = input.Text
+			if input.ImageURL != nil {
+				snippet = input.ImageURL.URL
+			}
+		}
+	}
+
+	if runes := []rune(snippet); len(runes) > maxSnippetLength {
+		snippet = string(runes[:maxSnippetLength]) + "..."
+	}
+
+	return scores, snippet
+}
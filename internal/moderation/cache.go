@@ -0,0 +1,118 @@
+package moderation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/lru"
+	"sync"
+	"time"
+)
+
+// Cache Cache the moderation result of each input, only the inputs not cached are sent to the moderator,
+// so the earlier messages of a conversation are not checked again on every turn
+type Cache struct {
+	moderator Moderator
+	results   *lru.Cache[string, Result]
+}
+
+// NewCache Create a cache holding the results of at most size inputs for ttl
+func NewCache(moderator Moderator, size int, ttl time.Duration) *Cache {
+	return &Cache{moderator: moderator, results: lru.New[string, Result](size, ttl)}
+}
+
+func (c *Cache) Moderation(ctx context.Context, req Request) (*Response, error) {
+	keys := make([]string, len(req.Input))
+	results := make([]Result, len(req.Input))
+	missed := make([]int, 0, len(req.Input))
+
+	for i, input := range req.Input {
+		keys[i] = inputHash(req.Model, input)
+		if result, ok := c.results.Get(keys[i]); ok {
+			results[i] = result
+		} else {
+			missed = append(missed, i)
+		}
+	}
+
+	if len(missed) == 0 {
+		return &Response{Model: req.Model, Results: results}, nil
+	}
+
+	// The missed texts are checked by one request, the result of each text is at its index. omni-moderation returns
+	// one combined result for an array of multimodal inputs, so each image is checked by its own request, concurrently
+	var texts, images []int
+	for _, i := range missed {
+		if req.Input[i].Type == "image_url" {
+			images = append(images, i)
+		} else {
+			texts = append(texts, i)
+		}
+	}
+
+	batches := make([][]int, 0, len(images)+1)
+	if len(texts) > 0 {
+		batches = append(batches, texts)
+	}
+	for _, i := range images {
+		batches = append(batches, []int{i})
+	}
+
+	responses := make([]*Response, len(batches))
+	errs := make([]error, len(batches))
+
+	var wg sync.WaitGroup
+	for b, batch := range batches {
+		wg.Add(1)
+		go func(b int, batch []int) {
+			defer wg.Done()
+			responses[b], errs[b] = c.moderate(ctx, req.Model, req.Input, batch)
+		}(b, batch)
+	}
+	wg.Wait()
+
+	var id, model string
+	for b, batch := range batches {
+		if errs[b] != nil {
+			return nil, errs[b]
+		}
+
+		id, model = responses[b].ID, responses[b].Model
+		for j, i := range batch {
+			results[i] = responses[b].Results[j]
+			c.results.Set(keys[i], responses[b].Results[j])
+		}
+	}
+
+	return &Response{ID: id, Model: model, Results: results}, nil
+}
+
+// moderate Check the inputs at the indexes by one request, the response has exactly one result for each of them
+func (c *Cache) moderate(ctx context.Context, model string, inputs []Input, indexes []int) (*Response, error) {
+	resp, err := c.moderator.Moderation(ctx, Request{Model: model, Input: array.Map(indexes, func(i int, _ int) Input { return inputs[i] })})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Results) != len(indexes) {
+		log.F(log.M{"request_id": base.RequestID(ctx), "inputs": len(indexes), "results": len(resp.Results)}).Warningf("unexpected number of moderation results")
+		return nil, fmt.Errorf("unexpected number of moderation results: %d, expected %d", len(resp.Results), len(indexes))
+	}
+
+	return resp, nil
+}
+
+// inputHash Return the cache key of the input
+func inputHash(model string, input Input) string {
+	h := sha256.New()
+	h.Write([]byte(model + "\x00" + input.Type + "\x00" + input.Text + "\x00"))
+	if input.ImageURL != nil {
+		h.Write([]byte(input.ImageURL.URL))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
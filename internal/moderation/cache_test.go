@@ -0,0 +1,124 @@
+package moderation
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoModerator Flag the inputs containing "bad", and record the inputs received. Like omni-moderation,
+// one combined result is returned for the multimodal inputs
+type echoModerator struct {
+	lock   sync.Mutex
+	inputs [][]Input
+	delay  time.Duration
+
+	// active, peak The number of requests in progress, and the most of them at the same time
+	active, peak int
+}
+
+func (m *echoModerator) Moderation(_ context.Context, req Request) (*Response, error) {
+	m.lock.Lock()
+	m.inputs = append(m.inputs, req.Input)
+	m.active++
+	m.peak = max(m.peak, m.active)
+	m.lock.Unlock()
+
+	time.Sleep(m.delay)
+
+	m.lock.Lock()
+	m.active--
+	m.lock.Unlock()
+
+	resp := Response{Model: req.Model}
+	if len(req.Input) > 1 && array.In("image_url", array.Map(req.Input, func(input Input, _ int) string { return input.Type })) {
+		bad := len(array.Filter(req.Input, func(input Input, _ int) bool { return strings.Contains(input.Text, "bad") })) > 0
+		resp.Results = append(resp.Results, Result{Flagged: bad, CategoryScores: map[string]float64{"hate": map[bool]float64{true: 1, false: 0}[bad]}})
+		return &resp, nil
+	}
+
+	for _, input := range req.Input {
+		bad := strings.Contains(input.Text, "bad")
+		resp.Results = append(resp.Results, Result{Flagged: bad, CategoryScores: map[string]float64{"hate": map[bool]float64{true: 1, false: 0}[bad]}})
+	}
+
+	return &resp, nil
+}
+
+func TestCache_Moderation(t *testing.T) {
+	m := &echoModerator{}
+	c := NewCache(m, 100, time.Minute)
+
+	// The missed texts are checked by one request
+	resp, err := c.Moderation(context.Background(), Request{Model: "m", Input: []Input{{Type: "text", Text: "hello"}, {Type: "text", Text: "bad"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.Results))
+	assert.Equal(t, 1, len(m.inputs))
+
+	// Only the new messages are sent to the moderator, the results keep the order of the inputs
+	resp, err = c.Moderation(context.Background(), Request{Model: "m", Input: []Input{{Type: "text", Text: "fine"}, {Type: "text", Text: "hello"}, {Type: "text", Text: "bad"}, {Type: "text", Text: "bad too"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(resp.Results))
+	assert.EqualValues(t, []bool{false, false, true, true}, array.Map(resp.Results, func(r Result, _ int) bool { return r.Flagged }))
+	assert.Equal(t, 2, len(m.inputs))
+	assert.EqualValues(t, []Input{{Type: "text", Text: "fine"}, {Type: "text", Text: "bad too"}}, m.inputs[1])
+
+	// Different model, different cache
+	_, _ = c.Moderation(context.Background(), Request{Model: "other", Input: []Input{{Type: "text", Text: "hello"}}})
+	assert.Equal(t, 3, len(m.inputs))
+
+	// The images get one result each, they are cached, and only the new input is checked on the next turn
+	image := Input{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,AAAA"}}
+	resp, err = c.Moderation(context.Background(), Request{Model: "m", Input: []Input{{Type: "text", Text: "look"}, image}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.Results))
+	assert.Equal(t, 5, len(m.inputs))
+
+	resp, err = c.Moderation(context.Background(), Request{Model: "m", Input: []Input{{Type: "text", Text: "look"}, image, {Type: "text", Text: "bad cat"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(resp.Results))
+	assert.False(t, resp.Results[1].Flagged)
+	assert.True(t, resp.Results[2].Flagged)
+	assert.Equal(t, 6, len(m.inputs))
+	assert.EqualValues(t, []Input{{Type: "text", Text: "bad cat"}}, m.inputs[5])
+}
+
+func TestCache_ModerationImages(t *testing.T) {
+	m := &echoModerator{delay: 20 * time.Millisecond}
+	c := NewCache(NewLimiter(m, 2, time.Second), 100, time.Minute)
+
+	inputs := []Input{{Type: "text", Text: "look"}, {Type: "text", Text: "bad"}}
+	for _, url := range []string{"a", "b", "c"} {
+		inputs = append(inputs, Input{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+	}
+
+	// The images are checked concurrently, at most as many as the limiter allows
+	resp, err := c.Moderation(context.Background(), Request{Model: "m", Input: inputs})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(resp.Results))
+	assert.True(t, resp.Results[1].Flagged)
+	assert.Equal(t, 4, len(m.inputs))
+	assert.Equal(t, 2, m.peak)
+}
+
+func TestLimiter_Moderation(t *testing.T) {
+	l := NewLimiter(&echoModerator{delay: 50 * time.Millisecond}, 1, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = l.Moderation(context.Background(), Request{Input: []Input{{Type: "text", Text: "hello"}}})
+		}(i)
+	}
+	wg.Wait()
+
+	assert.True(t, (errs[0] == nil) != (errs[1] == nil))
+	assert.True(t, errs[0] == ErrTooManyRequests || errs[1] == ErrTooManyRequests)
+}
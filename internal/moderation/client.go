@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
 	"golang.org/x/net/proxy"
 	"io"
 	"net/http"
@@ -108,7 +109,7 @@ func (client *Client) Moderation(ctx context.Context, req Request) (*Response, e
 	startTime := time.Now()
 	defer func() {
 		if log.DebugEnabled() {
-			log.Debugf("moderation request completed, duration: %s", time.Since(startTime))
+			log.F(log.M{"request_id": base.RequestID(ctx)}).Debugf("moderation request completed, duration: %s", time.Since(startTime))
 		}
 	}()
 
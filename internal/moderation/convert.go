@@ -1,6 +1,19 @@
 package moderation
 
-import "github.com/sashabaranov/go-openai"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"io"
+	"net/http"
+	"strings"
+)
 
 func ConvertChatToRequest(req openai.ChatCompletionRequest, moderationModel string) Request {
 	res := Request{
@@ -35,3 +48,113 @@ func ConvertChatToRequest(req openai.ChatCompletionRequest, moderationModel stri
 
 	return res
 }
+
+// ConvertRequest Convert the request body of an endpoint to a moderation request.
+// The inputs are empty when the request contains nothing to check, such as the audio of transcriptions
+func ConvertRequest(endpoint base.Endpoint, contentType string, body []byte, moderationModel string) (Request, error) {
+	res := Request{Model: moderationModel, Input: []Input{}}
+
+	switch base.Endpoint(strings.TrimSuffix(string(endpoint), "/")) {
+	case base.EndpointChatCompletion:
+		var req openai.ChatCompletionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return res, err
+		}
+
+		// If the role of the last Message is robot, then there is no need to perform a sensitive word check
+		// because this is the result of the tool call
+		if len(req.Messages) == 0 || strings.ToLower(req.Messages[len(req.Messages)-1].Role) == "robot" {
+			return res, nil
+		}
+
+		return ConvertChatToRequest(req, moderationModel), nil
+	case base.EndpointCompletion:
+		return jsonTextInputs(res, body, "prompt")
+	case base.EndpointImageGeneration:
+		return jsonTextInputs(res, body, "prompt")
+	case base.EndpointAudioSpeech, base.EndpointEmbedding:
+		return jsonTextInputs(res, body, "input")
+	case base.EndpointImageEdit, base.EndpointImageVariation:
+		if !formdata.IsForm(contentType) {
+			return jsonTextInputs(res, body, "prompt")
+		}
+
+		// The body is in memory already, so nothing is written to the temporary files
+		form, err := formdata.Parse(bytes.NewReader(body), contentType, int64(len(body)))
+		if err != nil {
+			return res, err
+		}
+		defer form.RemoveAll()
+
+		return ConvertForm(endpoint, form, moderationModel)
+	}
+
+	return res, nil
+}
+
+// jsonTextInputs Add the text of the field to the inputs, the field can be a string or an array of strings.
+// The token arrays accepted by completions and embeddings are skipped
+func jsonTextInputs(res Request, body []byte, field string) (Request, error) {
+	if !gjson.ValidBytes(body) {
+		return res, errors.New("invalid json body")
+	}
+
+	value := gjson.GetBytes(body, field)
+	values := []gjson.Result{value}
+	if value.IsArray() {
+		values = value.Array()
+	}
+
+	for _, v := range values {
+		if v.Type == gjson.String && v.String() != "" {
+			res.Input = append(res.Input, Input{Type: "text", Text: v.String()})
+		}
+	}
+
+	return res, nil
+}
+
+// ConvertForm Convert the multipart form of an endpoint to a moderation request, the prompt and the uploaded images
+// of image edits and variations are checked, the images are sent to the moderation as data urls
+func ConvertForm(endpoint base.Endpoint, form *formdata.Form, moderationModel string) (Request, error) {
+	res := Request{Model: moderationModel, Input: []Input{}}
+	if !array.In(base.Endpoint(strings.TrimSuffix(string(endpoint), "/")), []base.Endpoint{base.EndpointImageEdit, base.EndpointImageVariation}) {
+		return res, nil
+	}
+
+	for _, part := range form.Parts {
+		if !array.In(part.Name(), []string{"prompt", "image", "image[]"}) || part.Size() == 0 {
+			continue
+		}
+
+		reader, err := part.Open()
+		if err != nil {
+			return res, err
+		}
+
+		data, err := io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			return res, err
+		}
+
+		if part.Name() == "prompt" {
+			res.Input = append(res.Input, Input{Type: "text", Text: string(data)})
+			continue
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if !strings.HasPrefix(contentType, "image/") {
+			contentType = http.DetectContentType(data)
+		}
+
+		res.Input = append(res.Input, Input{
+			Type: "image_url",
+			ImageURL: &ImageURL{
+				URL: "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data),
+			},
+		})
+	}
+
+	return res, nil
+}
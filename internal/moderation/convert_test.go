@@ -0,0 +1,73 @@
+package moderation
+
+import (
+	"bytes"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func texts(req Request) []string {
+	return array.Map(
+		array.Filter(req.Input, func(input Input, _ int) bool { return input.Type == "text" }),
+		func(input Input, _ int) string { return input.Text },
+	)
+}
+
+func TestConvertRequest(t *testing.T) {
+	testCases := []struct {
+		endpoint base.Endpoint
+		body     string
+		expected []string
+	}{
+		{base.EndpointChatCompletion, `{"messages":[{"role":"user","content":"hello"}]}`, []string{"hello"}},
+		{base.EndpointChatCompletion, `{"messages":[{"role":"user","content":"hello"},{"role":"robot","content":"result"}]}`, []string{}},
+		{base.EndpointCompletion, `{"model":"gpt-3.5-turbo-instruct","prompt":"hello"}`, []string{"hello"}},
+		{base.EndpointCompletion, `{"model":"gpt-3.5-turbo-instruct","prompt":["hello","world"]}`, []string{"hello", "world"}},
+		{base.EndpointCompletion, `{"model":"gpt-3.5-turbo-instruct","prompt":[1212,318]}`, []string{}},
+		{base.EndpointImageGeneration, `{"model":"dall-e-3","prompt":"a cat"}`, []string{"a cat"}},
+		{base.EndpointAudioSpeech, `{"model":"tts-1","input":"hello"}`, []string{"hello"}},
+		{base.EndpointEmbedding, `{"model":"text-embedding-3-small","input":["hello","world"]}`, []string{"hello", "world"}},
+		{base.EndpointAudioTranscript, `{}`, []string{}},
+	}
+
+	for _, tc := range testCases {
+		req, err := ConvertRequest(tc.endpoint, "application/json", []byte(tc.body), "omni-moderation-latest")
+		assert.NoError(t, err)
+		assert.Equal(t, "omni-moderation-latest", req.Model)
+		assert.EqualValues(t, tc.expected, texts(req))
+	}
+
+	_, err := ConvertRequest(base.EndpointCompletion, "application/json", []byte(`prompt=hello`), "omni-moderation-latest")
+	assert.True(t, err != nil)
+}
+
+func TestConvertRequest_Multipart(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("model", "dall-e-2")
+	_ = mw.WriteField("prompt", "add a hat")
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="image"; filename="cat.png"`)
+	header.Set("Content-Type", "application/octet-stream")
+	part, _ := mw.CreatePart(header)
+	_, _ = part.Write([]byte("\x89PNG\r\n\x1a\n0000"))
+
+	mask, _ := mw.CreateFormFile("mask", "mask.png")
+	_, _ = mask.Write([]byte("\x89PNG\r\n\x1a\n1111"))
+	_ = mw.Close()
+
+	req, err := ConvertRequest(base.EndpointImageEdit, mw.FormDataContentType(), body.Bytes(), "omni-moderation-latest")
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"add a hat"}, texts(req))
+
+	// The mask is not checked, the content type of the image is detected when it is not set
+	assert.Equal(t, 2, len(req.Input))
+	assert.Equal(t, "image_url", req.Input[1].Type)
+	assert.True(t, strings.HasPrefix(req.Input[1].ImageURL.URL, "data:image/png;base64,"))
+}
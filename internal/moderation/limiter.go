@@ -0,0 +1,37 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTooManyRequests No free slot is available for the moderation request in time
+var ErrTooManyRequests = errors.New("too many concurrent moderation requests")
+
+// Limiter Limit the number of concurrent moderation requests
+type Limiter struct {
+	moderator Moderator
+	slots     chan struct{}
+	wait      time.Duration
+}
+
+// NewLimiter Create a limiter allowing at most n concurrent requests, a request waits at most wait for a free slot
+func NewLimiter(moderator Moderator, n int, wait time.Duration) *Limiter {
+	return &Limiter{moderator: moderator, slots: make(chan struct{}, n), wait: wait}
+}
+
+func (l *Limiter) Moderation(ctx context.Context, req Request) (*Response, error) {
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		defer func() { <-l.slots }()
+		return l.moderator.Moderation(ctx, req)
+	case <-timer.C:
+		return nil, ErrTooManyRequests
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,168 @@
+package moderation
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/pkg/ahocorasick"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// LocalModel The model name of the local moderation responses
+const LocalModel = "local"
+
+// LocalRule A rule of the local moderation engine, the inputs matching any keyword, regex or dictionary word
+// are flagged with the category and score of the rule
+type LocalRule struct {
+	Category string
+	// Score The score of the category when matched, the default value is 1
+	Score    float64
+	Keywords []string
+	Regexes  []string
+	// Dictionaries Files containing one word per line, empty lines and lines starting with # are ignored
+	Dictionaries  []string
+	CaseSensitive bool
+}
+
+// Local A local moderation engine based on keywords, regexes and dictionaries, no network call is needed
+type Local struct {
+	rules []localRule
+}
+
+type localRule struct {
+	category      string
+	score         float64
+	caseSensitive bool
+	words         *ahocorasick.Matcher
+	regexes       []*regexp.Regexp
+}
+
+// NewLocal Create a local moderation engine, the dictionaries are loaded at once
+func NewLocal(rules []LocalRule) (*Local, error) {
+	local := &Local{rules: make([]localRule, 0, len(rules))}
+
+	for _, rule := range rules {
+		words := append([]string{}, rule.Keywords...)
+		for _, dict := range rule.Dictionaries {
+			dictWords, err := LoadDictionary(dict)
+			if err != nil {
+				return nil, err
+			}
+
+			words = append(words, dictWords...)
+		}
+
+		if !rule.CaseSensitive {
+			for i, word := range words {
+				words[i] = strings.ToLower(word)
+			}
+		}
+
+		regexes := make([]*regexp.Regexp, 0, len(rule.Regexes))
+		for _, expr := range rule.Regexes {
+			if !rule.CaseSensitive && !strings.HasPrefix(expr, "(?i)") {
+				expr = "(?i)" + expr
+			}
+
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q for category %s: %w", expr, rule.Category, err)
+			}
+
+			regexes = append(regexes, re)
+		}
+
+		score := rule.Score
+		if score == 0 {
+			score = 1
+		}
+
+		local.rules = append(local.rules, localRule{
+			category:      rule.Category,
+			score:         score,
+			caseSensitive: rule.CaseSensitive,
+			words:         ahocorasick.New(words),
+			regexes:       regexes,
+		})
+	}
+
+	return local, nil
+}
+
+// LoadDictionary Load the words from a dictionary file, one word per line
+func LoadDictionary(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load dictionary failed: %w", err)
+	}
+	defer f.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+
+		words = append(words, word)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("load dictionary %s failed: %w", path, err)
+	}
+
+	return words, nil
+}
+
+// Moderation Check the text inputs against the rules, one result is returned for each input, images are not checked
+func (local *Local) Moderation(_ context.Context, req Request) (*Response, error) {
+	resp := Response{Model: LocalModel, Results: make([]Result, 0, len(req.Input))}
+
+	for _, input := range req.Input {
+		result := Result{Categories: map[string]bool{}, CategoryScores: map[string]float64{}}
+		if input.Type == "text" {
+			for _, rule := range local.rules {
+				matched := rule.match(input.Text)
+				if matched == "" {
+					continue
+				}
+
+				result.Flagged = true
+				result.Categories[rule.category] = true
+				if rule.score > result.CategoryScores[rule.category] {
+					result.CategoryScores[rule.category] = rule.score
+				}
+
+				if log.DebugEnabled() {
+					log.F(log.M{"category": rule.category, "matched": matched}).Debugf("input is flagged by local moderation")
+				}
+			}
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	return &resp, nil
+}
+
+// match Return the first word or regex match found in the text, empty if not matched
+func (rule localRule) match(text string) string {
+	if rule.words.Len() > 0 {
+		if matched := rule.words.FindAll(ternary.If(rule.caseSensitive, text, strings.ToLower(text))); len(matched) > 0 {
+			return matched[0]
+		}
+	}
+
+	for _, re := range rule.regexes {
+		if matched := re.FindString(text); matched != "" {
+			return matched
+		}
+	}
+
+	return ""
+}
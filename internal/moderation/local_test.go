@@ -0,0 +1,85 @@
+package moderation
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocal_Moderation(t *testing.T) {
+	dict := filepath.Join(t.TempDir(), "dict.txt")
+	assert.NoError(t, os.WriteFile(dict, []byte("# comment\n\nbadword\n违禁词\n"), 0644))
+
+	local, err := NewLocal([]LocalRule{
+		{Category: "custom", Keywords: []string{"Forbidden"}, Dictionaries: []string{dict}},
+		{Category: "pii", Score: 0.5, Regexes: []string{`\d{3}-\d{4}-\d{4}`}},
+	})
+	assert.NoError(t, err)
+
+	resp, err := local.Moderation(context.Background(), Request{Input: []Input{
+		{Type: "text", Text: "this is FORBIDDEN, call 138-0000-0000"},
+		{Type: "text", Text: "这里有违禁词"},
+		{Type: "text", Text: "hello"},
+		{Type: "image_url", ImageURL: &ImageURL{URL: "https://example.com/badword.png"}},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, LocalModel, resp.Model)
+	assert.Equal(t, 4, len(resp.Results))
+	assert.True(t, resp.Results[0].Categories["custom"] && resp.Results[0].Categories["pii"])
+	assert.Equal(t, 0.5, resp.Results[0].CategoryScores["pii"])
+	assert.True(t, resp.Results[1].Flagged)
+	assert.False(t, resp.Results[2].Flagged)
+	assert.False(t, resp.Results[3].Flagged)
+
+	assert.True(t, resp.Flagged(0.7))
+	assert.EqualValues(t, []string{"custom"}, array.Uniq(resp.FlaggedCategories(0.7)))
+
+	_, err = NewLocal([]LocalRule{{Category: "custom", Dictionaries: []string{"not-exist.txt"}}})
+	assert.True(t, err != nil)
+}
+
+type staticModerator struct {
+	resp  Response
+	calls int
+}
+
+func (m *staticModerator) Moderation(context.Context, Request) (*Response, error) {
+	m.calls++
+	return &m.resp, nil
+}
+
+func TestChain_Moderation(t *testing.T) {
+	flagged := &staticModerator{resp: Response{Model: "local", Results: []Result{{Flagged: true, CategoryScores: map[string]float64{"hate": 0.8}}}}}
+	passed := &staticModerator{resp: Response{Model: "remote", Results: []Result{{CategoryScores: map[string]float64{"hate": 0.1, "violence": 0.2}}}}}
+	req := Request{Input: []Input{{Type: "text", Text: "hello"}}}
+	ctx := WithPolicy(context.Background(), Policy{ScoreThreshold: 0.7})
+
+	// The results of the moderators are merged, one result for each input
+	resp, err := NewChain(passed, flagged).Moderation(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "remote,local", resp.Model)
+	assert.Equal(t, 1, len(resp.Results))
+	assert.True(t, resp.Results[0].Flagged)
+	assert.EqualValues(t, map[string]float64{"hate": 0.8, "violence": 0.2}, resp.Results[0].CategoryScores)
+
+	resp, err = NewChain(flagged, passed).Moderation(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "local", resp.Model)
+	assert.Equal(t, 1, passed.calls)
+
+	// The policy of the request decides whether the next moderator is consulted
+	resp, err = NewChain(flagged, passed).Moderation(WithPolicy(context.Background(), Policy{ScoreThreshold: 0.9}), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "local,remote", resp.Model)
+	assert.Equal(t, 2, passed.calls)
+
+	// A combined result applies to all inputs
+	combined := &staticModerator{resp: Response{Model: "omni", Results: []Result{{CategoryScores: map[string]float64{"sexual": 0.9}}}}}
+	resp, err = NewChain(combined).Moderation(ctx, Request{Input: []Input{{Type: "text", Text: "look"}, {Type: "image_url", ImageURL: &ImageURL{URL: "https://example.com/a.png"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.Results))
+	assert.Equal(t, 0.9, resp.Results[1].CategoryScores["sexual"])
+}
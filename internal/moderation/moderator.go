@@ -0,0 +1,104 @@
+package moderation
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/array"
+	"strings"
+)
+
+// Moderator Check whether the inputs contain illegal content
+type Moderator interface {
+	Moderation(ctx context.Context, req Request) (*Response, error)
+}
+
+type contextKey string
+
+const policyKey contextKey = "moderation-policy"
+
+// WithPolicy Attach the policy of the request to the context, the chain uses it to decide whether the request is flagged
+func WithPolicy(ctx context.Context, policy Policy) context.Context {
+	return context.WithValue(ctx, policyKey, policy)
+}
+
+// PolicyFrom Get the policy of the request from the context
+func PolicyFrom(ctx context.Context) (Policy, bool) {
+	policy, ok := ctx.Value(policyKey).(Policy)
+	return policy, ok
+}
+
+// Chain Run the moderators in order, the following moderators are skipped once the request is flagged
+// by the policy in the context. The results of the moderators are merged, so there is one result for each input
+type Chain struct {
+	moderators []Moderator
+}
+
+// NewChain Create a moderator chain
+func NewChain(moderators ...Moderator) *Chain {
+	return &Chain{moderators: moderators}
+}
+
+func (chain *Chain) Moderation(ctx context.Context, req Request) (*Response, error) {
+	result := Response{Results: make([]Result, len(req.Input))}
+	models := make([]string, 0, len(chain.moderators))
+	policy, hasPolicy := PolicyFrom(ctx)
+
+	for _, moderator := range chain.moderators {
+		resp, err := moderator.Moderation(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.ID == "" {
+			result.ID = resp.ID
+		}
+
+		models = append(models, resp.Model)
+		if len(resp.Results) == len(result.Results) {
+			for i, res := range resp.Results {
+				result.Results[i] = mergeResult(result.Results[i], res)
+			}
+		} else {
+			// A combined result, such as the one of omni-moderation for the multimodal inputs, applies to all inputs
+			for _, res := range resp.Results {
+				for i := range result.Results {
+					result.Results[i] = mergeResult(result.Results[i], res)
+				}
+			}
+		}
+
+		if hasPolicy && len(policy.FlaggedCategories(*resp)) > 0 {
+			break
+		}
+	}
+
+	result.Model = strings.Join(models, ",")
+	return &result, nil
+}
+
+// mergeResult Merge the results of the same input, the higher score of each category is kept
+func mergeResult(dst, src Result) Result {
+	res := Result{
+		Flagged:                   dst.Flagged || src.Flagged,
+		Categories:                make(map[string]bool),
+		CategoryScores:            make(map[string]float64),
+		CategoryAppliedInputTypes: make(map[string][]string),
+	}
+
+	for _, r := range []Result{dst, src} {
+		for category, flagged := range r.Categories {
+			res.Categories[category] = res.Categories[category] || flagged
+		}
+
+		for category, score := range r.CategoryScores {
+			if current, ok := res.CategoryScores[category]; !ok || score > current {
+				res.CategoryScores[category] = score
+			}
+		}
+
+		for category, types := range r.CategoryAppliedInputTypes {
+			res.CategoryAppliedInputTypes[category] = array.Uniq(append(res.CategoryAppliedInputTypes[category], types...))
+		}
+	}
+
+	return res
+}
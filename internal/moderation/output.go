@@ -0,0 +1,385 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputChecker Check the output text, return the violated categories, empty if the text is allowed
+type OutputChecker func(ctx context.Context, text string) ([]string, error)
+
+type outputMode int
+
+const (
+	outputModeUndecided outputMode = iota
+	outputModePassthrough
+	outputModeBuffered
+	outputModeStream
+)
+
+// OutputWriter Moderate the chat completion or audio transcription output before it is sent to the client.
+//
+// A non-stream response is buffered and checked as a whole, the message content is removed when it is flagged.
+// A transcription has no place to mark the filtered content, so it is replaced with an error when flagged.
+// A stream response is released window by window: the text of the chunks is accumulated until it reaches the
+// window size, and the chunks are sent only after the window is checked. Once a window is flagged, the stream is
+// cut off with a content_filter finish reason, and the rest of the upstream response is discarded.
+// Responses that are not successful chat completions are passed through.
+type OutputWriter struct {
+	w          http.ResponseWriter
+	ctx        context.Context
+	check      OutputChecker
+	windowSize int
+	// failClosed Treat the output as violated when the check fails
+	failClosed bool
+
+	mode   outputMode
+	status int
+	buf    bytes.Buffer
+
+	// pending The stream events received but not released yet
+	pending [][]byte
+	window  []rune
+	// tail The last checked window, checked again with the next window so that the words
+	// split across windows are detected
+	tail []rune
+	// last The metadata of the last stream chunk, used by the cut off chunk
+	last     openai.ChatCompletionStreamResponse
+	maxIndex int
+	cutOff   bool
+	closed   bool
+
+	checked  bool
+	violated []string
+	err      error
+}
+
+// NewOutputWriter Create an output writer, windowSize is the number of characters checked at a time in stream responses.
+// When failClosed is true, the output is blocked if the check fails, otherwise it is allowed
+func NewOutputWriter(ctx context.Context, w http.ResponseWriter, windowSize int, failClosed bool, check OutputChecker) *OutputWriter {
+	return &OutputWriter{w: w, ctx: ctx, check: check, windowSize: windowSize, failClosed: failClosed}
+}
+
+func (ow *OutputWriter) Header() http.Header {
+	return ow.w.Header()
+}
+
+func (ow *OutputWriter) WriteHeader(statusCode int) {
+	if ow.mode != outputModeUndecided {
+		return
+	}
+
+	ow.status = statusCode
+	contentType := ow.w.Header().Get("Content-Type")
+	switch {
+	case statusCode != http.StatusOK:
+		ow.mode = outputModePassthrough
+	case strings.Contains(contentType, "text/event-stream"):
+		ow.mode = outputModeStream
+		ow.w.Header().Del("Content-Length")
+	case strings.Contains(contentType, "application/json"), strings.Contains(contentType, "text/plain"):
+		ow.mode = outputModeBuffered
+		return
+	default:
+		ow.mode = outputModePassthrough
+	}
+
+	ow.w.WriteHeader(statusCode)
+}
+
+func (ow *OutputWriter) Write(data []byte) (int, error) {
+	if ow.mode == outputModeUndecided {
+		ow.WriteHeader(http.StatusOK)
+	}
+
+	switch ow.mode {
+	case outputModeBuffered:
+		return ow.buf.Write(data)
+	case outputModeStream:
+		if ow.cutOff || ow.closed {
+			// Discard the rest of the upstream response
+			return len(data), nil
+		}
+
+		ow.buf.Write(data)
+		ow.processEvents()
+		return len(data), nil
+	default:
+		return ow.w.Write(data)
+	}
+}
+
+func (ow *OutputWriter) Flush() {
+	if ow.mode == outputModePassthrough {
+		ow.flush()
+	}
+}
+
+func (ow *OutputWriter) Unwrap() http.ResponseWriter {
+	return ow.w
+}
+
+// Result Return whether the output is checked, the violated categories and the error of the last check
+func (ow *OutputWriter) Result() (checked bool, violated []string, err error) {
+	return ow.checked, ow.violated, ow.err
+}
+
+// Close Check the rest of the output and send it to the client, it must be called after the response is served
+func (ow *OutputWriter) Close() {
+	if ow.closed {
+		return
+	}
+
+	switch ow.mode {
+	case outputModeBuffered:
+		ow.closed = true
+		ow.writeBuffered()
+	case outputModeStream:
+		if !ow.cutOff {
+			// The stream ends without [DONE], release the incomplete events as they are
+			if ow.buf.Len() > 0 {
+				ow.pending = append(ow.pending, append([]byte{}, ow.buf.Bytes()...))
+				ow.buf.Reset()
+			}
+
+			ow.checkWindow(true)
+		}
+
+		ow.closed = true
+	}
+}
+
+func (ow *OutputWriter) flush() {
+	if f, ok := ow.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// writeBuffered Check the whole non-stream response, the content of all choices is removed if flagged
+func (ow *OutputWriter) writeBuffered() {
+	body := ow.buf.Bytes()
+
+	choices := gjson.GetBytes(body, "choices")
+	if !choices.IsArray() {
+		ow.writeTranscription(body)
+		return
+	}
+
+	var text strings.Builder
+	for _, choice := range choices.Array() {
+		text.WriteString(choice.Get("message.content").String())
+	}
+
+	if violated := ow.runCheck(text.String()); len(violated) > 0 {
+		data := string(body)
+		for i := range choices.Array() {
+			data, _ = sjson.Set(data, fmt.Sprintf("choices.%d.message.content", i), "")
+			data, _ = sjson.Set(data, fmt.Sprintf("choices.%d.finish_reason", i), openai.FinishReasonContentFilter)
+		}
+
+		body = []byte(data)
+		ow.w.Header().Set("X-VIOLATED-CATEGORIES", strings.Join(violated, ","))
+	}
+
+	ow.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	ow.w.WriteHeader(ow.status)
+	_, _ = ow.w.Write(body)
+}
+
+// OutputViolatedMessage The error message sent instead of the flagged transcription
+const OutputViolatedMessage = "the response contains illegal content, we cannot service you"
+
+// writeTranscription Check the text of the transcription, the json formats carry it in the text field,
+// while the text, srt and vtt formats are plain text
+func (ow *OutputWriter) writeTranscription(body []byte) {
+	text := string(body)
+	if gjson.ValidBytes(body) {
+		text = gjson.GetBytes(body, "text").String()
+	}
+
+	if violated := ow.runCheck(text); len(violated) > 0 {
+		body, _ = json.Marshal(map[string]any{"error": map[string]any{"message": OutputViolatedMessage}})
+		ow.status = http.StatusUnprocessableEntity
+		ow.w.Header().Set("Content-Type", "application/json")
+		ow.w.Header().Set("X-VIOLATED-CATEGORIES", strings.Join(violated, ","))
+	}
+
+	ow.w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	ow.w.WriteHeader(ow.status)
+	_, _ = ow.w.Write(body)
+}
+
+// eventEnd The end of the first complete SSE event in the data, -1 if there is none. As the SSE spec allows,
+// the lines end with \r\n, \n or \r, and an event ends with an empty line
+func eventEnd(data []byte) int {
+	lineStart := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\n' && data[i] != '\r' {
+			continue
+		}
+
+		end := i + 1
+		if data[i] == '\r' {
+			if end == len(data) {
+				// The \n of \r\n may be in the next write
+				return -1
+			}
+
+			if data[end] == '\n' {
+				end++
+			}
+		}
+
+		if i == lineStart {
+			return end
+		}
+
+		lineStart, i = end, end-1
+	}
+
+	return -1
+}
+
+// processEvents Handle the complete SSE events in the buffer
+func (ow *OutputWriter) processEvents() {
+	for !ow.cutOff {
+		data := ow.buf.Bytes()
+		end := eventEnd(data)
+		if end < 0 {
+			return
+		}
+
+		event := append([]byte{}, data[:end]...)
+		ow.buf.Next(end)
+
+		payload, ok := eventData(event)
+		if !ok {
+			ow.pending = append(ow.pending, event)
+			continue
+		}
+
+		if payload == "[DONE]" {
+			ow.pending = append(ow.pending, event)
+			ow.checkWindow(true)
+			continue
+		}
+
+		var chunk openai.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(payload), &chunk); err == nil {
+			if chunk.ID != "" {
+				ow.last.ID, ow.last.Model, ow.last.Created = chunk.ID, chunk.Model, chunk.Created
+			}
+
+			for _, choice := range chunk.Choices {
+				ow.window = append(ow.window, []rune(choice.Delta.Content)...)
+				if choice.Index > ow.maxIndex {
+					ow.maxIndex = choice.Index
+				}
+			}
+		}
+
+		ow.pending = append(ow.pending, event)
+		ow.checkWindow(false)
+	}
+}
+
+// checkWindow Check the window when it is full or the stream ends, the pending events are released if allowed
+func (ow *OutputWriter) checkWindow(final bool) {
+	if !final && len(ow.window) < ow.windowSize {
+		return
+	}
+
+	if len(ow.window) > 0 {
+		text := append(append([]rune{}, ow.tail...), ow.window...)
+		if violated := ow.runCheck(string(text)); len(violated) > 0 {
+			ow.cut()
+			return
+		}
+
+		ow.tail = ow.window
+		ow.window = nil
+	}
+
+	for _, event := range ow.pending {
+		_, _ = ow.w.Write(event)
+	}
+
+	ow.pending = nil
+	ow.flush()
+}
+
+// cut Discard the pending events, and end the stream with the content_filter finish reason
+func (ow *OutputWriter) cut() {
+	ow.cutOff = true
+	ow.pending = nil
+	ow.window = nil
+	ow.buf.Reset()
+
+	// Only the fields needed are sent, the chunk struct of go-openai contains lots of empty fields
+	choices := make([]map[string]any, 0, ow.maxIndex+1)
+	for i := 0; i <= ow.maxIndex; i++ {
+		choices = append(choices, map[string]any{"index": i, "delta": map[string]any{}, "finish_reason": openai.FinishReasonContentFilter})
+	}
+
+	data, _ := json.Marshal(map[string]any{
+		"id":      ow.last.ID,
+		"object":  "chat.completion.chunk",
+		"created": ternary.If(ow.last.Created == 0, time.Now().Unix(), ow.last.Created),
+		"model":   ow.last.Model,
+		"choices": choices,
+	})
+
+	_, _ = ow.w.Write([]byte(fmt.Sprintf("data: %s\n\n", data)))
+	_, _ = ow.w.Write([]byte("data: [DONE]\n\n"))
+	ow.flush()
+}
+
+// ModerationUnavailable The category reported when the output is blocked because the check failed
+const ModerationUnavailable = "moderation-unavailable"
+
+// runCheck Check the text, the errors are recorded and the text is allowed unless failClosed is set
+func (ow *OutputWriter) runCheck(text string) []string {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+
+	ow.checked = true
+	violated, err := ow.check(ow.ctx, text)
+	if err != nil {
+		ow.err = err
+		if ow.failClosed {
+			ow.violated = []string{ModerationUnavailable}
+			return ow.violated
+		}
+
+		return nil
+	}
+
+	if len(violated) > 0 {
+		ow.violated = violated
+	}
+
+	return violated
+}
+
+// eventData Return the data of the SSE event
+func eventData(event []byte) (string, bool) {
+	for _, line := range strings.FieldsFunc(string(event), func(r rune) bool { return r == '\n' || r == '\r' }) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "data:") {
+			return strings.TrimSpace(line[5:]), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,159 @@
+package moderation
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func keywordChecker(keyword string) OutputChecker {
+	return func(ctx context.Context, text string) ([]string, error) {
+		if strings.Contains(text, keyword) {
+			return []string{"custom"}, nil
+		}
+
+		return nil, nil
+	}
+}
+
+func chunk(content string) string {
+	return `data: {"id":"1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"` + content + `"}}]}` + "\n\n"
+}
+
+func TestOutputWriter_Stream(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ow := NewOutputWriter(context.Background(), rec, 6, false, keywordChecker("forbidden"))
+
+	ow.Header().Set("Content-Type", "text/event-stream")
+	ow.WriteHeader(http.StatusOK)
+
+	_, _ = ow.Write([]byte(chunk("Hello ") + chunk("world")))
+	// The first window is released after it is checked
+	assert.Equal(t, chunk("Hello "), rec.Body.String())
+
+	// The event split across writes is handled when it is complete, the keyword split across windows is detected
+	data := chunk(", forb") + chunk("idden words")
+	_, _ = ow.Write([]byte(data[:10]))
+	_, _ = ow.Write([]byte(data[10:]))
+	_, _ = ow.Write([]byte(chunk("more") + "data: [DONE]\n\n"))
+	ow.Close()
+
+	body := rec.Body.String()
+	assert.False(t, strings.Contains(body, "idden"))
+	assert.True(t, strings.Contains(body, `"finish_reason":"content_filter"`))
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+
+	checked, violated, err := ow.Result()
+	assert.True(t, checked)
+	assert.EqualValues(t, []string{"custom"}, violated)
+	assert.NoError(t, err)
+}
+
+func TestOutputWriter_StreamPassed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ow := NewOutputWriter(context.Background(), rec, 100, false, keywordChecker("forbidden"))
+
+	ow.Header().Set("Content-Type", "text/event-stream")
+	data := chunk("Hello ") + chunk("world") + "data: [DONE]\n\n"
+	_, _ = ow.Write([]byte(data))
+	ow.Close()
+
+	assert.Equal(t, data, rec.Body.String())
+}
+
+func TestOutputWriter_StreamLineEndings(t *testing.T) {
+	for _, eol := range []string{"\r\n", "\r"} {
+		rec := httptest.NewRecorder()
+		ow := NewOutputWriter(context.Background(), rec, 6, false, keywordChecker("forbidden"))
+		ow.Header().Set("Content-Type", "text/event-stream")
+
+		data := strings.ReplaceAll(chunk("Hello ")+chunk("forbidden")+chunk("words")+"data: [DONE]\n\n", "\n", eol)
+		// The line ending split across writes is not taken as an empty line
+		for i := 0; i < len(data); i += 7 {
+			_, _ = ow.Write([]byte(data[i:min(i+7, len(data))]))
+		}
+		ow.Close()
+
+		body := rec.Body.String()
+		assert.True(t, strings.HasPrefix(body, strings.ReplaceAll(chunk("Hello "), "\n", eol)))
+		assert.False(t, strings.Contains(body, "forbidden"))
+		assert.True(t, strings.Contains(body, `"finish_reason":"content_filter"`))
+
+		_, violated, _ := ow.Result()
+		assert.EqualValues(t, []string{"custom"}, violated)
+	}
+
+	assert.Equal(t, 5, eventEnd([]byte("a\r\n\r\nb")))
+	assert.Equal(t, 3, eventEnd([]byte("a\n\nb")))
+	assert.Equal(t, 4, eventEnd([]byte("a\r\n\nb")))
+	assert.Equal(t, -1, eventEnd([]byte("a\r\n\r")))
+	assert.Equal(t, -1, eventEnd([]byte("data: a\n")))
+}
+
+func TestOutputWriter_Buffered(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ow := NewOutputWriter(context.Background(), rec, 100, false, keywordChecker("forbidden"))
+
+	body := `{"id":"1","choices":[{"index":0,"message":{"role":"assistant","content":"some forbidden words"},"finish_reason":"stop"}]}`
+	ow.Header().Set("Content-Type", "application/json")
+	ow.Header().Set("Content-Length", "120")
+	ow.WriteHeader(http.StatusOK)
+	_, _ = ow.Write([]byte(body))
+	assert.Equal(t, 0, rec.Body.Len())
+
+	ow.Close()
+	assert.Equal(t, "", gjson.Get(rec.Body.String(), "choices.0.message.content").String())
+	assert.Equal(t, "content_filter", gjson.Get(rec.Body.String(), "choices.0.finish_reason").String())
+	assert.Equal(t, "custom", rec.Header().Get("X-VIOLATED-CATEGORIES"))
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+}
+
+func TestOutputWriter_Transcription(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ow := NewOutputWriter(context.Background(), rec, 100, false, keywordChecker("forbidden"))
+
+	ow.Header().Set("Content-Type", "application/json")
+	ow.WriteHeader(http.StatusOK)
+	_, _ = ow.Write([]byte(`{"text":"some forbidden words"}`))
+	ow.Close()
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, OutputViolatedMessage, gjson.Get(rec.Body.String(), "error.message").String())
+	assert.Equal(t, "custom", rec.Header().Get("X-VIOLATED-CATEGORIES"))
+
+	// The text, srt and vtt formats are checked as a whole
+	rec = httptest.NewRecorder()
+	ow = NewOutputWriter(context.Background(), rec, 100, false, keywordChecker("forbidden"))
+
+	ow.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = ow.Write([]byte("hello world\n"))
+	ow.Close()
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "hello world\n", rec.Body.String())
+
+	checked, violated, _ := ow.Result()
+	assert.True(t, checked)
+	assert.Equal(t, 0, len(violated))
+}
+
+func TestOutputWriter_Passthrough(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ow := NewOutputWriter(context.Background(), rec, 100, false, keywordChecker("forbidden"))
+
+	ow.Header().Set("Content-Type", "application/json")
+	ow.WriteHeader(http.StatusTooManyRequests)
+	_, _ = ow.Write([]byte(`{"error":{"message":"forbidden"}}`))
+	ow.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, `{"error":{"message":"forbidden"}}`, rec.Body.String())
+
+	checked, _, _ := ow.Result()
+	assert.False(t, checked)
+}
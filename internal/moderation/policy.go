@@ -0,0 +1,41 @@
+package moderation
+
+import "github.com/mylxsw/go-utils/array"
+
+// Policy Decide which categories of a moderation response are flagged and which are blocked
+type Policy struct {
+	// Categories The categories to block
+	Categories []string
+	// ScoreThreshold The threshold of the categories without a threshold in Thresholds
+	ScoreThreshold float64
+	// Thresholds The threshold of each category
+	Thresholds map[string]float64
+}
+
+// Threshold Return the threshold of the category
+func (p Policy) Threshold(category string) float64 {
+	if threshold, ok := p.Thresholds[category]; ok {
+		return threshold
+	}
+
+	return p.ScoreThreshold
+}
+
+// FlaggedCategories Return the categories whose score reaches the threshold
+func (p Policy) FlaggedCategories(resp Response) []string {
+	categories := make([]string, 0)
+	for _, result := range resp.Results {
+		for category, score := range result.CategoryScores {
+			if score >= p.Threshold(category) && !array.In(category, categories) {
+				categories = append(categories, category)
+			}
+		}
+	}
+
+	return categories
+}
+
+// Violated Return the flagged categories which should be blocked
+func (p Policy) Violated(flagged []string) []string {
+	return array.Intersect(flagged, p.Categories)
+}
@@ -0,0 +1,39 @@
+package moderation
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	resp := Response{Results: []Result{
+		{Flagged: true, CategoryScores: map[string]float64{"violence": 0.6, "sexual/minors": 0.2}},
+		{Flagged: true, CategoryScores: map[string]float64{"violence": 0.8, "hate": 0.1}},
+	}}
+
+	policy := Policy{
+		Categories:     []string{"violence", "sexual/minors"},
+		ScoreThreshold: 0.7,
+		Thresholds:     map[string]float64{"sexual/minors": 0.1, "violence": 0.9},
+	}
+
+	flagged := policy.FlaggedCategories(resp)
+	assert.EqualValues(t, []string{"sexual/minors"}, flagged)
+	assert.EqualValues(t, []string{"sexual/minors"}, policy.Violated(flagged))
+
+	policy.Thresholds = nil
+	assert.EqualValues(t, []string{"violence"}, policy.FlaggedCategories(resp))
+}
+
+func TestPolicy_Offending(t *testing.T) {
+	req := Request{Input: []Input{{Type: "text", Text: "hello"}, {Type: "text", Text: strings.Repeat("违", 300)}}}
+	resp := Response{Results: []Result{
+		{CategoryScores: map[string]float64{"violence": 0.1}},
+		{Flagged: true, CategoryScores: map[string]float64{"violence": 0.8, "hate": 0.2}},
+	}}
+
+	scores, snippet := Policy{ScoreThreshold: 0.7}.Offending(req, resp)
+	assert.EqualValues(t, map[string]float64{"violence": 0.8}, scores)
+	assert.Equal(t, strings.Repeat("违", maxSnippetLength)+"...", snippet)
+}
@@ -1,14 +1,29 @@
 package anthropic
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/go-utils/array"
 	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
 	"github.com/mylxsw/openai-dispatcher/pkg/image"
 	"github.com/sashabaranov/go-openai"
 	"golang.org/x/net/proxy"
+	"io"
 	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// apiVersion The version of the Messages API
+	apiVersion = "2023-06-01"
+	// defaultMaxTokens The max tokens of the requests without one, it is required by the Messages API
+	defaultMaxTokens = 4096
 )
 
 type Client struct {
@@ -16,6 +31,8 @@ type Client struct {
 	serverURL string
 	dialer    proxy.Dialer
 	client    *http.Client
+	// images Download the remote images, Claude only accepts base64 images
+	images *image.Fetcher
 }
 
 func New(serverURL, apiKey string, dialer proxy.Dialer) *Client {
@@ -31,10 +48,11 @@ func New(serverURL, apiKey string, dialer proxy.Dialer) *Client {
 		apiKey:    apiKey,
 		dialer:    dialer,
 		client:    client,
+		images:    image.NewFetcher(dialer),
 	}
 }
 
-func (client *Client) convertRequest(openaiReq openai.ChatCompletionRequest) (*MessageRequest, error) {
+func (client *Client) convertRequest(ctx context.Context, openaiReq openai.ChatCompletionRequest) (*MessageRequest, error) {
 	var systemMessage string
 	var contextMessages []Message
 
@@ -51,16 +69,18 @@ func (client *Client) convertRequest(openaiReq openai.ChatCompletionRequest) (*M
 					if ct.Type == "text" {
 						item.Text = ct.Text
 					} else if ct.ImageURL != nil {
-						imageMimeType, err := image.Base64ImageMediaType(ct.ImageURL.URL)
+						// The remote images are downloaded, the images Claude does not accept are converted and scaled down
+						img, err := client.images.Fetch(ctx, ct.ImageURL.URL)
+						if err == nil {
+							img, err = image.Normalize(img, image.AnthropicLimits)
+						}
+
 						if err != nil {
-							log.F(log.M{"url": ct.ImageURL.URL}).Errorf("parse image mime type failed: %v", err)
+							log.F(log.M{"url": ternary.If(len(ct.ImageURL.URL) > 100, ct.ImageURL.URL[:100]+"...", ct.ImageURL.URL), "request_id": base.RequestID(ctx)}).Errorf("load image failed: %v", err)
 							return nil, err
 						}
 
-						item.Source = NewImageSource(
-							imageMimeType,
-							image.RemoveImageBase64Prefix(ct.ImageURL.URL),
-						)
+						item.Source = NewImageSource(img.MediaType, img.Base64())
 					}
 
 					contents = append(contents, item)
@@ -105,14 +125,215 @@ func (client *Client) convertRequest(openaiReq openai.ChatCompletionRequest) (*M
 	return &res, nil
 }
 
+// request Send the chat completion request to the Messages API, the errors are logged and the next upstream is tried
+func (client *Client) request(ctx context.Context, openaiReq openai.ChatCompletionRequest, stream bool) (*http.Response, error) {
+	req, err := client.convertRequest(ctx, openaiReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Stream = stream
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = defaultMaxTokens
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("marshal request failed: %v", err)
+		return nil, base.ErrUpstreamShouldRetry
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(client.serverURL, "/")+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("create request failed: %v", err)
+		return nil, base.ErrUpstreamShouldRetry
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Api-Key", client.apiKey)
+	httpReq.Header.Set("Anthropic-Version", apiVersion)
+
+	resp, err := client.client.Do(httpReq)
+	if err != nil {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("request failed: %v", err)
+		return nil, base.ErrUpstreamShouldRetry
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx), "status": resp.StatusCode}).Errorf("request failed: %s", string(data))
+		return nil, base.ErrUpstreamShouldRetry
+	}
+
+	return resp, nil
+}
+
 func (client *Client) Completion(ctx context.Context, openaiReq openai.ChatCompletionRequest, w http.ResponseWriter) error {
-	//TODO implement me
-	panic("implement me")
+	resp, err := client.request(ctx, openaiReq, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var msgResp MessageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&msgResp); err != nil {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("decode response failed: %v", err)
+		return base.ErrUpstreamShouldRetry
+	}
+
+	if msgResp.Error != nil {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("chat failed: %s", msgResp.Error.Message)
+		return base.ErrUpstreamShouldRetry
+	}
+
+	openaiResp := openai.ChatCompletionResponse{
+		ID:      msgResp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   openaiReq.Model,
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Index:        0,
+				Message:      openai.ChatCompletionMessage{Role: "assistant", Content: msgResp.Text()},
+				FinishReason: finishReason(msgResp.StopReason),
+			},
+		},
+	}
+
+	if msgResp.Usage != nil {
+		openaiResp.Usage = msgResp.Usage.OpenAI()
+	}
+
+	data, _ := json.Marshal(openaiResp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+
+	return nil
 }
 
 func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.ChatCompletionRequest, w http.ResponseWriter) error {
-	//TODO implement me
-	panic("implement me")
+	resp, err := client.request(ctx, openaiReq, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var id string
+	var usage Usage
+	started := false
+	write := func(chunk openai.ChatCompletionStreamResponse) {
+		chunk.ID, chunk.Object, chunk.Created, chunk.Model = id, "chat.completion.chunk", time.Now().Unix(), openaiReq.Model
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		data, _ := json.Marshal(chunk)
+		_, _ = w.Write([]byte(fmt.Sprintf("data: %s\n\n", data)))
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var event MessageStreamResponse
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &event); err != nil {
+			log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("decode response failed: %v", err)
+			if !started {
+				return base.ErrUpstreamShouldRetry
+			}
+
+			break
+		}
+
+		switch event.Type {
+		case "error":
+			message := ternary.If(event.Error != nil, event.Error, &ResponseError{})
+			log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("chat failed: %s", message.Message)
+			if !started {
+				return base.ErrUpstreamShouldRetry
+			}
+		case "message_start":
+			if event.Message != nil {
+				id = event.Message.ID
+				if event.Message.Usage != nil {
+					usage.InputTokens = event.Message.Usage.InputTokens
+				}
+			}
+
+			write(openai.ChatCompletionStreamResponse{
+				Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Role: "assistant"}}},
+			})
+		case "content_block_delta":
+			if text := event.Text(); text != "" {
+				write(openai.ChatCompletionStreamResponse{
+					Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: text}}},
+				})
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				usage.OutputTokens = event.Usage.OutputTokens
+			}
+
+			if event.Delta != nil && event.Delta.StopReason != "" {
+				write(openai.ChatCompletionStreamResponse{
+					Choices: []openai.ChatCompletionStreamChoice{{FinishReason: finishReason(event.Delta.StopReason)}},
+				})
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Errorf("read response failed: %v", err)
+		if !started {
+			return base.ErrUpstreamShouldRetry
+		}
+	}
+
+	if !started {
+		log.F(log.M{"type": "anthropic", "request_id": base.RequestID(ctx)}).Error("empty response")
+		return base.ErrUpstreamShouldRetry
+	}
+
+	if openaiReq.StreamOptions != nil && openaiReq.StreamOptions.IncludeUsage {
+		openaiUsage := usage.OpenAI()
+		write(openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{}, Usage: &openaiUsage})
+	}
+
+	_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+// finishReason Convert the stop reason of Claude to the finish reason of OpenAI
+func finishReason(stopReason string) openai.FinishReason {
+	switch stopReason {
+	case "":
+		return ""
+	case "max_tokens":
+		return openai.FinishReasonLength
+	case "tool_use":
+		return openai.FinishReasonToolCalls
+	default:
+		return openai.FinishReasonStop
+	}
 }
 
 type MessageRequest struct {
@@ -251,6 +472,11 @@ type Usage struct {
 	OutputTokens int `json:"output_tokens,omitempty"`
 }
 
+// OpenAI Convert the usage to the OpenAI format
+func (u Usage) OpenAI() openai.Usage {
+	return openai.Usage{PromptTokens: u.InputTokens, CompletionTokens: u.OutputTokens, TotalTokens: u.InputTokens + u.OutputTokens}
+}
+
 type MessageResponseContent struct {
 	Type string `json:"type,omitempty"`
 	Text string `json:"text,omitempty"`
@@ -268,6 +494,10 @@ type MessageStreamResponse struct {
 	Type  string        `json:"type"`
 	Index int           `json:"index,omitempty"`
 	Delta *MessageDelta `json:"delta,omitempty"`
+	// Message The message with empty content, only in the message_start event
+	Message *MessageResponse `json:"message,omitempty"`
+	// Usage The cumulative output tokens, only in the message_delta event
+	Usage *Usage `json:"usage,omitempty"`
 	// Error 错误信息
 	Error *ResponseError `json:"error,omitempty"`
 }
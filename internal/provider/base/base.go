@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
 	"github.com/sashabaranov/go-openai"
 	"net/http"
 	"strings"
@@ -26,12 +27,43 @@ const (
 	EndpointAudioTranslate  Endpoint = "/v1/audio/translations"
 	EndpointModeration      Endpoint = "/v1/moderations"
 	EndpointEmbedding       Endpoint = "/v1/embeddings"
+	EndpointTokenize        Endpoint = "/v1/tokenize"
 )
 
-func EndpointNeedModeration(path string) bool {
+// ModerationEndpoints The endpoints whose content can be moderated.
+// The inputs are checked for most of them, for audio transcriptions and translations the transcribed text is checked
+var ModerationEndpoints = []Endpoint{
+	EndpointChatCompletion,
+	EndpointCompletion,
+	EndpointImageGeneration,
+	EndpointImageEdit,
+	EndpointImageVariation,
+	EndpointAudioSpeech,
+	EndpointAudioTranscript,
+	EndpointAudioTranslate,
+	EndpointEmbedding,
+}
+
+// DefaultModerationEndpoints The endpoints moderated by default
+var DefaultModerationEndpoints = []Endpoint{
+	EndpointChatCompletion,
+	EndpointCompletion,
+	EndpointImageGeneration,
+	EndpointImageEdit,
+	EndpointImageVariation,
+	EndpointAudioSpeech,
+}
+
+// EndpointNeedModeration Whether the request path is one of the moderated endpoints
+func EndpointNeedModeration(path string, endpoints []Endpoint) bool {
+	return array.In(Endpoint(strings.TrimSuffix(path, "/")), endpoints)
+}
+
+// EndpointModerateOutput Whether the output of the endpoint is moderated instead of the input
+func EndpointModerateOutput(path string) bool {
 	return array.In(Endpoint(strings.TrimSuffix(path, "/")), []Endpoint{
-		EndpointChatCompletion,
-		EndpointCompletion,
+		EndpointAudioTranscript,
+		EndpointAudioTranslate,
 	})
 }
 
@@ -59,6 +91,41 @@ type Provider interface {
 	CompletionStream(ctx context.Context, openaiReq openai.ChatCompletionRequest, w http.ResponseWriter) error
 }
 
+type contextKey string
+
+const (
+	requestIDKey contextKey = "request-id"
+	formKey      contextKey = "form"
+)
+
+// WithRequestID Attach the request ID to the context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID Get the request ID from the context, return empty string if not exist
+func RequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+
+	return ""
+}
+
+// WithForm Attach the multipart form of the request to the context, the handlers encode it for each upstream
+func WithForm(ctx context.Context, form *formdata.Form) context.Context {
+	return context.WithValue(ctx, formKey, form)
+}
+
+// Form Get the multipart form of the request from the context, return nil if the request is not a multipart form
+func Form(ctx context.Context) *formdata.Form {
+	if form, ok := ctx.Value(formKey).(*formdata.Form); ok {
+		return form
+	}
+
+	return nil
+}
+
 type ResponseError struct {
 	Err  error
 	Resp *http.Response
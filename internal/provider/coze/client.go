@@ -167,17 +167,17 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 
 	body, err := json.Marshal(cozeReq)
 	if err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("marshal request failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("marshal request failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 
 	if log.DebugEnabled() {
-		log.Debug("coze request: ", string(body))
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Debug("coze request: ", string(body))
 	}
 
 	req, err := http.NewRequest("POST", client.url, strings.NewReader(string(body)))
 	if err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("create request failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("create request failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 
@@ -191,14 +191,14 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 
 	resp, err := client.client.Do(req)
 	if err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("request failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("request failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
 		data, _ := io.ReadAll(resp.Body)
-		log.F(log.M{"type": "coze"}).Errorf("request failed: %s", string(data))
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("request failed: %s", string(data))
 		return base.ErrUpstreamShouldRetry
 	}
 
@@ -206,7 +206,7 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 
 	defer func() {
 		if err := recover(); err != nil {
-			log.F(log.M{"type": "coze"}).Errorf("coze request panic: %v", err)
+			log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("coze request panic: %v", err)
 
 			if outputMessage != "" {
 				finalMessage, _ := json.Marshal(openai.ChatCompletionStreamResponse{
@@ -261,7 +261,7 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 				panic(fmt.Errorf("read response failed: %v", err))
 			}
 
-			log.F(log.M{"type": "coze"}).Errorf("read response failed: %v", err)
+			log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("read response failed: %v", err)
 			return base.ErrUpstreamShouldRetry
 		}
 
@@ -271,7 +271,7 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 		}
 
 		if log.DebugEnabled() {
-			log.Debugf("coze response: %s", string(data))
+			log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Debugf("coze response: %s", string(data))
 		}
 
 		if !strings.HasPrefix(dataStr, "data:") {
@@ -286,7 +286,7 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 				panic(fmt.Errorf("decode response failed: %v", err))
 			}
 
-			log.F(log.M{"type": "coze"}).Errorf("decode response failed: %v", err)
+			log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("decode response failed: %v", err)
 			return base.ErrUpstreamShouldRetry
 		}
 
@@ -295,7 +295,7 @@ func (client *Client) CompletionStream(ctx context.Context, openaiReq openai.Cha
 				panic(fmt.Errorf("chat failed: %s", cozeResp.ErrorInformation.Msg))
 			}
 
-			log.F(log.M{"type": "coze"}).Errorf("chat failed: %s", cozeResp.ErrorInformation.Msg)
+			log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("chat failed: %s", cozeResp.ErrorInformation.Msg)
 			return base.ErrUpstreamShouldRetry
 		}
 
@@ -362,13 +362,13 @@ func (client *Client) Completion(ctx context.Context, openaiReq openai.ChatCompl
 
 	body, err := json.Marshal(cozeReq)
 	if err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("marshal request failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("marshal request failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 
 	req, err := http.NewRequest("POST", client.url, strings.NewReader(string(body)))
 	if err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("create request failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("create request failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 
@@ -382,29 +382,29 @@ func (client *Client) Completion(ctx context.Context, openaiReq openai.ChatCompl
 
 	resp, err := client.client.Do(req)
 	if err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("request failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("request failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.F(log.M{"type": "coze"}).Errorf("request failed: %d", resp.StatusCode)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("request failed: %d", resp.StatusCode)
 		return base.ErrUpstreamShouldRetry
 	}
 
 	var cozeResp Response
 	if err := json.NewDecoder(resp.Body).Decode(&cozeResp); err != nil {
-		log.F(log.M{"type": "coze"}).Errorf("decode response failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("decode response failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 
 	if cozeResp.Code != 0 {
-		log.F(log.M{"type": "coze"}).Errorf("chat failed: %s", cozeResp.Msg)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("chat failed: %s", cozeResp.Msg)
 		return base.ErrUpstreamShouldRetry
 	}
 
 	if log.DebugEnabled() {
-		log.With(cozeResp).Debugf("coze non-stream response")
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx), "response": cozeResp}).Debugf("coze non-stream response")
 	}
 
 	openaiResp := openai.ChatCompletionResponse{
@@ -449,7 +449,7 @@ func (client *Client) Completion(ctx context.Context, openaiReq openai.ChatCompl
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(openaiResp); err != nil {
 		w.Header().Del("Content-Type")
-		log.F(log.M{"type": "coze"}).Errorf("encode response failed: %v", err)
+		log.F(log.M{"type": "coze", "request_id": base.RequestID(ctx)}).Errorf("encode response failed: %v", err)
 		return base.ErrUpstreamShouldRetry
 	}
 
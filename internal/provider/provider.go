@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"github.com/mylxsw/asteria/log"
@@ -9,21 +10,27 @@ import (
 	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
 	"github.com/mylxsw/openai-dispatcher/internal/provider/coze"
 	"github.com/mylxsw/openai-dispatcher/internal/provider/transport"
+	"github.com/mylxsw/openai-dispatcher/internal/transform"
+	"github.com/mylxsw/openai-dispatcher/pkg/stream"
 	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 	"golang.org/x/net/proxy"
+	"io"
 	"net/http"
 	"strings"
 )
 
 type provider struct {
-	client  base.Provider
-	server  string
-	key     string
-	dialer  proxy.Dialer
-	replace func(model string) string
+	client      base.Provider
+	server      string
+	key         string
+	dialer      proxy.Dialer
+	replace     func(model string) string
+	transformer *transform.Transformer
 }
 
-func CreateHandler(typ base.ChannelType, server string, key string, dialer proxy.Dialer, replace func(model string) string) (base.Handler, error) {
+func CreateHandler(typ base.ChannelType, server string, key string, dialer proxy.Dialer, replace func(model string) string, transformer *transform.Transformer) (base.Handler, error) {
 	var client base.Provider
 	//var err error
 	switch typ {
@@ -32,34 +39,97 @@ func CreateHandler(typ base.ChannelType, server string, key string, dialer proxy
 	case base.ChannelTypeAnthropic:
 		client = anthropic.New(server, key, dialer)
 	default:
-		return transport.New(server, key, dialer, replace)
+		return transport.New(server, key, dialer, replace, transformer)
 	}
 
 	return &provider{
-		client:  client,
-		server:  server,
-		key:     key,
-		dialer:  dialer,
-		replace: replace,
+		client:      client,
+		server:      server,
+		key:         key,
+		dialer:      dialer,
+		replace:     replace,
+		transformer: transformer,
 	}, nil
 }
 
 func (p *provider) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, errorHandler func(w http.ResponseWriter, r *http.Request, err error)) {
 	if !array.In(base.Endpoint(strings.TrimSuffix(r.URL.Path, "/")), []base.Endpoint{base.EndpointChatCompletion}) {
-		log.F(log.M{"endpoint": r.URL.Path}).Warningf("unsupported endpoint for coze: %s", r.URL.Path)
+		log.F(log.M{"endpoint": r.URL.Path, "request_id": base.RequestID(ctx)}).Warningf("unsupported endpoint for coze: %s", r.URL.Path)
 		errorHandler(w, r, base.ErrUpstreamShouldRetry)
 		return
 	}
 
-	var req openai.ChatCompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Errorf("decode request failed: %v", err)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.F(log.M{"request_id": base.RequestID(ctx)}).Errorf("read request failed: %v", err)
 		errorHandler(w, r, base.ErrUpstreamShouldRetry)
 		return
 	}
 
+	model := gjson.GetBytes(body, "model").String()
 	if p.replace != nil {
-		req.Model = p.replace(req.Model)
+		model = p.replace(model)
+		body, _ = sjson.SetBytes(body, "model", model)
+	}
+
+	body, transformed, err := p.transformer.Apply(base.EndpointChatCompletion, model, body)
+	if err != nil {
+		log.F(log.M{"request_id": base.RequestID(ctx)}).Errorf("transform request failed: %v", err)
+		errorHandler(w, r, err)
+		return
+	}
+
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.F(log.M{"request_id": base.RequestID(ctx)}).Errorf("decode request failed: %v", err)
+		errorHandler(w, r, base.ErrUpstreamShouldRetry)
+		return
+	}
+
+	switch {
+	case transformed.EmulateStream:
+		// Make a non-stream request and convert the response to a stream
+		buf := &responseBuffer{header: make(http.Header)}
+		if err := p.client.Completion(ctx, req, buf); err != nil {
+			errorHandler(w, r, err)
+			return
+		}
+
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(buf.body.Bytes(), &resp); err != nil {
+			log.F(log.M{"request_id": base.RequestID(ctx)}).Errorf("decode response failed: %v", err)
+			errorHandler(w, r, base.ErrUpstreamShouldRetry)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		_ = stream.Write(ctx, w, stream.SplitN(resp, transformed.IncludeUsage, transformed.ChunkSize), transformed.ChunkInterval)
+		return
+	case transformed.AggregateStream:
+		// Make a stream request and merge the stream into a complete response
+		buf := &responseBuffer{header: make(http.Header)}
+		if err := p.client.CompletionStream(ctx, req, buf); err != nil {
+			errorHandler(w, r, err)
+			return
+		}
+
+		merged, err := stream.Merge(buf.body.Bytes())
+		if err != nil {
+			log.F(log.M{"request_id": base.RequestID(ctx)}).Errorf("merge stream failed: %v", err)
+			errorHandler(w, r, base.ErrUpstreamShouldRetry)
+			return
+		}
+
+		body, err := stream.Marshal(merged)
+		if err != nil {
+			errorHandler(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+		return
 	}
 
 	if req.Stream {
@@ -72,3 +142,19 @@ func (p *provider) Serve(ctx context.Context, w http.ResponseWriter, r *http.Req
 		}
 	}
 }
+
+// responseBuffer An http.ResponseWriter keeping the response body in memory
+type responseBuffer struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(int) {}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
@@ -7,8 +7,9 @@ import (
 	"fmt"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/go-utils/array"
-	"github.com/mylxsw/go-utils/must"
 	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/transform"
+	"github.com/mylxsw/openai-dispatcher/pkg/stream"
 	"github.com/sashabaranov/go-openai"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
@@ -18,6 +19,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -32,9 +34,11 @@ type Client struct {
 	// director Request edit
 	director func(req *http.Request)
 	replace  func(model string) string
+	// transformer Transform the request body after the model is replaced
+	transformer *transform.Transformer
 }
 
-func New(server string, key string, dialer proxy.Dialer, replace func(model string) string) (*Client, error) {
+func New(server string, key string, dialer proxy.Dialer, replace func(model string) string, transformer *transform.Transformer) (*Client, error) {
 	target, err := url.Parse(server)
 	if err != nil {
 		return nil, err
@@ -54,7 +58,8 @@ func New(server string, key string, dialer proxy.Dialer, replace func(model stri
 				r.Header.Set("Authorization", "Bearer "+key)
 			}
 		},
-		replace: replace,
+		replace:     replace,
+		transformer: transformer,
 	}, nil
 }
 
@@ -77,138 +82,44 @@ func (target *Client) replaceRequestBody(r *http.Request, newBody []byte) {
 }
 
 func (target *Client) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, errorHandler func(w http.ResponseWriter, r *http.Request, err error)) {
+	var transformed transform.Result
+	if form := base.Form(ctx); form != nil {
+		// The multipart form is encoded again for each upstream with the rewritten model, the uploaded files are streamed
+		model := form.Value("model")
+		if target.replace != nil {
+			model = target.replace(model)
+		}
 
-	if target.replace != nil && base.EndpointHasModel(r.URL.Path) && !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) {
+		body, contentType, length := form.Reader(map[string]string{"model": model})
+		_ = r.Body.Close()
+		r.Body, r.ContentLength = body, length
+		r.Header.Set("Content-Type", contentType)
+	} else if (target.replace != nil || target.transformer != nil) && base.EndpointHasModel(r.URL.Path) && !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) {
 		body, err := target.readRequestBody(r)
 		if err != nil {
 			errorHandler(w, r, err)
 			return
 		}
 
-		newModel := target.replace(gjson.Get(string(body), "model").String())
-		newBody, _ := sjson.Set(string(body), "model", newModel)
-		if strings.HasPrefix(newModel, "o1-") && gjson.Get(string(body), "stream").Bool() {
-			// Temporary solution, as the current o1 series model does not support streaming.
-			// If the model is o1-*, the stream field is forcibly set to false
-			var reqBody openai.ChatCompletionRequest
-			if err := json.Unmarshal([]byte(newBody), &reqBody); err != nil {
-				errorHandler(w, r, err)
-				return
-			}
-
-			reqBody.Stream = false
-			includeUsage := reqBody.StreamOptions != nil && reqBody.StreamOptions.IncludeUsage
-			reqBody.StreamOptions = nil
-
-			// replace system role with user role
-			reqBody.Messages = array.Map(reqBody.Messages, func(item openai.ChatCompletionMessage, index int) openai.ChatCompletionMessage {
-				if item.Role == "system" {
-					item.Role = "user"
-				}
-
-				return item
-			})
-
-			// send a post request to the server
-			req, err := http.NewRequestWithContext(ctx, "POST", must.Must(url.JoinPath(target.server, "/v1/chat/completions")), strings.NewReader(string(must.Must(json.Marshal(reqBody)))))
-			if err != nil {
-				errorHandler(w, r, err)
-				return
-			}
-
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+target.key)
-
-			client := &http.Client{}
-			if target.dialer != nil {
-				client.Transport = &http.Transport{
-					Dial: target.dialer.Dial,
-				}
-			}
-
-			resp, err := client.Do(req)
-			if err != nil {
-				log.F(log.M{"type": "openai"}).Errorf("request failed: %v", err)
-				errorHandler(w, r, base.ErrUpstreamShouldRetry)
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
-				data, _ := io.ReadAll(resp.Body)
-				log.F(log.M{"type": "openai"}).Errorf("request failed: %s", string(data))
-				errorHandler(w, r, base.ErrUpstreamShouldRetry)
-				return
-			}
-
-			data, _ := io.ReadAll(resp.Body)
-			var openaiResp openai.ChatCompletionResponse
-			if err := json.Unmarshal(data, &openaiResp); err != nil {
-				log.F(log.M{"type": "openai"}).Errorf("unmarshal response failed: %v", err)
-				errorHandler(w, r, base.ErrUpstreamShouldRetry)
-				return
-			}
-
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Connection", "keep-alive")
-
-			streamResp := openai.ChatCompletionStreamResponse{
-				ID:      openaiResp.ID,
-				Object:  "chat.completion.chunk",
-				Created: openaiResp.Created,
-				Model:   openaiResp.Model,
-				Choices: array.Map(openaiResp.Choices, func(item openai.ChatCompletionChoice, index int) openai.ChatCompletionStreamChoice {
-					return openai.ChatCompletionStreamChoice{
-						Index: item.Index,
-						Delta: openai.ChatCompletionStreamChoiceDelta{
-							Content:      item.Message.Content,
-							Role:         item.Message.Role,
-							FunctionCall: item.Message.FunctionCall,
-							ToolCalls:    item.Message.ToolCalls,
-						},
-						FinishReason: item.FinishReason,
-					}
-				}),
-				Usage: nil,
-			}
-
-			streamRespData, _ := json.Marshal(streamResp)
-			_, _ = w.Write([]byte(fmt.Sprintf("data: %s\n\n", string(streamRespData))))
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
-
-			if includeUsage {
-				// If includeUsage, an additional chunk will be streamed before the data: [DONE] message.
-				// The usage field on this chunk shows the token usage statistics for the entire request,
-				// and the choices field will always be an empty array.
-				// All other chunks will also include a usage field, but with a null value.
-				usage, _ := json.Marshal(openai.ChatCompletionStreamResponse{
-					ID:      openaiResp.ID + "-usage",
-					Object:  "chat.completion.chunk",
-					Created: openaiResp.Created,
-					Model:   openaiResp.Model,
-					Choices: []openai.ChatCompletionStreamChoice{},
-					Usage:   &openaiResp.Usage,
-				})
-
-				_, _ = w.Write([]byte(fmt.Sprintf("data: %s\n\n", string(usage))))
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
-			}
-
-			_, _ = w.Write([]byte("data: [DONE]\n\n"))
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			}
+		model := gjson.GetBytes(body, "model").String()
+		if target.replace != nil {
+			model = target.replace(model)
+			body, _ = sjson.SetBytes(body, "model", model)
+		}
 
+		body, transformed, err = target.transformer.Apply(base.Endpoint(strings.TrimSuffix(r.URL.Path, "/")), model, body)
+		if err != nil {
+			log.F(log.M{"type": "openai", "request_id": base.RequestID(ctx)}).Errorf("transform request failed: %v", err)
+			errorHandler(w, r, err)
 			return
 		}
 
-		body = []byte(newBody)
 		target.replaceRequestBody(r, body)
+
+		// The response is converted, it can only be read when it is not compressed
+		if transformed.EmulateStream || transformed.AggregateStream {
+			r.Header.Del("Accept-Encoding")
+		}
 	}
 
 	// Proxy forwarding
@@ -246,13 +157,22 @@ func (target *Client) Serve(ctx context.Context, w http.ResponseWriter, r *http.
 	}
 	revProxy.ModifyResponse = func(resp *http.Response) error {
 		if log.DebugEnabled() {
-			log.Debugf("request: %s %s [%d] %v", resp.Request.Method, resp.Request.URL.String(), resp.StatusCode, time.Since(startTime))
+			log.F(log.M{"request_id": base.RequestID(ctx)}).Debugf("request: %s %s [%d] %v", resp.Request.Method, resp.Request.URL.String(), resp.StatusCode, time.Since(startTime))
 		}
 
 		if resp.StatusCode >= 500 {
 			return fmt.Errorf("%w | %w", parseErrorMessage(resp), base.ErrUpstreamShouldRetry)
 		}
 
+		if resp.StatusCode == http.StatusOK {
+			switch {
+			case transformed.EmulateStream:
+				return emulateStream(ctx, resp, transformed)
+			case transformed.AggregateStream:
+				return aggregateStream(resp)
+			}
+		}
+
 		switch resp.StatusCode {
 		case 400:
 			// 400 Error Responding to a content filtering issue with Azure
@@ -282,6 +202,79 @@ func (target *Client) Serve(ctx context.Context, w http.ResponseWriter, r *http.
 	revProxy.ServeHTTP(w, r)
 }
 
+// emulateStream Convert the non-stream chat completion response to a stream, for the clients asking for a stream
+// from the upstreams not supporting it. The chunks are written one by one when the chunk interval is set
+func emulateStream(ctx context.Context, resp *http.Response, transformed transform.Result) error {
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("%w | %w", err, base.ErrUpstreamShouldRetry)
+	}
+
+	var completion openai.ChatCompletionResponse
+	if err := json.Unmarshal(data, &completion); err != nil {
+		return fmt.Errorf("unmarshal response failed: %w | %w", err, base.ErrUpstreamShouldRetry)
+	}
+
+	chunks := stream.SplitN(completion, transformed.IncludeUsage, transformed.ChunkSize)
+
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Header.Set("Cache-Control", "no-cache")
+	resp.Header.Del("Content-Encoding")
+
+	if transformed.ChunkInterval > 0 {
+		reader, writer := io.Pipe()
+		go func() {
+			_ = writer.CloseWithError(stream.Write(ctx, writer, chunks, transformed.ChunkInterval))
+		}()
+
+		resp.Body = reader
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+
+	body := stream.Encode(chunks)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// aggregateStream Merge the stream response into a complete chat completion response, for the clients asking for
+// a non-stream response from the upstreams only supporting streams
+func aggregateStream(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("%w | %w", err, base.ErrUpstreamShouldRetry)
+	}
+
+	merged, err := stream.Merge(data)
+	if err != nil {
+		return fmt.Errorf("merge stream failed: %w | %w", err, base.ErrUpstreamShouldRetry)
+	}
+
+	body, err := stream.Marshal(merged)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Cache-Control")
+
+	return nil
+}
+
 func parseErrorMessage(resp *http.Response) error {
 	data, _ := io.ReadAll(resp.Body)
 	_ = resp.Body.Close()
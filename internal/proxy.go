@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/pkg/image"
 	"golang.org/x/net/proxy"
 )
 
@@ -12,3 +14,15 @@ func createSocks5Dialer(proxyAddr string) (proxy.Dialer, error) {
 
 	return dialer, nil
 }
+
+// fetchOptions The limits of downloading the images in the requests
+func fetchOptions(conf config.ImageFetch) image.FetchOptions {
+	return image.FetchOptions{
+		MaxBytes:     conf.MaxBytes,
+		Timeout:      conf.Timeout,
+		MediaTypes:   conf.MediaTypes,
+		CacheSize:    conf.CacheSize,
+		CacheTTL:     conf.CacheTTL,
+		AllowPrivate: conf.AllowPrivate,
+	}
+}
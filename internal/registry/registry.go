@@ -0,0 +1,162 @@
+package registry
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strings"
+)
+
+//go:embed models.yaml
+var builtinModels []byte
+
+// Capability A capability a request may need from the model
+type Capability string
+
+const (
+	CapabilityVision   Capability = "vision"
+	CapabilityTools    Capability = "tools"
+	CapabilityJSONMode Capability = "json-mode"
+)
+
+// Registry The capabilities of the known models, the built-in models are replaced by the configured ones of the same name
+type Registry struct {
+	models  []config.ModelInfo
+	names   map[string]int
+	aliases map[string]int
+	// patterns The aliases with wildcards, the longest matching pattern wins
+	patterns []pattern
+}
+
+type pattern struct {
+	alias string
+	re    *regexp.Regexp
+	index int
+}
+
+// New Create a registry of the built-in models and the configured models
+func New(models []config.ModelInfo) (*Registry, error) {
+	var builtin []config.ModelInfo
+	if err := yaml.Unmarshal(builtinModels, &builtin); err != nil {
+		return nil, fmt.Errorf("load built-in models failed: %w", err)
+	}
+
+	reg := &Registry{names: make(map[string]int), aliases: make(map[string]int)}
+	for _, model := range append(builtin, models...) {
+		if index, ok := reg.names[model.Name]; ok {
+			reg.models[index] = model
+			continue
+		}
+
+		reg.names[model.Name] = len(reg.models)
+		reg.models = append(reg.models, model)
+	}
+
+	for index, model := range reg.models {
+		for _, alias := range model.Aliases {
+			if !strings.Contains(alias, "*") {
+				reg.aliases[alias] = index
+				continue
+			}
+
+			reg.patterns = append(reg.patterns, pattern{
+				alias: alias,
+				re:    regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(alias), `\*`, ".*") + "$"),
+				index: index,
+			})
+		}
+	}
+
+	return reg, nil
+}
+
+// Lookup Find the model by the name, the aliases and then the aliases with wildcards
+func (reg *Registry) Lookup(model string) (config.ModelInfo, bool) {
+	if reg == nil {
+		return config.ModelInfo{}, false
+	}
+
+	if index, ok := reg.names[model]; ok {
+		return reg.models[index], true
+	}
+
+	if index, ok := reg.aliases[model]; ok {
+		return reg.models[index], true
+	}
+
+	matched := -1
+	for i, p := range reg.patterns {
+		if p.re.MatchString(model) && (matched < 0 || len(p.alias) > len(reg.patterns[matched].alias)) {
+			matched = i
+		}
+	}
+
+	if matched < 0 {
+		return config.ModelInfo{}, false
+	}
+
+	return reg.models[reg.patterns[matched].index], true
+}
+
+// Supports Whether the model supports the capability, the unknown models and capabilities are assumed to be supported
+func (reg *Registry) Supports(model string, capability Capability) bool {
+	info, ok := reg.Lookup(model)
+	if !ok {
+		return true
+	}
+
+	var supported *bool
+	switch capability {
+	case CapabilityVision:
+		supported = info.Vision
+	case CapabilityTools:
+		supported = info.Tools
+	case CapabilityJSONMode:
+		supported = info.JSONMode
+	}
+
+	return supported == nil || *supported
+}
+
+// Tokenizer The tokenizer family of the model, empty if it is unknown
+func (reg *Registry) Tokenizer(model string) string {
+	info, _ := reg.Lookup(model)
+	return info.Tokenizer
+}
+
+// Required The capabilities required by the chat completion request: images in the messages need vision,
+// tools or functions need tools, and a JSON response format needs the JSON mode
+func Required(body []byte) []Capability {
+	res := make([]Capability, 0)
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		if message.Get(`content.#(type=="image_url")`).Exists() {
+			res = append(res, CapabilityVision)
+			break
+		}
+	}
+
+	if len(gjson.GetBytes(body, "tools").Array()) > 0 || len(gjson.GetBytes(body, "functions").Array()) > 0 {
+		res = append(res, CapabilityTools)
+	}
+
+	if format := gjson.GetBytes(body, "response_format.type").String(); format == "json_object" || format == "json_schema" {
+		res = append(res, CapabilityJSONMode)
+	}
+
+	return res
+}
+
+// Missing The capabilities the model does not support in the required ones
+func (reg *Registry) Missing(model string, required []Capability) []Capability {
+	res := make([]Capability, 0)
+	for _, capability := range required {
+		if !reg.Supports(model, capability) {
+			res = append(res, capability)
+		}
+	}
+
+	return res
+}
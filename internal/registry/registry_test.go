@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"testing"
+)
+
+func TestRegistry_Lookup(t *testing.T) {
+	vision := true
+	reg, err := New([]config.ModelInfo{
+		{Name: "glm-4v", Vision: &vision, Tokenizer: "custom"},
+		{Name: "my-model", Aliases: []string{"my-*", "my-model-v2-*"}, MaxOutput: 100},
+	})
+	assert.NoError(t, err)
+
+	info, ok := reg.Lookup("gpt-4o-2024-08-06")
+	assert.True(t, ok)
+	assert.Equal(t, "gpt-4o", info.Name)
+
+	// The longest wildcard alias wins
+	info, ok = reg.Lookup("gpt-4o-mini-2024-07-18")
+	assert.True(t, ok)
+	assert.Equal(t, "gpt-4o-mini", info.Name)
+
+	// The configured models replace the built-in ones of the same name
+	assert.Equal(t, "custom", reg.Tokenizer("glm-4v"))
+	info, ok = reg.Lookup("my-model-v2-beta")
+	assert.True(t, ok)
+	assert.Equal(t, 100, info.MaxOutput)
+
+	_, ok = reg.Lookup("unknown")
+	assert.False(t, ok)
+	assert.True(t, reg.Supports("unknown", CapabilityVision))
+	assert.False(t, reg.Supports("o1-mini", CapabilityVision))
+	assert.True(t, reg.Supports("my-model", CapabilityTools))
+}
+
+func TestRequired(t *testing.T) {
+	assert.Equal(t, 0, len(Required([]byte(`{"messages":[{"role":"user","content":"hi"}]}`))))
+
+	required := Required([]byte(`{
+		"messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"x"}}]}],
+		"tools":[{"type":"function"}],
+		"response_format":{"type":"json_object"}
+	}`))
+	assert.EqualValues(t, []Capability{CapabilityVision, CapabilityTools, CapabilityJSONMode}, required)
+
+	reg, err := New(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, []Capability{CapabilityVision, CapabilityTools, CapabilityJSONMode}, reg.Missing("o1-mini", required))
+	assert.Equal(t, 0, len(reg.Missing("gpt-4o", required)))
+}
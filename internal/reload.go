@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/mylxsw/asteria/level"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/pkg/image"
+	"github.com/mylxsw/openai-dispatcher/pkg/token"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Reload Reload the configuration file and replace the runtime state.
+// If the new configuration is invalid or changes the settings only used when the server starts,
+// the current state is kept and the error is returned
+func (s *Server) Reload() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	conf, err := config.LoadConfig(s.configFilePath)
+	if err != nil {
+		log.F(log.M{"path": s.configFilePath}).Errorf("reload configuration failed, keep the current configuration: %v", err)
+		return err
+	}
+
+	old := s.state.Load()
+	if changed := restartRequired(old.conf, conf); len(changed) > 0 {
+		err := fmt.Errorf("%s can not be changed by reload, restart the server to apply the configuration", strings.Join(changed, ", "))
+		log.F(log.M{"path": s.configFilePath}).Errorf("reload configuration failed, keep the current configuration: %v", err)
+		return err
+	}
+
+	st, err := newState(conf)
+	if err != nil {
+		log.F(log.M{"path": s.configFilePath}).Errorf("build upstreams failed, keep the current configuration: %v", err)
+		return err
+	}
+
+	st.components, err = newComponents(s.ctx, conf, old.components)
+	if err != nil {
+		log.F(log.M{"path": s.configFilePath}).Errorf("build components failed, keep the current configuration: %v", err)
+		return err
+	}
+
+	s.state.Store(st)
+	token.SetFamilyResolver(st.registry.Tokenizer)
+	image.SetFetchOptions(fetchOptions(st.conf.ImageFetch))
+	log.All().LogLevel(ternary.If(conf.Debug, level.Debug, level.Info))
+
+	// The replaced components are closed when the requests started on the old state have finished
+	time.AfterFunc(requestTimeout+time.Minute, func() { old.components.release(st.components) })
+
+	log.F(log.M{"path": s.configFilePath, "models": len(st.upstreams), "rules": len(conf.Rules)}).Info("configuration reloaded")
+	return nil
+}
+
+// restartRequired The changed settings which are only used when the server starts
+func restartRequired(old, conf *config.Config) []string {
+	var changed []string
+	for _, setting := range []struct {
+		name    string
+		changed bool
+	}{
+		{name: "listen", changed: old.Listen != conf.Listen},
+		{name: "log-path", changed: old.LogPath != conf.LogPath},
+		{name: "enable-prometheus", changed: old.EnablePrometheus != conf.EnablePrometheus},
+		{name: "admin.listen", changed: old.Admin.Listen != conf.Admin.Listen},
+	} {
+		if setting.changed {
+			changed = append(changed, setting.name)
+		}
+	}
+
+	return changed
+}
+
+// WatchConfig Reload the configuration when SIGHUP is received or the configuration file is modified
+func (s *Server) WatchConfig(ctx context.Context, interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSignature := s.configSignature()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.F(log.M{"path": s.configFilePath}).Info("SIGHUP received, reload configuration")
+			_ = s.Reload()
+			lastSignature = s.configSignature()
+		case <-ticker.C:
+			signature := s.configSignature()
+			if signature == lastSignature {
+				continue
+			}
+
+			log.F(log.M{"path": s.configFilePath}).Info("configuration file changed, reload configuration")
+			_ = s.Reload()
+			lastSignature = s.configSignature()
+		}
+	}
+}
+
+// configSignature The modification time of all configuration files, it changes when any of them is modified.
+// The configuration path itself is included, so that adding a file to the configuration directory is detected
+func (s *Server) configSignature() string {
+	paths := append([]string{s.configFilePath}, s.state.Load().conf.Sources...)
+
+	var signature strings.Builder
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil {
+			signature.WriteString(fmt.Sprintf("%s:%d;", path, stat.ModTime().UnixNano()))
+		}
+	}
+
+	return signature.String()
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chatUpstream A fake upstream answering the chat completions with the content
+func chatUpstream(content string, handle func()) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handle != nil {
+			handle()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"` + content + `"},"finish_reason":"stop"}]}`))
+	}))
+}
+
+func reloadConfig(upstreamURL string, extra string) string {
+	return `keys: ["client-key-123456"]
+rules:
+  - servers: ["` + upstreamURL + `"]
+    keys: ["sk-upstream"]
+    models: [gpt-4o]
+` + extra
+}
+
+func TestReload(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	first := chatUpstream("first", func() {
+		once.Do(func() { close(started) })
+		<-release
+	})
+	defer first.Close()
+
+	second := chatUpstream("second", nil)
+	defer second.Close()
+
+	server := newTestServer(t, reloadConfig(first.URL, ""))
+	chat := func() string {
+		w := doRequest(server, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+		return gjson.Get(w.Body.String(), "choices.0.message.content").String()
+	}
+
+	// The request in flight keeps the state it started with
+	inflight := make(chan string)
+	go func() { inflight <- chat() }()
+	<-started
+
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(second.URL, "")), 0644))
+	assert.NoError(t, server.Reload())
+	assert.Equal(t, "second", chat())
+
+	close(release)
+	assert.Equal(t, "first", <-inflight)
+
+	// The invalid configuration is rejected, the current one is kept
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(first.URL, "policy: unknown\n")), 0644))
+	assert.True(t, server.Reload() != nil)
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte("rules: [\n"), 0644))
+	assert.True(t, server.Reload() != nil)
+	assert.Equal(t, "second", chat())
+}
+
+func TestReload_Components(t *testing.T) {
+	var requests atomic.Int32
+	up := chatUpstream("ok", func() { requests.Add(1) })
+	defer up.Close()
+
+	cacheConfig := "cache:\n  enabled: true\n  ttl: 1h\n"
+	server := newTestServer(t, reloadConfig(up.URL, cacheConfig))
+	chat := func() string {
+		return doRequest(server, http.MethodPost, "/v1/chat/completions", `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`).Header().Get("X-Cache")
+	}
+
+	assert.Equal(t, "MISS", chat())
+	assert.Equal(t, "HIT", chat())
+
+	// The cache is kept when its settings are not changed
+	cached := server.state.Load().cache
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(up.URL, cacheConfig+"extra-models: [gpt-4o-mini]\n")), 0644))
+	assert.NoError(t, server.Reload())
+	assert.True(t, cached == server.state.Load().cache)
+	assert.Equal(t, "HIT", chat())
+
+	// The cache and the capturer are rebuilt with the new settings
+	capturePath := t.TempDir()
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(up.URL, "cache:\n  enabled: true\n  ttl: 2h\ncapture:\n  enabled: true\n  all-keys: true\n  path: "+capturePath+"\n")), 0644))
+	assert.NoError(t, server.Reload())
+	assert.False(t, cached == server.state.Load().cache)
+	assert.Equal(t, 2*time.Hour, server.state.Load().cache.conf.(config.Cache).TTL)
+	assert.Equal(t, "MISS", chat())
+
+	files, _ := os.ReadDir(capturePath)
+	assert.Equal(t, 1, len(files))
+
+	// Disabled by the reload
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(up.URL, "")), 0644))
+	assert.NoError(t, server.Reload())
+	assert.Equal(t, "", chat())
+	assert.Equal(t, int32(3), requests.Load())
+
+	// The settings only used when the server starts can not be reloaded, nothing is applied
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(up.URL, "listen: \":9999\"\ncache:\n  enabled: true\n")), 0644))
+	err := server.Reload()
+	assert.True(t, err != nil && strings.Contains(err.Error(), "listen can not be changed by reload"))
+	assert.True(t, server.state.Load().cache == nil)
+}
+
+func TestWatchConfig(t *testing.T) {
+	first := chatUpstream("first", nil)
+	defer first.Close()
+	second := chatUpstream("second", nil)
+	defer second.Close()
+
+	server := newTestServer(t, reloadConfig(first.URL, ""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.WatchConfig(ctx, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// The modification time is moved forward, so that the change is detected on any file system
+	assert.NoError(t, os.WriteFile(server.configFilePath, []byte(reloadConfig(second.URL, "")), 0644))
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(server.configFilePath, future, future))
+
+	for i := 0; i < 100 && server.state.Load().conf.Rules[0].Servers[0] != second.URL; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, second.URL, server.state.Load().conf.Rules[0].Servers[0])
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/internal/capture"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/moderation"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"io"
+	"sort"
+	"strings"
+)
+
+// RemoderateOptions The policy overrides used when re-running moderation over captured inputs
+type RemoderateOptions struct {
+	// ClientKey The name of the client key whose policy is used, the policy of the captured key is used when empty
+	ClientKey string
+	// ScoreThreshold Override the threshold of the categories without a threshold
+	ScoreThreshold float64
+	// Thresholds Override the threshold of the categories
+	Thresholds map[string]float64
+	// Verbose Print every record, otherwise only the flagged ones are printed
+	Verbose bool
+}
+
+// remoderateStat The statistics of a category
+type remoderateStat struct {
+	flagged  int
+	maxScore float64
+}
+
+// Remoderate Re-run moderation over the captured inputs of the moderated endpoints, and print the decisions under the policy.
+// It is used to tune the thresholds offline, the captured inputs must not be redacted
+func Remoderate(ctx context.Context, conf *config.Config, path string, opts RemoderateOptions, out io.Writer) error {
+	st, err := newState(conf)
+	if err != nil {
+		return err
+	}
+
+	if st.moderation == nil {
+		return fmt.Errorf("moderation is disabled")
+	}
+
+	keyByName := func(name string) *config.ClientKey {
+		for i := range conf.Keys {
+			if conf.Keys[i].Name == name {
+				return &conf.Keys[i]
+			}
+		}
+
+		return nil
+	}
+
+	var total, skipped, failed, passed, flagged, blocked int
+	stats := make(map[string]*remoderateStat)
+
+	err = capture.ReadFile(path, func(rec capture.Record) error {
+		total++
+
+		if !base.EndpointNeedModeration(rec.Endpoint, conf.Moderation.Endpoints) {
+			skipped++
+			return nil
+		}
+
+		// The bodies of the multipart forms are not captured, they are skipped since nothing is found in them
+		mReq, err := moderation.ConvertRequest(base.Endpoint(rec.Endpoint), "application/json", rec.Request, conf.Moderation.API.Model)
+		if err != nil {
+			skipped++
+			return nil
+		}
+
+		mReq.Input = array.Filter(mReq.Input, func(input moderation.Input, _ int) bool {
+			return input.Type != "text" || (input.Text != "" && input.Text != capture.RedactedValue)
+		})
+		if len(mReq.Input) == 0 {
+			skipped++
+			return nil
+		}
+
+		mp := st.moderationPolicy(keyByName(rec.ClientKey))
+		if opts.ClientKey != "" {
+			key := keyByName(opts.ClientKey)
+			if key == nil {
+				return fmt.Errorf("client key %s not found", opts.ClientKey)
+			}
+
+			mp = st.moderationPolicy(key)
+		}
+
+		policy := mp.policy
+		if opts.ScoreThreshold > 0 {
+			policy.ScoreThreshold = opts.ScoreThreshold
+		}
+
+		if len(opts.Thresholds) > 0 {
+			thresholds := make(map[string]float64)
+			for category, threshold := range policy.Thresholds {
+				thresholds[category] = threshold
+			}
+
+			for category, threshold := range opts.Thresholds {
+				thresholds[category] = threshold
+			}
+
+			policy.Thresholds = thresholds
+		}
+
+		res, err := st.moderation.Moderation(moderation.WithPolicy(ctx, policy), mReq)
+		if err != nil {
+			failed++
+			_, _ = fmt.Fprintf(out, "%s\t%s\terror\t%v\n", rec.RequestID, rec.ClientKey, err)
+			return nil
+		}
+
+		maxScores := make(map[string]float64)
+		for _, result := range res.Results {
+			for category, score := range result.CategoryScores {
+				if score > maxScores[category] {
+					maxScores[category] = score
+				}
+			}
+		}
+
+		flaggedCategories := policy.FlaggedCategories(*res)
+		violated := policy.Violated(flaggedCategories)
+		for category, score := range maxScores {
+			if stats[category] == nil {
+				stats[category] = &remoderateStat{}
+			}
+
+			if score > stats[category].maxScore {
+				stats[category].maxScore = score
+			}
+
+			if array.In(category, flaggedCategories) {
+				stats[category].flagged++
+			}
+		}
+
+		verdict := "passed"
+		switch {
+		case len(violated) > 0:
+			verdict = "blocked"
+			blocked++
+		case len(flaggedCategories) > 0:
+			verdict = "flagged"
+			flagged++
+		default:
+			passed++
+		}
+
+		if verdict == "passed" && !opts.Verbose {
+			return nil
+		}
+
+		_, snippet := policy.Offending(mReq, *res)
+		_, _ = fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%q\n", rec.RequestID, rec.ClientKey, verdict, formatScores(maxScores, 3), snippet)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "\nrecords: %d, skipped: %d, errors: %d, passed: %d, flagged: %d, blocked: %d\n", total, skipped, failed, passed, flagged, blocked)
+
+	categories := make([]string, 0, len(stats))
+	for category := range stats {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	for _, category := range categories {
+		_, _ = fmt.Fprintf(out, "  %-24s flagged: %-6d max score: %.4f\n", category, stats[category].flagged, stats[category].maxScore)
+	}
+
+	return nil
+}
+
+// formatScores Format the top n scores, such as "violence=0.9312 hate=0.0102"
+func formatScores(scores map[string]float64, n int) string {
+	categories := make([]string, 0, len(scores))
+	for category := range scores {
+		categories = append(categories, category)
+	}
+
+	sort.Slice(categories, func(i, j int) bool { return scores[categories[i]] > scores[categories[j]] })
+	if len(categories) > n {
+		categories = categories[:n]
+	}
+
+	return strings.Join(array.Map(categories, func(category string, _ int) string {
+		return fmt.Sprintf("%s=%.4f", category, scores[category])
+	}), " ")
+}
@@ -3,101 +3,83 @@ package internal
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/go-utils/array"
-	"github.com/mylxsw/go-utils/maps"
-	"github.com/mylxsw/go-utils/must"
 	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/accesslog"
+	"github.com/mylxsw/openai-dispatcher/internal/cache"
+	"github.com/mylxsw/openai-dispatcher/internal/capture"
 	"github.com/mylxsw/openai-dispatcher/internal/config"
 	"github.com/mylxsw/openai-dispatcher/internal/moderation"
-	"github.com/mylxsw/openai-dispatcher/internal/provider"
 	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
 	"github.com/mylxsw/openai-dispatcher/internal/upstream"
-	"github.com/mylxsw/openai-dispatcher/pkg/expr"
-	"github.com/sashabaranov/go-openai"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
+	"github.com/mylxsw/openai-dispatcher/pkg/image"
+	"github.com/mylxsw/openai-dispatcher/pkg/token"
 	"github.com/tidwall/gjson"
-	"golang.org/x/net/proxy"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// requestTimeout The maximum duration of dispatching a request to the upstreams
+const requestTimeout = 180 * time.Second
+
 var (
 	ErrRequestFlagged = errors.New("the request contains illegal content, we cannot service you")
 	ErrModelRequired  = errors.New("model is required")
 	ErrNotSupport     = errors.New("not support")
+	// ErrModerationUnavailable The moderation fails and the fail mode is closed
+	ErrModerationUnavailable = errors.New("content moderation is unavailable, please try again later")
+	// ErrModelNotAllowed The client key is not allowed to use the model
+	ErrModelNotAllowed = errors.New("the model is not allowed for this key")
+	// ErrCapabilityNotSupported No upstream of the model supports the capabilities required by the request
+	ErrCapabilityNotSupported = errors.New("the model does not support")
 )
 
 type Server struct {
-	conf             *config.Config
-	upstreams        map[string]*upstream.Upstreams
-	defaultUpstreams *upstream.Upstreams
-	exprRules        []config.Rule
-
-	supportModels []openai.Model
-
-	dialer proxy.Dialer
-	once   sync.Once
-
-	moderation *moderation.Client
+	// state The runtime state built from the configuration, replaced as a whole when the configuration is reloaded.
+	// Each request loads the state once, so in-flight requests finish on the state they started with
+	state atomic.Pointer[state]
+
+	// ctx The lifecycle of the server, the background tasks of the components stop when it is done
+	ctx            context.Context
+	configFilePath string
+	reloadLock     sync.Mutex
 }
 
-func NewServer(conf *config.Config) (*Server, error) {
-	var dialer proxy.Dialer
-	var err error
-
-	if conf.Socks5 != "" {
-		dialer, err = createSocks5Dialer(conf.Socks5)
-		if err != nil {
-			log.Errorf("create socks5 dialer failed: %v", err)
-		}
+func NewServer(ctx context.Context, conf *config.Config, configFilePath string) (*Server, error) {
+	st, err := newState(conf)
+	if err != nil {
+		return nil, err
 	}
 
-	result, err := upstream.BuildUpstreamsFromRules(upstream.Policy(conf.Policy), conf.Rules, dialer)
+	st.components, err = newComponents(ctx, conf, components{})
 	if err != nil {
 		return nil, err
 	}
 
-	for model, ups := range result.Upstreams {
+	for model, ups := range st.upstreams {
 		fmt.Println(model)
 		ups.Print()
 	}
 
 	fmt.Println("-------- defaults ---------")
 
-	result.Default.Print()
-
-	// Support models
-	models := make([]openai.Model, 0)
-	for _, model := range array.Uniq(append(maps.Keys(result.Upstreams), conf.ExtraModels...)) {
-		models = append(models, openai.Model{
-			ID:        model,
-			Object:    "model",
-			CreatedAt: time.Now().Unix(),
-			OwnedBy:   "system",
-		})
-	}
-
-	server := Server{
-		conf:             conf,
-		upstreams:        result.Upstreams,
-		defaultUpstreams: result.Default,
-		exprRules:        result.ExprRules,
-		supportModels:    models,
-	}
+	st.defaultUpstreams.Print()
 
-	if conf.Moderation.Enabled {
-		server.moderation = moderation.New(
-			conf.Moderation.API.Server,
-			conf.Moderation.API.Key,
-			ternary.If(conf.Moderation.API.Proxy, dialer, nil),
-		)
-	}
+	server := Server{ctx: ctx, configFilePath: configFilePath}
+	server.state.Store(st)
+	token.SetFamilyResolver(st.registry.Tokenizer)
+	image.SetFetchOptions(fetchOptions(st.conf.ImageFetch))
 
 	return &server, nil
 }
@@ -145,195 +127,304 @@ func (s *Server) buildRequest(r *http.Request) (*Request, error) {
 	}, nil
 }
 
-func (s *Server) selectUpstreams(model string) *upstream.Upstreams {
-	if ups, ok := s.upstreams[model]; ok {
-		return ups
-	}
-
+// Dispatch Request distribution implementation logic
+func (s *Server) Dispatch(st *state, clientKey *config.ClientKey, w http.ResponseWriter, r *http.Request) error {
 	var ups *upstream.Upstreams
-	for _, rule := range s.exprRules {
-		if rule.Expr == nil || rule.Expr.Match == "" {
-			continue
-		}
-
-		matched, err := must.Must(expr.NewBoolVM(rule.Expr.Match)).Run(expr.Data{Model: model})
-		if err != nil {
-			log.F(log.M{"model": model, "expr": rule.Expr.Match}).Errorf("evaluate expr failed: %v", err)
-			continue
-		}
+	var selected *upstream.Upstream
+	var selectedIndex int
+	// excluded The upstreams never used to serve the request, even when retrying
+	var excluded []int
 
-		if matched {
-			if ups == nil {
-				ups = upstream.NewUpstreams(upstream.Policy(s.conf.Policy))
-			}
+	entry := accesslog.EntryFromContext(r.Context())
+	internal, isInternal := internalRequestFrom(r.Context())
 
-			for serverIndex, server := range rule.Servers {
-				for keyIndex, key := range rule.Keys {
-					if handler, err := provider.CreateHandler(rule.Type, server, key, ternary.If(rule.Proxy, s.dialer, nil), rule.ModelReplacer); err != nil {
-						log.Errorf("upstream failed to create: %v", err)
-					} else {
-						ups.Add(&upstream.Upstream{
-							Rule:        rule,
-							Handler:     handler,
-							ServerIndex: serverIndex,
-							KeyIndex:    keyIndex,
-						})
-					}
-				}
-			}
-		}
+	// The requests of the clients are completed even if the clients have gone away, so the responses can be cached,
+	// the internal requests are cancelled with the requests made them
+	parent := context.Background()
+	if isInternal {
+		parent = r.Context()
 	}
 
-	if ups != nil && ups.Len() > 0 {
-		if err := ups.Init(); err != nil {
-			log.F(log.M{"model": model, "ups": ups}).Errorf("upstreams init failed: %v", err)
-			return nil
-		}
-
-		return ups
-	}
+	ctx, cancel := context.WithTimeout(base.WithRequestID(parent, entry.RequestID), requestTimeout)
+	defer cancel()
 
-	return nil
-}
+	var body []byte
+	// form The multipart form of the request, such as audio transcriptions and image edits, it is read only once and
+	// the large files are kept in temporary files instead of the memory
+	var form *formdata.Form
+	if !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) {
+		if formdata.IsForm(r.Header.Get("Content-Type")) {
+			var err error
+			form, err = formdata.Parse(r.Body, r.Header.Get("Content-Type"), formdata.DefaultMaxMemory)
+			if err != nil {
+				return fmt.Errorf("parse multipart form: %w", err)
+			}
+			defer form.RemoveAll()
 
-func (s *Server) EvalTest(model string) {
-	ups := s.selectUpstreams(model)
-	if ups == nil || ups.Len() == 0 {
-		// If no corresponding upstream is found, use the default upstream.
-		ups = s.defaultUpstreams
-	}
+			if rec := capture.RecordFromContext(r.Context()); rec != nil {
+				rec.Form = capture.NewForm(form)
+			}
 
-	for i, up := range ups.All() {
-		log.F(log.M{"cur": up.Name(), "index": i}).Infof("dispatch request: %s -> %s", model, up.Rule.ModelReplacer(model))
+			ctx = base.WithForm(ctx, form)
+			entry.Stream = form.Value("stream") == "true"
+			entry.Model = form.Value("model")
+		} else {
+			body, _ = s.readRequestBody(r)
+			entry.Stream = gjson.GetBytes(body, "stream").Bool()
+			entry.Model = gjson.GetBytes(body, "model").String()
+		}
 	}
-}
-
-type OpenAIModelResponse struct {
-	Object string         `json:"object"`
-	Data   []openai.Model `json:"data"`
-}
-
-// Dispatch Request distribution implementation logic
-func (s *Server) Dispatch(w http.ResponseWriter, r *http.Request) error {
-	var ups *upstream.Upstreams
-	var selected *upstream.Upstream
-	var selectedIndex int
 
-	var body []byte
-	if !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) {
-		body, _ = s.readRequestBody(r)
+	// The internal requests use the models of the configuration, they are not limited by the models of the key
+	if entry.Model != "" && !isInternal && !clientKey.AllowModel(entry.Model) {
+		return ErrModelNotAllowed
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
-	defer cancel()
-
-	// Check if the request contains any illegal content
-	if s.moderation != nil && base.EndpointNeedModeration(r.URL.Path) {
-		if s.conf.Moderation.ClientCanIgnore && strings.ToLower(r.Header.Get("X-Ignore-Moderation")) == "true" {
+	// Check if the request contains any illegal content, the internal requests have been checked as part of the client requests
+	entry.Moderation = accesslog.ModerationSkipped
+	mp := st.moderationPolicy(clientKey)
+	if mp.enabled && !isInternal && base.EndpointNeedModeration(r.URL.Path, st.conf.Moderation.Endpoints) {
+		if mp.canIgnore && strings.ToLower(r.Header.Get("X-Ignore-Moderation")) == "true" {
+			entry.Moderation = accesslog.ModerationIgnored
 			if log.DebugEnabled() {
-				log.Debugf("client ignore moderation: %s", r.URL.Path)
+				log.F(log.M{"request_id": entry.RequestID}).Debugf("client ignore moderation: %s", r.URL.Path)
 			}
 		} else {
-			var req openai.ChatCompletionRequest
-			if err := json.Unmarshal(body, &req); err != nil {
+			var mReq moderation.Request
+			var err error
+			if form != nil {
+				mReq, err = moderation.ConvertForm(base.Endpoint(r.URL.Path), form, st.conf.Moderation.API.Model)
+			} else {
+				mReq, err = moderation.ConvertRequest(base.Endpoint(r.URL.Path), r.Header.Get("Content-Type"), body, st.conf.Moderation.API.Model)
+			}
+			if err != nil {
 				return err
 			}
 
-			// If the role of the last Message is robot, then there is no need to perform a sensitive word check
-			// because this is the result of the tool call
-			if len(req.Messages) > 0 && strings.ToLower(req.Messages[len(req.Messages)-1].Role) != "robot" {
-				mReq := moderation.ConvertChatToRequest(req, s.conf.Moderation.API.Model)
-				mRes, err := s.moderation.Moderation(ctx, mReq)
+			if len(mReq.Input) > 0 {
+				mRes, flaggedCategories, violatedCategories, err := st.checkModeration(ctx, mp.policy, mReq)
 				if err != nil {
-					log.With(mReq).Errorf("moderation failed: %v", err)
-					// If the moderation fails, we will continue to process the request
+					entry.Moderation = accesslog.ModerationError
+					log.F(log.M{"request_id": entry.RequestID, "moderation_request": mReq}).Errorf("moderation failed: %v", err)
+
+					// If the moderation fails, we will continue to process the request unless the fail mode is closed
+					if st.conf.Moderation.FailMode == config.ModerationFailClosed {
+						return ErrModerationUnavailable
+					}
 				} else {
-					if mRes.Flagged(s.conf.Moderation.ScoreThreshold) {
-						flaggedCategories := mRes.FlaggedCategories(s.conf.Moderation.ScoreThreshold)
-						violatedCategories := array.Intersect(flaggedCategories, s.conf.Moderation.Categories)
+					entry.Moderation = accesslog.ModerationPassed
+					if len(flaggedCategories) > 0 {
+						st.audit(entry, mp.policy, moderation.AuditSourceInput, mReq, mRes, flaggedCategories, violatedCategories)
+
 						// If the request is flagged by moderation, we will send the categories to the client as a response header
 						w.Header().Set("X-VIOLATED-CATEGORIES", strings.Join(violatedCategories, ","))
 
 						if len(violatedCategories) > 0 {
-							log.With(log.M{"moderation": mRes}).Warning("request is flagged by moderation, blocked")
+							entry.Moderation = accesslog.ModerationBlocked
+							log.F(log.M{"request_id": entry.RequestID, "moderation": mRes}).Warning("request is flagged by moderation, blocked")
 							return ErrRequestFlagged
 						}
 
-						log.With(log.M{"moderation": mRes}).Info("request is flagged by moderation, but not blocked")
+						entry.Moderation = accesslog.ModerationFlagged
+						log.F(log.M{"request_id": entry.RequestID, "moderation": mRes}).Info("request is flagged by moderation, but not blocked")
 					}
 				}
 			}
 
+			// Check the output of chat completions and audio transcriptions before it is sent to the client
+			isChat := base.Endpoint(strings.TrimSuffix(r.URL.Path, "/")) == base.EndpointChatCompletion
+			if (isChat && st.conf.Moderation.Output.Enabled) || base.EndpointModerateOutput(r.URL.Path) {
+				// The output can only be checked when it is not compressed
+				r.Header.Del("Accept-Encoding")
+
+				failClosed := st.conf.Moderation.FailMode == config.ModerationFailClosed
+				ow := moderation.NewOutputWriter(ctx, w, st.conf.Moderation.Output.WindowSize, failClosed, func(ctx context.Context, text string) ([]string, error) {
+					oReq := moderation.Request{
+						Model: st.conf.Moderation.API.Model,
+						Input: []moderation.Input{{Type: "text", Text: text}},
+					}
+
+					oRes, flagged, violated, err := st.checkModeration(ctx, mp.policy, oReq)
+					if err == nil && len(flagged) > 0 {
+						st.audit(entry, mp.policy, moderation.AuditSourceOutput, oReq, oRes, flagged, violated)
+					}
+
+					return violated, err
+				})
+				defer func() {
+					ow.Close()
+
+					checked, violated, err := ow.Result()
+					if !checked {
+						return
+					}
+
+					entry.OutputModeration = accesslog.ModerationPassed
+					if err != nil {
+						entry.OutputModeration = accesslog.ModerationError
+						log.F(log.M{"request_id": entry.RequestID}).Errorf("output moderation failed: %v", err)
+					}
+
+					if len(violated) > 0 {
+						entry.OutputModeration = accesslog.ModerationBlocked
+						log.F(log.M{"request_id": entry.RequestID, "categories": violated}).Warning("response is flagged by moderation, blocked")
+					}
+				}()
+
+				w = ow
+			}
+		}
+	}
+
+	// Serve the embeddings of the inputs from the per-input cache, only the missed inputs are sent to the upstream
+	responseCache := st.cache.get()
+	isEmbedding := base.Endpoint(strings.TrimSuffix(r.URL.Path, "/")) == base.EndpointEmbedding
+	if responseCache != nil && responseCache.EmbeddingEnabled() && isEmbedding && !internal.raw && entry.Model != "" {
+		if served, err := s.serveEmbeddings(st, clientKey, w, r, body); served || err != nil {
+			return err
+		}
+	}
+
+	// Serve the identical deterministic requests from the response cache, the output moderation applies to them too.
+	// The multipart forms are not cached, their bodies are not kept in memory
+	if responseCache != nil && !internal.raw && entry.Model != "" && form == nil {
+		if decision := responseCache.Lookup(ctx, r, clientKey.ID(), entry.Model, body, s.embedder(st, clientKey, entry.RequestID)); decision != nil {
+			entry.Cache = decision.Result
+			w.Header().Set("X-Cache", strings.ToUpper(decision.Result))
+
+			switch decision.Result {
+			case cache.ResultHit:
+				return responseCache.Replay(w, decision)
+			case cache.ResultSemanticHit:
+				w.Header().Set("X-Cache-Similarity", strconv.FormatFloat(decision.Similarity, 'f', 4, 64))
+				return responseCache.Replay(w, decision)
+			}
+
+			recorder := accesslog.NewResponseRecorder(w, responseCache.MaxBodyBytes()+1)
+			defer func() {
+				respBody, complete := recorder.Body()
+				responseCache.Save(ctx, decision, recorder.Status(), recorder.Header().Get("Content-Type"), respBody, complete)
+			}()
+
+			w = recorder
+		}
+	}
+
+	// The tokens are counted by the dispatcher, the request is not sent to the upstreams
+	if base.Endpoint(strings.TrimSuffix(r.URL.Path, "/")) == base.EndpointTokenize {
+		return s.serveTokenize(st, w, body)
+	}
+
+	// Drop the turns of the long conversations to fit the context of the model, the internal requests have been trimmed
+	// as part of the client requests
+	if base.Endpoint(strings.TrimSuffix(r.URL.Path, "/")) == base.EndpointChatCompletion && !isInternal && entry.Model != "" {
+		trimmed, res, err := st.trimContext(clientKey, entry.Model, body)
+		if err != nil {
+			log.F(log.M{"request_id": entry.RequestID}).Warningf("trim context failed: %v", err)
+		} else if res != nil {
+			w.Header().Set("X-Context-Trimmed", res.String())
+			log.F(log.M{"request_id": entry.RequestID, "model": entry.Model, "context": res.String()}).Info("conversation exceeds the context limit, trimmed")
+
+			if res.Dropped > 0 {
+				body = trimmed
+				s.replaceRequestBody(r, body)
+			}
 		}
 	}
 
 	var model string
 	if base.EndpointHasModel(r.URL.Path) {
-		model = gjson.Get(string(body), "model").String()
+		model = ternary.If(form != nil, entry.Model, gjson.Get(string(body), "model").String())
 		if model == "" {
 			return ErrModelRequired
 		}
 
-		ups = s.selectUpstreams(model)
+		entry.Model = model
+
+		ups = st.selectUpstreams(ctx, model)
 		if ups == nil || ups.Len() == 0 {
 			// If no corresponding upstream is found, use the default upstream.
-			ups = s.defaultUpstreams
+			ups = st.defaultUpstreams
+		}
+
+		// The upstreams whose model lacks the capabilities required by the request are never selected
+		incapable, missing := st.incapableUpstreams(ups, r.URL.Path, model, body)
+		if len(incapable) > 0 && len(incapable) == ups.Len() {
+			return fmt.Errorf("%w %s", ErrCapabilityNotSupported, strings.Join(array.Map(missing, func(c registry.Capability, _ int) string { return string(c) }), ", "))
 		}
 
 		selected, selectedIndex = ups.Next()
+		if selected != nil && array.In(selectedIndex, incapable) {
+			selected, selectedIndex = ups.Next(incapable...)
+		}
+
 		if selected == nil {
 			return ErrNotSupport
 		}
-	} else if strings.TrimSuffix(r.URL.Path, "/") == "/v1/models" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(must.Must(json.Marshal(OpenAIModelResponse{
-			Object: "list",
-			Data:   s.supportModels,
-		})))
-		return nil
+
+		excluded = incapable
+	} else if isModelsPath(r.Method, r.URL.Path) {
+		return s.serveModels(ctx, st, clientKey, w, r)
 	} else {
-		ups = s.defaultUpstreams
+		ups = st.defaultUpstreams
 		selected, selectedIndex = ups.Next()
 		if selected == nil {
 			return ErrNotSupport
 		}
 	}
 
+	entry.AddUpstream(selected.Name())
+	if model != "" {
+		entry.RewrittenModel = selected.Rule.ModelReplacer(model)
+	}
+
 	if log.DebugEnabled() {
-		logCtx := log.M{"cur": selected.Name(), "candidates": ups.Len(), "model": model}
-		if s.conf.Verbose && s.conf.Debug {
+		logCtx := log.M{"request_id": entry.RequestID, "cur": selected.Name(), "candidates": ups.Len(), "model": model}
+		if st.conf.Verbose && st.conf.Debug {
 			logCtx["body"] = string(body)
 		}
 
 		log.F(logCtx).Debugf("dispatch request: %s %s", r.Method, r.URL.String())
 	}
 
-	usedIndex := []int{selectedIndex}
+	usedIndex := append(excluded, selectedIndex)
 
 	var retry func(w http.ResponseWriter, r *http.Request, err error)
 	retryCount := 0
+	serve := func(up *upstream.Upstream, w http.ResponseWriter, r *http.Request) {
+		up.Stats().Begin()
+		up.Handler.Serve(ctx, w, r, retry)
+	}
+
 	retry = func(w http.ResponseWriter, r *http.Request, err error) {
 		// 如果当前 upstream 失败，则尝试下一个 upstream
 		cur := selected
+		cur.Stats().End(err)
+
 		selected, selectedIndex = ups.Next(usedIndex...)
 		if selected != nil {
 			retryCount++
-			log.F(log.M{"cur": cur.Name(), "used": usedIndex, "next": selected.Name(), "candidates": ups.Len(), "model": model}).
+			log.F(log.M{"request_id": entry.RequestID, "cur": cur.Name(), "used": usedIndex, "next": selected.Name(), "candidates": ups.Len(), "model": model}).
 				Warningf("retry next upstream[%d]: %v", retryCount, err)
 
 			usedIndex = append(usedIndex, selectedIndex)
+			entry.AddUpstream(selected.Name())
+			if model != "" {
+				entry.RewrittenModel = selected.Rule.ModelReplacer(model)
+			}
 
-			if !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) {
+			// The multipart form is encoded again by the handler
+			if !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) && form == nil {
 				_ = r.Body.Close()
 				r.Body = io.NopCloser(bytes.NewBuffer(body))
 			}
 
-			selected.Handler.Serve(ctx, w, r, retry)
+			serve(selected, w, r)
 			return
 		}
 
-		log.F(log.M{"used": usedIndex, "retry_count": retryCount, "model": model}).Errorf("all upstreams failed: %v", err)
+		entry.Error = err.Error()
+		log.F(log.M{"request_id": entry.RequestID, "used": usedIndex, "retry_count": retryCount, "model": model}).Errorf("all upstreams failed: %v", err)
 
 		var respErr base.ResponseError
 		if errors.As(err, &respErr) {
@@ -356,20 +447,99 @@ func (s *Server) Dispatch(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	selected.Handler.Serve(ctx, w, r, retry)
+	serve(selected, w, r)
+
+	// The last selected upstream has served the request successfully, it is nil if all upstreams failed
+	if selected != nil {
+		selected.Stats().End(nil)
+	}
 
 	return nil
 }
 
+// audit Write the flagged moderation decision to the audit log
+func (st *state) audit(entry *accesslog.Entry, policy moderation.Policy, source string, req moderation.Request, res *moderation.Response, flagged, violated []string) {
+	auditLog := st.auditLog.get()
+	if auditLog == nil {
+		return
+	}
+
+	scores, snippet := policy.Offending(req, *res)
+	auditLog.Write(moderation.AuditEntry{
+		Time:       time.Now(),
+		RequestID:  entry.RequestID,
+		ClientKey:  entry.ClientKey,
+		Endpoint:   entry.Endpoint,
+		Model:      entry.Model,
+		Source:     source,
+		Action:     ternary.If(len(violated) > 0, moderation.AuditActionBlocked, moderation.AuditActionFlagged),
+		Categories: flagged,
+		Blocked:    violated,
+		Scores:     scores,
+		Snippet:    snippet,
+	})
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Use the request ID sent by the client, or generate a new one
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+
 	// CORS
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
+	entry := &accesslog.Entry{
+		Time:      time.Now(),
+		RequestID: requestID,
+		Method:    r.Method,
+		Endpoint:  r.URL.Path,
+	}
+
+	// The state is loaded once, the request is served by the same configuration and components even if it is reloaded
+	st := s.state.Load()
+	accessLog, capturer := st.accessLog.get(), st.capturer.get()
+
+	// The response body is only kept for the usage of the access log and the captured requests,
+	// otherwise only the status and the size are recorded
+	recorder := accesslog.NewResponseRecorder(w, ternary.If(accessLog != nil, accesslog.DefaultMaxBodySize, 0))
+	w = recorder
+	r = r.WithContext(accesslog.WithEntry(r.Context(), entry))
+
+	// captured The record of the request being captured, the form of the request is added to it by the dispatcher
+	var captured *capture.Record
+	var capturedBody []byte
+
+	defer func() {
+		if captured != nil {
+			captured.Time, captured.RequestID, captured.ClientKey = entry.Time, entry.RequestID, entry.ClientKey
+			captured.Method, captured.Endpoint, captured.Model, captured.Stream = entry.Method, entry.Endpoint, entry.Model, entry.Stream
+			captured.Status = recorder.Status()
+
+			respBody, complete := recorder.Body()
+			capturer.Capture(*captured, capturedBody, respBody, complete, recorder.Header().Get("Content-Type"))
+		}
+
+		if accessLog == nil {
+			return
+		}
+
+		entry.Status = recorder.Status()
+		entry.TTFB = recorder.TTFB().Milliseconds()
+		entry.Duration = time.Since(entry.Time).Milliseconds()
+		entry.Bytes = recorder.Written()
+		entry.Usage = recorder.Usage()
+		accessLog.Write(entry)
+	}()
+
 	authHeader := strings.TrimPrefix(strings.ToLower(r.Header.Get("Authorization")), "bearer ")
-	if authHeader == "" || !array.In(authHeader, s.conf.Keys) {
+	clientKey := st.conf.ClientKey(authHeader)
+	if authHeader == "" || clientKey == nil {
 		w.Header().Set("Content-Type", "application/json")
 
 		w.WriteHeader(http.StatusUnauthorized)
@@ -377,17 +547,41 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	entry.ClientKey = clientKey.Name
+
+	if capturer.ShouldCapture(clientKey) {
+		captured = &capture.Record{ContentType: r.Header.Get("Content-Type")}
+		r = r.WithContext(capture.WithRecord(r.Context(), captured))
+		recorder.KeepBody(capturer.MaxBodySize())
+
+		// The multipart forms are not read here, the uploads are streamed to the temporary files by the dispatcher
+		if !array.In(r.Method, []string{"GET", "OPTIONS", "HEAD"}) && !formdata.IsForm(captured.ContentType) {
+			capturedBody, _ = s.readRequestBody(r)
+		}
+	}
+
 	// Distribution request
-	if err := s.Dispatch(w, r); err != nil {
+	if err := s.Dispatch(st, clientKey, w, r); err != nil {
+		entry.Error = err.Error()
+
 		w.Header().Set("Content-Type", "application/json")
 
 		if errors.Is(err, ErrRequestFlagged) {
 			w.WriteHeader(http.StatusUnprocessableEntity)
 			_, _ = w.Write([]byte(fmt.Sprintf(`{"error": {"message": "%s"}}`, err.Error())))
+		} else if errors.Is(err, ErrModerationUnavailable) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"error": {"message": "%s"}}`, err.Error())))
+		} else if errors.Is(err, ErrModelNotAllowed) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"error": {"message": "%s", "type": "invalid_request_error", "code": "model_not_allowed"}}`, err.Error())))
+		} else if errors.Is(err, ErrCapabilityNotSupported) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"error": {"message": "%s", "type": "invalid_request_error"}}`, err.Error())))
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
 			_, _ = w.Write([]byte(`{"error": {"message": "invalid request"}}`))
-			log.Errorf("dispatch request failed: %v", err)
+			log.F(log.M{"request_id": requestID}).Errorf("dispatch request failed: %v", err)
 		}
 
 		return
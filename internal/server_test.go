@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/capture"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/tidwall/gjson"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testClientKey The client key used by the test requests
+const testClientKey = "client-key-123456"
+
+// writeTestConfig Write the configuration to a temporary config.yaml, return the path of the file
+func writeTestConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(yaml), 0644))
+	return path
+}
+
+// newTestServer Create a server with the configuration
+func newTestServer(t *testing.T, yaml string) *Server {
+	path := writeTestConfig(t, yaml)
+
+	conf, err := config.LoadConfig(path)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server, err := NewServer(ctx, conf, path)
+	assert.NoError(t, err)
+
+	return server
+}
+
+// newTestRequest Create a request authorized by the test client key
+func newTestRequest(method, path string, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testClientKey)
+	return r
+}
+
+// serve Serve the request and return the response
+func serve(server *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+// doRequest Send a request authorized by the test client key
+func doRequest(server *Server, method, path string, body string) *httptest.ResponseRecorder {
+	return serve(server, newTestRequest(method, path, body))
+}
+
+func readBody(r *http.Request) string {
+	data, _ := io.ReadAll(r.Body)
+	return string(data)
+}
+
+func TestDispatchCapabilities(t *testing.T) {
+	var models []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		models = append(models, gjson.Get(readBody(r), "model").String())
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`))
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t, `keys: ["client-key-123456"]
+rules:
+  - name: mini
+    servers: ["`+upstream.URL+`"]
+    keys: ["sk-upstream"]
+    models: [assistant, reasoner]
+    rewrite: [{src: assistant, dst: o1-mini}, {src: reasoner, dst: o1-mini}]
+  - name: omni
+    servers: ["`+upstream.URL+`"]
+    keys: ["sk-upstream"]
+    models: [assistant]
+    rewrite: [{src: assistant, dst: gpt-4o}]
+`)
+
+	chat := func(model string) *httptest.ResponseRecorder {
+		body := `{"model":"` + model + `","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,"}}]}]}`
+		return doRequest(server, http.MethodPost, "/v1/chat/completions", body)
+	}
+
+	// The images are never sent to the upstream of o1-mini, which has no vision
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusOK, chat("assistant").Code)
+	}
+	assert.Equal(t, []string{"gpt-4o", "gpt-4o", "gpt-4o", "gpt-4o"}, models)
+
+	w := chat("reasoner")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "the model does not support vision", gjson.Get(w.Body.String(), "error.message").String())
+	assert.Equal(t, 4, len(models))
+}
+
+func TestDispatchContext(t *testing.T) {
+	var messages []int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		messages = append(messages, len(gjson.Get(readBody(r), "messages").Array()))
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`))
+	}))
+	defer upstream.Close()
+
+	server := newTestServer(t, `keys:
+  - client-key-123456
+  - key: client-key-654321
+    context: {enabled: false}
+context:
+  models:
+    - {model: "gpt-4o*", enabled: true, max-prompt-tokens: 100}
+rules:
+  - name: omni
+    servers: ["`+upstream.URL+`"]
+    keys: ["sk-upstream"]
+    models: [gpt-4o, gpt-4]
+`)
+
+	chat := func(key string, model string) *httptest.ResponseRecorder {
+		long := strings.Repeat("hello world ", 50)
+		r := newTestRequest(http.MethodPost, "/v1/chat/completions", `{"model":"`+model+`","messages":[{"role":"user","content":"`+long+`"},{"role":"assistant","content":"ok"},{"role":"user","content":"hi"}]}`)
+		r.Header.Set("Authorization", "Bearer "+key)
+		return serve(server, r)
+	}
+
+	w := chat("client-key-123456", "gpt-4o")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("X-Context-Trimmed"), "strategy=oldest; dropped=1;"))
+
+	// The context management is disabled for the model and the key
+	assert.Equal(t, "", chat("client-key-123456", "gpt-4").Header().Get("X-Context-Trimmed"))
+	assert.Equal(t, "", chat("client-key-654321", "gpt-4o").Header().Get("X-Context-Trimmed"))
+	assert.Equal(t, []int{2, 3, 3}, messages)
+}
+
+func TestDispatchMultipart(t *testing.T) {
+	var models, files []string
+	var lengths []int64
+	failed := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseMultipartForm(1<<20))
+		models = append(models, r.FormValue("model"))
+		lengths = append(lengths, r.ContentLength)
+
+		file, _, err := r.FormFile("file")
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(file)
+		files = append(files, string(data))
+
+		// The first upstream fails, the form is sent to the next upstream again
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"text":"hello"}`))
+	}))
+	defer upstream.Close()
+
+	capturePath := t.TempDir()
+	server := newTestServer(t, `keys: ["client-key-123456"]
+rules:
+  - name: whisper
+    servers: ["`+upstream.URL+`", "`+upstream.URL+`/"]
+    keys: ["sk-upstream"]
+    models: [transcriber]
+    rewrite: [{src: transcriber, dst: whisper-1}]
+capture:
+  enabled: true
+  all-keys: true
+  path: `+capturePath+`
+`)
+
+	audio := strings.Repeat("0123456789", 1024*1024)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("model", "transcriber")
+	file, _ := mw.CreateFormFile("file", "speech.mp3")
+	_, _ = file.Write([]byte(audio))
+	_ = mw.Close()
+
+	r := newTestRequest(http.MethodPost, "/v1/audio/transcriptions", body.String())
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	w := serve(server, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", gjson.Get(w.Body.String(), "text").String())
+	assert.EqualValues(t, []string{"whisper-1", "whisper-1"}, models)
+	assert.True(t, files[0] == audio && files[1] == audio)
+	assert.True(t, lengths[0] > int64(len(audio)) && lengths[0] == lengths[1])
+
+	// Only the fields and the file sizes of the form are captured
+	captures, _ := filepath.Glob(filepath.Join(capturePath, "capture.*.jsonl"))
+	assert.Equal(t, 1, len(captures))
+	assert.NoError(t, capture.ReadFile(captures[0], func(rec capture.Record) error {
+		assert.Equal(t, "transcriber", rec.Form.Fields["model"])
+		assert.EqualValues(t, []capture.File{{Field: "file", Name: "speech.mp3", Size: int64(len(audio))}}, rec.Form.Files)
+		assert.Equal(t, 0, len(rec.Request))
+		return nil
+	}))
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/go-utils/maps"
+	"github.com/mylxsw/go-utils/must"
+	"github.com/mylxsw/go-utils/ternary"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/moderation"
+	"github.com/mylxsw/openai-dispatcher/internal/provider"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
+	"github.com/mylxsw/openai-dispatcher/internal/transform"
+	"github.com/mylxsw/openai-dispatcher/internal/upstream"
+	"github.com/mylxsw/openai-dispatcher/pkg/expr"
+	"golang.org/x/net/proxy"
+	"strings"
+	"time"
+)
+
+// state The runtime state built from the configuration
+type state struct {
+	conf             *config.Config
+	upstreams        map[string]*upstream.Upstreams
+	defaultUpstreams *upstream.Upstreams
+	exprRules        []config.Rule
+	registry         *registry.Registry
+
+	supportModels  []ModelObject
+	upstreamModels *upstreamModels
+
+	dialer     proxy.Dialer
+	moderation moderation.Moderator
+
+	// components The access log, the audit log, the capturer and the response cache, they are built by the server
+	components
+}
+
+func newState(conf *config.Config) (*state, error) {
+	var dialer proxy.Dialer
+	var err error
+
+	if conf.Socks5 != "" {
+		dialer, err = createSocks5Dialer(conf.Socks5)
+		if err != nil {
+			log.Errorf("create socks5 dialer failed: %v", err)
+		}
+	}
+
+	reg, err := registry.New(conf.Models)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := upstream.BuildUpstreamsFromRules(upstream.Policy(conf.Policy), conf.Rules, dialer, reg)
+	if err != nil {
+		return nil, err
+	}
+
+	st := buildState(conf, reg, result)
+	st.dialer = dialer
+
+	if conf.Moderation.Enabled {
+		st.moderation, err = newModerator(conf.Moderation, dialer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// newRoutingState Build the state only used to explain the routing, the handlers and the moderators are not created,
+// so nothing is connected or loaded
+func newRoutingState(conf *config.Config) (*state, error) {
+	reg, err := registry.New(conf.Models)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := upstream.BuildRoutesFromRules(upstream.Policy(conf.Policy), conf.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildState(conf, reg, result), nil
+}
+
+func buildState(conf *config.Config, reg *registry.Registry, result *upstream.Result) *state {
+	// Support models, the owner and the creation time are read from the registry
+	models := make([]ModelObject, 0)
+	for _, model := range array.Uniq(append(maps.Keys(result.Upstreams), conf.ExtraModels...)) {
+		models = append(models, newModelObject(reg, conf.ModelList, model, defaultModelCreated, "system"))
+	}
+
+	st := state{
+		conf:             conf,
+		upstreams:        result.Upstreams,
+		defaultUpstreams: result.Default,
+		exprRules:        result.ExprRules,
+		registry:         reg,
+		supportModels:    models,
+	}
+
+	if conf.ModelList.Upstream {
+		st.upstreamModels = &upstreamModels{}
+	}
+
+	return &st
+}
+
+// newModerator Create the moderation engines in the configured order
+func newModerator(conf config.Moderation, dialer proxy.Dialer) (moderation.Moderator, error) {
+	moderators := make([]moderation.Moderator, 0, len(conf.Engines))
+	for _, engine := range conf.Engines {
+		switch engine {
+		case config.ModerationEngineLocal:
+			local, err := moderation.NewLocal(array.Map(conf.Local, func(rule config.LocalModerationRule, _ int) moderation.LocalRule {
+				return moderation.LocalRule{
+					Category:      rule.Category,
+					Score:         rule.Score,
+					Keywords:      rule.Keywords,
+					Regexes:       rule.Regexes,
+					Dictionaries:  rule.Dictionaries,
+					CaseSensitive: rule.CaseSensitive,
+				}
+			}))
+			if err != nil {
+				return nil, fmt.Errorf("create local moderation failed: %w", err)
+			}
+
+			moderators = append(moderators, local)
+		case config.ModerationEngineAPI:
+			var api moderation.Moderator = moderation.New(conf.API.Server, conf.API.Key, ternary.If(conf.API.Proxy, dialer, nil))
+			if conf.MaxConcurrency > 0 {
+				api = moderation.NewLimiter(api, conf.MaxConcurrency, 5*time.Second)
+			}
+
+			// The cache is outside the limiter, so the cached requests never wait for a slot
+			if conf.Cache.Enabled {
+				api = moderation.NewCache(api, conf.Cache.Size, conf.Cache.TTL)
+			}
+
+			moderators = append(moderators, api)
+		}
+	}
+
+	if len(moderators) == 1 {
+		return moderators[0], nil
+	}
+
+	return moderation.NewChain(moderators...), nil
+}
+
+// moderationPolicy The moderation settings applied to the requests of a client key
+type moderationPolicy struct {
+	enabled   bool
+	canIgnore bool
+	policy    moderation.Policy
+}
+
+// moderationPolicy Resolve the moderation settings of the client key, the global settings are used for the fields not set
+func (st *state) moderationPolicy(key *config.ClientKey) moderationPolicy {
+	res := moderationPolicy{
+		enabled:   st.conf.Moderation.Enabled,
+		canIgnore: st.conf.Moderation.ClientCanIgnore,
+		policy: moderation.Policy{
+			Categories:     st.conf.Moderation.Categories,
+			ScoreThreshold: st.conf.Moderation.ScoreThreshold,
+			Thresholds:     st.conf.Moderation.Thresholds,
+		},
+	}
+
+	if key == nil || key.Moderation == nil {
+		return res
+	}
+
+	if key.Moderation.Enabled != nil {
+		res.enabled = res.enabled && *key.Moderation.Enabled
+	}
+
+	if key.Moderation.CanIgnore != nil {
+		res.canIgnore = *key.Moderation.CanIgnore
+	}
+
+	if len(key.Moderation.Categories) > 0 {
+		res.policy.Categories = key.Moderation.Categories
+	}
+
+	if key.Moderation.ScoreThreshold > 0 {
+		res.policy.ScoreThreshold = key.Moderation.ScoreThreshold
+	}
+
+	if len(key.Moderation.Thresholds) > 0 {
+		// The thresholds of the key override the global ones of the same categories
+		thresholds := make(map[string]float64)
+		for category, threshold := range st.conf.Moderation.Thresholds {
+			thresholds[category] = threshold
+		}
+
+		for category, threshold := range key.Moderation.Thresholds {
+			thresholds[category] = threshold
+		}
+
+		res.policy.Thresholds = thresholds
+	}
+
+	return res
+}
+
+// checkModeration Check the inputs, return the moderation result, the flagged categories and the categories which should be blocked
+func (st *state) checkModeration(ctx context.Context, policy moderation.Policy, req moderation.Request) (*moderation.Response, []string, []string, error) {
+	res, err := st.moderation.Moderation(moderation.WithPolicy(ctx, policy), req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	flagged := policy.FlaggedCategories(*res)
+	return res, flagged, policy.Violated(flagged), nil
+}
+
+// incapableUpstreams The indexes of the upstreams whose rewritten model lacks the capabilities required by the
+// chat completion request, and the missing capabilities
+func (st *state) incapableUpstreams(ups *upstream.Upstreams, path string, model string, body []byte) ([]int, []registry.Capability) {
+	if base.Endpoint(strings.TrimSuffix(path, "/")) != base.EndpointChatCompletion {
+		return nil, nil
+	}
+
+	required := registry.Required(body)
+	if len(required) == 0 {
+		return nil, nil
+	}
+
+	incapable := make([]int, 0)
+	missing := make([]registry.Capability, 0)
+	for _, up := range ups.All() {
+		if lacked := st.registry.Missing(up.Rule.ModelReplacer(model), required); len(lacked) > 0 {
+			incapable = append(incapable, up.Index)
+			missing = array.Uniq(append(missing, lacked...))
+		}
+	}
+
+	return incapable, missing
+}
+
+func (st *state) selectUpstreams(ctx context.Context, model string) *upstream.Upstreams {
+	if ups, ok := st.upstreams[model]; ok {
+		return ups
+	}
+
+	var ups *upstream.Upstreams
+	for _, rule := range st.exprRules {
+		if rule.Expr == nil || rule.Expr.Match == "" {
+			continue
+		}
+
+		matched, err := must.Must(expr.NewBoolVM(rule.Expr.Match)).Run(expr.Data{Model: model})
+		if err != nil {
+			log.F(log.M{"request_id": base.RequestID(ctx), "model": model, "expr": rule.Expr.Match}).Errorf("evaluate expr failed: %v", err)
+			continue
+		}
+
+		if matched {
+			if ups == nil {
+				ups = upstream.NewUpstreams(upstream.Policy(st.conf.Policy))
+			}
+
+			transformer := transform.New(rule.Transforms, st.registry)
+			for serverIndex, server := range rule.Servers {
+				for keyIndex, key := range rule.Keys {
+					if handler, err := provider.CreateHandler(rule.Type, server, key, ternary.If(rule.Proxy, st.dialer, nil), rule.ModelReplacer, transformer); err != nil {
+						log.F(log.M{"request_id": base.RequestID(ctx), "model": model, "rule": rule.Name}).Errorf("upstream failed to create: %v", err)
+					} else {
+						ups.Add(&upstream.Upstream{
+							Rule:        rule,
+							Handler:     handler,
+							ServerIndex: serverIndex,
+							KeyIndex:    keyIndex,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	if ups != nil && ups.Len() > 0 {
+		if err := ups.Init(); err != nil {
+			log.F(log.M{"request_id": base.RequestID(ctx), "model": model, "ups": ups}).Errorf("upstreams init failed: %v", err)
+			return nil
+		}
+
+		return ups
+	}
+
+	return nil
+}
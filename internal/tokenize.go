@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/go-utils/must"
+	"github.com/mylxsw/openai-dispatcher/pkg/token"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"net/http"
+)
+
+// TokenizeResponse The tokens of the request counted by /v1/tokenize
+type TokenizeResponse struct {
+	Object string `json:"object"`
+	// Model The upstream model after the rewrite, its tokenizer is used
+	Model string `json:"model"`
+	// Tokenizer The tokenizer family used to count the tokens
+	Tokenizer string `json:"tokenizer"`
+	// Estimated Whether the tokens are estimated, the tokenizers of some vendors are not public
+	Estimated    bool `json:"estimated"`
+	PromptTokens int  `json:"prompt_tokens"`
+	// InputTokens The tokens of each input, only returned when the input or prompt is counted
+	InputTokens []int `json:"input_tokens,omitempty"`
+}
+
+// serveTokenize Count the prompt tokens of the request without sending it to the upstreams.
+// The body is a chat completion request, or a request with a string or an array of strings in input or prompt
+func (s *Server) serveTokenize(st *state, w http.ResponseWriter, body []byte) error {
+	model := gjson.GetBytes(body, "model").String()
+	if model == "" {
+		return ErrModelRequired
+	}
+
+	// The tokenizer of the upstream model is used, the rewrite of the first upstream of the model is applied
+	model = st.upstreamModel(model)
+
+	family, estimator := token.EstimatorFor(model)
+	res := TokenizeResponse{Object: "tokenize", Model: model, Tokenizer: family, Estimated: estimator.Estimated()}
+
+	input := gjson.GetBytes(body, "input")
+	if !input.Exists() {
+		input = gjson.GetBytes(body, "prompt")
+	}
+
+	if input.Exists() {
+		texts := []gjson.Result{input}
+		if input.IsArray() {
+			texts = input.Array()
+		}
+
+		res.InputTokens = make([]int, 0, len(texts))
+		for _, text := range texts {
+			if text.Type != gjson.String {
+				return fmt.Errorf("unsupported input type: %s", text.Raw)
+			}
+
+			tokens, err := estimator.TextTokens(text.String())
+			if err != nil {
+				return err
+			}
+
+			res.InputTokens = append(res.InputTokens, tokens)
+			res.PromptTokens += tokens
+		}
+	} else {
+		var req openai.ChatCompletionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return fmt.Errorf("invalid tokenize request: %w", err)
+		}
+
+		req.Model = model
+
+		tokens, err := estimator.PromptTokens(req)
+		if err != nil {
+			return err
+		}
+
+		res.PromptTokens = tokens
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(must.Must(json.Marshal(res)))
+	return nil
+}
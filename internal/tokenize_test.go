@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeTokenize(t *testing.T) {
+	server := newTestServer(t, `keys: ["client-key-123456"]
+rules:
+  - servers: ["http://127.0.0.1:1"]
+    keys: ["sk-upstream"]
+    models: [assistant]
+    rewrite: [{src: assistant, dst: claude-3-5-sonnet-20241022}]
+`)
+
+	tokenize := func(body string) *httptest.ResponseRecorder {
+		return doRequest(server, http.MethodPost, "/v1/tokenize", body)
+	}
+
+	w := tokenize(`{"model":"gpt-4o","messages":[{"role":"user","content":"hello world"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "o200k_base", gjson.Get(w.Body.String(), "tokenizer").String())
+	assert.Equal(t, int64(9), gjson.Get(w.Body.String(), "prompt_tokens").Int())
+
+	// The tokenizer of the rewritten model is used
+	w = tokenize(`{"model":"assistant","input":["hello world","hello"]}`)
+	assert.Equal(t, "claude", gjson.Get(w.Body.String(), "tokenizer").String())
+	assert.True(t, gjson.Get(w.Body.String(), "estimated").Bool())
+	assert.Equal(t, `[2,1]`, gjson.Get(w.Body.String(), "input_tokens").Raw)
+}
@@ -0,0 +1,339 @@
+package transform
+
+import (
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result How the request is transformed
+type Result struct {
+	// EmulateStream The stream request is sent as a non-stream request, the response should be converted to a stream
+	EmulateStream bool
+	// IncludeUsage Whether the client asks for the usage chunk of the stream
+	IncludeUsage bool
+	// ChunkSize The characters of each content chunk of the emulated stream, 0 for one chunk
+	ChunkSize int
+	// ChunkInterval The interval between the chunks of the emulated stream
+	ChunkInterval time.Duration
+	// AggregateStream The non-stream request is sent as a stream request, the response should be merged
+	AggregateStream bool
+}
+
+// Transformer Apply the transforms of a rule to the request bodies
+type Transformer struct {
+	transforms []transform
+	registry   *registry.Registry
+}
+
+type transform struct {
+	config.Transform
+	models []*regexp.Regexp
+}
+
+// New Create a transformer of the transforms, the transforms derived from the model capabilities in the registry
+// are applied before them. nil is returned when there is no transform and no registry
+func New(transforms []config.Transform, reg *registry.Registry) *Transformer {
+	if len(transforms) == 0 && reg == nil {
+		return nil
+	}
+
+	t := &Transformer{registry: reg}
+	for _, item := range transforms {
+		t.transforms = append(t.transforms, transform{
+			Transform: item,
+			models: array.Map(item.Models, func(pattern string, _ int) *regexp.Regexp {
+				return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+			}),
+		})
+	}
+
+	return t
+}
+
+// Derive The transforms required by the capabilities of the model
+func Derive(info config.ModelInfo) []config.Transform {
+	tr := config.Transform{Endpoints: []base.Endpoint{base.EndpointChatCompletion}}
+
+	if info.Reasoning {
+		tr.Rename = map[string]string{"max_tokens": "max_completion_tokens"}
+		tr.Remove = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty"}
+	}
+
+	if info.MaxOutput > 0 {
+		max := float64(info.MaxOutput)
+		tr.Clamp = map[string]config.Range{"max_tokens": {Max: &max}, "max_completion_tokens": {Max: &max}}
+	}
+
+	if info.SystemRole != nil && !*info.SystemRole {
+		tr.Roles = map[string]string{"system": "user", "developer": "user"}
+	}
+
+	if info.Streaming != nil && !*info.Streaming {
+		tr.EmulateStream = true
+	}
+
+	if tr.Rename == nil && tr.Clamp == nil && tr.Roles == nil && !tr.EmulateStream {
+		return nil
+	}
+
+	return []config.Transform{tr}
+}
+
+// matched The transforms applied to the request of the endpoint and model, the derived ones come first
+func (t *Transformer) matched(endpoint base.Endpoint, model string) []transform {
+	res := make([]transform, 0)
+	if info, ok := t.registry.Lookup(model); ok {
+		for _, item := range Derive(info) {
+			if (transform{Transform: item}).match(endpoint, model) {
+				res = append(res, transform{Transform: item})
+			}
+		}
+	}
+
+	for _, tr := range t.transforms {
+		if tr.match(endpoint, model) {
+			res = append(res, tr)
+		}
+	}
+
+	return res
+}
+
+// match Whether the transform applies to the request of the endpoint and model
+func (t transform) match(endpoint base.Endpoint, model string) bool {
+	if len(t.Endpoints) > 0 && !array.In(endpoint, t.Endpoints) {
+		return false
+	}
+
+	if len(t.models) == 0 {
+		return true
+	}
+
+	for _, re := range t.models {
+		if re.MatchString(model) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply Transform the JSON request body sent to the upstream, the model is the upstream model after the rewrite
+func (t *Transformer) Apply(endpoint base.Endpoint, model string, body []byte) ([]byte, Result, error) {
+	var res Result
+	if t == nil || !gjson.ValidBytes(body) {
+		return body, res, nil
+	}
+
+	var err error
+	for _, tr := range t.matched(endpoint, model) {
+		if body, err = tr.apply(body, &res); err != nil {
+			return nil, res, err
+		}
+	}
+
+	return body, res, nil
+}
+
+// Explain Describe the transforms applied to the request of the endpoint and model
+func (t *Transformer) Explain(endpoint base.Endpoint, model string, stream bool) []string {
+	res := make([]string, 0)
+	if t == nil {
+		return res
+	}
+
+	for _, tr := range t.matched(endpoint, model) {
+		for _, src := range sortedKeys(tr.Rename) {
+			res = append(res, fmt.Sprintf("%s is renamed to %s", src, tr.Rename[src]))
+		}
+
+		for _, field := range tr.Remove {
+			res = append(res, fmt.Sprintf("%s is removed", field))
+		}
+
+		for _, field := range sortedKeys(tr.Default) {
+			res = append(res, fmt.Sprintf("%s defaults to %v", field, tr.Default[field]))
+		}
+
+		for _, field := range sortedKeys(tr.Set) {
+			res = append(res, fmt.Sprintf("%s is set to %v", field, tr.Set[field]))
+		}
+
+		for _, field := range sortedKeys(tr.Clamp) {
+			r := tr.Clamp[field]
+			res = append(res, fmt.Sprintf("%s is clamped to [%s, %s]", field, bound(r.Min, "-inf"), bound(r.Max, "+inf")))
+		}
+
+		if tr.SystemPrompt != "" {
+			res = append(res, "a system prompt is inserted if there is no system message")
+		}
+
+		for _, from := range sortedKeys(tr.Roles) {
+			res = append(res, fmt.Sprintf("%s messages are sent as %s messages", from, tr.Roles[from]))
+		}
+
+		if tr.EmulateStream && stream {
+			res = append(res, "stream emulation: the request is sent as a non-stream request, and the response is converted to an event-stream")
+		}
+
+		if tr.AggregateStream && !stream {
+			res = append(res, "stream aggregation: the request is sent as a stream request, and the event-stream is merged into a complete response")
+		}
+	}
+
+	return res
+}
+
+// bound Format the bound of a range, the unlimited text is used when it is not set
+func bound(value *float64, unlimited string) string {
+	if value == nil {
+		return unlimited
+	}
+
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+func (t transform) apply(body []byte, res *Result) ([]byte, error) {
+	var err error
+
+	for _, src := range sortedKeys(t.Rename) {
+		value := gjson.GetBytes(body, src)
+		if !value.Exists() {
+			continue
+		}
+
+		if body, err = sjson.SetRawBytes(body, t.Rename[src], []byte(value.Raw)); err != nil {
+			return nil, fmt.Errorf("rename %s failed: %w", src, err)
+		}
+
+		if body, err = sjson.DeleteBytes(body, src); err != nil {
+			return nil, fmt.Errorf("rename %s failed: %w", src, err)
+		}
+	}
+
+	for _, field := range t.Remove {
+		if body, err = sjson.DeleteBytes(body, field); err != nil {
+			return nil, fmt.Errorf("remove %s failed: %w", field, err)
+		}
+	}
+
+	for _, field := range sortedKeys(t.Default) {
+		if gjson.GetBytes(body, field).Exists() {
+			continue
+		}
+
+		if body, err = sjson.SetBytes(body, field, t.Default[field]); err != nil {
+			return nil, fmt.Errorf("default %s failed: %w", field, err)
+		}
+	}
+
+	for _, field := range sortedKeys(t.Set) {
+		if body, err = sjson.SetBytes(body, field, t.Set[field]); err != nil {
+			return nil, fmt.Errorf("set %s failed: %w", field, err)
+		}
+	}
+
+	for _, field := range sortedKeys(t.Clamp) {
+		value := gjson.GetBytes(body, field)
+		if value.Type != gjson.Number {
+			continue
+		}
+
+		clamped, r := value.Float(), t.Clamp[field]
+		if r.Min != nil {
+			clamped = math.Max(clamped, *r.Min)
+		}
+
+		if r.Max != nil {
+			clamped = math.Min(clamped, *r.Max)
+		}
+
+		if clamped == value.Float() {
+			continue
+		}
+
+		if body, err = sjson.SetBytes(body, field, clamped); err != nil {
+			return nil, fmt.Errorf("clamp %s failed: %w", field, err)
+		}
+	}
+
+	messages := gjson.GetBytes(body, "messages")
+	if t.SystemPrompt != "" && messages.IsArray() {
+		hasSystem := false
+		for _, message := range messages.Array() {
+			if role := message.Get("role").String(); role == "system" || role == "developer" {
+				hasSystem = true
+				break
+			}
+		}
+
+		if !hasSystem {
+			system, _ := sjson.Set(`{"role":"system"}`, "content", t.SystemPrompt)
+			raw := "[" + system
+			if len(messages.Array()) > 0 {
+				raw += "," + strings.TrimPrefix(strings.TrimSpace(messages.Raw), "[")
+			} else {
+				raw += "]"
+			}
+
+			if body, err = sjson.SetRawBytes(body, "messages", []byte(raw)); err != nil {
+				return nil, fmt.Errorf("insert system prompt failed: %w", err)
+			}
+		}
+	}
+
+	if len(t.Roles) > 0 {
+		for i, message := range gjson.GetBytes(body, "messages").Array() {
+			to, ok := t.Roles[message.Get("role").String()]
+			if !ok {
+				continue
+			}
+
+			if body, err = sjson.SetBytes(body, fmt.Sprintf("messages.%d.role", i), to); err != nil {
+				return nil, fmt.Errorf("rename role failed: %w", err)
+			}
+		}
+	}
+
+	if t.EmulateStream && !res.AggregateStream && gjson.GetBytes(body, "stream").Bool() {
+		res.EmulateStream = true
+		res.IncludeUsage = gjson.GetBytes(body, "stream_options.include_usage").Bool()
+
+		res.ChunkSize, res.ChunkInterval = t.ChunkSize, t.ChunkInterval
+
+		body, _ = sjson.SetBytes(body, "stream", false)
+		body, _ = sjson.DeleteBytes(body, "stream_options")
+	}
+
+	if t.AggregateStream && !res.EmulateStream && !gjson.GetBytes(body, "stream").Bool() {
+		res.AggregateStream = true
+
+		// The usage is only sent in the stream when it is requested
+		body, _ = sjson.SetBytes(body, "stream", true)
+		body, _ = sjson.SetBytes(body, "stream_options.include_usage", true)
+	}
+
+	return body, nil
+}
+
+// sortedKeys The keys of the map in order, so that the transforms are applied deterministically
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,106 @@
+package transform
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
+	"github.com/tidwall/gjson"
+	"testing"
+)
+
+func TestTransformer_Apply(t *testing.T) {
+	max := 100.0
+	transformer := New([]config.Transform{
+		{
+			Models:        []string{"o1-*"},
+			Rename:        map[string]string{"max_tokens": "max_completion_tokens"},
+			Remove:        []string{"temperature"},
+			Roles:         map[string]string{"system": "user"},
+			EmulateStream: true,
+		},
+		{
+			Endpoints:    []base.Endpoint{base.EndpointChatCompletion},
+			Default:      map[string]any{"top_p": 0.5},
+			Set:          map[string]any{"metadata.source": "dispatcher"},
+			Clamp:        map[string]config.Range{"max_completion_tokens": {Max: &max}},
+			SystemPrompt: "be brief",
+		},
+	}, nil)
+
+	body := `{"model":"o1-mini","stream":true,"stream_options":{"include_usage":true},"max_tokens":500,"temperature":0.3,"messages":[{"role":"user","content":"hi"}]}`
+	transformed, res, err := transformer.Apply(base.EndpointChatCompletion, "o1-mini", []byte(body))
+	assert.NoError(t, err)
+	assert.True(t, res.EmulateStream)
+	assert.True(t, res.IncludeUsage)
+
+	result := gjson.ParseBytes(transformed)
+	assert.False(t, result.Get("stream").Bool())
+	assert.False(t, result.Get("stream_options").Exists())
+	assert.False(t, result.Get("temperature").Exists())
+	assert.False(t, result.Get("max_tokens").Exists())
+	assert.Equal(t, int64(100), result.Get("max_completion_tokens").Int())
+	assert.Equal(t, 0.5, result.Get("top_p").Float())
+	assert.Equal(t, "dispatcher", result.Get("metadata.source").String())
+
+	// The system prompt is inserted by the second transform, after the roles of the first one are renamed
+	assert.Equal(t, `["system","user"]`, result.Get("messages.#.role").Raw)
+	assert.Equal(t, "be brief", result.Get("messages.0.content").String())
+
+	// The first transform does not match other models, the client values are kept
+	transformed, res, err = transformer.Apply(base.EndpointChatCompletion, "gpt-4o", []byte(`{"model":"gpt-4o","stream":true,"top_p":1,"messages":[{"role":"system","content":"x"}]}`))
+	assert.NoError(t, err)
+	assert.False(t, res.EmulateStream)
+	assert.Equal(t, `{"model":"gpt-4o","stream":true,"top_p":1,"messages":[{"role":"system","content":"x"}],"metadata":{"source":"dispatcher"}}`, string(transformed))
+
+	// No transform matches other endpoints
+	transformed, _, err = transformer.Apply(base.EndpointEmbedding, "text-embedding-3-small", []byte(`{"input":"x"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"input":"x"}`, string(transformed))
+}
+
+func TestTransformer_AggregateStream(t *testing.T) {
+	transformer := New([]config.Transform{{Models: []string{"qwq-*"}, AggregateStream: true}}, nil)
+
+	transformed, res, err := transformer.Apply(base.EndpointChatCompletion, "qwq-32b", []byte(`{"model":"qwq-32b"}`))
+	assert.NoError(t, err)
+	assert.True(t, res.AggregateStream)
+	assert.Equal(t, `{"model":"qwq-32b","stream":true,"stream_options":{"include_usage":true}}`, string(transformed))
+
+	// The stream requests are sent as they are
+	_, res, err = transformer.Apply(base.EndpointChatCompletion, "qwq-32b", []byte(`{"model":"qwq-32b","stream":true}`))
+	assert.NoError(t, err)
+	assert.False(t, res.AggregateStream)
+}
+
+func TestTransformer_Nil(t *testing.T) {
+	var transformer *Transformer
+	body, res, err := transformer.Apply(base.EndpointChatCompletion, "gpt-4o", []byte(`{"stream":true}`))
+	assert.NoError(t, err)
+	assert.False(t, res.EmulateStream)
+	assert.Equal(t, `{"stream":true}`, string(body))
+	assert.Equal(t, 0, len(transformer.Explain(base.EndpointChatCompletion, "gpt-4o", true)))
+}
+
+func TestTransformer_Registry(t *testing.T) {
+	reg, err := registry.New(nil)
+	assert.NoError(t, err)
+
+	transformer := New(nil, reg)
+	body := `{"model":"o1-mini","stream":true,"max_tokens":100000,"temperature":0.3,"messages":[{"role":"system","content":"x"}]}`
+	transformed, res, err := transformer.Apply(base.EndpointChatCompletion, "o1-mini", []byte(body))
+	assert.NoError(t, err)
+	assert.True(t, res.EmulateStream)
+
+	result := gjson.ParseBytes(transformed)
+	assert.False(t, result.Get("temperature").Exists())
+	assert.Equal(t, int64(65536), result.Get("max_completion_tokens").Int())
+	assert.Equal(t, "user", result.Get("messages.0.role").String())
+
+	// The models with all capabilities are sent as they are
+	body = `{"model":"gpt-4o","stream":true,"max_tokens":100,"messages":[{"role":"system","content":"x"}]}`
+	transformed, res, err = transformer.Apply(base.EndpointChatCompletion, "gpt-4o", []byte(body))
+	assert.NoError(t, err)
+	assert.False(t, res.EmulateStream)
+	assert.Equal(t, body, string(transformed))
+}
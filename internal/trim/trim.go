@@ -0,0 +1,160 @@
+package trim
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/pkg/token"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"strings"
+)
+
+// Result What was done to the conversation
+type Result struct {
+	Strategy string
+	// Dropped The number of messages dropped
+	Dropped int
+	// Before The prompt tokens of the original request
+	Before int
+	// After The prompt tokens of the trimmed request
+	After int
+	// Limit The limit of the prompt tokens, After is still larger than it when the kept messages are too long
+	Limit int
+}
+
+// Fit Whether the trimmed request fits in the limit
+func (res *Result) Fit() bool {
+	return res.After <= res.Limit
+}
+
+// String The summary sent to the client in the X-Context-Trimmed header
+func (res *Result) String() string {
+	summary := fmt.Sprintf("strategy=%s; dropped=%d; tokens=%d->%d; limit=%d", res.Strategy, res.Dropped, res.Before, res.After, res.Limit)
+	if !res.Fit() {
+		summary += "; over-limit"
+	}
+
+	return summary
+}
+
+// turn The messages dropped together, an assistant message calling tools and the results of the calls
+type turn struct {
+	start, end int
+	tokens     int
+}
+
+// Trim Drop the turns of the chat completion request until its prompt tokens are no more than the limit.
+// The system messages and the latest user message with the messages after it are always kept.
+// The result is nil when the request is not longer than the limit
+func Trim(body []byte, model string, strategy string, limit int) ([]byte, *Result, error) {
+	messages := gjson.GetBytes(body, "messages")
+	if !messages.IsArray() || limit <= 0 {
+		return body, nil, nil
+	}
+
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil, fmt.Errorf("invalid chat completion request: %w", err)
+	}
+
+	rawMessages := messages.Array()
+	if len(rawMessages) != len(req.Messages) {
+		return body, nil, nil
+	}
+
+	_, estimator := token.EstimatorFor(model)
+	req.Model = model
+
+	total, err := estimator.PromptTokens(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if total <= limit {
+		return body, nil, nil
+	}
+
+	// The tokens of each message are counted without the tokens primed for the reply
+	empty, err := estimator.PromptTokens(openai.ChatCompletionRequest{Model: model})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messageTokens := func(start, end int) (int, error) {
+		tokens, err := estimator.PromptTokens(openai.ChatCompletionRequest{Model: model, Messages: req.Messages[start:end]})
+		return tokens - empty, err
+	}
+
+	// The latest user message is what the client asks now, it is kept with the messages after it
+	pinned := len(req.Messages) - 1
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == openai.ChatMessageRoleUser {
+			pinned = i
+			break
+		}
+	}
+
+	candidates := make([]turn, 0)
+	for i := 0; i < pinned; {
+		message := req.Messages[i]
+		if message.Role == openai.ChatMessageRoleSystem || message.Role == "developer" {
+			i++
+			continue
+		}
+
+		end := i + 1
+		if len(message.ToolCalls) > 0 || message.FunctionCall != nil {
+			for end < pinned && array.In(req.Messages[end].Role, []string{openai.ChatMessageRoleTool, openai.ChatMessageRoleFunction}) {
+				end++
+			}
+		}
+
+		tokens, err := messageTokens(i, end)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		candidates = append(candidates, turn{start: i, end: end, tokens: tokens})
+		i = end
+	}
+
+	res := &Result{Strategy: strategy, Before: total, After: total, Limit: limit}
+	dropped := make(map[int]bool)
+	for len(candidates) > 0 && res.After > limit {
+		index := 0
+		if strategy == config.ContextStrategyMiddle {
+			index = len(candidates) / 2
+		}
+
+		t := candidates[index]
+		candidates = append(candidates[:index], candidates[index+1:]...)
+
+		for i := t.start; i < t.end; i++ {
+			dropped[i] = true
+		}
+
+		res.Dropped += t.end - t.start
+		res.After -= t.tokens
+	}
+
+	if res.Dropped == 0 {
+		return body, res, nil
+	}
+
+	kept := make([]string, 0, len(rawMessages)-res.Dropped)
+	for i, message := range rawMessages {
+		if !dropped[i] {
+			kept = append(kept, message.Raw)
+		}
+	}
+
+	trimmed, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(kept, ",")+"]"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return trimmed, res, nil
+}
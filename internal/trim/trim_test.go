@@ -0,0 +1,73 @@
+package trim_test
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/trim"
+	"github.com/tidwall/gjson"
+	"strings"
+	"testing"
+)
+
+func roles(body []byte) string {
+	return strings.Join(
+		func() []string {
+			res := make([]string, 0)
+			for _, message := range gjson.GetBytes(body, "messages").Array() {
+				res = append(res, message.Get("role").String()+":"+message.Get("content").String())
+			}
+			return res
+		}(),
+		",",
+	)
+}
+
+func TestTrim(t *testing.T) {
+	long := strings.Repeat("hello world ", 100)
+	body := []byte(`{"model":"gpt-4o","messages":[
+		{"role":"system","content":"be nice"},
+		{"role":"user","content":"1 ` + long + `"},
+		{"role":"assistant","content":"2"},
+		{"role":"user","content":"3 ` + long + `"},
+		{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},
+		{"role":"tool","tool_call_id":"call_1","content":"5 ` + long + `"},
+		{"role":"assistant","content":"6"},
+		{"role":"user","content":"7"}
+	],"temperature":0.5}`)
+
+	// The request is shorter than the limit
+	trimmed, res, err := trim.Trim(body, "gpt-4o", config.ContextStrategyOldest, 10000)
+	assert.NoError(t, err)
+	assert.True(t, res == nil)
+	assert.Equal(t, string(body), string(trimmed))
+
+	trimmed, res, err = trim.Trim(body, "gpt-4o", config.ContextStrategyOldest, 300)
+	assert.NoError(t, err)
+	assert.True(t, res.Fit())
+	assert.Equal(t, 3, res.Dropped)
+	assert.Equal(t, "system:be nice,assistant:,tool:5 "+long+",assistant:6,user:7", roles(trimmed))
+	assert.Equal(t, 0.5, gjson.GetBytes(trimmed, "temperature").Float())
+	assert.True(t, strings.Contains(res.String(), "strategy=oldest; dropped=3;"))
+
+	// The tool call and its result are dropped together
+	trimmed, res, err = trim.Trim(body, "gpt-4o", config.ContextStrategyOldest, 100)
+	assert.NoError(t, err)
+	assert.True(t, res.Fit())
+	assert.Equal(t, 5, res.Dropped)
+	assert.Equal(t, "system:be nice,assistant:6,user:7", roles(trimmed))
+
+	// The middle turns are dropped first
+	trimmed, res, err = trim.Trim(body, "gpt-4o", config.ContextStrategyMiddle, 500)
+	assert.NoError(t, err)
+	assert.True(t, res.Fit())
+	assert.Equal(t, 1, res.Dropped)
+	assert.Equal(t, "system:be nice,user:1 "+long+",assistant:2,assistant:,tool:5 "+long+",assistant:6,user:7", roles(trimmed))
+
+	// The system messages and the latest user message are kept even if they exceed the limit
+	trimmed, res, err = trim.Trim(body, "gpt-4o", config.ContextStrategyOldest, 5)
+	assert.NoError(t, err)
+	assert.False(t, res.Fit())
+	assert.Equal(t, 6, res.Dropped)
+	assert.Equal(t, "system:be nice,user:7", roles(trimmed))
+	assert.True(t, strings.HasSuffix(res.String(), "; over-limit"))
+}
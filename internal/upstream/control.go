@@ -0,0 +1,190 @@
+package upstream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The runtime state of upstreams is kept by name instead of in the Upstream object,
+// so it survives configuration reload, and is shared by the same upstream serving multiple models
+
+var (
+	statsRegistry sync.Map // upstream name -> *Stats
+	disabledUps   sync.Map // upstream name -> struct{}
+	disabledKeys  sync.Map // upstream key -> struct{}
+	drainedRules  sync.Map // rule name -> struct{}
+)
+
+// Stats Runtime statistics of an upstream
+type Stats struct {
+	inflight            atomic.Int64
+	total               atomic.Int64
+	failures            atomic.Int64
+	consecutiveFailures atomic.Int64
+
+	lock        sync.RWMutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// StatsSnapshot A point-in-time copy of Stats
+type StatsSnapshot struct {
+	Inflight            int64      `json:"inflight"`
+	Total               int64      `json:"total"`
+	Failures            int64      `json:"failures"`
+	ErrorRate           float64    `json:"error_rate"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	Healthy             bool       `json:"healthy"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+}
+
+// unhealthyThreshold The number of consecutive failures after which an upstream is considered unhealthy
+const unhealthyThreshold = 3
+
+// StatsOf Get the statistics of the upstream with the given name
+func StatsOf(name string) *Stats {
+	stats, _ := statsRegistry.LoadOrStore(name, &Stats{})
+	return stats.(*Stats)
+}
+
+// AllStats Get the statistics of all upstreams that have served requests
+func AllStats() map[string]StatsSnapshot {
+	res := make(map[string]StatsSnapshot)
+	statsRegistry.Range(func(key, value any) bool {
+		res[key.(string)] = value.(*Stats).Snapshot()
+		return true
+	})
+
+	return res
+}
+
+// Begin Mark the start of a request
+func (s *Stats) Begin() {
+	s.inflight.Add(1)
+	s.total.Add(1)
+}
+
+// End Mark the end of a request, err is nil if the request succeeded
+func (s *Stats) End(err error) {
+	s.inflight.Add(-1)
+
+	if err == nil {
+		s.consecutiveFailures.Store(0)
+		return
+	}
+
+	s.failures.Add(1)
+	s.consecutiveFailures.Add(1)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+// Snapshot Return a copy of the statistics
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	snapshot := StatsSnapshot{
+		Inflight:            s.inflight.Load(),
+		Total:               s.total.Load(),
+		Failures:            s.failures.Load(),
+		ConsecutiveFailures: s.consecutiveFailures.Load(),
+		LastError:           s.lastError,
+	}
+
+	if !s.lastErrorAt.IsZero() {
+		lastErrorAt := s.lastErrorAt
+		snapshot.LastErrorAt = &lastErrorAt
+	}
+
+	if snapshot.Total > 0 {
+		snapshot.ErrorRate = float64(snapshot.Failures) / float64(snapshot.Total)
+	}
+
+	snapshot.Healthy = snapshot.ConsecutiveFailures < unhealthyThreshold
+
+	return snapshot
+}
+
+// Disable Take the upstream with the given name out of rotation
+func Disable(name string) { disabledUps.Store(name, struct{}{}) }
+
+// Enable Put the upstream with the given name back into rotation
+func Enable(name string) { disabledUps.Delete(name) }
+
+// DisableKey Take all upstreams using the key out of rotation
+func DisableKey(key string) { disabledKeys.Store(key, struct{}{}) }
+
+// EnableKey Put all upstreams using the key back into rotation
+func EnableKey(key string) { disabledKeys.Delete(key) }
+
+// Drain Stop sending new requests to the upstreams of the rule, in-flight requests are not affected
+func Drain(rule string) { drainedRules.Store(rule, struct{}{}) }
+
+// Undrain Resume sending requests to the upstreams of the rule
+func Undrain(rule string) { drainedRules.Delete(rule) }
+
+// IsDisabled Whether the upstream with the given name is disabled
+func IsDisabled(name string) bool {
+	_, ok := disabledUps.Load(name)
+	return ok
+}
+
+// IsKeyDisabled Whether the key is disabled
+func IsKeyDisabled(key string) bool {
+	_, ok := disabledKeys.Load(key)
+	return ok
+}
+
+// IsDrained Whether the rule is drained
+func IsDrained(rule string) bool {
+	_, ok := drainedRules.Load(rule)
+	return ok
+}
+
+// Disabled Return the names of disabled upstreams, the masked disabled keys and the drained rules
+func Disabled() (upstreams []string, keys []string, rules []string) {
+	upstreams, keys, rules = make([]string, 0), make([]string, 0), make([]string, 0)
+	disabledUps.Range(func(key, _ any) bool {
+		upstreams = append(upstreams, key.(string))
+		return true
+	})
+	disabledKeys.Range(func(key, _ any) bool {
+		keys = append(keys, mask(10, key.(string)))
+		return true
+	})
+	drainedRules.Range(func(key, _ any) bool {
+		rules = append(rules, key.(string))
+		return true
+	})
+
+	return
+}
+
+// Stats Get the statistics of the upstream
+func (u *Upstream) Stats() *Stats {
+	return StatsOf(u.Name())
+}
+
+// Available Whether the upstream can accept new requests
+func (u *Upstream) Available() bool {
+	if _, ok := disabledUps.Load(u.Name()); ok {
+		return false
+	}
+
+	if _, ok := disabledKeys.Load(u.Rule.Keys[u.KeyIndex]); ok {
+		return false
+	}
+
+	if _, ok := drainedRules.Load(u.Rule.Name); ok && u.Rule.Name != "" {
+		return false
+	}
+
+	return true
+}
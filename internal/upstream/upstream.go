@@ -9,6 +9,8 @@ import (
 	"github.com/mylxsw/openai-dispatcher/internal/config"
 	"github.com/mylxsw/openai-dispatcher/internal/provider"
 	"github.com/mylxsw/openai-dispatcher/internal/provider/base"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
+	"github.com/mylxsw/openai-dispatcher/internal/transform"
 	"golang.org/x/net/proxy"
 	"math/rand"
 	"strings"
@@ -117,7 +119,7 @@ func (u *Upstreams) All() []*Upstream {
 func (u *Upstreams) Next(excludeIndex ...int) (*Upstream, int) {
 	// A retry is indicated when an index to exclude is included, in which case a random upstream (containing the upstream marked backup) is selected.
 	if len(excludeIndex) > 0 {
-		candidates := array.Filter(u.ups, func(item *Upstream, _ int) bool { return !array.In(item.Index, excludeIndex) })
+		candidates := array.Filter(u.ups, func(item *Upstream, _ int) bool { return !array.In(item.Index, excludeIndex) && item.Available() })
 		if len(candidates) == 0 {
 			return nil, -1
 		}
@@ -127,11 +129,13 @@ func (u *Upstreams) Next(excludeIndex ...int) (*Upstream, int) {
 	}
 
 	// If there is no index to exclude, it is a normal request and only the non-backup upstream is selected
-	candidates := array.Filter(u.ups, func(item *Upstream, _ int) bool { return !item.Rule.Backup })
+	// Upstreams that are disabled or drained are never selected
+	available := array.Filter(u.ups, func(item *Upstream, _ int) bool { return item.Available() })
+	candidates := array.Filter(available, func(item *Upstream, _ int) bool { return !item.Rule.Backup })
 	if len(candidates) == 0 {
 		// After the backup upstreams are excluded, if no upstreams are available, all upstreams are used.
 		// This is usually the case when all upstreams are backup, and if no upstreams are available, an error is returned
-		candidates = u.ups
+		candidates = available
 		if len(candidates) == 0 {
 			return nil, -1
 		}
@@ -150,6 +154,11 @@ func (u *Upstreams) Next(excludeIndex ...int) (*Upstream, int) {
 		return candidates[u.index], candidates[u.index].Index
 	case WeightPolicy: // Weight strategy
 		item := u.chooser.Pick()
+		if !item.Available() {
+			// The chooser is built at startup, fall back to a random available upstream
+			item = candidates[rand.Intn(len(candidates))]
+		}
+
 		return item, item.Index
 	default:
 		panic("unknown policy: " + u.policy)
@@ -182,7 +191,19 @@ type Result struct {
 	ExprRules []config.Rule
 }
 
-func BuildUpstreamsFromRules(policy Policy, rules config.Rules, dialer proxy.Dialer) (*Result, error) {
+// BuildUpstreamsFromRules Build the upstreams of the rules, a handler is created for each server and key
+func BuildUpstreamsFromRules(policy Policy, rules config.Rules, dialer proxy.Dialer, reg *registry.Registry) (*Result, error) {
+	return buildFromRules(policy, rules, func(rule config.Rule, server, key string) (base.Handler, error) {
+		return provider.CreateHandler(rule.Type, server, key, ternary.If(rule.Proxy, dialer, nil), rule.ModelReplacer, transform.New(rule.Transforms, reg))
+	})
+}
+
+// BuildRoutesFromRules Build the upstreams of the rules without the handlers, they are only used to explain the routing
+func BuildRoutesFromRules(policy Policy, rules config.Rules) (*Result, error) {
+	return buildFromRules(policy, rules, func(config.Rule, string, string) (base.Handler, error) { return nil, nil })
+}
+
+func buildFromRules(policy Policy, rules config.Rules, createHandler func(rule config.Rule, server, key string) (base.Handler, error)) (*Result, error) {
 	result := &Result{
 		Upstreams: make(map[string]*Upstreams),
 		Default:   NewUpstreams(policy),
@@ -197,7 +218,7 @@ func BuildUpstreamsFromRules(policy Policy, rules config.Rules, dialer proxy.Dia
 
 			for serverIndex, server := range rule.Servers {
 				for keyIndex, key := range rule.Keys {
-					if handler, err := provider.CreateHandler(rule.Type, server, key, ternary.If(rule.Proxy, dialer, nil), rule.ModelReplacer); err != nil {
+					if handler, err := createHandler(rule, server, key); err != nil {
 						return nil, fmt.Errorf("upstream failed to create #%d: %w", i+1, err)
 					} else {
 						result.Upstreams[model].ups = append(result.Upstreams[model].ups, &Upstream{
@@ -230,7 +251,7 @@ func BuildUpstreamsFromRules(policy Policy, rules config.Rules, dialer proxy.Dia
 		if _, ok := dum[rule.Name]; !ok {
 			for serverIndex, server := range rule.Servers {
 				for keyIndex, key := range rule.Keys {
-					if handler, err := provider.CreateHandler(rule.Type, server, key, ternary.If(rule.Proxy, dialer, nil), rule.ModelReplacer); err != nil {
+					if handler, err := createHandler(rule, server, key); err != nil {
 						return nil, fmt.Errorf("upstream failed to create #%d: %w", i+1, err)
 					} else {
 						result.Default.ups = append(result.Default.ups, &Upstream{
@@ -8,27 +8,54 @@ import (
 	"github.com/mylxsw/asteria/level"
 	"github.com/mylxsw/asteria/log"
 	"github.com/mylxsw/asteria/writer"
+	"github.com/mylxsw/go-utils/ternary"
 	"github.com/mylxsw/openai-dispatcher/internal"
+	"github.com/mylxsw/openai-dispatcher/internal/capture"
 	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"github.com/mylxsw/openai-dispatcher/internal/registry"
 	"github.com/mylxsw/openai-dispatcher/internal/upstream"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "explain":
+			runExplain(os.Args[2:])
+			return
+		case "moderate":
+			runModerate(os.Args[2:])
+			return
+		}
+	}
+
 	var configFilePath string
 	var configTest bool
 	var evalTestModel string
+	var replayFile, replayTarget, replayKey string
+	var replayRedacted bool
 
 	flag.StringVar(&configFilePath, "conf", "config.yaml", "Configuration file path")
 	flag.BoolVar(&configTest, "test", false, "Test profile")
-	flag.StringVar(&evalTestModel, "eval", "", "Test model evaluation")
+	flag.StringVar(&evalTestModel, "eval", "", "Test model evaluation, see the explain subcommand for more options")
+	flag.StringVar(&replayFile, "replay", "", "Replay the requests in the capture file")
+	flag.StringVar(&replayTarget, "replay-target", "", "The server address to replay to, the listen address is used by default")
+	flag.StringVar(&replayKey, "replay-key", "", "The client key used for replay, the first key in the configuration is used by default")
+	flag.BoolVar(&replayRedacted, "replay-redacted", false, "Also replay the requests whose values are redacted, the redacted values are sent as they are")
 	flag.Parse()
 
 	conf, err := config.LoadConfig(configFilePath)
 	if err != nil {
+		if configTest {
+			fmt.Printf("configuration file test failed：%v\n", err)
+			os.Exit(1)
+		}
+
 		panic(fmt.Errorf("failed to load the configuration file：%v", err))
 	}
 
@@ -46,7 +73,12 @@ func main() {
 	}
 
 	if configTest {
-		ret, err := upstream.BuildUpstreamsFromRules(upstream.Policy(conf.Policy), conf.Rules, nil)
+		reg, err := registry.New(conf.Models)
+		if err != nil {
+			panic(fmt.Errorf("configuration file test failed：%v", err))
+		}
+
+		ret, err := upstream.BuildUpstreamsFromRules(upstream.Policy(conf.Policy), conf.Rules, nil, reg)
 		if err != nil {
 			panic(fmt.Errorf("configuration file test failed：%v", err))
 		}
@@ -61,22 +93,64 @@ func main() {
 		fmt.Print("\n-------- Default-Upstreams --------\n\n")
 		ret.Default.Print()
 
+		fmt.Print("\n-------- Rules --------\n\n")
+		for i, rule := range conf.Rules {
+			fmt.Printf("    #%d %s <- %s\n", i+1, ternary.If(rule.Name == "", "(unnamed)", rule.Name), rule.Source)
+		}
+
 		return
 	}
 
-	log.With(conf).Debugf("The configuration file is successfully loaded")
+	if replayFile != "" {
+		if replayTarget == "" {
+			replayTarget = "http://" + conf.Listen
+			if strings.HasPrefix(conf.Listen, ":") {
+				replayTarget = "http://127.0.0.1" + conf.Listen
+			}
+		}
 
-	server, err := internal.NewServer(conf)
-	if err != nil {
-		panic(fmt.Errorf("failed to initialize the service：%v", err))
+		if replayKey == "" && len(conf.Keys) > 0 {
+			replayKey = conf.Keys[0].Key
+		}
+
+		if err := capture.Replay(context.Background(), replayFile, replayTarget, replayKey, replayRedacted, os.Stdout); err != nil {
+			panic(fmt.Errorf("replay failed：%v", err))
+		}
+
+		return
 	}
 
 	if evalTestModel != "" {
+		explanation, err := internal.Explain(conf, internal.ExplainRequest{Model: evalTestModel})
+		if err != nil {
+			panic(fmt.Errorf("model evaluation failed：%v", err))
+		}
+
 		fmt.Printf("\n---------------------- Eval ----------------------\n\n")
-		server.EvalTest(evalTestModel)
+		explanation.Print(os.Stdout)
 		return
 	}
 
+	log.With(conf).Debugf("The configuration file is successfully loaded")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := internal.NewServer(ctx, conf, configFilePath)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize the service：%v", err))
+	}
+
+	go server.WatchConfig(ctx, 5*time.Second)
+
+	if conf.Admin.Listen != "" {
+		go func() {
+			if err := http.ListenAndServe(conf.Admin.Listen, server.AdminHandler()); err != nil {
+				log.Errorf("admin api startup failure: %v", err)
+			}
+		}()
+	}
+
 	if conf.EnablePrometheus {
 		http.Handle("/metrics", promhttp.Handler())
 	}
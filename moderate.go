@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/mylxsw/asteria/level"
+	"github.com/mylxsw/asteria/log"
+	"github.com/mylxsw/openai-dispatcher/internal"
+	"github.com/mylxsw/openai-dispatcher/internal/config"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// thresholdFlags Repeatable -category-threshold flag, such as -category-threshold sexual/minors=0.1
+type thresholdFlags map[string]float64
+
+func (t thresholdFlags) String() string {
+	return fmt.Sprintf("%v", map[string]float64(t))
+}
+
+func (t thresholdFlags) Set(value string) error {
+	category, threshold, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid category threshold %q, the format should be 'category=0.5'", value)
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(threshold), 64)
+	if err != nil {
+		return fmt.Errorf("invalid category threshold %q: %v", value, err)
+	}
+
+	t[strings.TrimSpace(category)] = val
+	return nil
+}
+
+// runModerate Re-run moderation over the captured inputs to tune the thresholds offline
+//
+//	openai-dispatcher moderate -conf config.yaml -capture capture.20241018.0.jsonl -category-threshold violence=0.9
+func runModerate(args []string) {
+	var configFilePath, captureFile string
+	var opts internal.RemoderateOptions
+	thresholds := thresholdFlags{}
+
+	fs := flag.NewFlagSet("moderate", flag.ExitOnError)
+	fs.StringVar(&configFilePath, "conf", "config.yaml", "Configuration file path")
+	fs.StringVar(&captureFile, "capture", "", "Capture file to read the inputs from")
+	fs.StringVar(&opts.ClientKey, "key", "", "Use the moderation policy of the client key with this name, the policy of the captured key is used by default")
+	fs.Float64Var(&opts.ScoreThreshold, "threshold", 0, "Override the score threshold")
+	fs.Var(thresholds, "category-threshold", "Override the threshold of a category, such as 'violence=0.9', can be repeated")
+	fs.BoolVar(&opts.Verbose, "v", false, "Print all records, not only the flagged ones")
+	_ = fs.Parse(args)
+
+	if captureFile == "" {
+		fmt.Println("the capture file is required")
+		os.Exit(1)
+	}
+
+	opts.Thresholds = thresholds
+
+	conf, err := config.LoadConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("failed to load the configuration file：%v\n", err)
+		os.Exit(1)
+	}
+
+	if !conf.Debug {
+		log.All().LogLevel(level.Info)
+	}
+
+	if err := internal.Remoderate(context.Background(), conf, captureFile, opts, os.Stdout); err != nil {
+		fmt.Printf("moderate failed：%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,106 @@
+package ahocorasick
+
+// Matcher Aho-Corasick automaton, find all the patterns in a text with a single scan
+type Matcher struct {
+	patterns []string
+	nodes    []node
+}
+
+type node struct {
+	next map[byte]int
+	fail int
+	// outputs The indexes of the patterns ending at this node, including the ones reached by fail links
+	outputs []int
+}
+
+// New Build a matcher from the patterns, empty patterns are ignored
+func New(patterns []string) *Matcher {
+	m := &Matcher{nodes: []node{{next: map[byte]int{}}}}
+
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		cur := 0
+		for i := 0; i < len(pattern); i++ {
+			next, ok := m.nodes[cur].next[pattern[i]]
+			if !ok {
+				next = len(m.nodes)
+				m.nodes = append(m.nodes, node{next: map[byte]int{}})
+				m.nodes[cur].next[pattern[i]] = next
+			}
+
+			cur = next
+		}
+
+		m.nodes[cur].outputs = append(m.nodes[cur].outputs, len(m.patterns))
+		m.patterns = append(m.patterns, pattern)
+	}
+
+	// Build the fail links breadth first, so that the fail node of a node is always processed before it
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		for c, child := range m.nodes[cur].next {
+			fail := m.nodes[cur].fail
+			for fail > 0 {
+				if _, ok := m.nodes[fail].next[c]; ok {
+					break
+				}
+
+				fail = m.nodes[fail].fail
+			}
+
+			if next, ok := m.nodes[fail].next[c]; ok && next != child {
+				m.nodes[child].fail = next
+			}
+
+			m.nodes[child].outputs = append(m.nodes[child].outputs, m.nodes[m.nodes[child].fail].outputs...)
+			queue = append(queue, child)
+		}
+	}
+
+	return m
+}
+
+// Len Return the number of patterns
+func (m *Matcher) Len() int {
+	return len(m.patterns)
+}
+
+// FindAll Return all distinct patterns found in the text, in the order they first appear
+func (m *Matcher) FindAll(text string) []string {
+	var matched []string
+	seen := make(map[int]bool)
+
+	cur := 0
+	for i := 0; i < len(text); i++ {
+		for cur > 0 {
+			if _, ok := m.nodes[cur].next[text[i]]; ok {
+				break
+			}
+
+			cur = m.nodes[cur].fail
+		}
+
+		if next, ok := m.nodes[cur].next[text[i]]; ok {
+			cur = next
+		}
+
+		for _, idx := range m.nodes[cur].outputs {
+			if !seen[idx] {
+				seen[idx] = true
+				matched = append(matched, m.patterns[idx])
+			}
+		}
+	}
+
+	return matched
+}
@@ -0,0 +1,16 @@
+package ahocorasick
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"testing"
+)
+
+func TestMatcher_FindAll(t *testing.T) {
+	m := New([]string{"he", "she", "his", "hers", "", "敏感词"})
+	assert.Equal(t, 5, m.Len())
+
+	assert.EqualValues(t, []string{"she", "he", "hers"}, m.FindAll("ushers"))
+	assert.EqualValues(t, []string{"his"}, m.FindAll("this"))
+	assert.EqualValues(t, []string{"敏感词"}, m.FindAll("这是一个敏感词测试"))
+	assert.Equal(t, 0, len(m.FindAll("nothing to match")))
+}
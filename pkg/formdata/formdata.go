@@ -0,0 +1,228 @@
+package formdata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+)
+
+// DefaultMaxMemory The bytes of the parts kept in memory, the other files are written to temporary files
+const DefaultMaxMemory = 8 * 1024 * 1024
+
+// Part A field or a file of the form
+type Part struct {
+	Header textproto.MIMEHeader
+	// data The content of the part when it is kept in memory
+	data []byte
+	// file The temporary file keeping the content of the large files
+	file string
+	size int64
+}
+
+// Name The name of the form field
+func (p *Part) Name() string {
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	return params["name"]
+}
+
+// FileName The name of the uploaded file, empty for the other fields
+func (p *Part) FileName() string {
+	_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	return params["filename"]
+}
+
+// Size The bytes of the content
+func (p *Part) Size() int64 {
+	return p.size
+}
+
+// Open Read the content of the part
+func (p *Part) Open() (io.ReadCloser, error) {
+	if p.file != "" {
+		return os.Open(p.file)
+	}
+
+	return io.NopCloser(bytes.NewReader(p.data)), nil
+}
+
+// Form A multipart/form-data body. It is read once, the large files are kept in temporary files, so that the form can be
+// encoded again for each upstream without keeping the whole body in memory. The parts keep their order and headers
+type Form struct {
+	Parts    []*Part
+	boundary string
+}
+
+// IsForm Whether the content type is multipart/form-data
+func IsForm(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "multipart/form-data"
+}
+
+// Parse Read the multipart/form-data body, the parts beyond maxMemory are written to temporary files.
+// RemoveAll must be called to remove the temporary files when the form is no longer used
+func Parse(body io.Reader, contentType string, maxMemory int64) (*Form, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, fmt.Errorf("not a multipart form: %s", contentType)
+	}
+
+	if params["boundary"] == "" {
+		return nil, errors.New("multipart boundary is missing")
+	}
+
+	form := &Form{boundary: params["boundary"]}
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		// The raw part is used, so that the content is not decoded by Content-Transfer-Encoding
+		p, err := reader.NextRawPart()
+		if err == io.EOF {
+			return form, nil
+		}
+
+		if err != nil {
+			_ = form.RemoveAll()
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+
+		part, err := readPart(p, maxMemory)
+		_ = p.Close()
+		if err != nil {
+			_ = form.RemoveAll()
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+
+		maxMemory -= int64(len(part.data))
+		form.Parts = append(form.Parts, part)
+	}
+}
+
+// readPart Read the content into memory, it is moved to a temporary file once it is larger than maxMemory
+func readPart(p *multipart.Part, maxMemory int64) (*Part, error) {
+	part := &Part{Header: p.Header}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, p, max(maxMemory, 0)+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n <= maxMemory {
+		part.data, part.size = buf.Bytes(), n
+		return part, nil
+	}
+
+	file, err := os.CreateTemp("", "formdata-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	part.file = file.Name()
+	size, err := io.Copy(file, io.MultiReader(&buf, p))
+	if err != nil {
+		_ = os.Remove(part.file)
+		return nil, err
+	}
+
+	part.size = size
+	return part, nil
+}
+
+// Value The value of the first field with the name
+func (f *Form) Value(name string) string {
+	for _, p := range f.Parts {
+		if p.Name() == name && p.file == "" && p.FileName() == "" {
+			return string(p.data)
+		}
+	}
+
+	return ""
+}
+
+// RemoveAll Remove the temporary files of the form
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, p := range f.Parts {
+		if p.file != "" {
+			if err := os.Remove(p.file); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reader Encode the form again, the values of the fields in values replace the original ones.
+// The body is written while it is read, its length is calculated in advance
+func (f *Form) Reader(values map[string]string) (body io.ReadCloser, contentType string, length int64) {
+	counter := &countWriter{}
+	if err := f.write(counter, values, &counter.n); err == nil {
+		length = counter.n
+	} else {
+		length = -1
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		_ = writer.CloseWithError(f.write(writer, values, nil))
+	}()
+
+	return reader, "multipart/form-data; boundary=" + f.boundary, length
+}
+
+// write Write the form to w, the contents of the parts are not written but added to skipped if it is not nil
+func (f *Form) write(w io.Writer, values map[string]string, skipped *int64) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(f.boundary); err != nil {
+		return err
+	}
+
+	for _, p := range f.Parts {
+		pw, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return err
+		}
+
+		if value, ok := values[p.Name()]; ok && p.FileName() == "" {
+			if _, err := io.WriteString(pw, value); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if skipped != nil {
+			*skipped += p.size
+			continue
+		}
+
+		content, err := p.Open()
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(pw, content)
+		_ = content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// countWriter Count the bytes written
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
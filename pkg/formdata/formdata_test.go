@@ -0,0 +1,65 @@
+package formdata_test
+
+import (
+	"bytes"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/mylxsw/openai-dispatcher/pkg/formdata"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestForm(t *testing.T) {
+	audio := strings.Repeat("0123456789", 1000)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	file, _ := mw.CreateFormFile("file", "speech.mp3")
+	_, _ = file.Write([]byte(audio))
+	_ = mw.WriteField("model", "whisper")
+	_ = mw.WriteField("language", "en")
+	_ = mw.Close()
+
+	assert.True(t, formdata.IsForm(mw.FormDataContentType()))
+	assert.False(t, formdata.IsForm("application/json"))
+
+	// The file is larger than the memory limit, it is kept in a temporary file
+	form, err := formdata.Parse(bytes.NewReader(body.Bytes()), mw.FormDataContentType(), 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(form.Parts))
+	assert.Equal(t, "whisper", form.Value("model"))
+	assert.Equal(t, "speech.mp3", form.Parts[0].FileName())
+	assert.EqualValues(t, len(audio), form.Parts[0].Size())
+
+	// The form is encoded again with the same boundary, it is identical when nothing is replaced
+	reader, contentType, length := form.Reader(nil)
+	data, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, mw.FormDataContentType(), contentType)
+	assert.Equal(t, body.String(), string(data))
+	assert.EqualValues(t, len(data), length)
+
+	reader, contentType, length = form.Reader(map[string]string{"model": "whisper-1"})
+	data, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), length)
+
+	encoded, err := multipart.NewReader(bytes.NewReader(data), mw.Boundary()).ReadForm(1 << 20)
+	assert.NoError(t, err)
+	assert.EqualValues(t, []string{"whisper-1"}, encoded.Value["model"])
+	assert.EqualValues(t, []string{"en"}, encoded.Value["language"])
+
+	uploaded, _ := encoded.File["file"][0].Open()
+	content, _ := io.ReadAll(uploaded)
+	assert.Equal(t, audio, string(content))
+
+	// The temporary files are removed
+	assert.NoError(t, form.RemoveAll())
+	_, err = form.Parts[0].Open()
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = formdata.Parse(strings.NewReader("hello"), "multipart/form-data", 1024)
+	assert.True(t, err != nil)
+}
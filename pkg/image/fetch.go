@@ -0,0 +1,261 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"github.com/mylxsw/openai-dispatcher/pkg/lru"
+	"golang.org/x/net/proxy"
+	goimage "image"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrImageTooLarge The image is larger than the max bytes, or has more pixels than MaxPixels
+	ErrImageTooLarge = errors.New("image is too large")
+	// ErrImageType The media type of the image is not allowed
+	ErrImageType = errors.New("unsupported image type")
+	// ErrPrivateAddress The image is hosted on a loopback, private or link-local address
+	ErrPrivateAddress = errors.New("image url resolves to a private address")
+)
+
+// FetchOptions The limits of downloading the remote images
+type FetchOptions struct {
+	// MaxBytes The maximum size of an image
+	MaxBytes int64
+	// Timeout The timeout of downloading an image
+	Timeout time.Duration
+	// MediaTypes The media types allowed, detected from the content of the image
+	MediaTypes []string
+	// CacheSize The number of images cached, 0 to disable the cache
+	CacheSize int
+	// CacheTTL How long the images are cached
+	CacheTTL time.Duration
+	// AllowPrivate Whether the images can be downloaded from the loopback, private and link-local addresses
+	AllowPrivate bool
+}
+
+// MaxPixels The maximum number of pixels of an image. The images are decoded into memory to be converted, a small but
+// highly compressed image may declare a huge size, so the size is checked before decoding
+const MaxPixels = 50_000_000
+
+// DefaultFetchOptions The options used before SetFetchOptions is called
+var DefaultFetchOptions = FetchOptions{
+	MaxBytes:   20 * 1024 * 1024,
+	Timeout:    10 * time.Second,
+	MediaTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp", "image/tiff"},
+	CacheSize:  100,
+	CacheTTL:   10 * time.Minute,
+}
+
+var (
+	fetchOptions atomic.Pointer[FetchOptions]
+	fetched      atomic.Pointer[lru.Cache[string, *Image]]
+)
+
+func init() {
+	SetFetchOptions(DefaultFetchOptions)
+}
+
+// SetFetchOptions Set the limits of downloading the remote images, the cached images are dropped
+// when the size or the TTL of the cache changes
+func SetFetchOptions(opts FetchOptions) {
+	old := fetchOptions.Swap(&opts)
+	if old != nil && old.CacheSize == opts.CacheSize && old.CacheTTL == opts.CacheTTL {
+		return
+	}
+
+	if opts.CacheSize > 0 {
+		fetched.Store(lru.New[string, *Image](opts.CacheSize, opts.CacheTTL))
+	} else {
+		fetched.Store(nil)
+	}
+}
+
+// Image The decoded content of an image
+type Image struct {
+	Data      []byte
+	MediaType string
+	Width     int
+	Height    int
+}
+
+// Base64 The content of the image encoded by base64, without the data URL prefix
+func (img *Image) Base64() string {
+	return base64.StdEncoding.EncodeToString(img.Data)
+}
+
+// newImage Detect the media type and the dimensions of the image content, the media type is sniffed
+// from the content when the format can not be decoded
+func newImage(data []byte) *Image {
+	img := &Image{Data: data, MediaType: http.DetectContentType(data)}
+	if conf, format, err := goimage.DecodeConfig(bytes.NewReader(data)); err == nil {
+		img.MediaType, img.Width, img.Height = "image/"+format, conf.Width, conf.Height
+	}
+
+	return img
+}
+
+// cachedImage The image downloaded from the URL if it is still cached
+func cachedImage(url string) (*Image, bool) {
+	if cache := fetched.Load(); cache != nil {
+		return cache.Get(url)
+	}
+
+	return nil, false
+}
+
+// Fetcher Download the images in the requests, the base64 images and data URLs are decoded directly
+type Fetcher struct {
+	dialer proxy.Dialer
+}
+
+// NewFetcher Create a fetcher, the images are downloaded through the dialer if it is not nil
+func NewFetcher(dialer proxy.Dialer) *Fetcher {
+	return &Fetcher{dialer: dialer}
+}
+
+// Fetch Return the image of the URL, which is an http(s) URL, a data URL or a base64 string
+func (f *Fetcher) Fetch(ctx context.Context, url string) (*Image, error) {
+	opts := *fetchOptions.Load()
+
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		data, _, err := DecodeBase64ImageWithMime(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return f.check(opts, newImage(data))
+	}
+
+	if img, ok := cachedImage(url); ok {
+		return img, nil
+	}
+
+	data, err := f.download(ctx, opts, url)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := f.check(opts, newImage(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if cache := fetched.Load(); cache != nil {
+		cache.Set(url, img)
+	}
+
+	return img, nil
+}
+
+// check Whether the image is allowed by the options
+func (f *Fetcher) check(opts FetchOptions, img *Image) (*Image, error) {
+	if opts.MaxBytes > 0 && int64(len(img.Data)) > opts.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes", ErrImageTooLarge, len(img.Data))
+	}
+
+	if err := checkPixels(img); err != nil {
+		return nil, err
+	}
+
+	if len(opts.MediaTypes) > 0 && !array.In(img.MediaType, opts.MediaTypes) {
+		return nil, fmt.Errorf("%w: %s", ErrImageType, img.MediaType)
+	}
+
+	return img, nil
+}
+
+// checkPixels Whether the image has more pixels than MaxPixels
+func checkPixels(img *Image) error {
+	if int64(img.Width)*int64(img.Height) > MaxPixels {
+		return fmt.Errorf("%w: %dx%d pixels", ErrImageTooLarge, img.Width, img.Height)
+	}
+
+	return nil
+}
+
+func (f *Fetcher) download(ctx context.Context, opts FetchOptions, url string) ([]byte, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client(opts).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download image: unexpected status %s", resp.Status)
+	}
+
+	if opts.MaxBytes > 0 && resp.ContentLength > opts.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes", ErrImageTooLarge, resp.ContentLength)
+	}
+
+	// One more byte is read to find out whether the image exceeds the limit
+	reader := io.Reader(resp.Body)
+	if opts.MaxBytes > 0 {
+		reader = io.LimitReader(resp.Body, opts.MaxBytes+1)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("download image: %w", err)
+	}
+
+	return data, nil
+}
+
+// client The http client downloading the images. Without the proxy, the addresses are checked after they are resolved,
+// so that the clients can not reach the internal services through the dispatcher
+func (f *Fetcher) client(opts FetchOptions) *http.Client {
+	// The transport is created for each image, the connections are not reused
+	transport := &http.Transport{DisableKeepAlives: true}
+	if f.dialer != nil {
+		dial := f.dialer.Dial
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			if host, _, err := net.SplitHostPort(addr); err == nil && !opts.AllowPrivate && isPrivateIP(net.ParseIP(host)) {
+				return nil, ErrPrivateAddress
+			}
+
+			return dial(network, addr)
+		}
+	} else {
+		dialer := &net.Dialer{Timeout: opts.Timeout}
+		if !opts.AllowPrivate {
+			dialer.Control = func(network, address string, _ syscall.RawConn) error {
+				if host, _, err := net.SplitHostPort(address); err == nil && isPrivateIP(net.ParseIP(host)) {
+					return ErrPrivateAddress
+				}
+
+				return nil
+			}
+		}
+
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
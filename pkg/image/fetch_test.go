@@ -0,0 +1,122 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/mylxsw/go-utils/assert"
+	goimage "image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func pngImage(t *testing.T, width, height int) []byte {
+	img := goimage.NewRGBA(goimage.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, x%height, color.RGBA{R: 255, A: 255})
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestFetcher(t *testing.T) {
+	data := pngImage(t, 2000, 1000)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/text" {
+			_, _ = w.Write([]byte("hello world"))
+			return
+		}
+
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	defer SetFetchOptions(DefaultFetchOptions)
+	fetcher := NewFetcher(nil)
+
+	// The images on the loopback addresses are not downloaded by default
+	SetFetchOptions(DefaultFetchOptions)
+	_, err := fetcher.Fetch(context.Background(), server.URL+"/image.png")
+	assert.True(t, errors.Is(err, ErrPrivateAddress))
+
+	opts := DefaultFetchOptions
+	opts.AllowPrivate = true
+	SetFetchOptions(opts)
+
+	_, _, err = Dimensions(server.URL + "/image.png")
+	assert.True(t, errors.Is(err, ErrRemoteImage))
+
+	img, err := fetcher.Fetch(context.Background(), server.URL+"/image.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", img.MediaType)
+	assert.Equal(t, 2000, img.Width)
+
+	// The downloaded image is cached, its dimensions are known
+	_, err = fetcher.Fetch(context.Background(), server.URL+"/image.png")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	width, height, err := Dimensions(server.URL + "/image.png")
+	assert.NoError(t, err)
+	assert.Equal(t, 2000, width)
+	assert.Equal(t, 1000, height)
+
+	_, err = fetcher.Fetch(context.Background(), server.URL+"/text")
+	assert.True(t, errors.Is(err, ErrImageType))
+
+	opts.MaxBytes = 100
+	SetFetchOptions(opts)
+	_, err = fetcher.Fetch(context.Background(), server.URL+"/large.png")
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+
+	// The data URLs are decoded without downloading
+	img, err = fetcher.Fetch(context.Background(), "data:image/png;base64,"+base64.StdEncoding.EncodeToString(pngImage(t, 10, 10)))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, img.Height)
+
+	_, err = fetcher.Fetch(context.Background(), "data:image/gif;base64,"+base64.StdEncoding.EncodeToString(hugeGIF()))
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+}
+
+// hugeGIF A tiny gif whose header declares 8000x8000 pixels
+func hugeGIF() []byte {
+	return []byte("GIF89a\x40\x1f\x40\x1f\x00\x00\x00")
+}
+
+func TestNormalize(t *testing.T) {
+	img := newImage(pngImage(t, 2000, 1000))
+
+	// The image is scaled down to fit in the max edge, the png images are kept as png
+	res, err := Normalize(img, AnthropicLimits)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", res.MediaType)
+	assert.Equal(t, 1568, res.Width)
+	assert.Equal(t, 784, res.Height)
+
+	// The accepted images are not changed
+	small := newImage(pngImage(t, 100, 50))
+	res, err = Normalize(small, AnthropicLimits)
+	assert.NoError(t, err)
+	assert.True(t, res == small)
+
+	// The image types not accepted are converted to jpeg
+	res, err = Normalize(small, Limits{MediaTypes: []string{"image/jpeg"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", res.MediaType)
+	assert.Equal(t, 100, res.Width)
+
+	// The images with too many pixels are rejected before decoding
+	huge := newImage(hugeGIF())
+	assert.Equal(t, 8000, huge.Width)
+	_, err = Normalize(huge, AnthropicLimits)
+	assert.True(t, errors.Is(err, ErrImageTooLarge))
+}
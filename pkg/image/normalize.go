@@ -0,0 +1,117 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mylxsw/go-utils/array"
+	"golang.org/x/image/draw"
+	goimage "image"
+	"image/jpeg"
+	"image/png"
+)
+
+// Limits The images accepted by a provider
+type Limits struct {
+	// MediaTypes The media types accepted, the other images are converted to png or jpeg
+	MediaTypes []string
+	// MaxEdge The maximum length of the long edge, the larger images are scaled down
+	MaxEdge int
+	// MaxBytes The maximum size of an image
+	MaxBytes int
+}
+
+// AnthropicLimits Claude accepts jpeg, png, gif and webp images up to 5MB, the images whose long edge is larger
+// than 1568px are scaled down by the API, so they are scaled down before uploading.
+// https://docs.anthropic.com/en/docs/build-with-claude/vision
+var AnthropicLimits = Limits{
+	MediaTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+	MaxEdge:    1568,
+	MaxBytes:   5 * 1024 * 1024,
+}
+
+// jpegQuality The quality of the converted jpeg images
+const jpegQuality = 85
+
+// Normalize Convert the image to satisfy the limits. The image is returned as it is when it is accepted, otherwise it is
+// decoded, scaled down to fit in the max edge, and encoded as png (for the png, gif and bmp images) or jpeg
+func Normalize(img *Image, limits Limits) (*Image, error) {
+	fits := func(img *Image) bool {
+		return (limits.MaxEdge <= 0 || max(img.Width, img.Height) <= limits.MaxEdge) &&
+			(limits.MaxBytes <= 0 || len(img.Data) <= limits.MaxBytes)
+	}
+
+	if (len(limits.MediaTypes) == 0 || array.In(img.MediaType, limits.MediaTypes)) && fits(img) {
+		return img, nil
+	}
+
+	if err := checkPixels(img); err != nil {
+		return nil, err
+	}
+
+	src, _, err := goimage.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrImageType, img.MediaType)
+	}
+
+	// The png images are kept as png if possible, they are usually screenshots or diagrams
+	asPNG := array.In(img.MediaType, []string{"image/png", "image/gif", "image/bmp"}) && array.In("image/png", limits.MediaTypes)
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if limits.MaxEdge > 0 && max(width, height) > limits.MaxEdge {
+		width, height = scaleToFit(width, height, limits.MaxEdge)
+	}
+
+	// The image is scaled down by a quarter each time until it is small enough
+	for {
+		res, err := encode(resize(src, width, height), asPNG)
+		if err != nil {
+			return nil, err
+		}
+
+		if fits(res) || width <= 64 || height <= 64 {
+			return res, nil
+		}
+
+		if asPNG {
+			asPNG = false
+			continue
+		}
+
+		width, height = width*3/4, height*3/4
+	}
+}
+
+// scaleToFit The size of the image whose long edge is scaled to the max edge
+func scaleToFit(width, height, maxEdge int) (int, int) {
+	if width >= height {
+		return maxEdge, max(height*maxEdge/width, 1)
+	}
+
+	return max(width*maxEdge/height, 1), maxEdge
+}
+
+func resize(src goimage.Image, width, height int) goimage.Image {
+	if src.Bounds().Dx() == width && src.Bounds().Dy() == height {
+		return src
+	}
+
+	dst := goimage.NewRGBA(goimage.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+func encode(img goimage.Image, asPNG bool) (*Image, error) {
+	var buf bytes.Buffer
+	mediaType := "image/jpeg"
+
+	if asPNG {
+		mediaType = "image/png"
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, fmt.Errorf("encode png: %w", err)
+		}
+	} else if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, fmt.Errorf("encode jpeg: %w", err)
+	}
+
+	return &Image{Data: buf.Bytes(), MediaType: mediaType, Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
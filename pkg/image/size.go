@@ -0,0 +1,40 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	goimage "image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+// ErrRemoteImage The image is a remote URL, it has to be downloaded before it is decoded
+var ErrRemoteImage = errors.New("remote image")
+
+// Dimensions 获取 base64 图片或 data URL 的宽高，只解码图片头部，远程图片已经下载过时使用缓存中的宽高，否则返回 ErrRemoteImage
+func Dimensions(url string) (width int, height int, err error) {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		if img, ok := cachedImage(url); ok && img.Width > 0 {
+			return img.Width, img.Height, nil
+		}
+
+		return 0, 0, ErrRemoteImage
+	}
+
+	data, _, err := DecodeBase64ImageWithMime(url)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	conf, _, err := goimage.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return conf.Width, conf.Height, nil
+}
@@ -0,0 +1,104 @@
+package lru
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache A thread-safe LRU cache, the entries expire after the TTL
+type Cache[K comparable, V any] struct {
+	lock  sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[K]*list.Element
+	order *list.List
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiredAt time.Time
+}
+
+// New Create a cache holding at most size entries, the entries never expire if ttl is 0
+func New[K comparable, V any](size int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[K]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Get Return the value of the key, false if it does not exist or has expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var empty V
+	elem, ok := c.items[key]
+	if !ok {
+		return empty, false
+	}
+
+	item := elem.Value.(*entry[K, V])
+	if !item.expiredAt.IsZero() && time.Now().After(item.expiredAt) {
+		c.removeElement(elem)
+		return empty, false
+	}
+
+	c.order.MoveToFront(elem)
+	return item.value, true
+}
+
+// Set Add or update the value of the key with the default TTL
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL Add or update the value of the key, the least recently used entry is evicted when the cache is full
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var expiredAt time.Time
+	if ttl > 0 {
+		expiredAt = time.Now().Add(ttl)
+	}
+
+	if elem, ok := c.items[key]; ok {
+		item := elem.Value.(*entry[K, V])
+		item.value, item.expiredAt = value, expiredAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiredAt: expiredAt})
+	for c.size > 0 && c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Delete Remove the key from the cache
+func (c *Cache[K, V]) Delete(key K) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// Len Return the number of entries, including the expired ones not evicted yet
+func (c *Cache[K, V]) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *Cache[K, V]) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*entry[K, V]).key)
+}
@@ -0,0 +1,32 @@
+package lru
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := New[string, int](2, 0)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// a becomes the most recently used, so b is evicted
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.Set("c", 3)
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Len())
+
+	c.SetWithTTL("d", 4, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, ok = c.Get("d")
+	assert.False(t, ok)
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
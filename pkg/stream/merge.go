@@ -0,0 +1,178 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/sjson"
+	"sort"
+	"strings"
+)
+
+var ErrEmptyStream = errors.New("no chunk found in the stream")
+
+// Merger Merge chat completion chunks into a complete chat completion response
+type Merger struct {
+	resp    openai.ChatCompletionResponse
+	choices map[int]*openai.ChatCompletionChoice
+	count   int
+}
+
+// NewMerger create a new Merger
+func NewMerger() *Merger {
+	return &Merger{choices: make(map[int]*openai.ChatCompletionChoice)}
+}
+
+// Add a chunk to the merger
+func (m *Merger) Add(chunk openai.ChatCompletionStreamResponse) {
+	m.count++
+
+	if m.resp.ID == "" {
+		m.resp.ID = chunk.ID
+	}
+	if m.resp.Created == 0 {
+		m.resp.Created = chunk.Created
+	}
+	if m.resp.Model == "" {
+		m.resp.Model = chunk.Model
+	}
+	if m.resp.SystemFingerprint == "" {
+		m.resp.SystemFingerprint = chunk.SystemFingerprint
+	}
+	if chunk.Usage != nil {
+		m.resp.Usage = *chunk.Usage
+	}
+
+	for _, c := range chunk.Choices {
+		choice, ok := m.choices[c.Index]
+		if !ok {
+			choice = &openai.ChatCompletionChoice{Index: c.Index}
+			m.choices[c.Index] = choice
+		}
+
+		if c.Delta.Role != "" {
+			choice.Message.Role = c.Delta.Role
+		}
+
+		choice.Message.Content += c.Delta.Content
+
+		if c.Delta.FunctionCall != nil {
+			if choice.Message.FunctionCall == nil {
+				choice.Message.FunctionCall = &openai.FunctionCall{}
+			}
+
+			choice.Message.FunctionCall.Name += c.Delta.FunctionCall.Name
+			choice.Message.FunctionCall.Arguments += c.Delta.FunctionCall.Arguments
+		}
+
+		for _, tc := range c.Delta.ToolCalls {
+			index := len(choice.Message.ToolCalls)
+			if tc.Index != nil {
+				index = *tc.Index
+			}
+
+			for len(choice.Message.ToolCalls) <= index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, openai.ToolCall{})
+			}
+
+			call := &choice.Message.ToolCalls[index]
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			if tc.Type != "" {
+				call.Type = tc.Type
+			}
+
+			call.Function.Name += tc.Function.Name
+			call.Function.Arguments += tc.Function.Arguments
+		}
+
+		if c.FinishReason != "" {
+			choice.FinishReason = c.FinishReason
+		}
+	}
+}
+
+// Response Return the merged chat completion response
+func (m *Merger) Response() (*openai.ChatCompletionResponse, error) {
+	if m.count == 0 {
+		return nil, ErrEmptyStream
+	}
+
+	resp := m.resp
+	resp.Object = "chat.completion"
+	resp.Choices = make([]openai.ChatCompletionChoice, 0, len(m.choices))
+	for _, choice := range m.choices {
+		if choice.Message.Role == "" {
+			choice.Message.Role = openai.ChatMessageRoleAssistant
+		}
+
+		resp.Choices = append(resp.Choices, *choice)
+	}
+
+	sort.Slice(resp.Choices, func(i, j int) bool { return resp.Choices[i].Index < resp.Choices[j].Index })
+
+	return &resp, nil
+}
+
+// Merge Merge a chat completion event-stream body into a complete chat completion response
+func Merge(data []byte) (*openai.ChatCompletionResponse, error) {
+	merger := NewMerger()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		chunk, ok := ParseLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		merger.Add(chunk)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return merger.Response()
+}
+
+// Marshal Encode the merged response as JSON, the empty content filter results of go-openai which are not
+// sent by OpenAI are removed
+func Marshal(resp *openai.ChatCompletionResponse) ([]byte, error) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range resp.Choices {
+		body, _ = sjson.DeleteBytes(body, fmt.Sprintf("choices.%d.content_filter_results", i))
+	}
+
+	return body, nil
+}
+
+// ParseLine Parse an event-stream line into a chat completion chunk.
+// The second return value is false if the line is not a data line or cannot be decoded
+func ParseLine(line string) (openai.ChatCompletionStreamResponse, bool) {
+	var chunk openai.ChatCompletionStreamResponse
+
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "data:") {
+		return chunk, false
+	}
+
+	payload := strings.TrimSpace(line[5:])
+	if payload == "" || payload == "[DONE]" {
+		return chunk, false
+	}
+
+	if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+		return chunk, false
+	}
+
+	return chunk, true
+}
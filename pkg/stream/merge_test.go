@@ -0,0 +1,36 @@
+package stream
+
+import (
+	"github.com/mylxsw/go-utils/assert"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	body := `data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"}}]}
+
+data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"lo"}}]}
+
+data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}
+
+data: {"id":"1","model":"gpt-4o","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Beijing\"}"}}]},"finish_reason":"tool_calls"}]}
+
+data: {"id":"1","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}
+
+data: [DONE]
+
+`
+
+	resp, err := Merge([]byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", resp.ID)
+	assert.Equal(t, 1, len(resp.Choices))
+	assert.Equal(t, "Hello", resp.Choices[0].Message.Content)
+	assert.Equal(t, "assistant", resp.Choices[0].Message.Role)
+	assert.Equal(t, 1, len(resp.Choices[0].Message.ToolCalls))
+	assert.Equal(t, `{"city":"Beijing"}`, resp.Choices[0].Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, "tool_calls", string(resp.Choices[0].FinishReason))
+	assert.Equal(t, 5, resp.Usage.TotalTokens)
+
+	_, err = Merge([]byte("data: [DONE]\n\n"))
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,172 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Chunk A chat completion chunk, only the fields of the OpenAI spec are encoded
+type Chunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *openai.Usage `json:"usage,omitempty"`
+}
+
+type ChunkChoice struct {
+	Index        int                  `json:"index"`
+	Delta        ChunkDelta           `json:"delta"`
+	FinishReason *openai.FinishReason `json:"finish_reason"`
+}
+
+type ChunkDelta struct {
+	Role      string               `json:"role,omitempty"`
+	Content   string               `json:"content,omitempty"`
+	Refusal   string               `json:"refusal,omitempty"`
+	ToolCalls []openai.ToolCall    `json:"tool_calls,omitempty"`
+	Function  *openai.FunctionCall `json:"function_call,omitempty"`
+}
+
+// Split Split a chat completion response into chunks, it is the reverse of Merge.
+// Each choice is sent as a role chunk, a content chunk, a tool call chunk and a finish chunk,
+// the usage is sent in the last chunk without choices when includeUsage is true
+func Split(resp openai.ChatCompletionResponse, includeUsage bool) []Chunk {
+	return SplitN(resp, includeUsage, 0)
+}
+
+// SplitN Split a chat completion response into chunks like Split, the content and refusal are split into
+// chunks of at most size characters to simulate typing, 0 to send them in one chunk
+func SplitN(resp openai.ChatCompletionResponse, includeUsage bool, size int) []Chunk {
+	newChunk := func(choices ...ChunkChoice) Chunk {
+		return Chunk{
+			ID:                resp.ID,
+			Object:            "chat.completion.chunk",
+			Created:           resp.Created,
+			Model:             resp.Model,
+			SystemFingerprint: resp.SystemFingerprint,
+			Choices:           append([]ChunkChoice{}, choices...),
+		}
+	}
+
+	chunks := make([]Chunk, 0)
+	for _, choice := range resp.Choices {
+		role := choice.Message.Role
+		if role == "" {
+			role = openai.ChatMessageRoleAssistant
+		}
+
+		chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: ChunkDelta{Role: role}}))
+
+		if size <= 0 {
+			if choice.Message.Content != "" || choice.Message.Refusal != "" {
+				chunks = append(chunks, newChunk(ChunkChoice{
+					Index: choice.Index,
+					Delta: ChunkDelta{Content: choice.Message.Content, Refusal: choice.Message.Refusal},
+				}))
+			}
+		} else {
+			for _, part := range splitText(choice.Message.Content, size) {
+				chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: ChunkDelta{Content: part}}))
+			}
+
+			for _, part := range splitText(choice.Message.Refusal, size) {
+				chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: ChunkDelta{Refusal: part}}))
+			}
+		}
+
+		if len(choice.Message.ToolCalls) > 0 {
+			calls := make([]openai.ToolCall, 0, len(choice.Message.ToolCalls))
+			for i, call := range choice.Message.ToolCalls {
+				index := i
+				call.Index = &index
+				calls = append(calls, call)
+			}
+
+			chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: ChunkDelta{ToolCalls: calls}}))
+		}
+
+		if choice.Message.FunctionCall != nil {
+			chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, Delta: ChunkDelta{Function: choice.Message.FunctionCall}}))
+		}
+
+		finishReason := choice.FinishReason
+		if finishReason == "" {
+			finishReason = openai.FinishReasonStop
+		}
+
+		chunks = append(chunks, newChunk(ChunkChoice{Index: choice.Index, FinishReason: &finishReason}))
+	}
+
+	if includeUsage {
+		usage := resp.Usage
+		chunk := newChunk()
+		chunk.Usage = &usage
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// splitText Split the text into parts of at most size characters
+func splitText(text string, size int) []string {
+	parts := make([]string, 0)
+	runes := []rune(text)
+	for start := 0; start < len(runes); start += size {
+		parts = append(parts, string(runes[start:min(start+size, len(runes))]))
+	}
+
+	return parts
+}
+
+// Encode Encode the chunks as an event-stream body, ending with [DONE]
+func Encode(chunks []Chunk) []byte {
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		buf.Write(encodeChunk(chunk))
+	}
+
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.Bytes()
+}
+
+// Write Write the chunks to w as an event-stream ending with [DONE], each chunk is flushed and followed by
+// the interval to simulate typing. It stops when ctx is done
+func Write(ctx context.Context, w io.Writer, chunks []Chunk, interval time.Duration) error {
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	for i, chunk := range chunks {
+		if _, err := w.Write(encodeChunk(chunk)); err != nil {
+			return err
+		}
+		flush()
+
+		if interval > 0 && i < len(chunks)-1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+	}
+
+	_, err := w.Write([]byte("data: [DONE]\n\n"))
+	flush()
+	return err
+}
+
+func encodeChunk(chunk Chunk) []byte {
+	data, _ := json.Marshal(chunk)
+	return []byte("data: " + string(data) + "\n\n")
+}
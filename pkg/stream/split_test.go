@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"context"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/sashabaranov/go-openai"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplit(t *testing.T) {
+	resp := openai.ChatCompletionResponse{
+		ID:      "1",
+		Object:  "chat.completion",
+		Created: 1700000000,
+		Model:   "gpt-4o",
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Index: 0,
+				Message: openai.ChatCompletionMessage{
+					Role:    openai.ChatMessageRoleAssistant,
+					Content: "Hello",
+					ToolCalls: []openai.ToolCall{
+						{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Beijing"}`}},
+					},
+				},
+				FinishReason: openai.FinishReasonToolCalls,
+			},
+		},
+		Usage: openai.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+	}
+
+	body := Encode(Split(resp, true))
+	assert.True(t, strings.HasSuffix(string(body), "data: [DONE]\n\n"))
+	assert.True(t, strings.Contains(string(body), `"tool_calls":[{"index":0,`))
+	assert.False(t, strings.Contains(string(body), "content_filter_results"))
+
+	merged, err := Merge(body)
+	assert.NoError(t, err)
+	assert.EqualValues(t, resp, *merged)
+
+	// The usage chunk is only sent when it is requested
+	merged, err = Merge(Encode(Split(resp, false)))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, merged.Usage.TotalTokens)
+}
+
+func TestSplitN(t *testing.T) {
+	resp := openai.ChatCompletionResponse{
+		ID:      "1",
+		Object:  "chat.completion",
+		Model:   "gpt-4o",
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: "你好，世界!"}, FinishReason: openai.FinishReasonStop}},
+	}
+
+	// role, 3 content chunks and finish
+	chunks := SplitN(resp, false, 2)
+	assert.Equal(t, 5, len(chunks))
+	assert.Equal(t, "你好", chunks[1].Choices[0].Delta.Content)
+	assert.Equal(t, "界!", chunks[3].Choices[0].Delta.Content)
+
+	var buf strings.Builder
+	assert.NoError(t, Write(context.Background(), &buf, chunks, time.Millisecond))
+	assert.Equal(t, string(Encode(chunks)), buf.String())
+
+	merged, err := Merge([]byte(buf.String()))
+	assert.NoError(t, err)
+	assert.EqualValues(t, resp, *merged)
+}
@@ -0,0 +1,72 @@
+package token
+
+import (
+	"github.com/mylxsw/openai-dispatcher/pkg/image"
+	"github.com/sashabaranov/go-openai"
+	"math"
+)
+
+// The image size assumed when the dimensions can not be decoded, such as the remote images
+const (
+	defaultImageWidth  = 1024
+	defaultImageHeight = 1024
+)
+
+// imageSize The dimensions of the image, the default size is used when it can not be decoded
+func imageSize(url string) (float64, float64) {
+	width, height, err := image.Dimensions(url)
+	if err != nil || width <= 0 || height <= 0 {
+		return defaultImageWidth, defaultImageHeight
+	}
+
+	return float64(width), float64(height)
+}
+
+// openaiImageTokens The image is scaled to fit in 2048x2048, then its shortest side is scaled to 768,
+// each 512px tile costs 170 tokens plus 85 base tokens. The low detail images always cost 85 tokens.
+// https://platform.openai.com/docs/guides/vision#calculating-costs
+func openaiImageTokens(url string, detail openai.ImageURLDetail) int {
+	if detail == openai.ImageURLDetailLow {
+		return 85
+	}
+
+	width, height := imageSize(url)
+	if scale := 2048 / math.Max(width, height); scale < 1 {
+		width, height = width*scale, height*scale
+	}
+
+	if scale := 768 / math.Min(width, height); scale < 1 {
+		width, height = width*scale, height*scale
+	}
+
+	tiles := math.Ceil(width/512) * math.Ceil(height/512)
+	return 85 + int(tiles)*170
+}
+
+// claudeImageTokens The image is scaled so that the long edge is at most 1568px, it costs width * height / 750 tokens.
+// https://docs.anthropic.com/en/docs/build-with-claude/vision#calculate-image-costs
+func claudeImageTokens(url string, _ openai.ImageURLDetail) int {
+	width, height := imageSize(url)
+	if scale := 1568 / math.Max(width, height); scale < 1 {
+		width, height = width*scale, height*scale
+	}
+
+	// The images are also scaled to about 1.15 megapixels, which cost about 1600 tokens
+	return int(math.Min(math.Ceil(width*height/750), 1600))
+}
+
+// geminiImageTokens The images no larger than 384px cost 258 tokens, the larger ones are cropped into
+// 768x768 tiles of 258 tokens each
+func geminiImageTokens(url string, _ openai.ImageURLDetail) int {
+	width, height := imageSize(url)
+	if width <= 384 && height <= 384 {
+		return 258
+	}
+
+	return int(math.Ceil(width/768)*math.Ceil(height/768)) * 258
+}
+
+// glmImageTokens 智谱的 GLM 4V 模型，每张图片按照固定的 token 数计算
+func glmImageTokens(string, openai.ImageURLDetail) int {
+	return 1047
+}
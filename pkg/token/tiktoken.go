@@ -0,0 +1,175 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"strings"
+	"sync"
+)
+
+// The tokens counted for the messages and functions, see
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	// gpt-3.5-turbo-0301 wraps every message with <|start|>{role/name}\n{content}<|end|>\n,
+	// and the role is omitted when there is a name
+	tokensPerMessage0301 = 4
+	tokensPerName0301    = -1
+	// tokensReply Every reply is primed with <|start|>assistant<|message|>
+	tokensReply = 3
+
+	tokensPropertyInit = 3
+	tokensPropertyKey  = 3
+	tokensEnumInit     = -3
+	tokensEnumItem     = 3
+	tokensFunctionEnd  = 12
+)
+
+var encodings sync.Map
+
+// encoding The tiktoken encoding, it is created once since building the BPE is expensive
+func encoding(name string) (*tiktoken.Tiktoken, error) {
+	if enc, ok := encodings.Load(name); ok {
+		return enc.(*tiktoken.Tiktoken), nil
+	}
+
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("get encoding %s: %w", name, err)
+	}
+
+	actual, _ := encodings.LoadOrStore(name, enc)
+	return actual.(*tiktoken.Tiktoken), nil
+}
+
+// tiktokenEstimator Count the tokens by a tiktoken encoding as the OpenAI chat models do
+type tiktokenEstimator struct {
+	encoding string
+	// functionInit The tokens of each function definition, it differs between the model generations
+	functionInit int
+	// images The tokens of an image in the messages
+	images    func(url string, detail openai.ImageURLDetail) int
+	estimated bool
+}
+
+func (e *tiktokenEstimator) Estimated() bool {
+	return e.estimated
+}
+
+func (e *tiktokenEstimator) TextTokens(text string) (int, error) {
+	enc, err := encoding(e.encoding)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(enc.Encode(text, nil, nil)), nil
+}
+
+func (e *tiktokenEstimator) PromptTokens(req openai.ChatCompletionRequest) (int, error) {
+	enc, err := encoding(e.encoding)
+	if err != nil {
+		return 0, err
+	}
+
+	count := func(text string) int {
+		if text == "" {
+			return 0
+		}
+
+		return len(enc.Encode(text, nil, nil))
+	}
+
+	perMessage, perName := tokensPerMessage, tokensPerName
+	if strings.HasPrefix(req.Model, "gpt-3.5-turbo-0301") {
+		perMessage, perName = tokensPerMessage0301, tokensPerName0301
+	}
+
+	numTokens := tokensReply
+	for _, message := range req.Messages {
+		numTokens += perMessage + count(message.Role) + count(message.Content) + count(message.ToolCallID)
+		for _, part := range message.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil {
+				numTokens += e.images(part.ImageURL.URL, part.ImageURL.Detail)
+			} else {
+				numTokens += count(part.Text)
+			}
+		}
+
+		if message.Name != "" {
+			numTokens += count(message.Name) + perName
+		}
+
+		// The calls are sent back to the model as the JSON arguments of the functions
+		for _, call := range message.ToolCalls {
+			numTokens += count(call.Function.Name) + count(call.Function.Arguments)
+		}
+
+		if message.FunctionCall != nil {
+			numTokens += count(message.FunctionCall.Name) + count(message.FunctionCall.Arguments)
+		}
+	}
+
+	functions := req.Functions
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			functions = append(functions, *tool.Function)
+		}
+	}
+
+	if len(functions) > 0 {
+		for _, function := range functions {
+			numTokens += e.functionTokens(function, count)
+		}
+
+		numTokens += tokensFunctionEnd
+	}
+
+	return numTokens, nil
+}
+
+// functionTokens The tokens of the function definition, the name, description and the top-level properties
+// of the parameters are counted
+func (e *tiktokenEstimator) functionTokens(function openai.FunctionDefinition, count func(text string) int) int {
+	numTokens := e.functionInit + count(function.Name+":"+strings.TrimSuffix(function.Description, "."))
+
+	var parameters gjson.Result
+	switch p := function.Parameters.(type) {
+	case nil:
+	case json.RawMessage:
+		parameters = gjson.ParseBytes(p)
+	case []byte:
+		parameters = gjson.ParseBytes(p)
+	case string:
+		parameters = gjson.Parse(p)
+	default:
+		data, _ := json.Marshal(p)
+		parameters = gjson.ParseBytes(data)
+	}
+
+	properties := parameters.Get("properties").Map()
+	if len(properties) == 0 {
+		return numTokens
+	}
+
+	numTokens += tokensPropertyInit
+	parameters.Get("properties").ForEach(func(key, property gjson.Result) bool {
+		numTokens += tokensPropertyKey
+
+		if enum := property.Get("enum"); enum.IsArray() {
+			numTokens += tokensEnumInit
+			for _, item := range enum.Array() {
+				numTokens += tokensEnumItem + count(item.String())
+			}
+		}
+
+		description := strings.TrimSuffix(property.Get("description").String(), ".")
+		numTokens += count(key.String() + ":" + property.Get("type").String() + ":" + description)
+		return true
+	})
+
+	return numTokens
+}
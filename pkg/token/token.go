@@ -1,73 +1,113 @@
 package token
 
 import (
-	"fmt"
-	"github.com/mylxsw/go-utils/array"
 	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
 	"github.com/sashabaranov/go-openai"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// MessageTokenCount Count the number of tokens in the session context
-// TODO Token calculation methods that are not based on the vendor model may be different, and need to be differentiated according to the vendor model
-func MessageTokenCount(messages []openai.ChatCompletionMessage, model string) (numTokens int, err error) {
-	_model := model
+// The tokenizer families, the OpenAI families are the names of the tiktoken encodings
+const (
+	FamilyO200K  = "o200k_base"
+	FamilyCL100K = "cl100k_base"
+	FamilyClaude = "claude"
+	FamilyGemini = "gemini"
+	FamilyGLM    = "glm"
+)
 
-	// 所有非 gpt-3.5-turbo/gpt-4 的模型，都按照 gpt-3.5 的方式处理
-	if !array.In(_model, []string{"gpt-3.5-turbo", "gpt-4"}) {
-		_model = "gpt-3.5-turbo"
-	}
+func init() {
+	// The BPE files are embedded, so that the tokens can be counted without downloading them
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+
+	RegisterEstimator(FamilyO200K, &tiktokenEstimator{encoding: FamilyO200K, functionInit: 7, images: openaiImageTokens})
+	RegisterEstimator(FamilyCL100K, &tiktokenEstimator{encoding: FamilyCL100K, functionInit: 10, images: openaiImageTokens})
+
+	// The tokenizers of the other vendors are not public, the text is estimated by cl100k_base
+	RegisterEstimator(FamilyClaude, &tiktokenEstimator{encoding: FamilyCL100K, functionInit: 10, images: claudeImageTokens, estimated: true})
+	RegisterEstimator(FamilyGemini, &tiktokenEstimator{encoding: FamilyCL100K, functionInit: 10, images: geminiImageTokens, estimated: true})
+	RegisterEstimator(FamilyGLM, &tiktokenEstimator{encoding: FamilyCL100K, functionInit: 10, images: glmImageTokens, estimated: true})
+}
+
+// Estimator Count the tokens of the requests of a tokenizer family
+type Estimator interface {
+	// PromptTokens The prompt tokens of the chat completion request, including the messages, tools and functions
+	PromptTokens(req openai.ChatCompletionRequest) (int, error)
+	// TextTokens The tokens of the text
+	TextTokens(text string) (int, error)
+	// Estimated Whether the tokens are estimated, rather than counted by the tokenizer of the model
+	Estimated() bool
+}
+
+var (
+	estimatorsLock sync.RWMutex
+	estimators     = make(map[string]Estimator)
+)
+
+// RegisterEstimator Register the estimator of the tokenizer family, the registered one of the family is replaced
+func RegisterEstimator(family string, estimator Estimator) {
+	estimatorsLock.Lock()
+	defer estimatorsLock.Unlock()
+
+	estimators[family] = estimator
+}
+
+// FamilyResolver Resolve the tokenizer family of the model, empty if it is unknown
+type FamilyResolver func(model string) string
+
+var familyResolver atomic.Pointer[FamilyResolver]
 
-	tkm, err := tiktoken.EncodingForModel(_model)
-	if err != nil {
-		return 0, fmt.Errorf("EncodingForModel: %v", err)
+// SetFamilyResolver Set the resolver of the tokenizer families, usually backed by the model registry
+func SetFamilyResolver(resolver FamilyResolver) {
+	familyResolver.Store(&resolver)
+}
+
+// Family The tokenizer family of the model. The resolver is asked first, then the model names known by tiktoken,
+// cl100k_base is used for the other models
+func Family(model string) string {
+	if resolver := familyResolver.Load(); resolver != nil {
+		if family := (*resolver)(model); family != "" {
+			return family
+		}
 	}
 
-	var tokensPerMessage int
-	if strings.HasPrefix(_model, "gpt-3.5-turbo") {
-		tokensPerMessage = 4
-	} else if strings.HasPrefix(_model, "gpt-4") {
-		tokensPerMessage = 3
-	} else {
-		tokensPerMessage = 3
+	if encoding, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return encoding
 	}
 
-	for _, message := range messages {
-		numTokens += tokensPerMessage
-		if len(message.MultiContent) > 0 {
-			for _, content := range message.MultiContent {
-				if content.Type == "image_url" {
-					// 智谱的 GLM 4V 模型，图片的 token 计算方式不同
-					if model == "glm-4v" {
-						numTokens += 1047
-					} else if strings.HasPrefix(model, "claude-") {
-						// Anthropic 的 claude 系列模型，图片的 token 计算方式不同，这里简单处理
-						// tokens = (width px * height px)/750
-						// https://docs.anthropic.com/claude/docs/vision#image-costs
-						numTokens += 1000
-					} else {
-						if content.ImageURL.Detail == "low" {
-							numTokens += 65
-						} else {
-							// TODO 【价格昂贵，尽量避免】这里可能为 high 或者 auto，简单起见，auto 按照 high 处理
-							// 简单起见，这里假设 high 时大图为 2048x2048，切割为 16 个小图
-							//
-							// high will enable “high res” mode, which first allows the _model to see the low res image
-							// and then creates detailed crops of input images as 512px squares based on the input image size.
-							// Each of the detailed crops uses twice the token budget (65 tokens) for a total of 129 tokens
-							numTokens += 129 * 16
-						}
-					}
-
-				} else {
-					numTokens += len(tkm.Encode(content.Text, nil, nil))
-				}
-			}
-		} else {
-			numTokens += len(tkm.Encode(message.Content, nil, nil))
+	for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return encoding
 		}
-		numTokens += len(tkm.Encode(message.Role, nil, nil))
 	}
-	numTokens += 3
-	return numTokens, nil
+
+	return FamilyCL100K
+}
+
+// EstimatorFor The tokenizer family and the estimator of the model, the cl100k_base estimator is used
+// when no estimator is registered for the family
+func EstimatorFor(model string) (string, Estimator) {
+	family := Family(model)
+
+	estimatorsLock.RLock()
+	defer estimatorsLock.RUnlock()
+
+	if estimator, ok := estimators[family]; ok {
+		return family, estimator
+	}
+
+	return FamilyCL100K, estimators[FamilyCL100K]
+}
+
+// PromptTokens Count the prompt tokens of the chat completion request by the estimator of the model
+func PromptTokens(req openai.ChatCompletionRequest) (int, error) {
+	_, estimator := EstimatorFor(req.Model)
+	return estimator.PromptTokens(req)
+}
+
+// MessageTokenCount Count the number of tokens in the session context
+func MessageTokenCount(messages []openai.ChatCompletionMessage, model string) (numTokens int, err error) {
+	return PromptTokens(openai.ChatCompletionRequest{Model: model, Messages: messages})
 }
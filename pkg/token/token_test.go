@@ -0,0 +1,66 @@
+package token
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/mylxsw/go-utils/assert"
+	"github.com/sashabaranov/go-openai"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestPromptTokens(t *testing.T) {
+	assert.Equal(t, FamilyO200K, Family("gpt-4o-2024-08-06"))
+	assert.Equal(t, FamilyCL100K, Family("unknown-model"))
+
+	messages := []openai.ChatCompletionMessage{{Role: "user", Content: "hello world"}}
+
+	// 3 tokens per message, 1 for the role, 2 for the content and 3 for the reply
+	tokens, err := MessageTokenCount(messages, "gpt-4o")
+	assert.NoError(t, err)
+	assert.Equal(t, 9, tokens)
+
+	withName, err := MessageTokenCount([]openai.ChatCompletionMessage{{Role: "user", Content: "hello world", Name: "bob"}}, "gpt-4o")
+	assert.NoError(t, err)
+	assert.Equal(t, tokens+2, withName)
+
+	// gpt-3.5-turbo-0301 uses 4 tokens per message, and the role is replaced by the name
+	legacy, err := MessageTokenCount([]openai.ChatCompletionMessage{{Role: "user", Content: "hello world", Name: "bob"}}, "gpt-3.5-turbo-0301")
+	assert.NoError(t, err)
+	assert.Equal(t, tokens+1+1-1, legacy)
+
+	// The functions are counted with the name, description and properties
+	withTools, err := PromptTokens(openai.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: messages,
+		Tools: []openai.Tool{{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{
+			Name:        "get_weather",
+			Description: "Get the weather.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"unit":{"type":"string","enum":["c","f"]}}}`),
+		}}},
+	})
+	assert.NoError(t, err)
+
+	// func init 7, "get_weather:Get the weather" 5, property init 3, property key 3,
+	// enum -3 + (3 + 1) * 2, "unit:string:" 3 and function end 12
+	assert.Equal(t, tokens+7+5+3+3-3+8+3+12, withTools)
+}
+
+func TestImageTokens(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1024, 2048))))
+	url := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	// Scaled to 768x1536, 2x3 tiles
+	assert.Equal(t, 85+6*170, openaiImageTokens(url, openai.ImageURLDetailHigh))
+	assert.Equal(t, 85, openaiImageTokens(url, openai.ImageURLDetailLow))
+
+	// Scaled to 784x1568
+	assert.Equal(t, 1600, claudeImageTokens(url, ""))
+	assert.Equal(t, 2*3*258, geminiImageTokens(url, ""))
+
+	// The remote images are assumed to be 1024x1024
+	assert.Equal(t, 85+4*170, openaiImageTokens("https://example.com/a.png", ""))
+}